@@ -0,0 +1,99 @@
+package ocifs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// OCIArchiveFS constructs a layered file system from an OCI image layout
+// packaged as a tar archive, which contains the oci-layout and index.json files
+// and the blobs directory of the layout.
+//
+// The image is loaded like ImageFS does, reading the blobs from the archive at
+// r without extracting them. To select the manifest of a platform in archives
+// of multi-platform images, ImageFSForPlatform can be used with the file system
+// of the archive returned by TarFS.
+func OCIArchiveFS(r io.ReaderAt, size int64, options ...Option) (fs.FS, error) {
+	archive, err := TarFS(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return loadImage(archive, nil, options)
+}
+
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// DockerArchiveFS constructs a layered file system from an image archive
+// produced by docker save, which is a tar archive containing a manifest.json
+// file listing the layers of the image, and the layers themselves.
+//
+// The layers are read from the archive at r without being extracted; layers
+// stored as uncompressed tar archives are read on demand, and compressed layers
+// are detected like DetectFS does. Layers which are symbolic links to other
+// layers of the archive, as written by older versions of docker, are followed.
+// An error is returned if the archive contains more than one image.
+func DockerArchiveFS(r io.ReaderAt, size int64, options ...Option) (fs.FS, error) {
+	archive, err := TarFS(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var manifest []dockerArchiveManifest
+	if err := readJSON(archive, "manifest.json", &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest) != 1 {
+		var tags []string
+		for _, m := range manifest {
+			tags = append(tags, m.RepoTags...)
+		}
+		return nil, &fs.PathError{Op: "read", Path: "manifest.json", Err: fmt.Errorf("docker archive contains %d images: %s (%w)", len(manifest), strings.Join(tags, ", "), fs.ErrInvalid)}
+	}
+
+	c := newConfig(options)
+	m := manifest[0]
+	if max := c.maxLayers; max > 0 && len(m.Layers) > max {
+		return nil, fmt.Errorf("image has %d layers, exceeding the limit of %d: %w", len(m.Layers), max, ErrTooManyLayers)
+	}
+
+	layers := make([]fs.FS, len(m.Layers))
+	for i, name := range m.Layers {
+		layer, err := archiveLayerFS(archive, name)
+		if err != nil {
+			return nil, fmt.Errorf("loading layer %d (%s): %w", i, name, err)
+		}
+		layers[i] = layer
+	}
+	return LayerFSWithOptions(layers, options...), nil
+}
+
+// archiveLayerFS constructs a file system from the layer at name in an image
+// archive.
+func archiveLayerFS(archive fs.FS, name string) (fs.FS, error) {
+	name, ok := cleanTarPath(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	name, err := EvalSymlinks(archive, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := f.(io.ReaderAt)
+	if !ok || !s.Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("layer is not a regular file (%w)", fs.ErrInvalid)}
+	}
+	return DetectFS(r, s.Size())
+}
@@ -0,0 +1,138 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestDockerArchiveFS(t *testing.T) {
+	layer1 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+	layer2 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("etc/hostname", "container"),
+	)
+
+	archive := makeTar(t,
+		tarFile("manifest.json", `[{"Config":"config.json","RepoTags":["example:latest"],"Layers":["aaa/layer.tar","bbb/layer.tar","ccc/layer.tar"]}]`),
+		tarFile("config.json", `{}`),
+		tarFile("aaa/layer.tar", string(layer1)),
+		tarFile("bbb/layer.tar", string(gzipBytes(t, layer2))),
+		// Older versions of docker link duplicate layers.
+		tarSymlink("ccc/layer.tar", "../aaa/layer.tar"),
+	)
+
+	rootfs, err := ocifs.DockerArchiveFS(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := fstest.MapFS{
+		"etc":          &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"etc/hostname": &fstest.MapFile{Mode: 0444, Data: []byte("container")},
+		"etc/hosts":    &fstest.MapFile{Mode: 0444, Data: []byte("localhost")},
+		"etc/passwd":   &fstest.MapFile{Mode: 0444, Data: []byte("root:x:0:0")},
+	}
+	if err := fstest.EqualFS(expect, rootfs); err != nil {
+		t.Fatal(err)
+	}
+	if n := ocifs.NumLayers(rootfs); n != 3 {
+		t.Errorf("wrong number of layers: %d", n)
+	}
+}
+
+func TestDockerArchiveFSInvalid(t *testing.T) {
+	layer := makeTar(t, tarFile("hello", "world"))
+
+	tests := []struct {
+		scenario string
+		archive  []byte
+		err      error
+	}{
+		{
+			scenario: "missing manifest",
+			archive:  makeTar(t, tarFile("layer.tar", string(layer))),
+			err:      fs.ErrNotExist,
+		},
+		{
+			scenario: "multiple images",
+			archive: makeTar(t,
+				tarFile("manifest.json", `[{"RepoTags":["a:latest"],"Layers":["layer.tar"]},{"RepoTags":["b:latest"],"Layers":["layer.tar"]}]`),
+				tarFile("layer.tar", string(layer)),
+			),
+			err: fs.ErrInvalid,
+		},
+		{
+			scenario: "missing layer",
+			archive:  makeTar(t, tarFile("manifest.json", `[{"Layers":["layer.tar"]}]`)),
+			err:      fs.ErrNotExist,
+		},
+		{
+			scenario: "layer is a directory",
+			archive: makeTar(t,
+				tarFile("manifest.json", `[{"Layers":["layer"]}]`),
+				tarDir("layer/"),
+			),
+			err: fs.ErrInvalid,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			_, err := ocifs.DockerArchiveFS(bytes.NewReader(test.archive), int64(len(test.archive)))
+			if !errors.Is(err, test.err) {
+				t.Errorf("wrong error: want=%v got=%v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestOCIArchiveFS(t *testing.T) {
+	layer1 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+	layer2 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("etc/hostname", "container"),
+	)
+	image := makeImage(t,
+		testLayer{ocifs.MediaTypeImageLayerGzip, gzipBytes(t, layer1)},
+		testLayer{ocifs.MediaTypeImageLayer, layer2},
+	)
+
+	headers := []*tar.Header{tarDir("blobs/"), tarDir("blobs/sha256/")}
+	for name, file := range image {
+		headers = append(headers, tarFile(name, string(file.Data)))
+	}
+	archive := makeTar(t, headers...)
+
+	rootfs, err := ocifs.OCIArchiveFS(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := fstest.MapFS{
+		"etc":          &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"etc/hostname": &fstest.MapFile{Mode: 0444, Data: []byte("container")},
+		"etc/hosts":    &fstest.MapFile{Mode: 0444, Data: []byte("localhost")},
+	}
+	if err := fstest.EqualFS(expect, rootfs); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := bytes.Replace(archive, []byte("container"), []byte("CONTAINER"), 1)
+	if _, err := ocifs.OCIArchiveFS(bytes.NewReader(corrupted), int64(len(corrupted))); !errors.Is(err, ocifs.ErrDigestMismatch) {
+		t.Errorf("loading a corrupted layer must fail with ErrDigestMismatch: %v", err)
+	}
+}
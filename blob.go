@@ -0,0 +1,167 @@
+package ocifs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Media types of OCI and Docker image layers.
+const (
+	MediaTypeImageLayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeImageLayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	MediaTypeDockerLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeDockerLayerZstd = "application/vnd.docker.image.rootfs.diff.tar.zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	tarMagic  = []byte("ustar")
+)
+
+// tarMagicOffset is the offset of the magic field in ustar, pax, and gnu tar
+// headers.
+const tarMagicOffset = 257
+
+// TarZstdFS is like TarFS but the tar archive is compressed with zstd (media
+// type application/vnd.oci.image.layer.v1.tar+zstd).
+//
+// The zstd decoder is only created when the file system is first accessed, so
+// constructing file systems for layers that are never read does not allocate
+// decompression windows. Because zstd streams cannot be read at random offsets,
+// the content of files is buffered in memory on first access so that files
+// opened from the file system implement io.ReaderAt and io.Seeker.
+//
+// The function only validates that the blob starts with a zstd frame; errors
+// that occur when decompressing the layer are returned by the methods of the
+// file system.
+func TarZstdFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	return tarZstdFS(r, size, nil)
+}
+
+func tarZstdFS(r io.ReaderAt, size int64, check diffIDCheck) (*lazyFS, error) {
+	magic := make([]byte, len(zstdMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, &fs.PathError{Op: "read", Path: "zstd", Err: err}
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return nil, &fs.PathError{Op: "read", Path: "zstd", Err: zstd.ErrMagicMismatch}
+	}
+	return &lazyFS{
+		load: func() (fs.FS, error) {
+			z, err := zstd.NewReader(io.NewSectionReader(r, 0, size), zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, &fs.PathError{Op: "read", Path: "zstd", Err: err}
+			}
+			defer z.Close()
+			return readCompressedTar(z, "zstd", check)
+		},
+	}, nil
+}
+
+// BlobFS constructs a file system from a layer blob of the given media type,
+// dispatching to TarFS, TarGzFS, or TarZstdFS.
+func BlobFS(mediaType string, r io.ReaderAt, size int64) (fs.FS, error) {
+	return blobFS(mediaType, r, size, nil)
+}
+
+// blobFS is like BlobFS but calls check with the digest of the uncompressed
+// layer when it is not nil. Layers are eagerly decompressed when the digest
+// needs to be checked.
+func blobFS(mediaType string, r io.ReaderAt, size int64, check diffIDCheck) (fs.FS, error) {
+	switch mediaType {
+	case MediaTypeImageLayer, MediaTypeDockerLayer:
+		if check != nil {
+			h := sha256.New()
+			if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+				return nil, &fs.PathError{Op: "read", Path: "tar", Err: err}
+			}
+			if err := check("sha256:" + hex.EncodeToString(h.Sum(nil))); err != nil {
+				return nil, err
+			}
+		}
+		return TarFS(r, size)
+	case MediaTypeImageLayerGzip, MediaTypeDockerLayerGzip:
+		return tarGzFS(io.NewSectionReader(r, 0, size), check)
+	case MediaTypeImageLayerZstd, MediaTypeDockerLayerZstd:
+		fsys, err := tarZstdFS(r, size, check)
+		if err != nil {
+			return nil, err
+		}
+		if check != nil {
+			if _, err := fsys.get(); err != nil {
+				return nil, err
+			}
+		}
+		return fsys, nil
+	default:
+		return nil, fmt.Errorf("unsupported layer media type: %q", mediaType)
+	}
+}
+
+// retainsBlob returns true if the file system constructed by blobFS for the
+// media type reads the blob after it was constructed, in which case the blob
+// must remain open.
+func retainsBlob(mediaType string, check diffIDCheck) bool {
+	switch mediaType {
+	case MediaTypeImageLayerGzip, MediaTypeDockerLayerGzip:
+		return false
+	case MediaTypeImageLayerZstd, MediaTypeDockerLayerZstd:
+		// Zstd layers are decompressed on first use, unless the digest of
+		// the uncompressed layer was checked.
+		return check == nil
+	default:
+		return true
+	}
+}
+
+// DetectFS constructs a file system from a layer blob of unknown format. The
+// compression is detected from the magic bytes at the start of the blob, then
+// the blob is passed to TarGzFS, TarZstdFS, or TarFS.
+//
+// An error wrapping fs.ErrInvalid is returned if the blob is neither a gzip
+// stream, a zstd stream, or a tar archive.
+func DetectFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	header := make([]byte, 512)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, &fs.PathError{Op: "read", Path: "layer", Err: err}
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return TarGzFS(io.NewSectionReader(r, 0, size))
+	case bytes.HasPrefix(header, zstdMagic):
+		return TarZstdFS(r, size)
+	case isTarHeader(header):
+		return TarFS(r, size)
+	default:
+		return nil, &fs.PathError{Op: "read", Path: "layer", Err: fmt.Errorf("unrecognized layer format (%w)", fs.ErrInvalid)}
+	}
+}
+
+func isTarHeader(header []byte) bool {
+	if len(header) < 512 {
+		return false
+	}
+	if bytes.HasPrefix(header[tarMagicOffset:], tarMagic) {
+		return true
+	}
+	// An archive starting with a zero block is an empty tar archive.
+	for _, b := range header {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
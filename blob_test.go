@@ -0,0 +1,163 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func zstdBytes(t testing.TB, b []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarZstdFS(t *testing.T) {
+	b := zstdBytes(t, makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+	))
+
+	layer, err := ocifs.TarZstdFS(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(layer, "etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ocifs.TarZstdFS(bytes.NewReader([]byte("hello")), 5); err == nil {
+		t.Error("constructing a zstd layer from invalid data must fail")
+	}
+}
+
+func TestBlobFS(t *testing.T) {
+	b := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+	)
+
+	blobs := map[string][]byte{
+		ocifs.MediaTypeImageLayer:     b,
+		ocifs.MediaTypeImageLayerGzip: gzipBytes(t, b),
+		ocifs.MediaTypeImageLayerZstd: zstdBytes(t, b),
+	}
+
+	for mediaType, blob := range blobs {
+		t.Run(mediaType, func(t *testing.T) {
+			layer, err := ocifs.BlobFS(mediaType, bytes.NewReader(blob), int64(len(blob)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := fs.ReadFile(layer, "etc/hosts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "localhost" {
+				t.Errorf("wrong file content: %q", data)
+			}
+		})
+	}
+
+	if _, err := ocifs.BlobFS("application/json", bytes.NewReader(b), int64(len(b))); err == nil {
+		t.Error("constructing a layer from an unsupported media type must fail")
+	}
+}
+
+func TestDetectFS(t *testing.T) {
+	b := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+	)
+
+	blobs := map[string][]byte{
+		"tar":      b,
+		"tar+gzip": gzipBytes(t, b),
+		"tar+zstd": zstdBytes(t, b),
+	}
+
+	for format, blob := range blobs {
+		t.Run(format, func(t *testing.T) {
+			layer, err := ocifs.DetectFS(bytes.NewReader(blob), int64(len(blob)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := fs.ReadFile(layer, "etc/hosts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "localhost" {
+				t.Errorf("wrong file content: %q", data)
+			}
+		})
+	}
+
+	for _, blob := range [][]byte{nil, []byte("hello world"), bytes.Repeat([]byte("x"), 1024)} {
+		if _, err := ocifs.DetectFS(bytes.NewReader(blob), int64(len(blob))); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("detecting the format of an invalid layer must fail with fs.ErrInvalid: %v", err)
+		}
+	}
+}
+
+// makeLargeTar generates a tar archive of approximately the given size, made of
+// 1 MiB files with compressible content.
+func makeLargeTar(b *testing.B, size int) []byte {
+	const fileSize = 1 << 20
+	prng := rand.New(rand.NewSource(0))
+	data := make([]byte, fileSize)
+	headers := make([]*tar.Header, 0, size/fileSize)
+	for i := 0; i < size/fileSize; i++ {
+		for j := range data {
+			data[j] = 'a' + byte(prng.Intn(4))
+		}
+		headers = append(headers, tarFile(fmt.Sprintf("data/%04d", i), string(data)))
+	}
+	return makeTar(b, headers...)
+}
+
+func BenchmarkBlobFS(b *testing.B) {
+	const size = 200 << 20
+	layer := makeLargeTar(b, size)
+
+	blobs := []struct {
+		mediaType string
+		data      []byte
+	}{
+		{ocifs.MediaTypeImageLayerGzip, gzipBytes(b, layer)},
+		{ocifs.MediaTypeImageLayerZstd, zstdBytes(b, layer)},
+	}
+
+	for _, blob := range blobs {
+		b.Run(blob.mediaType, func(b *testing.B) {
+			b.SetBytes(int64(len(layer)))
+			for i := 0; i < b.N; i++ {
+				fsys, err := ocifs.BlobFS(blob.mediaType, bytes.NewReader(blob.data), int64(len(blob.data)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				// Force the layer to be loaded, zstd layers are lazily decoded.
+				if _, err := fs.Stat(fsys, "data"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package ocifs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// BlobCache is a content store on the local file system caching the layer
+// blobs of images, keyed by digest. It is configured on ImageFS with the
+// WithBlobCache option, so that loading images from remote sources (e.g. a file
+// system backed by a registry) only fetches each blob once.
+//
+// Blobs are stored in the directory of the cache with the layout of the blobs
+// directory of OCI images. The cache is safe to use concurrently, blobs being
+// fetched by one goroutine are awaited by the others instead of being fetched
+// again. Blob caches may also be shared between processes, since blobs are
+// written to temporary files and atomically renamed when complete.
+type BlobCache struct {
+	dir   string
+	group singleflight.Group
+}
+
+// tempBlobPrefix is the prefix of the temporary files holding partially
+// fetched blobs.
+const tempBlobPrefix = ".tmp-"
+
+// NewBlobCache constructs a blob cache storing blobs in dir, which is created
+// if it does not exist.
+func NewBlobCache(dir string) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &BlobCache{dir: dir}, nil
+}
+
+// WithBlobCache configures ImageFS to consult the blob cache before reading
+// layer blobs from the image directory, and to store the blobs in the cache
+// after reading them.
+//
+// The digest of blobs is verified when they are stored in the cache, and every
+// time they are read from it unless WithoutDigestVerification is used. Cached
+// blobs that fail verification are discarded and fetched again.
+func WithBlobCache(cache *BlobCache) Option {
+	return func(c *config) { c.blobCache = cache }
+}
+
+// Size returns the total size of the blobs stored in the cache.
+func (c *BlobCache) Size() (int64, error) {
+	blobs, err := c.blobs()
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for _, blob := range blobs {
+		size += blob.size
+	}
+	return size, nil
+}
+
+// Prune removes the least recently used blobs from the cache until its total
+// size does not exceed maxSize.
+func (c *BlobCache) Prune(maxSize int64) error {
+	blobs, err := c.blobs()
+	if err != nil {
+		return err
+	}
+	size := int64(0)
+	for _, blob := range blobs {
+		size += blob.size
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].used.Before(blobs[j].used)
+	})
+	for _, blob := range blobs {
+		if size <= maxSize {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= blob.size
+	}
+	return nil
+}
+
+type cachedBlob struct {
+	path string
+	size int64
+	used time.Time
+}
+
+func (c *BlobCache) blobs() ([]cachedBlob, error) {
+	var blobs []cachedBlob
+	err := filepath.WalkDir(c.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempBlobPrefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		blobs = append(blobs, cachedBlob{path: path, size: info.Size(), used: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
+
+// open returns the cached file of the blob at name, fetching it from dir if it
+// is not in the cache yet. The modification time of cached blobs is updated
+// when they are used, which records the order of the least recently used
+// blobs.
+func (c *BlobCache) open(dir fs.FS, name string, desc descriptor, verify bool) (*os.File, error) {
+	path := filepath.Join(c.dir, filepath.FromSlash(name))
+
+	f, err := c.openCached(path, name, desc, verify)
+	if err != nil || f != nil {
+		return f, err
+	}
+
+	_, err, _ = c.group.Do(desc.Digest, func() (any, error) {
+		if _, err := os.Stat(path); err == nil {
+			return nil, nil
+		}
+		return nil, c.fetch(dir, path, name, desc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// openCached opens the blob at path, returning a nil file if it is not in the
+// cache or if its content does not match its digest.
+func (c *BlobCache) openCached(path, name string, desc descriptor, verify bool) (*os.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if verify {
+		if err := verifyBlob(name, desc, io.NewSectionReader(f, 0, desc.Size+1)); err != nil {
+			f.Close()
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			return nil, nil
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetch copies the blob at name from dir to path, verifying its digest.
+func (c *BlobCache) fetch(dir fs.FS, path, name string, desc descriptor) error {
+	src, err := dir.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempBlobPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := verifyBlob(name, desc, io.TeeReader(src, tmp)); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
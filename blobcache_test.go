@@ -0,0 +1,140 @@
+package ocifs_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// syncCountOpenFS is like countOpenFS but can be used concurrently.
+type syncCountOpenFS struct {
+	fstest.MapFS
+	opens atomic.Int64
+}
+
+func (f *syncCountOpenFS) Open(name string) (fs.File, error) {
+	f.opens.Add(1)
+	return f.MapFS.Open(name)
+}
+
+func TestBlobCache(t *testing.T) {
+	layer1 := makeTar(t, tarFile("etc/hosts", "localhost"))
+	layer2 := makeTar(t, tarFile("etc/hostname", "container"))
+	image := &syncCountOpenFS{MapFS: makeImage(t,
+		testLayer{ocifs.MediaTypeImageLayer, layer1},
+		testLayer{ocifs.MediaTypeImageLayerGzip, gzipBytes(t, layer2)},
+	)}
+	expect := fstest.MapFS{
+		"etc/hosts":    &fstest.MapFile{Mode: 0444, Data: []byte("localhost")},
+		"etc/hostname": &fstest.MapFile{Mode: 0444, Data: []byte("container")},
+	}
+
+	dir := t.TempDir()
+	cache, err := ocifs.NewBlobCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() {
+		t.Helper()
+		rootfs, err := ocifs.ImageFS(image, ocifs.WithBlobCache(cache))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := fstest.EqualFS(expect, rootfs); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			load()
+		}()
+	}
+	wg.Wait()
+	if n := image.opens.Load(); n != 2 {
+		t.Errorf("concurrent loads must fetch each blob once: %d blobs opened", n)
+	}
+
+	load()
+	if n := image.opens.Load(); n != 2 {
+		t.Errorf("cached blobs must not be fetched again: %d blobs opened", n)
+	}
+
+	var blobs []string
+	var total int64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			info, _ := entry.Info()
+			blobs = append(blobs, path)
+			total += info.Size()
+		}
+		return err
+	})
+	if len(blobs) != 2 {
+		t.Fatalf("wrong number of blobs in the cache: %q", blobs)
+	}
+	size, err := cache.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != total {
+		t.Errorf("wrong cache size: want=%d got=%d", total, size)
+	}
+
+	// Corrupted blobs are discarded and fetched again.
+	for _, blob := range blobs {
+		b, err := os.ReadFile(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(blob, []byte(strings.Repeat("x", len(b))), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load()
+	if n := image.opens.Load(); n != 4 {
+		t.Errorf("corrupted blobs must be fetched again: %d blobs opened", n)
+	}
+
+	// The least recently used blob is pruned first.
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(blobs[0], old, old); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(blobs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Prune(info.Size()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobs[0]); !os.IsNotExist(err) {
+		t.Errorf("least recently used blob was not pruned: %v", err)
+	}
+	if _, err := os.Stat(blobs[1]); err != nil {
+		t.Errorf("most recently used blob was pruned: %v", err)
+	}
+	if size, _ := cache.Size(); size != info.Size() {
+		t.Errorf("wrong cache size after pruning: want=%d got=%d", info.Size(), size)
+	}
+
+	if err := cache.Prune(0); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := cache.Size(); size != 0 {
+		t.Errorf("cache must be empty after pruning: %d", size)
+	}
+}
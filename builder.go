@@ -0,0 +1,188 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Builder constructs layers in memory, which is useful to create the fixtures
+// of tests or to generate small layers in tools. The zero value is an empty
+// layer.
+//
+// Names are cleaned like the names of tar entries, and the parent directories
+// of files are synthesized when they are not added explicitly. Adding a file at
+// a name replaces the previous file; a directory replaced by a file loses its
+// content. Files are created with a zero modification time and are owned by
+// the user and group 0.
+//
+// Remove and RemoveAll write the whiteout files of the OCI image specification
+// to mask the content of the layers below the one being built.
+type Builder struct {
+	files map[string]*builderEntry
+	err   error
+}
+
+type builderEntry struct {
+	header tar.Header
+	data   []byte
+}
+
+// AddFile adds a regular file at name with the given permissions and content.
+// The data is copied, the slice may be reused after the call.
+func (b *Builder) AddFile(name string, mode fs.FileMode, data []byte) {
+	b.add("add", name, &builderEntry{
+		header: tar.Header{
+			Typeflag: tar.TypeReg,
+			Mode:     tarMode(mode),
+			Size:     int64(len(data)),
+		},
+		data: bytes.Clone(data),
+	})
+}
+
+// AddDir adds a directory at name with the given permissions. Adding a
+// directory which already exists only changes its permissions.
+func (b *Builder) AddDir(name string, mode fs.FileMode) {
+	b.add("mkdir", name, &builderEntry{
+		header: tar.Header{
+			Typeflag: tar.TypeDir,
+			Mode:     tarMode(mode),
+		},
+	})
+}
+
+// AddSymlink adds a symbolic link at name pointing to target.
+func (b *Builder) AddSymlink(name, target string) {
+	b.add("symlink", name, &builderEntry{
+		header: tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Linkname: target,
+			Mode:     0777,
+		},
+	})
+}
+
+// Remove masks the file at name in the layers below by adding a whiteout file,
+// and removes the file from the layer if it was added.
+func (b *Builder) Remove(name string) {
+	name, _ = cleanTarPath(name)
+	if name == "." {
+		b.fail("remove", name)
+		return
+	}
+	b.removeAll(name)
+	delete(b.files, name)
+	dir, base := path.Split(name)
+	b.add("remove", path.Join(dir, whiteoutPrefix+base), newWhiteoutEntry())
+}
+
+// RemoveAll masks the content of the directory dir in the layers below by
+// adding an opaque marker to the directory, and removes the files that were
+// added to the directory in the layer. The directory itself remains, it is
+// added to the layer if it did not exist.
+func (b *Builder) RemoveAll(dir string) {
+	dir, _ = cleanTarPath(dir)
+	if e := b.files[dir]; e != nil && e.header.Typeflag != tar.TypeDir {
+		delete(b.files, dir)
+	}
+	b.removeAll(dir)
+	b.add("removeall", path.Join(dir, whiteoutOpaque), newWhiteoutEntry())
+}
+
+// Build returns a file system containing the files added to the builder. The
+// file system is a snapshot, it does not change when the builder is modified
+// after the call.
+//
+// An error wrapping fs.ErrInvalid is returned if one of the operations was
+// invalid, for example adding a file under a name which is not a directory.
+func (b *Builder) Build() (fs.FS, error) {
+	fsys, err := b.build()
+	if err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func (b *Builder) build() (*tarFS, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	fsys := &tarFS{
+		files: map[string]*tarEntry{
+			".": newTarDir("."),
+		},
+		size: -1,
+	}
+	for name, e := range b.files {
+		header := e.header
+		header.Name = name
+		entry := &tarEntry{header: &header, info: header.FileInfo()}
+		if header.Typeflag == tar.TypeReg {
+			entry.data = bytes.NewReader(e.data)
+		}
+		fsys.put(name, entry)
+	}
+	if err := fsys.link(); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func (b *Builder) add(op, name string, entry *builderEntry) {
+	name, _ = cleanTarPath(name)
+	if name == "." && entry.header.Typeflag != tar.TypeDir {
+		b.fail(op, name)
+		return
+	}
+	if b.files == nil {
+		b.files = make(map[string]*builderEntry)
+	}
+	if prev := b.files[name]; prev != nil && prev.header.Typeflag == tar.TypeDir && entry.header.Typeflag != tar.TypeDir {
+		b.removeAll(name)
+	}
+	b.files[name] = entry
+}
+
+// fail records the error of an invalid operation, which is returned by the
+// file system constructed by Build. The root directory can only be modified
+// with AddDir and RemoveAll.
+func (b *Builder) fail(op, name string) {
+	if b.err == nil {
+		b.err = &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+}
+
+// removeAll removes the files added under dir.
+func (b *Builder) removeAll(dir string) {
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	for name := range b.files {
+		if strings.HasPrefix(name, prefix) && name != "." {
+			delete(b.files, name)
+		}
+	}
+}
+
+func newWhiteoutEntry() *builderEntry {
+	return &builderEntry{header: tar.Header{Typeflag: tar.TypeReg, Mode: 0644}}
+}
+
+// tarMode converts the permissions of mode to the mode of a tar header.
+func tarMode(mode fs.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
@@ -0,0 +1,114 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// build returns the file system built by b, failing the test on errors.
+func build(t testing.TB, b *ocifs.Builder) fs.FS {
+	t.Helper()
+	fsys, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestBuilder(t *testing.T) {
+	var lower ocifs.Builder
+	lower.AddDir("etc", 0755)
+	lower.AddFile("etc/hosts", 0644, []byte("localhost"))
+	lower.AddFile("etc/passwd", 0644, []byte("root:x:0:0"))
+	lower.AddFile("opt/app/config", 0600, []byte("a=1"))
+	lower.AddFile("opt/app/data", 0600, []byte("data"))
+	lower.AddFile("usr/bin/sh", 0755|fs.ModeSetuid, []byte("#!"))
+	lower.AddFile("var/log", 0644, []byte("file"))
+
+	data := []byte("localhost\n")
+	var upper ocifs.Builder
+	upper.AddFile("etc/hosts", 0644, data)
+	upper.Remove("etc/passwd")
+	upper.RemoveAll("opt/app")
+	upper.AddFile("opt/app/config", 0600, []byte("a=2"))
+	upper.AddSymlink("usr/bin/bash", "sh")
+	upper.AddDir("var/log", 0700)
+	upper.AddFile("tmp/removed", 0644, nil)
+	upper.Remove("tmp/removed")
+	copy(data, "XXXXXXXXX")
+
+	layers := ocifs.LayerFS(build(t, &lower), build(t, &upper))
+	expect := fstest.MapFS{
+		"etc":            &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"etc/hosts":      &fstest.MapFile{Mode: 0444, Data: []byte("localhost\n")},
+		"opt":            &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"opt/app":        &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"opt/app/config": &fstest.MapFile{Mode: 0400, Data: []byte("a=2")},
+		"tmp":            &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"usr":            &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"usr/bin":        &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"usr/bin/bash":   &fstest.MapFile{Mode: 0555 | fs.ModeSymlink, Data: []byte("sh")},
+		"usr/bin/sh":     &fstest.MapFile{Mode: 0555 | fs.ModeSetuid, Data: []byte("#!")},
+		"var":            &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"var/log":        &fstest.MapFile{Mode: 0500 | fs.ModeDir},
+	}
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	whiteouts := []string{"etc/.wh.passwd", "opt/app/.wh..wh..opq", "tmp/.wh.removed"}
+	if err := fstest.TestFS(build(t, &upper), whiteouts...); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Stat(build(t, &upper), "tmp/removed"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("removed files must not be in the layer: %v", err)
+	}
+	if link, err := fslink.ReadLink(build(t, &upper), "usr/bin/bash"); err != nil || link != "sh" {
+		t.Errorf("wrong symbolic link: %q (%v)", link, err)
+	}
+
+	// The file systems are snapshots of the builder.
+	before := build(t, &upper)
+	upper.AddFile("etc/hostname", 0644, []byte("container"))
+	if _, err := fs.Stat(before, "etc/hostname"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the file system must not change after it was built: %v", err)
+	}
+}
+
+func TestBuilderInvalid(t *testing.T) {
+	tests := []struct {
+		scenario string
+		build    func(*ocifs.Builder)
+	}{
+		{
+			scenario: "file under a file",
+			build: func(b *ocifs.Builder) {
+				b.AddFile("a", 0644, nil)
+				b.AddFile("a/b", 0644, nil)
+			},
+		},
+		{
+			scenario: "remove the root",
+			build:    func(b *ocifs.Builder) { b.Remove("/") },
+		},
+		{
+			scenario: "file at the root",
+			build:    func(b *ocifs.Builder) { b.AddFile(".", 0644, nil) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			var b ocifs.Builder
+			test.build(&b)
+			if _, err := b.Build(); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("wrong error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package ocifs
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+)
+
+// lookupCache memoizes the results of resolving paths to their visible layers.
+// Paths which do not exist are also recorded so repeated misses are cheap.
+type lookupCache struct {
+	entries sync.Map // map[string]lookupEntry
+}
+
+type lookupEntry struct {
+	layers   []layer // nil for paths that do not exist
+	realName string
+}
+
+func (c *lookupCache) lookup(ctx context.Context, fsys *layerFS, op, name string) ([]layer, string, error) {
+	metrics := fsys.config.metrics
+	if v, ok := c.entries.Load(name); ok {
+		if metrics != nil {
+			metrics.LookupCacheHits.Add(1)
+		}
+		entry := v.(lookupEntry)
+		if entry.layers == nil {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		// Callers may modify the returned slice, the cached one must remain
+		// untouched.
+		return append([]layer{}, entry.layers...), entry.realName, nil
+	}
+
+	if metrics != nil {
+		metrics.LookupCacheMisses.Add(1)
+	}
+	layers, realName, err := fsys.resolveOnce(ctx, op, name)
+	switch {
+	case err == nil:
+		c.entries.Store(name, lookupEntry{layers: append([]layer{}, layers...), realName: realName})
+	case errors.Is(err, fs.ErrNotExist):
+		c.entries.Store(name, lookupEntry{})
+	}
+	return layers, realName, err
+}
+
+// resolveOnce is like resolve but coalesces concurrent resolutions of the same
+// path when WithSingleflight was used. Since layers are immutable, the result
+// of a resolution can be shared by all the callers waiting for it.
+func (fsys *layerFS) resolveOnce(ctx context.Context, op, name string) ([]layer, string, error) {
+	if fsys.flight == nil {
+		return fsys.resolve(ctx, op, name)
+	}
+	v, err, shared := fsys.flight.Do(name, func() (any, error) {
+		layers, realName, err := fsys.resolve(ctx, op, name)
+		return lookupEntry{layers: layers, realName: realName}, err
+	})
+	if !shared {
+		entry := v.(lookupEntry)
+		return entry.layers, entry.realName, err
+	}
+	if err != nil {
+		if ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			// The context of the caller which resolved the path was
+			// canceled, but ours was not, so we retry on our own.
+			return fsys.resolve(ctx, op, name)
+		}
+		if e, ok := err.(*fs.PathError); ok && e.Op != op {
+			err = &fs.PathError{Op: op, Path: e.Path, Err: e.Err}
+		}
+		return nil, "", err
+	}
+	// Callers may modify the returned slice, the shared one must remain
+	// untouched.
+	entry := v.(lookupEntry)
+	return append([]layer{}, entry.layers...), entry.realName, nil
+}
+
+// statCache is a LRU cache of the results of fs.Stat on the layers of a file
+// system. Only results that are not affected by transient errors are cached:
+// successful calls, and calls failing with fs.ErrNotExist.
+type statCache struct {
+	metrics *Metrics
+	mutex   sync.Mutex
+	size    int
+	lru     list.List // *statEntry, most recently used first
+	entries map[statKey]*list.Element
+}
+
+type statKey struct {
+	layer int
+	name  string
+}
+
+type statEntry struct {
+	key  statKey
+	info fs.FileInfo // nil if the file did not exist
+}
+
+func newStatCache(size int, metrics *Metrics) *statCache {
+	return &statCache{metrics: metrics, size: size, entries: make(map[statKey]*list.Element, size)}
+}
+
+func (c *statCache) stat(l layer, name string) (fs.FileInfo, error) {
+	key := statKey{layer: l.index, name: name}
+
+	c.mutex.Lock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mutex.Unlock()
+
+	if ok {
+		if c.metrics != nil {
+			c.metrics.StatCacheHits.Add(1)
+		}
+		if info := elem.Value.(*statEntry).info; info != nil {
+			return info, nil
+		}
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if c.metrics != nil {
+		c.metrics.StatCacheMisses.Add(1)
+	}
+	info, err := statLayer(l, name, c.metrics)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&statEntry{key: key, info: info})
+		if c.lru.Len() > c.size {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*statEntry).key)
+		}
+	}
+	return info, err
+}
@@ -0,0 +1,185 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// countStatFS counts the calls to Stat on the file system it wraps.
+type countStatFS struct {
+	fstest.MapFS
+	stats atomic.Int64
+}
+
+func (f *countStatFS) Stat(name string) (fs.FileInfo, error) {
+	f.stats.Add(1)
+	return f.MapFS.Stat(name)
+}
+
+func TestLayerFSLookupCache(t *testing.T) {
+	lower := &countStatFS{MapFS: fstest.MapFS{
+		"a/b/c/file": &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+		"a/b/old":    &fstest.MapFile{Mode: 0444, Data: []byte("old")},
+	}}
+	upper := &countStatFS{MapFS: fstest.MapFS{
+		"a/b/c/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+		"a/b/.wh.old": &fstest.MapFile{Mode: 0444},
+	}}
+
+	layers := ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithLookupCache())
+	expect := fstest.MapFS{
+		"a/b/c/file":  &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+		"a/b/c/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a/b/c/file", "a/b/old"} {
+		fs.Stat(layers, name)
+		stats := lower.stats.Load() + upper.stats.Load()
+
+		for i := 0; i < 10; i++ {
+			_, err := fs.Stat(layers, name)
+			if name == "a/b/old" && !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("%s: cached lookup must fail with fs.ErrNotExist: %v", name, err)
+			}
+		}
+		// Stat still needs to query the top layer for the file metadata, but
+		// the lookup must not walk the layers again.
+		if n := lower.stats.Load() + upper.stats.Load() - stats; n > 10 {
+			t.Errorf("%s: lookups were not cached: %d calls to Stat", name, n)
+		}
+	}
+
+	sub, err := fs.Sub(layers, "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.EqualFS(fstest.MapFS{
+		"c/file":  &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+		"c/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}, sub); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayerFSStatCache(t *testing.T) {
+	lower := &countStatFS{MapFS: fstest.MapFS{
+		"a/b/c/d/file": &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+	}}
+	upper := &countStatFS{MapFS: fstest.MapFS{
+		"a/b/c/d/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}}
+
+	stats := func() int64 { return lower.stats.Load() + upper.stats.Load() }
+	names := []string{"a", "a/b", "a/b/c", "a/b/c/d", "a/b/c/d/file", "a/b/c/d/other", "a/b/c/d/nope"}
+
+	uncached := ocifs.LayerFS(lower, upper)
+	for _, name := range names {
+		fs.Stat(uncached, name)
+	}
+	uncachedStats := stats()
+
+	cached := ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithStatCache(100))
+	for _, name := range names {
+		fs.Stat(cached, name)
+	}
+	if n := stats() - uncachedStats; n >= uncachedStats {
+		t.Errorf("stat results were not reused: uncached=%d cached=%d", uncachedStats, n)
+	}
+
+	before := stats()
+	for _, name := range names {
+		_, err := fs.Stat(cached, name)
+		if name == "a/b/c/d/nope" {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: cached stat must fail with fs.ErrNotExist: %v", name, err)
+			}
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := stats() - before; n != 0 {
+		t.Errorf("stat results were not cached: %d calls to Stat", n)
+	}
+
+	// A cache too small to hold the results of a single lookup keeps evicting
+	// its entries, but must return correct results.
+	small := ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithStatCache(1))
+	expect := fstest.MapFS{
+		"a/b/c/d/file":  &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+		"a/b/c/d/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}
+	if err := fstest.EqualFS(expect, small); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// gateStatFS blocks calls to Stat for a name until the gate is opened.
+type gateStatFS struct {
+	fstest.MapFS
+	name  string
+	gate  chan struct{}
+	stats atomic.Int64
+}
+
+func (f *gateStatFS) Stat(name string) (fs.FileInfo, error) {
+	if name == f.name {
+		f.stats.Add(1)
+		<-f.gate
+	}
+	return f.MapFS.Stat(name)
+}
+
+func TestLayerFSSingleflight(t *testing.T) {
+	lower := &gateStatFS{
+		MapFS: fstest.MapFS{
+			"a/file": &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+		},
+		name: "a",
+		gate: make(chan struct{}),
+	}
+	upper := fstest.MapFS{
+		"a/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}
+	layers := ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithSingleflight())
+
+	const N = 10
+	errs := make(chan error, N)
+	for i := 0; i < N; i++ {
+		go func() {
+			_, err := fs.Stat(layers, "a/file")
+			errs <- err
+		}()
+	}
+	// Give the goroutines time to all wait on the resolution of the path
+	// before letting it complete.
+	time.Sleep(50 * time.Millisecond)
+	close(lower.gate)
+
+	for i := 0; i < N; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := lower.stats.Load(); n >= N {
+		t.Errorf("concurrent lookups were not coalesced: %d calls to Stat", n)
+	}
+
+	if _, err := fs.Stat(layers, "a/nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing file must fail with fs.ErrNotExist: %v", err)
+	}
+	if err := fstest.EqualFS(fstest.MapFS{
+		"a/file":  &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+		"a/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}, layers); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package ocifs
+
+import (
+	"io/fs"
+	"strings"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// Caps is a bitset of the optional extensions of the fs.FS interface that a
+// file system supports.
+type Caps uint
+
+const (
+	// CapStat is set when the file system implements fs.StatFS.
+	CapStat Caps = 1 << iota
+	// CapReadFile is set when the file system implements fs.ReadFileFS.
+	CapReadFile
+	// CapReadDir is set when the file system implements fs.ReadDirFS.
+	CapReadDir
+	// CapGlob is set when the file system implements fs.GlobFS.
+	CapGlob
+	// CapSub is set when the file system implements fs.SubFS.
+	CapSub
+	// CapReadLink is set when the file system implements fslink.ReadLinkFS.
+	CapReadLink
+)
+
+var capNames = [...]string{
+	"stat",
+	"readfile",
+	"readdir",
+	"glob",
+	"sub",
+	"readlink",
+}
+
+// Has returns true if all the capabilities in c are set.
+func (caps Caps) Has(c Caps) bool {
+	return (caps & c) == c
+}
+
+func (caps Caps) String() string {
+	names := make([]string, 0, len(capNames))
+	for i, name := range capNames {
+		if caps.Has(1 << i) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Capabilities returns the set of optional fs.FS extensions supported by fsys.
+//
+// When fsys is a layered file system, the capabilities that depend on the
+// backing layers are reported only if all the layers support them. For
+// example, ReadLink on the overlay can only resolve symbolic links if each
+// layer implements fslink.ReadLinkFS, so CapReadLink is only set if it is
+// supported by every layer.
+func Capabilities(fsys fs.FS) Caps {
+	caps := capabilities(fsys)
+	if layers, ok := fsys.(*layerFS); ok {
+		for _, layer := range layers.layers {
+			base := baseFS(layer.fsys)
+			if s, ok := base.(*subLayer); ok {
+				base = baseFS(s.fsys)
+			}
+			if !Capabilities(base).Has(CapReadLink) {
+				caps &= ^CapReadLink
+			}
+		}
+	}
+	return caps
+}
+
+func capabilities(fsys fs.FS) (caps Caps) {
+	if _, ok := fsys.(fs.StatFS); ok {
+		caps |= CapStat
+	}
+	if _, ok := fsys.(fs.ReadFileFS); ok {
+		caps |= CapReadFile
+	}
+	if _, ok := fsys.(fs.ReadDirFS); ok {
+		caps |= CapReadDir
+	}
+	if _, ok := fsys.(fs.GlobFS); ok {
+		caps |= CapGlob
+	}
+	if _, ok := fsys.(fs.SubFS); ok {
+		caps |= CapSub
+	}
+	if _, ok := fsys.(fslink.ReadLinkFS); ok {
+		caps |= CapReadLink
+	}
+	return caps
+}
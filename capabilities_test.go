@@ -0,0 +1,83 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// openOnlyFS hides all the optional methods of the file system it wraps.
+type openOnlyFS struct{ fsys fs.FS }
+
+func (f openOnlyFS) Open(name string) (fs.File, error) { return f.fsys.Open(name) }
+
+func TestCapabilities(t *testing.T) {
+	layer := fstest.MapFS{
+		"a":      &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"a/file": &fstest.MapFile{Mode: 0444, Data: []byte("hello")},
+		"a/link": &fstest.MapFile{Mode: 0777 | fs.ModeSymlink, Data: []byte("file")},
+	}
+
+	mapCaps := ocifs.Capabilities(layer)
+	if want := ocifs.CapStat | ocifs.CapReadFile | ocifs.CapReadDir | ocifs.CapGlob | ocifs.CapSub | ocifs.CapReadLink; mapCaps != want {
+		t.Errorf("wrong capabilities for map layer: want=%v got=%v", want, mapCaps)
+	}
+
+	if caps := ocifs.Capabilities(openOnlyFS{layer}); caps != 0 {
+		t.Errorf("wrong capabilities for open-only layer: want=0 got=%v", caps)
+	}
+
+	tests := []struct {
+		scenario string
+		layers   []fs.FS
+		readLink bool
+	}{
+		{
+			scenario: "all layers support symbolic links",
+			layers:   []fs.FS{layer, layer},
+			readLink: true,
+		},
+		{
+			scenario: "one layer does not support symbolic links",
+			layers:   []fs.FS{openOnlyFS{layer}, layer},
+			readLink: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			fsys := ocifs.LayerFS(test.layers...)
+			caps := ocifs.Capabilities(fsys)
+
+			if !caps.Has(ocifs.CapSub) {
+				t.Errorf("layered file system must support sub: %v", caps)
+			}
+			if caps.Has(ocifs.CapReadLink) != test.readLink {
+				t.Errorf("wrong readlink capability: want=%t got=%v", test.readLink, caps)
+			}
+
+			// The capabilities must match what the file system actually does.
+			_, isStatFS := fsys.(fs.StatFS)
+			if caps.Has(ocifs.CapStat) != isStatFS {
+				t.Errorf("stat capability does not match fs.StatFS: %v", caps)
+			}
+
+			// Resolve the link in the bottom layer only, which is the one
+			// that may not support symbolic links.
+			sub := ocifs.LayerFS(test.layers[0])
+			_, err := fslink.ReadLink(sub, "a/link")
+			switch {
+			case err == nil && !ocifs.Capabilities(sub).Has(ocifs.CapReadLink):
+				t.Error("reading the link succeeded but the capability is not reported")
+			case err != nil && ocifs.Capabilities(sub).Has(ocifs.CapReadLink):
+				t.Errorf("reading the link failed but the capability is reported: %v", err)
+			case err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrInvalid):
+				t.Errorf("unexpected error reading the link: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package ocifs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// ErrFileChanged is returned by reads on files of a layered file system
+// configured with WithConsistentReads when the content of the file changed
+// in the backing layer after it was opened.
+var ErrFileChanged = errors.New("file changed since it was opened")
+
+// snapshot records the size of the top layer in files if it is a regular file,
+// replacing it with a wrapper ensuring that reads remain consistent with the
+// recorded size.
+func snapshot(files []fs.File, name string) error {
+	s, err := files[0].Stat()
+	if err != nil {
+		return err
+	}
+	if s.Mode().IsRegular() {
+		files[0] = &consistentFile{File: files[0], name: name, size: s.Size()}
+	}
+	return nil
+}
+
+// isReaderAt returns true if the file of a layer implements io.ReaderAt, looking
+// through the wrapper installed by WithConsistentReads, which only supports
+// ReadAt when the file it wraps does.
+func isReaderAt(f fs.File) bool {
+	if c, ok := f.(*consistentFile); ok {
+		f = c.File
+	}
+	_, ok := f.(io.ReaderAt)
+	return ok
+}
+
+type consistentFile struct {
+	fs.File
+	name   string
+	size   int64
+	offset int64
+}
+
+// Stat returns the information of the file with the size recorded when it was
+// opened, which is the size that reads are limited to.
+func (f *consistentFile) Stat() (fs.FileInfo, error) {
+	s, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &consistentInfo{FileInfo: s, size: f.size}, nil
+}
+
+type consistentInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (info *consistentInfo) Size() int64 { return info.size }
+
+func (f *consistentFile) Read(b []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if limit := f.size - f.offset; int64(len(b)) > limit {
+		b = b[:limit]
+	}
+	n, err := f.File.Read(b)
+	f.offset += int64(n)
+	if err == io.EOF && f.offset < f.size {
+		err = &fs.PathError{Op: "read", Path: f.name, Err: ErrFileChanged}
+	}
+	return n, err
+}
+
+func (f *consistentFile) ReadAt(b []byte, offset int64) (int, error) {
+	r, ok := f.File.(io.ReaderAt)
+	if !ok {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset >= f.size {
+		return 0, io.EOF
+	}
+	short := false
+	if limit := f.size - offset; int64(len(b)) > limit {
+		b, short = b[:limit], true
+	}
+	n, err := r.ReadAt(b, offset)
+	switch {
+	case n < len(b) && err == io.EOF:
+		err = &fs.PathError{Op: "read", Path: f.name, Err: ErrFileChanged}
+	case short && err == nil:
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *consistentFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.File.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if whence == io.SeekEnd {
+		// The end of the file is the size recorded when it was opened.
+		offset, whence = f.size+offset, io.SeekStart
+	}
+	offset, err := s.Seek(offset, whence)
+	if err == nil {
+		f.offset = offset
+	}
+	return offset, err
+}
+
+var (
+	_ io.ReaderAt = (*consistentFile)(nil)
+	_ io.Seeker   = (*consistentFile)(nil)
+)
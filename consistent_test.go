@@ -0,0 +1,144 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+// mutableFS is a file system exposing a single file named "file" whose
+// content can be changed while it is opened.
+type mutableFS struct{ data *[]byte }
+
+func (fsys mutableFS) Open(name string) (fs.File, error) {
+	switch name {
+	case ".":
+		return &mutableDir{}, nil
+	case "file":
+		return &mutableFile{data: fsys.data}, nil
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+}
+
+type mutableDir struct{}
+
+func (*mutableDir) Close() error                       { return nil }
+func (*mutableDir) Read([]byte) (int, error)           { return 0, io.EOF }
+func (*mutableDir) Stat() (fs.FileInfo, error)         { return mutableInfo{".", 0555 | fs.ModeDir, 0}, nil }
+func (*mutableDir) ReadDir(int) ([]fs.DirEntry, error) { return nil, io.EOF }
+
+type mutableFile struct {
+	data   *[]byte
+	offset int64
+}
+
+func (f *mutableFile) Close() error { return nil }
+
+func (f *mutableFile) Stat() (fs.FileInfo, error) {
+	return mutableInfo{"file", 0444, int64(len(*f.data))}, nil
+}
+
+func (f *mutableFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *mutableFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(*f.data))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *mutableFile) ReadAt(b []byte, offset int64) (int, error) {
+	data := *f.data
+	if offset >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type mutableInfo struct {
+	name string
+	mode fs.FileMode
+	size int64
+}
+
+func (info mutableInfo) Name() string       { return info.name }
+func (info mutableInfo) Size() int64        { return info.size }
+func (info mutableInfo) Mode() fs.FileMode  { return info.mode }
+func (info mutableInfo) ModTime() time.Time { return time.Time{} }
+func (info mutableInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info mutableInfo) Sys() any           { return nil }
+
+func TestConsistentReads(t *testing.T) {
+	data := []byte("hello world")
+	fsys := ocifs.LayerFSWithOptions([]fs.FS{mutableFS{&data}}, ocifs.WithConsistentReads())
+
+	f, err := fsys.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(f, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("wrong content: %q", b)
+	}
+
+	// Growing the file must not make new data visible.
+	data = []byte("hello world, and more")
+	b = make([]byte, 32)
+	n, err := f.(io.ReaderAt).ReadAt(b, 0)
+	if err != io.EOF {
+		t.Fatalf("reading past the snapshot size must return io.EOF: %v", err)
+	}
+	if string(b[:n]) != "hello world" {
+		t.Fatalf("wrong content: %q", b[:n])
+	}
+	// The size reported by Stat is the one that reads are limited to.
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 11 {
+		t.Errorf("stat must report the size of the snapshot: %d", info.Size())
+	}
+	// Seeking relative to the end of the file is also relative to the size of
+	// the snapshot.
+	if offset, err := f.(io.Seeker).Seek(-5, io.SeekEnd); err != nil || offset != 6 {
+		t.Errorf("wrong offset seeking from the end of the file: %d (%v)", offset, err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "world" {
+		t.Errorf("wrong content read from the end of the file: %q (%v)", b, err)
+	}
+	if _, err := f.(io.Seeker).Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrinking the file must be reported as an error.
+	data = []byte("hello")
+	if _, err := io.ReadAll(f); !errors.Is(err, ocifs.ErrFileChanged) {
+		t.Fatalf("reading a truncated file must return ErrFileChanged: %v", err)
+	}
+	if _, err := f.(io.ReaderAt).ReadAt(b[:4], 4); !errors.Is(err, ocifs.ErrFileChanged) {
+		t.Fatalf("reading a truncated file must return ErrFileChanged: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package ocifs
+
+import (
+	"context"
+	"io/fs"
+)
+
+// ContextFS is an extension of the fs.FS interface implemented by file systems
+// which accept a context to cancel the opening of files, for example because
+// it involves fetching data from a remote location.
+//
+// Layered file systems implement ContextFS, and pass the context to their
+// layers when they implement ContextFS as well.
+type ContextFS interface {
+	fs.FS
+	// Opens the file at name, aborting if ctx is canceled.
+	OpenCtx(ctx context.Context, name string) (fs.File, error)
+}
+
+// ReadDirContextFS is an extension of the fs.FS interface implemented by file
+// systems which accept a context to cancel reading directories.
+//
+// Layered file systems implement ReadDirContextFS; they check ctx between
+// reads of the layers, and open the directory in each layer with the context
+// if the layer implements ContextFS.
+type ReadDirContextFS interface {
+	fs.FS
+	// Reads the directory at name and returns its entries sorted by name,
+	// aborting if ctx is canceled.
+	ReadDirCtx(ctx context.Context, name string) ([]fs.DirEntry, error)
+}
+
+func openContext(ctx context.Context, fsys fs.FS, name string) (fs.File, error) {
+	if c, ok := fsys.(ContextFS); ok {
+		return c.OpenCtx(ctx, name)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return fsys.Open(name)
+}
+
+// ReadDirCtx reads the merged entries of the directory at name.
+func (fsys *layerFS) ReadDirCtx(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	f, err := fsys.open(ctx, "readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.readDir(ctx, -1)
+}
+
+var (
+	_ ContextFS        = (*layerFS)(nil)
+	_ ReadDirContextFS = (*layerFS)(nil)
+)
@@ -0,0 +1,69 @@
+package ocifs_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+type contextKey struct{}
+
+// contextFS records the values passed in the contexts of calls to OpenCtx.
+type contextFS struct {
+	fstest.MapFS
+	values []any
+}
+
+func (fsys *contextFS) OpenCtx(ctx context.Context, name string) (fs.File, error) {
+	fsys.values = append(fsys.values, ctx.Value(contextKey{}))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return fsys.MapFS.Open(name)
+}
+
+func TestLayerFSContext(t *testing.T) {
+	dir := &fstest.MapFile{Mode: 0755 | fs.ModeDir}
+	file := &fstest.MapFile{Mode: 0644}
+
+	lower := &contextFS{MapFS: fstest.MapFS{"a": dir, "a/1": file, "a/2": file}}
+	upper := fstest.MapFS{"a": dir, "a/3": file}
+	layers := ocifs.LayerFS(lower, upper)
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "value")
+	f, err := layers.(ocifs.ContextFS).OpenCtx(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if !reflect.DeepEqual(lower.values, []any{"value"}) {
+		t.Errorf("the context was not passed to the layer: %v", lower.values)
+	}
+
+	entries, err := layers.(ocifs.ReadDirContextFS).ReadDirCtx(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	if !reflect.DeepEqual(names, []string{"1", "2", "3"}) {
+		t.Errorf("wrong directory entries: %v", names)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := layers.(ocifs.ContextFS).OpenCtx(canceled, "a/1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("opening a file with a canceled context must fail with context.Canceled: %v", err)
+	}
+	if _, err := layers.(ocifs.ReadDirContextFS).ReadDirCtx(canceled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("reading a directory with a canceled context must fail with context.Canceled: %v", err)
+	}
+}
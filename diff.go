@@ -0,0 +1,194 @@
+package ocifs
+
+import (
+	"bytes"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ChangeKind represents the kind of change made to a file between two file
+// systems.
+type ChangeKind int
+
+const (
+	// The file exists in the new file system but not in the old one.
+	Added ChangeKind = iota
+	// The file exists in both file systems but was modified.
+	Modified
+	// The file exists in the old file system but not in the new one.
+	Deleted
+)
+
+func (kind ChangeKind) String() string {
+	switch kind {
+	case Added:
+		return "added"
+	case Modified:
+		return "modified"
+	case Deleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+// Change describes a change made to a file between two file systems.
+type Change struct {
+	// Path of the file that changed.
+	Path string
+	// Kind of change made to the file.
+	Kind ChangeKind
+	// Information about the file in the new file system, or in the old file
+	// system if the file was deleted.
+	Info fs.FileInfo
+}
+
+// Diff computes the list of changes needed to transform the file system old
+// into the file system new, sorted by path. The file systems are usually two
+// images, or two points of the same stack of layers, constructed with LayerFS.
+//
+// Files are considered modified when their type, size, permissions, or
+// modification time differ, or when they are symbolic links with different
+// targets. The WithContentComparison option enables the comparison of the
+// content of regular files which otherwise appear identical.
+//
+// Files are deleted when they are absent from new, or when new contains a
+// whiteout file masking them (which happens when new is a single layer). When
+// a directory is deleted, only the directory appears in the list of changes.
+func Diff(old, new fs.FS, options ...Option) ([]Change, error) {
+	c := newConfig(options)
+
+	oldFiles := make(map[string]fs.FileInfo)
+	err := fs.WalkDir(old, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." || c.isWhiteout(path.Base(name)) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		oldFiles[name] = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	newFiles := make(map[string]fs.FileInfo)
+	deleted := make(map[string]struct{})
+
+	err = fs.WalkDir(new, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		base := path.Base(name)
+		if c.isWhiteoutMetadata(base) {
+			return nil
+		}
+		if strings.HasPrefix(base, c.whiteoutPrefix) {
+			masked := path.Join(path.Dir(name), base[len(c.whiteoutPrefix):])
+			if _, ok := oldFiles[masked]; ok {
+				deleted[masked] = struct{}{}
+			}
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		newFiles[name] = info
+
+		oldInfo, ok := oldFiles[name]
+		if !ok {
+			changes = append(changes, Change{Path: name, Kind: Added, Info: info})
+			return nil
+		}
+		modified, err := c.modified(old, new, name, oldInfo, info)
+		if err != nil {
+			return err
+		}
+		if modified {
+			changes = append(changes, Change{Path: name, Kind: Modified, Info: info})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range oldFiles {
+		if _, ok := newFiles[name]; !ok {
+			deleted[name] = struct{}{}
+		}
+	}
+	for name := range deleted {
+		// Only report the top-most deleted paths; the content of deleted
+		// directories or of directories replaced by other types of files
+		// is implicitly deleted.
+		if dir := path.Dir(name); dir != "." {
+			if _, ok := deleted[dir]; ok {
+				continue
+			}
+			if info, ok := newFiles[dir]; ok && !info.IsDir() {
+				continue
+			}
+		}
+		changes = append(changes, Change{Path: name, Kind: Deleted, Info: oldFiles[name]})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// modified returns true if the file at name differs between the old and new
+// file systems.
+func (c *config) modified(old, new fs.FS, name string, oldInfo, newInfo fs.FileInfo) (bool, error) {
+	oldMode, newMode := oldInfo.Mode(), newInfo.Mode()
+	if oldMode.Type() != newMode.Type() || oldMode.Perm() != newMode.Perm() {
+		return true, nil
+	}
+	if !oldInfo.ModTime().Equal(newInfo.ModTime()) {
+		return true, nil
+	}
+
+	switch oldMode.Type() {
+	case fs.ModeSymlink:
+		oldLink, err := readRawLink(old, name)
+		if err != nil {
+			return false, err
+		}
+		newLink, err := readRawLink(new, name)
+		if err != nil {
+			return false, err
+		}
+		return oldLink != newLink, nil
+	case 0:
+		if oldInfo.Size() != newInfo.Size() {
+			return true, nil
+		}
+		if c.compareContent {
+			oldData, err := fs.ReadFile(old, name)
+			if err != nil {
+				return false, err
+			}
+			newData, err := fs.ReadFile(new, name)
+			if err != nil {
+				return false, err
+			}
+			return !bytes.Equal(oldData, newData), nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,112 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestDiff(t *testing.T) {
+	mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	file := func(name, data string) *tar.Header {
+		h := tarFile(name, data)
+		h.ModTime = mtime
+		return h
+	}
+
+	base := tarFS(t,
+		tarDir("etc/"),
+		file("etc/hosts", "localhost"),
+		file("etc/passwd", "root:x:0:0"),
+		file("etc/group", "root:x:0:"),
+		tarSymlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+		tarDir("var/"),
+		tarDir("var/cache/"),
+		file("var/cache/a", "a"),
+		file("var/cache/b", "b"),
+		file("opt", "file replaced by a directory"),
+	)
+
+	update := tarFS(t,
+		tarDir("etc/"),
+		file("etc/hostname", "container"),
+		file("etc/hosts", "127.0.0.1 localhost"), // modified size
+		file("etc/group", "ROOT:x:0:"),           // same size and mtime
+		tarFile("etc/.wh.passwd", ""),
+		tarSymlink("etc/localtime", "/usr/share/zoneinfo/CET"),
+		tarDir("var/"),
+		tarFile("var/.wh.cache", ""),
+		tarDir("opt/"),
+		file("opt/app", "app"),
+	)
+
+	type change struct {
+		path string
+		kind ocifs.ChangeKind
+	}
+
+	diff := func(t *testing.T, options ...ocifs.Option) []change {
+		t.Helper()
+		changes, err := ocifs.Diff(ocifs.LayerFS(base), ocifs.LayerFS(base, update), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make([]change, len(changes))
+		for i, c := range changes {
+			if c.Info == nil {
+				t.Errorf("%s: missing file information", c.Path)
+			}
+			result[i] = change{c.Path, c.Kind}
+		}
+		return result
+	}
+
+	expect := []change{
+		{"etc/hostname", ocifs.Added},
+		{"etc/hosts", ocifs.Modified},
+		{"etc/localtime", ocifs.Modified},
+		{"etc/passwd", ocifs.Deleted},
+		{"opt", ocifs.Modified},
+		{"opt/app", ocifs.Added},
+		{"var/cache", ocifs.Deleted},
+	}
+	if changes := diff(t); !reflect.DeepEqual(changes, expect) {
+		t.Errorf("wrong changes:\nwant=%v\ngot= %v", expect, changes)
+	}
+
+	expect = []change{
+		{"etc/group", ocifs.Modified},
+		{"etc/hostname", ocifs.Added},
+		{"etc/hosts", ocifs.Modified},
+		{"etc/localtime", ocifs.Modified},
+		{"etc/passwd", ocifs.Deleted},
+		{"opt", ocifs.Modified},
+		{"opt/app", ocifs.Added},
+		{"var/cache", ocifs.Deleted},
+	}
+	if changes := diff(t, ocifs.WithContentComparison()); !reflect.DeepEqual(changes, expect) {
+		t.Errorf("wrong changes with content comparison:\nwant=%v\ngot= %v", expect, changes)
+	}
+
+	// When the new file system is a single layer, its whiteout files mark the
+	// deletions.
+	changes, err := ocifs.Diff(base, tarFS(t, tarDir("etc/"), tarFile("etc/.wh.hosts", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range changes {
+		if c.Path == "etc/hosts" && c.Kind == ocifs.Deleted {
+			found = true
+		}
+		if c.Path == "etc/.wh.hosts" {
+			t.Errorf("whiteout files must not be reported as changes")
+		}
+	}
+	if !found {
+		t.Errorf("deletion of etc/hosts was not reported: %v", changes)
+	}
+}
@@ -0,0 +1,93 @@
+package ocifs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/fs"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// MerkleRoot computes a stable hash of the merged view exposed by fsys.
+//
+// The hash covers the paths, file types and permissions, symbolic link targets,
+// and digests of the content of regular files, visited in lexical order. Two
+// file systems exposing the same tree produce the same hash, regardless of the
+// number of layers or whiteouts that were involved in constructing them, which
+// makes it useful to compute cache keys of the effective root file system of
+// an image.
+//
+// Modification times are not part of the hash.
+//
+// The returned value has the form "sha256:<hex>".
+func MerkleRoot(fsys fs.FS) (string, error) {
+	root, err := merkleHash(fsys, ".", fs.ModeDir)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(root), nil
+}
+
+func merkleHash(fsys fs.FS, name string, typ fs.FileMode) ([]byte, error) {
+	hash := sha256.New()
+
+	switch {
+	case typ.IsDir():
+		entries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			child, err := merkleHash(fsys, joinPath(name, entry.Name()), entry.Type())
+			if err != nil {
+				return nil, err
+			}
+			writeMerkleString(hash, entry.Name())
+			writeMerkleUint32(hash, uint32(info.Mode()))
+			hash.Write(child)
+		}
+
+	case typ&fs.ModeSymlink != 0:
+		link, err := fslink.ReadLink(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		writeMerkleString(hash, link)
+
+	case typ.IsRegular():
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(hash, f); err != nil {
+			return nil, err
+		}
+	}
+
+	return hash.Sum(nil), nil
+}
+
+func writeMerkleString(w io.Writer, s string) {
+	writeMerkleUint32(w, uint32(len(s)))
+	io.WriteString(w, s)
+}
+
+func writeMerkleUint32(w io.Writer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func joinPath(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
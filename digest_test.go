@@ -0,0 +1,84 @@
+package ocifs_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestMerkleRoot(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	link := func(target string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0777 | fs.ModeSymlink, Data: []byte(target)}
+	}
+
+	flat := ocifs.LayerFS(fstest.MapFS{
+		"bin":           dir(),
+		"bin/sh":        file("#!"),
+		"etc":           dir(),
+		"etc/hosts":     file("localhost"),
+		"etc/localtime": link("hosts"),
+	})
+
+	layered := ocifs.LayerFS(
+		fstest.MapFS{
+			"bin":       dir(),
+			"bin/sh":    file("#!"),
+			"bin/bash":  file("#!"),
+			"etc":       dir(),
+			"etc/hosts": file("127.0.0.1"),
+		},
+		fstest.MapFS{
+			"bin":           dir(),
+			"bin/.wh.bash":  file(""),
+			"etc":           dir(),
+			"etc/hosts":     file("localhost"),
+			"etc/localtime": link("hosts"),
+		},
+		fstest.MapFS{
+			"bin":    dir(),
+			"bin/sh": file("#!"),
+		},
+	)
+
+	different := ocifs.LayerFS(fstest.MapFS{
+		"bin":           dir(),
+		"bin/sh":        file("#!"),
+		"etc":           dir(),
+		"etc/hosts":     file("127.0.0.1"),
+		"etc/localtime": link("hosts"),
+	})
+
+	root1, err := ocifs.MerkleRoot(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root2, err := ocifs.MerkleRoot(layered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root3, err := ocifs.MerkleRoot(different)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(root1, "sha256:") {
+		t.Errorf("wrong merkle root format: %q", root1)
+	}
+	if root1 != root2 {
+		t.Errorf("equivalent file systems must have the same merkle root: %q != %q", root1, root2)
+	}
+	if root1 == root3 {
+		t.Errorf("different file systems must have different merkle roots: %q", root1)
+	}
+}
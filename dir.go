@@ -0,0 +1,227 @@
+package ocifs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// DirFS returns a file system backed by the directory root of the local file
+// system. It is like os.DirFS, but exposes symbolic links the same way as the
+// layers constructed from tar archives, so they are resolved by LayerFS within
+// the layered file system instead of the local file system: Stat does not
+// follow symbolic links, and ReadLink returns their targets verbatim, with
+// slash separators.
+//
+// Open, ReadFile, and ReadDir do not follow symbolic links either, they fail
+// with an error wrapping fs.ErrInvalid when the last component of the name is
+// a link, so the files of the local file system that links point to are never
+// read. Symbolic links in the intermediate components of names are expected
+// to be resolved by the caller, as LayerFS does.
+//
+// Files opened from the file system are *os.File values, which implement
+// io.ReaderAt and io.Seeker.
+func DirFS(root string) fs.FS {
+	return &dirFS{root: root}
+}
+
+type dirFS struct {
+	root string
+}
+
+func (fsys *dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(fsys.root, filepath.FromSlash(name)), nil
+}
+
+// fixErr replaces the path of errors returned by the os package with the name
+// that the file system was called with, like os.DirFS does.
+func (fsys *dirFS) fixErr(name string, err error) error {
+	if e, ok := err.(*fs.PathError); ok {
+		e.Path = name
+	}
+	return err
+}
+
+func (fsys *dirFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := fsys.Lstat(name)
+	if err != nil {
+		if e, ok := err.(*fs.PathError); ok {
+			e.Op = "stat"
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+func (fsys *dirFS) Open(name string) (fs.File, error) {
+	f, err := fsys.open("open", name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fsys *dirFS) open(op, name string, flag int, perm fs.FileMode) (*os.File, error) {
+	path, err := fsys.join(op, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openNoFollow(path, flag, perm)
+	if err != nil {
+		if e, ok := err.(*fs.PathError); ok {
+			e.Op = op
+		}
+		return nil, fsys.fixErr(name, err)
+	}
+	return f, nil
+}
+
+func (fsys *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.open("readdir", name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		return nil, fsys.fixErr(name, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (fsys *dirFS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.open("read", name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fsys.fixErr(name, err)
+	}
+	return b, nil
+}
+
+func (fsys *dirFS) ReadLink(name string) (string, error) {
+	path, err := fsys.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	link, err := os.Readlink(path)
+	if err != nil {
+		if errors.Is(err, syscall.EINVAL) {
+			// Report files which are not symbolic links like the other
+			// layers, so EvalSymlinks can resolve paths of the directory.
+			return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+		}
+		return "", fsys.fixErr(name, err)
+	}
+	return filepath.ToSlash(link), nil
+}
+
+func (fsys *dirFS) Lstat(name string) (fs.FileInfo, error) {
+	path, err := fsys.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, fsys.fixErr(name, err)
+	}
+	return info, nil
+}
+
+// errOpenSymlink returns the error reported when opening the symbolic link at
+// path, which DirFS does not follow.
+func errOpenSymlink(path string) error {
+	return &fs.PathError{Op: "open", Path: path, Err: fmt.Errorf("cannot open symbolic link (%w)", fs.ErrInvalid)}
+}
+
+var (
+	_ fs.StatFS         = (*dirFS)(nil)
+	_ fs.ReadDirFS      = (*dirFS)(nil)
+	_ fs.ReadFileFS     = (*dirFS)(nil)
+	_ fslink.ReadLinkFS = (*dirFS)(nil)
+)
+
+// DirLayer returns a layer backed by a directory of the local file system,
+// typically one where a layer tarball was extracted.
+//
+// Whiteout files of the aufs convention (".wh." prefix) are detected by name,
+// so they are still interpreted by LayerFS when extracted to disk. However,
+// overlayfs whiteouts represented as character devices are only recognized
+// with WithCharDeviceWhiteouts if they were extracted as device files, which
+// usually requires elevated privileges.
+//
+// The function validates that the path exists and is a directory, returning
+// an error otherwise.
+func DirLayer(path string) (fs.FS, error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fmt.Errorf("layer is not a directory (%w)", fs.ErrInvalid)}
+	}
+	return DirFS(path), nil
+}
+
+// WritableDirLayer is like DirLayer but returns a layer which can be modified,
+// typically used as the upper layer of OverlayFS. Like Open, OpenFile does not
+// follow symbolic links, so writes never modify the files of the local file
+// system that links point to.
+func WritableDirLayer(path string) (WritableFS, error) {
+	fsys, err := DirLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return &writableDirFS{dirFS: fsys.(*dirFS)}, nil
+}
+
+type writableDirFS struct {
+	*dirFS
+}
+
+func (fsys *writableDirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	f, err := fsys.open("open", name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fsys *writableDirFS) Mkdir(name string, perm fs.FileMode) error {
+	path, err := fsys.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return fsys.fixErr(name, os.Mkdir(path, perm))
+}
+
+func (fsys *writableDirFS) Remove(name string) error {
+	path, err := fsys.join("remove", name)
+	if err != nil {
+		return err
+	}
+	return fsys.fixErr(name, os.Remove(path))
+}
+
+var (
+	_ fs.StatFS         = (*writableDirFS)(nil)
+	_ fs.ReadDirFS      = (*writableDirFS)(nil)
+	_ fslink.ReadLinkFS = (*writableDirFS)(nil)
+	_ WritableFS        = (*writableDirFS)(nil)
+)
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package ocifs
+
+import "os"
+
+// openNoFollow opens the file at path with the flags and permissions of
+// os.OpenFile, failing if the file is a symbolic link.
+func openNoFollow(path string, flag int, perm os.FileMode) (*os.File, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil:
+		if info.Mode().Type() == os.ModeSymlink {
+			return nil, errOpenSymlink(path)
+		}
+	case !os.IsNotExist(err) || (flag&os.O_CREATE) == 0:
+		return nil, err
+	}
+	return os.OpenFile(path, flag, perm)
+}
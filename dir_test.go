@@ -0,0 +1,276 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// extract writes the files of a layer to a temporary directory, mimicking the
+// extraction of a layer tarball on disk.
+func extract(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestDirLayer(t *testing.T) {
+	lower, err := ocifs.DirLayer(extract(t, map[string]string{
+		"etc/hosts":       "localhost",
+		"etc/resolv.conf": "nameserver 8.8.8.8",
+		"var/log/boot":    "ok",
+		"var/log/kern":    "ok",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upper, err := ocifs.DirLayer(extract(t, map[string]string{
+		"etc/.wh.resolv.conf":  "",
+		"etc/hostname":         "container",
+		"var/log/.wh..wh..opq": "",
+		"var/log/app":          "started",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	expect := fstest.MapFS{
+		"etc":          dir(),
+		"etc/hostname": file("container"),
+		"etc/hosts":    file("localhost"),
+		"var":          dir(),
+		"var/log":      dir(),
+		"var/log/app":  file("started"),
+	}
+
+	if err := fstest.EqualFS(expect, ocifs.LayerFS(lower, upper)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirLayerInvalid(t *testing.T) {
+	root := extract(t, map[string]string{"file": "hello"})
+
+	if _, err := ocifs.DirLayer(filepath.Join(root, "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a missing directory must fail with fs.ErrNotExist: %v", err)
+	}
+	if _, err := ocifs.DirLayer(filepath.Join(root, "file")); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("opening a regular file must fail with fs.ErrInvalid: %v", err)
+	}
+}
+
+func TestDirFSSymlinks(t *testing.T) {
+	root := extract(t, map[string]string{"etc/hosts": "localhost"})
+	if err := os.Symlink("hosts", filepath.Join(root, "etc", "hosts.link")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink("/usr/share/zoneinfo", filepath.Join(root, "etc", "zoneinfo")); err != nil {
+		t.Fatal(err)
+	}
+
+	base := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "127.0.0.1"),
+		tarDir("usr/share/zoneinfo/"),
+		tarFile("usr/share/zoneinfo/UTC", "TZif"),
+	)
+	layer := ocifs.DirFS(root)
+	layers := ocifs.LayerFS(base, layer)
+
+	for name, target := range map[string]string{
+		"etc/hosts.link": "hosts",
+		"etc/zoneinfo":   "/usr/share/zoneinfo",
+	} {
+		link, err := layer.(fslink.ReadLinkFS).ReadLink(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link != target {
+			t.Errorf("%s: wrong link target: want=%q got=%q", name, target, link)
+		}
+		info, err := ocifs.Lstat(layers, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Type() != fs.ModeSymlink {
+			t.Errorf("%s: not a symbolic link: %v", name, info.Mode())
+		}
+	}
+
+	if link, err := fslink.ReadLink(layers, "etc/hosts.link"); err != nil || link != "hosts" {
+		t.Errorf("wrong link target read from the layers: %q (%v)", link, err)
+	}
+
+	// Absolute links are not followed, they would resolve to the root of the
+	// local file system.
+	if _, err := fs.ReadFile(layers, "etc/zoneinfo/UTC"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("reading through an absolute link must fail with fs.ErrInvalid: %v", err)
+	}
+
+	f, err := layers.Open("etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(io.ReaderAt); !ok {
+		t.Error("files of the layer must implement io.ReaderAt")
+	}
+
+	_, err = layer.(fslink.ReadLinkFS).ReadLink("etc/hosts")
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "etc/hosts" {
+		t.Errorf("errors must report the path relative to the root: %v", err)
+	}
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("reading a file which is not a link must fail with fs.ErrInvalid: %v", err)
+	}
+	if _, err := ocifs.Lstat(layer, "etc/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist: %v", err)
+	}
+}
+
+func TestDirFSSymlinkTraversal(t *testing.T) {
+	root := extract(t, map[string]string{"etc/passwd": "layer"})
+	if err := os.Symlink("/etc/passwd", filepath.Join(root, "etc", "absolute")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink("../../../../etc/passwd", filepath.Join(root, "etc", "relative")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := ocifs.HTTPFS(ocifs.DirFS(root))
+
+	// Neither link is served, even though the absolute one would resolve to a
+	// file of the directory if the directory was the root.
+	for _, name := range []string{"/etc/absolute", "/etc/relative"} {
+		if f, err := fsys.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			if err == nil {
+				f.Close()
+			}
+			t.Errorf("%s: serving a link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+		}
+	}
+}
+
+func TestDirFSDoesNotFollowSymlinks(t *testing.T) {
+	host, err := os.ReadFile("/etc/hostname")
+	if err != nil {
+		t.Skip(err)
+	}
+	root := extract(t, map[string]string{"etc/hosts": "localhost"})
+	if err := os.Symlink("/etc/hostname", filepath.Join(root, "etc", "hostname")); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink("../../../../../../etc/hostname", filepath.Join(root, "etc", "rel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	layer := ocifs.DirFS(root)
+
+	for _, fsys := range []fs.FS{layer, ocifs.LayerFS(layer)} {
+		for _, name := range []string{"etc/hostname", "etc/rel"} {
+			b, err := fs.ReadFile(fsys, name)
+			if err == nil && string(b) == string(host) {
+				t.Fatalf("%s: read the file of the local file system through a symbolic link", name)
+			}
+			if !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("%s: reading a symbolic link must fail with fs.ErrInvalid: %v", name, err)
+			}
+			if f, err := fsys.Open(name); !errors.Is(err, fs.ErrInvalid) {
+				if err == nil {
+					f.Close()
+				}
+				t.Errorf("%s: opening a symbolic link must fail with fs.ErrInvalid: %v", name, err)
+			}
+		}
+		if _, err := fs.ReadDir(fsys, "dir"); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("listing a symbolic link must fail with fs.ErrInvalid: %v", err)
+		}
+	}
+
+	// Regular files and directories are still accessible.
+	if b, err := fs.ReadFile(layer, "etc/hosts"); err != nil || string(b) != "localhost" {
+		t.Errorf("wrong content of etc/hosts: %q (%v)", b, err)
+	}
+	entries, err := fs.ReadDir(layer, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"hostname", "hosts", "rel"}) {
+		t.Errorf("wrong entries: %q", names)
+	}
+}
+
+func TestWritableDirLayerDoesNotFollowSymlinks(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(outside, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := extract(t, map[string]string{"etc/hosts": "localhost"})
+	if err := os.Symlink(outside, filepath.Join(root, "etc", "link")); err != nil {
+		t.Skip(err)
+	}
+	layer, err := ocifs.WritableDirLayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flag := range []int{os.O_WRONLY | os.O_TRUNC, os.O_WRONLY | os.O_CREATE | os.O_APPEND, os.O_RDWR} {
+		f, err := layer.OpenFile("etc/link", flag, 0644)
+		if err == nil {
+			f.Close()
+		}
+		if !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("opening a symbolic link for writing must fail with fs.ErrInvalid: %v", err)
+		}
+		var pathErr *fs.PathError
+		if !errors.As(err, &pathErr) || pathErr.Path != "etc/link" {
+			t.Errorf("errors must report the path relative to the root: %v", err)
+		}
+	}
+	if b, err := os.ReadFile(outside); err != nil || string(b) != "host" {
+		t.Errorf("the file of the local file system was modified through a symbolic link: %q (%v)", b, err)
+	}
+
+	_, err = layer.OpenFile("var/log/boot", os.O_WRONLY|os.O_CREATE, 0644)
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "var/log/boot" || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("errors must report the path relative to the root: %v", err)
+	}
+	if err := layer.Remove("etc/missing"); !errors.As(err, &pathErr) || pathErr.Path != "etc/missing" {
+		t.Errorf("errors must report the path relative to the root: %v", err)
+	}
+
+	// Regular files are still writable.
+	writeFile(t, layer, "etc/hosts", os.O_WRONLY|os.O_APPEND, "\n127.0.0.1 localhost")
+	if b, err := fs.ReadFile(layer, "etc/hosts"); err != nil || string(b) != "localhost\n127.0.0.1 localhost" {
+		t.Errorf("wrong content of etc/hosts: %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package ocifs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openNoFollow opens the file at path with the flags and permissions of
+// os.OpenFile, failing if the file is a symbolic link. The check is done by
+// the kernel with O_NOFOLLOW, so the link cannot be swapped in after the check.
+func openNoFollow(path string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flag|syscall.O_NOFOLLOW, perm)
+	if err != nil && errors.Is(err, syscall.ELOOP) {
+		if info, lstatErr := os.Lstat(path); lstatErr == nil && info.Mode().Type() == os.ModeSymlink {
+			return nil, errOpenSymlink(path)
+		}
+	}
+	return f, err
+}
@@ -0,0 +1,74 @@
+package ocifs
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+)
+
+// dumpEntry is the representation of a file written by DumpJSON.
+type dumpEntry struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	Target string `json:"target,omitempty"`
+	Layer  int    `json:"layer"`
+}
+
+// DumpJSON writes to w a JSON array describing the files of the merged view of
+// fsys, which is useful to compare the content of images in tests. Each file
+// is an object with the fields:
+//
+//	path:   the name of the file in fsys
+//	type:   "file", "dir", "symlink", or the type of special files
+//	size:   the size of the file, as reported by Stat
+//	mode:   the type and permissions of the file, formatted like fs.FileMode
+//	target: the target of symbolic links, omitted for other files
+//	layer:  the index of the layer that the file resolves to, like Resolve
+//
+// The files are written in the order of WalkDir, which visits the entries of
+// directories in lexical order, so dumping the same tree always produces the
+// same output. Files masked by whiteouts are omitted.
+//
+// If fsys is not a layered file system, it is treated as a single layer.
+func DumpJSON(fsys fs.FS, w io.Writer) error {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		layers = LayerFS(fsys).(*layerFS)
+	}
+
+	entries := []dumpEntry{}
+	err := WalkDir(layers, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// The layers that files are visible in are already known to WalkDir,
+		// the top most one is the layer that the file resolves to.
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := dumpEntry{
+			Path:  name,
+			Type:  fileTypeName(info.Mode()),
+			Size:  info.Size(),
+			Mode:  info.Mode().String(),
+			Layer: d.(*walkEntry).layers[0].index,
+		}
+		if info.Mode().Type() == fs.ModeSymlink {
+			if entry.Target, err = readRawLink(layers, name); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
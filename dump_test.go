@@ -0,0 +1,111 @@
+package ocifs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestDumpJSON(t *testing.T) {
+	layer0 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("usr/"),
+		tarDir("usr/bin/"),
+		tarFile("usr/bin/sh", "#!"),
+	)
+	layer1 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+		tarSymlink("bin", "usr/bin"),
+	)
+	fsys := ocifs.LayerFS(layer0, layer1)
+
+	var b bytes.Buffer
+	if err := ocifs.DumpJSON(fsys, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Path   string `json:"path"`
+		Type   string `json:"type"`
+		Size   int64  `json:"size"`
+		Mode   string `json:"mode"`
+		Target string `json:"target"`
+		Layer  int    `json:"layer"`
+	}
+	var got []entry
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	expect := []entry{
+		{Path: ".", Type: "dir", Mode: "dr-xr-xr-x", Layer: 1},
+		{Path: "bin", Type: "symlink", Mode: "Lr-xr-xr-x", Target: "usr/bin", Layer: 1},
+		{Path: "etc", Type: "dir", Mode: "dr-xr-xr-x", Layer: 1},
+		{Path: "etc/hosts", Type: "file", Size: 19, Mode: "-r--r--r--", Layer: 1},
+		{Path: "usr", Type: "dir", Mode: "dr-xr-xr-x", Layer: 0},
+		{Path: "usr/bin", Type: "dir", Mode: "dr-xr-xr-x", Layer: 0},
+		{Path: "usr/bin/sh", Type: "file", Size: 2, Mode: "-r--r--r--", Layer: 0},
+	}
+	if !reflect.DeepEqual(expect, got) {
+		t.Errorf("wrong entries:\nwant: %+v\ngot:  %+v", expect, got)
+	}
+
+	// The output is deterministic, dumping the same tree again produces the
+	// same bytes.
+	var b2 bytes.Buffer
+	if err := ocifs.DumpJSON(ocifs.LayerFS(layer0, layer1), &b2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), b2.Bytes()) {
+		t.Errorf("dumping the same tree produced different outputs:\n%s\n%s", b.Bytes(), b2.Bytes())
+	}
+}
+
+func TestDumpJSONDoesNotResolvePaths(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0644, Data: []byte(data)}
+	}
+	layer0 := &countStatFS{MapFS: fstest.MapFS{
+		"etc/hosts":      file("localhost"),
+		"etc/passwd":     file("root:x:0:0"),
+		"usr/bin/sh":     file("#!"),
+		"usr/lib/libc.a": file("!<arch>"),
+	}}
+	layer1 := &countStatFS{MapFS: fstest.MapFS{
+		"etc/.wh.passwd":  file(""),
+		"etc/group":       file("root:x:0:"),
+		"usr/lib/libm.a":  file("!<arch>"),
+		"usr/share/doc/a": file("a"),
+	}}
+	stats := func() int64 { return layer0.stats.Load() + layer1.stats.Load() }
+	fsys := ocifs.LayerFS(layer0, layer1)
+
+	// Dumping the tree must not stat more files than walking it and getting
+	// the information of every entry.
+	before := stats()
+	ocifs.WalkDir(fsys, ".", func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = d.Info()
+		return err
+	})
+	walkStats := stats() - before
+
+	before = stats()
+	if err := ocifs.DumpJSON(fsys, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats() - before; n > walkStats {
+		t.Errorf("dumping the tree must not resolve the path of files: WalkDir=%d DumpJSON=%d", walkStats, n)
+	}
+}
@@ -0,0 +1,332 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Name of the tar entry holding the table of contents of eStargz layers.
+const estargzTOCName = "stargz.index.json"
+
+// Maximum size of the footer of eStargz layers. The footer is an empty gzip
+// member, its exact size depends on the compressor which wrote it.
+const estargzFooterSize = 51
+
+// EStargzFS constructs a file system from an eStargz layer, a gzip-compressed
+// tar archive where the content of each file is compressed in its own gzip
+// members, and which ends with a table of contents describing the files.
+//
+// Only the footer and the table of contents are read when the function is
+// called; directory listings and file metadata are served from the table of
+// contents, and the content of files is read from r on demand, one chunk at a
+// time. This allows r to fetch the layer lazily, for example with HTTP range
+// requests, so files can be accessed before the whole layer was downloaded.
+//
+// The legacy stargz format is also supported. The landmark files used by
+// eStargz to order prefetching are not exposed in the file system.
+//
+// Files opened from the file system implement io.ReaderAt and io.Seeker.
+func EStargzFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	tocOffset, footerSize, err := readEStargzFooter(r, size)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: "estargz", Err: err}
+	}
+	toc, err := readEStargzTOC(io.NewSectionReader(r, tocOffset, size-footerSize-tocOffset))
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: estargzTOCName, Err: err}
+	}
+	fsys, err := toc.fs(r, tocOffset)
+	if err != nil {
+		return nil, err
+	}
+	fsys.size = size
+	return fsys, nil
+}
+
+// readEStargzFooter returns the offset of the table of contents recorded in
+// the footer of the layer, and the size of the footer.
+func readEStargzFooter(r io.ReaderAt, size int64) (offset, footerSize int64, err error) {
+	tail := make([]byte, min(size, estargzFooterSize))
+	if _, err := r.ReadAt(tail, size-int64(len(tail))); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	for i := 0; i < len(tail); i++ {
+		footer := tail[i:]
+		if !bytes.HasPrefix(footer, gzipMagic) {
+			continue
+		}
+		z, err := gzip.NewReader(bytes.NewReader(footer))
+		if err != nil {
+			continue
+		}
+		// The offset is stored in the "SG" subfield of the extra field, or
+		// directly in the extra field in the legacy stargz format.
+		extra := z.Header.Extra
+		if len(extra) >= 4 && string(extra[:2]) == "SG" && int(binary.LittleEndian.Uint16(extra[2:4])) == len(extra)-4 {
+			extra = extra[4:]
+		}
+		if len(extra) != 22 || string(extra[16:]) != "STARGZ" {
+			continue
+		}
+		footerSize := int64(len(footer))
+		offset, err := strconv.ParseInt(string(extra[:16]), 16, 64)
+		if err != nil || offset < 0 || offset > size-footerSize {
+			continue
+		}
+		return offset, footerSize, nil
+	}
+	return 0, 0, fmt.Errorf("missing eStargz footer (%w)", fs.ErrInvalid)
+}
+
+type estargzTOC struct {
+	Version int                `json:"version"`
+	Entries []*estargzTOCEntry `json:"entries"`
+}
+
+type estargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+}
+
+func readEStargzTOC(r io.Reader) (*estargzTOC, error) {
+	z, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	tr := tar.NewReader(z)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if header.Name != estargzTOCName {
+		return nil, fmt.Errorf("unexpected tar entry in place of the table of contents: %q (%w)", header.Name, fs.ErrInvalid)
+	}
+	toc := new(estargzTOC)
+	if err := json.NewDecoder(tr).Decode(toc); err != nil {
+		return nil, err
+	}
+	return toc, nil
+}
+
+var estargzTypes = map[string]byte{
+	"dir":      tar.TypeDir,
+	"reg":      tar.TypeReg,
+	"symlink":  tar.TypeSymlink,
+	"hardlink": tar.TypeLink,
+	"char":     tar.TypeChar,
+	"block":    tar.TypeBlock,
+	"fifo":     tar.TypeFifo,
+}
+
+// fs constructs a file system from the table of contents. The content of
+// regular files is read from r, which must not extend past tocOffset.
+func (toc *estargzTOC) fs(r io.ReaderAt, tocOffset int64) (*tarFS, error) {
+	fsys := &tarFS{
+		files: map[string]*tarEntry{
+			".": newTarDir("."),
+		},
+		size: -1,
+	}
+	files := make(map[string]*estargzData)
+
+	for _, e := range toc.Entries {
+		name, ok := cleanTarPath(e.Name)
+		if !ok {
+			continue
+		}
+		if e.Type == "chunk" {
+			data := files[name]
+			if data == nil {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("chunk of missing regular file (%w)", fs.ErrInvalid)}
+			}
+			data.chunks = append(data.chunks, estargzChunk{offset: e.Offset, uoffset: e.ChunkOffset})
+			continue
+		}
+		if name == ".prefetch.landmark" || name == ".no.prefetch.landmark" {
+			continue
+		}
+		typeflag, ok := estargzTypes[e.Type]
+		if !ok {
+			continue
+		}
+
+		header := &tar.Header{
+			Typeflag: typeflag,
+			Name:     name,
+			Linkname: e.LinkName,
+			Size:     e.Size,
+			Mode:     e.Mode,
+			Uid:      e.UID,
+			Gid:      e.GID,
+			Uname:    e.Uname,
+			Gname:    e.Gname,
+			Devmajor: e.DevMajor,
+			Devminor: e.DevMinor,
+		}
+		if e.ModTime != "" {
+			t, err := time.Parse(time.RFC3339, e.ModTime)
+			if err != nil {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+			}
+			header.ModTime = t
+		}
+		for key, value := range e.Xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[paxXattrPrefix+key] = string(value)
+		}
+		if !isSupportedTarEntry(header) {
+			continue
+		}
+
+		entry := &tarEntry{header: header, info: header.FileInfo()}
+		if typeflag == tar.TypeReg {
+			data := &estargzData{r: r, end: tocOffset, size: e.Size}
+			if e.Size > 0 {
+				data.chunks = []estargzChunk{{offset: e.Offset, uoffset: e.ChunkOffset}}
+			}
+			files[name] = data
+			entry.data = data
+		}
+		fsys.put(name, entry)
+	}
+
+	for name, data := range files {
+		sort.Slice(data.chunks, func(i, j int) bool {
+			return data.chunks[i].uoffset < data.chunks[j].uoffset
+		})
+		for i, chunk := range data.chunks {
+			if chunk.offset < 0 || chunk.offset >= tocOffset || (i == 0 && chunk.uoffset != 0) || (i > 0 && chunk.uoffset <= data.chunks[i-1].uoffset) {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("invalid chunk offsets (%w)", fs.ErrInvalid)}
+			}
+		}
+	}
+
+	if err := fsys.resolveHardlinks(); err != nil {
+		return nil, err
+	}
+	if err := fsys.link(); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// estargzData is an io.ReaderAt reading the content of a regular file from the
+// chunks of an eStargz layer.
+type estargzData struct {
+	r      io.ReaderAt
+	end    int64
+	size   int64
+	chunks []estargzChunk
+
+	mutex  sync.Mutex
+	cursor *gzipCursor
+	chunk  int
+}
+
+// estargzChunk is the offset of the gzip member holding a chunk of a file in
+// the layer, and the offset of the chunk in the file.
+type estargzChunk struct {
+	offset  int64
+	uoffset int64
+}
+
+func (d *estargzData) ReadAt(b []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	n := 0
+	for n < len(b) && off < d.size {
+		i := sort.Search(len(d.chunks), func(i int) bool {
+			return d.chunks[i].uoffset > off
+		}) - 1
+		chunk := d.chunks[i]
+		end := d.size
+		if i+1 < len(d.chunks) {
+			end = d.chunks[i+1].uoffset
+		}
+
+		// The decoder of the previous read is reused when it is positioned
+		// before the offset in the same chunk, which is the case of
+		// sequential reads.
+		c := d.cursor
+		if c == nil || d.chunk != i || c.offset > off {
+			d.reset()
+			z, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(d.r, chunk.offset, d.end-chunk.offset)))
+			if err != nil {
+				return n, err
+			}
+			z.Multistream(false)
+			c = &gzipCursor{z: z, offset: chunk.uoffset}
+			d.cursor, d.chunk = c, i
+		}
+
+		if skip := off - c.offset; skip > 0 {
+			m, err := io.CopyN(io.Discard, c.z, skip)
+			c.offset += m
+			if err != nil {
+				d.reset()
+				return n, noEOF(err)
+			}
+		}
+		m, err := io.ReadFull(c.z, b[n:n+int(min(int64(len(b)-n), end-off))])
+		c.offset += int64(m)
+		n += m
+		off += int64(m)
+		if err != nil {
+			d.reset()
+			return n, noEOF(err)
+		}
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *estargzData) reset() {
+	if d.cursor != nil {
+		d.cursor.z.Close()
+		d.cursor = nil
+	}
+}
+
+// noEOF converts io.EOF errors to io.ErrUnexpectedEOF, for reads which must
+// not reach the end of the stream.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// estargzWriter writes eStargz layers, compressing each file in its own gzip
+// members and splitting files in chunks of chunkSize bytes.
+type estargzWriter struct {
+	t         testing.TB
+	buf       bytes.Buffer
+	z         *gzip.Writer
+	tw        *tar.Writer
+	entries   []map[string]any
+	chunkSize int
+}
+
+func (w *estargzWriter) Write(b []byte) (int, error) {
+	if w.z == nil {
+		w.z = gzip.NewWriter(&w.buf)
+	}
+	return w.z.Write(b)
+}
+
+func (w *estargzWriter) closeGzip() {
+	if w.z != nil {
+		if err := w.z.Close(); err != nil {
+			w.t.Fatal(err)
+		}
+		w.z = nil
+	}
+}
+
+func (w *estargzWriter) add(h *tar.Header) {
+	copy := *h
+	h = &copy
+	data := ""
+	if h.Typeflag == tar.TypeReg {
+		data, h.Linkname = h.Linkname, ""
+	}
+	if err := w.tw.WriteHeader(h); err != nil {
+		w.t.Fatal(err)
+	}
+	types := map[byte]string{tar.TypeDir: "dir", tar.TypeReg: "reg", tar.TypeSymlink: "symlink"}
+	entry := map[string]any{
+		"name":     h.Name,
+		"type":     types[h.Typeflag],
+		"mode":     h.Mode,
+		"linkName": h.Linkname,
+		"modtime":  h.ModTime.UTC().Format(time.RFC3339),
+	}
+	w.entries = append(w.entries, entry)
+	if h.Typeflag != tar.TypeReg {
+		return
+	}
+	entry["size"] = len(data)
+
+	for off := 0; off < len(data); off += w.chunkSize {
+		chunk := data[off:min(off+w.chunkSize, len(data))]
+		w.closeGzip()
+		if off == 0 {
+			entry["offset"] = w.buf.Len()
+			entry["chunkSize"] = len(chunk)
+		} else {
+			w.entries = append(w.entries, map[string]any{
+				"name":        h.Name,
+				"type":        "chunk",
+				"offset":      w.buf.Len(),
+				"chunkOffset": off,
+				"chunkSize":   len(chunk),
+			})
+		}
+		if _, err := io.WriteString(w.tw, chunk); err != nil {
+			w.t.Fatal(err)
+		}
+	}
+	w.closeGzip()
+}
+
+func makeEStargz(t testing.TB, chunkSize int, headers ...*tar.Header) []byte {
+	t.Helper()
+	w := &estargzWriter{t: t, chunkSize: chunkSize}
+	w.tw = tar.NewWriter(w)
+	for _, h := range headers {
+		w.add(h)
+	}
+	w.closeGzip()
+
+	toc, err := json.Marshal(map[string]any{"version": 1, "entries": w.entries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tocOffset := w.buf.Len()
+	w.tw = tar.NewWriter(w)
+	if err := w.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "stargz.index.json", Mode: 0644, Size: int64(len(toc))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.tw.Write(toc); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w.closeGzip()
+
+	z, err := gzip.NewWriterLevel(&w.buf, gzip.NoCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.Header.Extra = append([]byte{'S', 'G', 22, 0}, fmt.Sprintf("%016xSTARGZ", tocOffset)...)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.buf.Bytes()
+}
+
+// countReaderAt records the number of bytes read from a blob.
+type countReaderAt struct {
+	r     io.ReaderAt
+	bytes atomic.Int64
+}
+
+func (r *countReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(b, off)
+	r.bytes.Add(int64(n))
+	return n, err
+}
+
+func TestEStargzFS(t *testing.T) {
+	large := strings.Repeat("0123456789abcdef", 10000)
+	headers := []*tar.Header{
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("usr/share/large", large),
+		tarSymlink("usr/lib", "../lib"),
+		tarFile(".prefetch.landmark", "\xf0"),
+	}
+	b := makeEStargz(t, 4096, headers...)
+	r := &countReaderAt{r: bytes.NewReader(b)}
+
+	layer, err := ocifs.EStargzFS(r, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadDir(layer, "usr/share"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(layer, "usr/share/large"); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.bytes.Load(); n > int64(len(b)/2) {
+		t.Errorf("listing files must not read their content: %d/%d bytes read", n, len(b))
+	}
+
+	expect := fstest.MapFS{
+		"etc/hosts":       &fstest.MapFile{Mode: 0644, Data: []byte("localhost")},
+		"etc/.wh.passwd":  &fstest.MapFile{Mode: 0644},
+		"usr/share/large": &fstest.MapFile{Mode: 0644, Data: []byte(large)},
+		"usr/lib":         &fstest.MapFile{Mode: fs.ModeSymlink | 0777, Data: []byte("../lib")},
+	}
+	if err := fstest.EqualFS(expect, layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(layer, "etc/hosts", "etc/.wh.passwd", "usr/share/large", "usr/lib"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := layer.Open("usr/share/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Reads crossing chunk boundaries.
+	buf := make([]byte, 100)
+	for _, off := range []int{len(large) - 100, 4050, 0, 8190} {
+		if _, err := f.(io.ReaderAt).ReadAt(buf, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != large[off:off+100] {
+			t.Fatalf("wrong content read at offset %d: %q", off, buf)
+		}
+	}
+	if _, err := f.(io.Seeker).Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tail) != large[len(large)-5:] {
+		t.Errorf("wrong content read after seek: %q", tail)
+	}
+}
+
+func TestEStargzFSInvalid(t *testing.T) {
+	b := makeTar(t, tarFile("hello", "world"))
+	for _, data := range [][]byte{b, gzipBytes(t, b)} {
+		_, err := ocifs.EStargzFS(bytes.NewReader(data), int64(len(data)))
+		if !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("layers without eStargz footer must fail with fs.ErrInvalid: %v", err)
+		}
+	}
+}
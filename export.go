@@ -0,0 +1,344 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WriteLayer writes a layer tarball to w applying the list of changes, which is
+// usually obtained from Diff. The content and metadata of added and modified
+// files are read from base, which is the file system that the changes lead to.
+// Deleted files are written as whiteout files.
+//
+// The parent directories of changed files are included in the layer with
+// their metadata from base. Entries are written in sorted order, so the output
+// is deterministic for a given list of changes and base file system.
+//
+// With the WithGzip option, the tarball is compressed with gzip.
+func WriteLayer(w io.Writer, changes []Change, base fs.FS, options ...Option) error {
+	c := newConfig(options)
+
+	entries := make(map[string]fs.FileInfo)
+	whiteouts := make(map[string]bool)
+	for _, change := range changes {
+		name := change.Path
+		if !fs.ValidPath(name) || name == "." {
+			return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+		}
+		if change.Kind == Deleted {
+			whiteoutOne, _ := c.whiteout(name)
+			entries[whiteoutOne] = nil
+			whiteouts[whiteoutOne] = true
+		} else {
+			entries[name] = change.Info
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := entries[dir]; !ok {
+				entries[dir] = nil
+			}
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw, z := c.newTarWriter(w)
+
+	for _, name := range names {
+		if whiteouts[name] {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}); err != nil {
+				return err
+			}
+			continue
+		}
+		info := entries[name]
+		if info == nil {
+			s, err := fs.Stat(base, name)
+			if err != nil {
+				return err
+			}
+			info = s
+		}
+		if err := c.writeTarEntry(tw, base, name, name, info); err != nil {
+			return err
+		}
+	}
+	return closeTarWriter(tw, z)
+}
+
+// Squash writes a single layer tarball to w containing the tree of files
+// visible in fsys, which is usually a layered file system constructed with
+// LayerFS. Files masked by whiteouts are not written, and the layer does not
+// contain any whiteout files.
+//
+// The permissions, ownership, and extended attributes of files are preserved
+// when the file system exposes them (see FileInfoSys), and symbolic links are
+// written with their targets. Entries are written in the order of fs.WalkDir,
+// with parent directories preceding their content.
+//
+// With the WithFollowSymlinks option, symbolic links are replaced by the files
+// that they resolve to, see EvalSymlinks.
+//
+// With the WithReproducible option, timestamps are zeroed and entries are
+// written in sorted order of their names so that squashing the same file tree
+// always produces the same output; WithMtimeClamp, WithRootOwnership, and
+// WithStripXattrs normalize the rest of the metadata. With the WithGzip
+// option, the tarball is compressed with gzip.
+func Squash(w io.Writer, fsys fs.FS, options ...Option) error {
+	c := newConfig(options)
+	tw, z := c.newTarWriter(w)
+	s := &squasher{config: c, fsys: fsys, tw: tw}
+
+	if err := s.walk(".", ".", nil); err != nil {
+		return err
+	}
+	// Sorting the full names keeps directories before their content since
+	// the name of a directory is a prefix of the names of its files.
+	sort.Slice(s.entries, func(i, j int) bool {
+		return s.entries[i].name < s.entries[j].name
+	})
+	for _, e := range s.entries {
+		if err := c.writeTarEntry(tw, fsys, e.name, e.source, e.info); err != nil {
+			return err
+		}
+	}
+	return closeTarWriter(tw, z)
+}
+
+type squasher struct {
+	config *config
+	fsys   fs.FS
+	tw     *tar.Writer
+	// buffered entries, only when they are written in sorted order
+	entries []squashEntry
+}
+
+type squashEntry struct {
+	name   string
+	source string
+	info   fs.FileInfo
+}
+
+// walk writes the files of the directory root to the layer, with names where
+// the root is replaced by prefix. The directories are different when walking
+// the target of a symbolic link that was followed; targets holds the targets
+// of the links being followed, to detect cycles.
+func (s *squasher) walk(root, prefix string, targets []string) error {
+	c := s.config
+	return fs.WalkDir(s.fsys, root, func(source string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, relPath(root, source))
+		if name == "." {
+			return nil
+		}
+		if c.isWhiteout(entry.Name()) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if c.followSymlinks && info.Mode().Type() == fs.ModeSymlink {
+			target, err := EvalSymlinks(s.fsys, source)
+			if err != nil {
+				return err
+			}
+			if info, err = fs.Stat(s.fsys, target); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				// Following a link to a directory containing the link, or
+				// the links that led to it, would never terminate.
+				cycle := isSubPath(source, target)
+				for _, dir := range targets {
+					cycle = cycle || isSubPath(dir, target)
+				}
+				if cycle {
+					return &fs.PathError{Op: "write", Path: name, Err: fmt.Errorf("symbolic link cycle to %q (%w)", target, syscall.ELOOP)}
+				}
+				return s.walk(target, name, append(targets[:len(targets):len(targets)], target))
+			}
+			source = target
+		}
+
+		if c.reproducible {
+			s.entries = append(s.entries, squashEntry{name, source, info})
+			return nil
+		}
+		return c.writeTarEntry(s.tw, s.fsys, name, source, info)
+	})
+}
+
+// relPath returns the path of name relative to the directory dir containing
+// it.
+func relPath(dir, name string) string {
+	switch {
+	case dir == ".":
+		return name
+	case name == dir:
+		return "."
+	default:
+		return name[len(dir)+1:]
+	}
+}
+
+// isSubPath returns true if name is dir or one of the files that it contains.
+func isSubPath(name, dir string) bool {
+	return dir == "." || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// newTarWriter returns a tar writer producing its output to w, and the gzip
+// writer it is layered on top of if the layer is compressed.
+func (c *config) newTarWriter(w io.Writer) (*tar.Writer, *gzip.Writer) {
+	if !c.gzipLayer {
+		return tar.NewWriter(w), nil
+	}
+	z := gzip.NewWriter(w)
+	return tar.NewWriter(z), z
+}
+
+func closeTarWriter(tw *tar.Writer, z *gzip.Writer) error {
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if z != nil {
+		return z.Close()
+	}
+	return nil
+}
+
+// writeTarEntry writes the file at source of fsys to tw, with the given name
+// in the layer.
+func (c *config) writeTarEntry(tw *tar.Writer, fsys fs.FS, name, source string, info fs.FileInfo) error {
+	var link string
+	if info.Mode().Type() == fs.ModeSymlink {
+		target, err := readRawLink(fsys, source)
+		if err != nil {
+			return err
+		}
+		link = target
+	}
+
+	header, err := tarHeader(name, info, link)
+	if err != nil {
+		return err
+	}
+	c.normalizeTarHeader(header)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := fsys.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(tw, f)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	if n != header.Size {
+		return &fs.PathError{Op: "write", Path: name, Err: fmt.Errorf("file size changed from %d to %d bytes (%w)", header.Size, n, ErrFileChanged)}
+	}
+	return nil
+}
+
+// normalizeTarHeader applies the options normalizing the metadata of the files
+// written to layers.
+func (c *config) normalizeTarHeader(header *tar.Header) {
+	switch {
+	case c.reproducible:
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	case !c.mtimeClamp.IsZero():
+		header.ModTime = clampTime(header.ModTime, c.mtimeClamp)
+		header.AccessTime = clampTime(header.AccessTime, c.mtimeClamp)
+		header.ChangeTime = clampTime(header.ChangeTime, c.mtimeClamp)
+	}
+	if c.rootOwnership {
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+	}
+	if c.stripXattrs {
+		for key := range header.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				delete(header.PAXRecords, key)
+			}
+		}
+	}
+}
+
+func clampTime(t, max time.Time) time.Time {
+	if t.After(max) {
+		return max
+	}
+	return t
+}
+
+// tarHeader constructs the tar header of the file at name, preserving the
+// metadata recorded in FileInfoSys when it is available.
+func tarHeader(name string, info fs.FileInfo, link string) (*tar.Header, error) {
+	if l, ok := info.(*layerInfo); ok {
+		// Layered file systems remove write permissions from files, the
+		// original permissions must be preserved in the layer.
+		info = l.FileInfo
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// Hard links are written as regular files since their targets may not be
+	// part of the layer.
+	if header.Typeflag == tar.TypeLink {
+		header.Typeflag = tar.TypeReg
+		header.Linkname = ""
+		header.Size = info.Size()
+	}
+	// Only retain the PAX records which do not conflict with the fields of the
+	// new header.
+	header.Xattrs = nil
+	header.PAXRecords = nil
+
+	if s, ok := fileInfoSys(info.Sys()); ok {
+		header.Uid, header.Gid = s.Uid, s.Gid
+		header.ModTime = s.Mtime
+		header.AccessTime = s.Atime
+		header.ChangeTime = s.Ctime
+		if header.Typeflag == tar.TypeChar || header.Typeflag == tar.TypeBlock {
+			major, minor := unmakedev(s.Rdev)
+			header.Devmajor, header.Devminor = major, minor
+		}
+		for key, value := range s.Xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[paxXattrPrefix+key] = string(value)
+		}
+	}
+	return header, nil
+}
@@ -0,0 +1,457 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestWriteLayer(t *testing.T) {
+	mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	file := func(name, data string) *tar.Header {
+		h := tarFile(name, data)
+		h.ModTime = mtime
+		return h
+	}
+
+	base := tarFS(t,
+		tarDir("etc/"),
+		file("etc/hosts", "localhost"),
+		file("etc/passwd", "root:x:0:0"),
+		tarDir("var/"),
+		tarDir("var/cache/"),
+		file("var/cache/a", "a"),
+	)
+
+	update := tarFS(t,
+		tarDir("etc/"),
+		file("etc/hosts", "127.0.0.1 localhost"),
+		tarFile("etc/.wh.passwd", ""),
+		tarSymlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+		tarDir("var/"),
+		tarFile("var/.wh.cache", ""),
+		tarDir("usr/"),
+		tarDir("usr/bin/"),
+		file("usr/bin/app", "#!/bin/sh"),
+	)
+
+	changes, err := ocifs.Diff(ocifs.LayerFS(base), ocifs.LayerFS(base, update))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(t *testing.T, options ...ocifs.Option) []byte {
+		t.Helper()
+		b := new(bytes.Buffer)
+		if err := ocifs.WriteLayer(b, changes, ocifs.LayerFS(base, update), options...); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	layer := write(t)
+	if !bytes.Equal(layer, write(t)) {
+		t.Error("writing the same changes twice produced different layers")
+	}
+
+	var names []string
+	r := tar.NewReader(bytes.NewReader(layer))
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	expect := []string{
+		"etc/",
+		"etc/.wh.passwd",
+		"etc/hosts",
+		"etc/localtime",
+		"usr/",
+		"usr/bin/",
+		"usr/bin/app",
+		"var/",
+		"var/.wh.cache",
+	}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("wrong layer entries:\nwant=%v\ngot= %v", expect, names)
+	}
+
+	fsys, err := ocifs.TarFS(bytes.NewReader(layer), int64(len(layer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualFS(t, ocifs.LayerFS(base, fsys), ocifs.LayerFS(base, update))
+
+	gz := write(t, ocifs.WithGzip())
+	fsys, err = ocifs.TarGzFS(bytes.NewReader(gz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualFS(t, ocifs.LayerFS(base, fsys), ocifs.LayerFS(base, update))
+}
+
+func assertEqualFS(t *testing.T, got, want fs.FS) {
+	t.Helper()
+	changes, err := ocifs.Diff(want, got, ocifs.WithContentComparison())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		t.Errorf("%s: %s", c.Path, c.Kind)
+	}
+}
+
+func TestSquash(t *testing.T) {
+	mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	file := func(name, data string) *tar.Header {
+		h := tarFile(name, data)
+		h.ModTime = mtime
+		h.Uid, h.Gid = 1000, 1000
+		return h
+	}
+
+	base := tarFS(t,
+		tarDir("etc/"),
+		file("etc/hosts", "localhost"),
+		file("etc/passwd", "root:x:0:0"),
+		tarDir("var/"),
+		tarDir("var/cache/"),
+		file("var/cache/a", "a"),
+	)
+
+	update := tarFS(t,
+		tarDir("etc/"),
+		file("etc/hosts", "127.0.0.1 localhost"),
+		tarFile("etc/.wh.passwd", ""),
+		tarSymlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+		tarDir("var/"),
+		tarFile("var/.wh.cache", ""),
+	)
+
+	squash := func(t *testing.T, fsys fs.FS, options ...ocifs.Option) []byte {
+		t.Helper()
+		b := new(bytes.Buffer)
+		if err := ocifs.Squash(b, fsys, options...); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	merged := ocifs.LayerFS(base, update)
+	layer := squash(t, merged)
+
+	var names []string
+	r := tar.NewReader(bytes.NewReader(layer))
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name == "etc/hosts" && (h.Uid != 1000 || h.Gid != 1000 || h.Mode&0200 == 0) {
+			t.Errorf("etc/hosts: ownership or permissions not preserved: uid=%d gid=%d mode=%o", h.Uid, h.Gid, h.Mode)
+		}
+		names = append(names, h.Name)
+	}
+	expect := []string{
+		"etc/",
+		"etc/hosts",
+		"etc/localtime",
+		"var/",
+	}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("wrong layer entries:\nwant=%v\ngot= %v", expect, names)
+	}
+
+	fsys, err := ocifs.TarFS(bytes.NewReader(layer), int64(len(layer)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualFS(t, ocifs.LayerFS(fsys), merged)
+
+	// Squashing the same tree with different timestamps in reproducible mode
+	// must produce the same output.
+	mtime = mtime.Add(time.Hour)
+	other := ocifs.LayerFS(tarFS(t,
+		tarDir("etc/"),
+		file("etc/hosts", "127.0.0.1 localhost"),
+		tarSymlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+		tarDir("var/"),
+	))
+	if bytes.Equal(layer, squash(t, other)) {
+		t.Error("squashed trees with different timestamps must differ")
+	}
+	if !bytes.Equal(squash(t, merged, ocifs.WithReproducible()), squash(t, other, ocifs.WithReproducible())) {
+		t.Error("reproducible squashes of the same tree produced different outputs")
+	}
+
+	// Directories named like whiteouts in a source which is not layered are
+	// skipped with their content.
+	layer = squash(t, fstest.MapFS{
+		"etc/hosts":         &fstest.MapFile{Mode: 0644, Data: []byte("localhost")},
+		".wh.x/child":       &fstest.MapFile{Mode: 0644, Data: []byte("child")},
+		".wh..wh.plnk/1234": &fstest.MapFile{Mode: 0644},
+	})
+	names = names[:0]
+	r = tar.NewReader(bytes.NewReader(layer))
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	expect = []string{
+		"etc/",
+		"etc/hosts",
+	}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("wrong layer entries of a source with whiteout directories:\nwant=%v\ngot= %v", expect, names)
+	}
+}
+
+func TestSquashNormalizedMetadata(t *testing.T) {
+	tree := func(mtime time.Time, uid int, xattr string) fs.FS {
+		file := func(name, data string) *tar.Header {
+			h := tarFile(name, data)
+			h.ModTime = mtime
+			h.Uid, h.Gid = uid, uid
+			h.Uname, h.Gname = "user", "group"
+			h.PAXRecords = map[string]string{"SCHILY.xattr.user.tag": xattr}
+			return h
+		}
+		return ocifs.LayerFS(tarFS(t,
+			tarDir("a/"),
+			file("a/x", "x"),
+			file("a-b", "b"),
+			file("c", "c"),
+		))
+	}
+
+	squash := func(t *testing.T, fsys fs.FS, options ...ocifs.Option) []*tar.Header {
+		t.Helper()
+		b := new(bytes.Buffer)
+		if err := ocifs.Squash(b, fsys, options...); err != nil {
+			t.Fatal(err)
+		}
+		var headers []*tar.Header
+		r := tar.NewReader(b)
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				return headers
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers = append(headers, h)
+		}
+	}
+
+	t1 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("reproducible", func(t *testing.T) {
+		options := []ocifs.Option{
+			ocifs.WithReproducible(),
+			ocifs.WithRootOwnership(),
+			ocifs.WithStripXattrs(),
+		}
+		var layers [2][]byte
+		for i, fsys := range []fs.FS{tree(t1, 1000, "a"), tree(t2, 1001, "b")} {
+			b := new(bytes.Buffer)
+			if err := ocifs.Squash(b, fsys, options...); err != nil {
+				t.Fatal(err)
+			}
+			layers[i] = b.Bytes()
+		}
+		if !bytes.Equal(layers[0], layers[1]) {
+			t.Error("squashes of the same tree with different metadata produced different outputs")
+		}
+
+		var names []string
+		for _, h := range squash(t, tree(t1, 1000, "a"), options...) {
+			names = append(names, h.Name)
+			if h.Uid != 0 || h.Gid != 0 || h.Uname != "" || h.Gname != "" {
+				t.Errorf("%s: ownership not normalized: uid=%d gid=%d uname=%q gname=%q", h.Name, h.Uid, h.Gid, h.Uname, h.Gname)
+			}
+			if len(h.PAXRecords) != 0 {
+				t.Errorf("%s: extended attributes not stripped: %v", h.Name, h.PAXRecords)
+			}
+			if !h.ModTime.Equal(time.Unix(0, 0)) {
+				t.Errorf("%s: timestamp not zeroed: %v", h.Name, h.ModTime)
+			}
+		}
+		if expect := []string{"a/", "a-b", "a/x", "c"}; !reflect.DeepEqual(names, expect) {
+			t.Errorf("entries not sorted by name:\nwant=%v\ngot= %v", expect, names)
+		}
+	})
+
+	t.Run("clamp", func(t *testing.T) {
+		clamp := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+		for _, test := range []struct {
+			mtime  time.Time
+			expect time.Time
+		}{
+			{mtime: t1, expect: t1},
+			{mtime: t2, expect: clamp},
+		} {
+			for _, h := range squash(t, tree(test.mtime, 1000, "a"), ocifs.WithMtimeClamp(clamp)) {
+				if h.Typeflag != tar.TypeReg {
+					continue
+				}
+				if !h.ModTime.Equal(test.expect) {
+					t.Errorf("%s: wrong timestamp: want=%v got=%v", h.Name, test.expect, h.ModTime)
+				}
+				if h.Uid != 1000 || h.PAXRecords["SCHILY.xattr.user.tag"] != "a" {
+					t.Errorf("%s: metadata must be preserved: uid=%d xattrs=%v", h.Name, h.Uid, h.PAXRecords)
+				}
+			}
+		}
+	})
+}
+
+func TestSquashFollowSymlinks(t *testing.T) {
+	base := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarSymlink("etc/hosts.link", "hosts"),
+		tarSymlink("etc/parent", "../etc/hosts"),
+		tarDir("usr/bin/"),
+		tarFile("usr/bin/sh", "#!"),
+		tarSymlink("bin", "usr/bin"),
+	)
+
+	squash := func(t *testing.T, fsys fs.FS, options ...ocifs.Option) (map[string]*tar.Header, map[string]string, error) {
+		t.Helper()
+		b := new(bytes.Buffer)
+		if err := ocifs.Squash(b, fsys, options...); err != nil {
+			return nil, nil, err
+		}
+		headers := map[string]*tar.Header{}
+		contents := map[string]string{}
+		r := tar.NewReader(b)
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				return headers, contents, nil
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			headers[h.Name] = h
+			contents[h.Name] = string(data)
+		}
+	}
+
+	headers, _, err := squash(t, ocifs.LayerFS(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"etc/hosts.link": "hosts",
+		"etc/parent":     "../etc/hosts",
+		"bin":            "usr/bin",
+	} {
+		if h := headers[name]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != target {
+			t.Errorf("%s: symbolic link not preserved: %+v", name, h)
+		}
+	}
+
+	headers, contents, err := squash(t, ocifs.LayerFS(base), ocifs.WithFollowSymlinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"etc/hosts.link": "localhost",
+		"etc/parent":     "localhost",
+		"bin/sh":         "#!",
+		"usr/bin/sh":     "#!",
+	} {
+		if h := headers[name]; h == nil || h.Typeflag != tar.TypeReg {
+			t.Errorf("%s: not written as a regular file: %+v", name, h)
+		} else if contents[name] != data {
+			t.Errorf("%s: wrong content: want=%q got=%q", name, data, contents[name])
+		}
+	}
+	if h := headers["bin/"]; h == nil || h.Typeflag != tar.TypeDir {
+		t.Errorf("bin: link to a directory not written as a directory: %+v", h)
+	}
+
+	for _, test := range []struct {
+		scenario string
+		layer    fs.FS
+		err      error
+	}{
+		{
+			scenario: "link to a parent directory",
+			layer:    tarFS(t, tarSymlink("usr/bin/loop", "..")),
+			err:      syscall.ELOOP,
+		},
+		{
+			scenario: "cycle of links to directories",
+			layer: tarFS(t,
+				tarSymlink("a/link", "../b"),
+				tarSymlink("b/link", "../a"),
+			),
+			err: syscall.ELOOP,
+		},
+		{
+			scenario: "cycle of links",
+			layer: tarFS(t,
+				tarSymlink("etc/a", "b"),
+				tarSymlink("etc/b", "a"),
+			),
+			err: syscall.ELOOP,
+		},
+		{
+			scenario: "link escaping the root",
+			layer:    tarFS(t, tarSymlink("etc/escape", "../../outside")),
+			err:      fs.ErrInvalid,
+		},
+		{
+			scenario: "absolute link",
+			layer:    tarFS(t, tarDir("etc/"), tarSymlink("etc/absolute", "/etc")),
+			err:      fs.ErrInvalid,
+		},
+		{
+			scenario: "dangling link",
+			layer:    tarFS(t, tarSymlink("etc/dangling", "missing")),
+			err:      fs.ErrNotExist,
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			_, _, err := squash(t, ocifs.LayerFS(base, test.layer), ocifs.WithFollowSymlinks())
+			if !errors.Is(err, test.err) {
+				t.Errorf("expected an error wrapping %v, got %v", test.err, err)
+			}
+			// The links are preserved when they are not followed.
+			if _, _, err := squash(t, ocifs.LayerFS(base, test.layer)); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
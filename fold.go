@@ -0,0 +1,169 @@
+package ocifs
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// WithCaseInsensitive configures a layered file system to compare names
+// case-insensitively, like the file systems of macOS and Windows on which some
+// images are built. Paths resolve to the files of the layers regardless of
+// their case, whiteout files mask the files of the lower layers whose names
+// only differ by case, and directory listings contain a single entry for names
+// which only differ by case.
+//
+// When a directory of a layer contains several names which only differ by
+// case, the first one in lexical order is the one visible in the layered file
+// system, whichever case is used to open it.
+//
+// The default is to compare names case-sensitively, which is what POSIX and
+// the OCI image specification require.
+func WithCaseInsensitive() Option {
+	return func(c *config) { c.caseInsensitive = true }
+}
+
+// fold returns the key that name is compared with, which is name itself unless
+// the layered file system is case-insensitive.
+func (c *config) fold(name string) string {
+	if !c.caseInsensitive {
+		return name
+	}
+	return foldName(name)
+}
+
+// foldName maps each character of name to the smallest character that it is
+// equal to under Unicode simple case folding, so that two names are equal
+// after folding if and only if strings.EqualFold reports that they are.
+func foldName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c >= utf8.RuneSelf || ('a' <= c && c <= 'z') {
+			return strings.Map(foldRune, name)
+		}
+	}
+	return name
+}
+
+func foldRune(r rune) rune {
+	m := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < m {
+			m = f
+		}
+	}
+	return m
+}
+
+// foldFS is a layer of a case-insensitive layered file system. It maps the
+// names that it receives to the names of the files in the layer, listing the
+// directories of the layer to find names which are equal after folding.
+//
+// Layers are immutable, so the listings are memoized for the lifetime of the
+// file system.
+type foldFS struct {
+	fsys  fs.FS
+	mutex sync.Mutex
+	dirs  map[string]map[string]string
+}
+
+// baseFS returns the file system that a layer was constructed with.
+func baseFS(fsys fs.FS) fs.FS {
+	if f, ok := fsys.(*foldFS); ok {
+		return f.fsys
+	}
+	return fsys
+}
+
+// realName returns the name of the file in the layer which is equal to name
+// after folding. When the file is not found, the path is returned with the
+// names of the parent directories that were found, so the errors reported by
+// the layer describe the actual problem.
+func (f *foldFS) realName(name string) string {
+	if !fs.ValidPath(name) || name == "." {
+		return name
+	}
+	dir := "."
+	for {
+		elem, rest, more := strings.Cut(name, "/")
+		names, err := f.names(dir)
+		if err != nil {
+			return path.Join(dir, name)
+		}
+		if real, ok := names[foldName(elem)]; ok {
+			elem = real
+		}
+		dir = path.Join(dir, elem)
+		if !more {
+			return dir
+		}
+		name = rest
+	}
+}
+
+func (f *foldFS) names(dir string) (map[string]string, error) {
+	f.mutex.Lock()
+	names, ok := f.dirs[dir]
+	f.mutex.Unlock()
+	if ok {
+		return names, nil
+	}
+
+	entries, err := fs.ReadDir(f.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	names = make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key := foldName(entry.Name())
+		if _, exist := names[key]; !exist {
+			names[key] = entry.Name()
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.dirs == nil {
+		f.dirs = make(map[string]map[string]string)
+	}
+	f.dirs[dir] = names
+	return names, nil
+}
+
+func (f *foldFS) Open(name string) (fs.File, error) {
+	return f.fsys.Open(f.realName(name))
+}
+
+func (f *foldFS) OpenCtx(ctx context.Context, name string) (fs.File, error) {
+	return openContext(ctx, f.fsys, f.realName(name))
+}
+
+func (f *foldFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(f.fsys, f.realName(name))
+}
+
+func (f *foldFS) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(f.fsys, f.realName(name))
+}
+
+func (f *foldFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(f.fsys, f.realName(name))
+}
+
+func (f *foldFS) ReadLink(name string) (string, error) {
+	return readLink(f.fsys, f.realName(name))
+}
+
+func (f *foldFS) Lstat(name string) (fs.FileInfo, error) {
+	return Lstat(f.fsys, f.realName(name))
+}
+
+var (
+	_ ContextFS     = (*foldFS)(nil)
+	_ fs.StatFS     = (*foldFS)(nil)
+	_ fs.ReadFileFS = (*foldFS)(nil)
+	_ fs.ReadDirFS  = (*foldFS)(nil)
+)
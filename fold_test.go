@@ -0,0 +1,89 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestLayerFSCaseInsensitive(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0644, Data: []byte(data)}
+	}
+	lower := fstest.MapFS{
+		"README":         file("upper case"),
+		"readme":         file("lower case"),
+		"Etc/hosts":      file("localhost"),
+		"Etc/Passwd":     file("root:x:0:0"),
+		"usr/bin/Python": file("python2"),
+	}
+	upper := fstest.MapFS{
+		"etc/.WH.passwd": file(""),
+		"etc/group":      file("root:x:0:"),
+		"USR/BIN/python": file("python3"),
+	}
+	layers := []fs.FS{lower, upper}
+
+	rootfs := ocifs.LayerFSWithOptions(layers, ocifs.WithCaseInsensitive())
+	for name, data := range map[string]string{
+		"readme":         "upper case",
+		"ETC/HOSTS":      "localhost",
+		"etc/Group":      "root:x:0:",
+		"usr/bin/python": "python3",
+		"Usr/Bin/PYTHON": "python3",
+	} {
+		b, err := fs.ReadFile(rootfs, name)
+		if err != nil {
+			t.Error(err)
+		} else if string(b) != data {
+			t.Errorf("%s: wrong content: want=%q got=%q", name, data, b)
+		}
+	}
+
+	for _, name := range []string{"etc/passwd", "ETC/PASSWD", "etc/.wh.passwd"} {
+		if _, err := fs.Stat(rootfs, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: whiteout must mask the file: %v", name, err)
+		}
+	}
+
+	var names []string
+	err := fs.WalkDir(rootfs, ".", func(name string, _ fs.DirEntry, err error) error {
+		names = append(names, name)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Directories are listed with the case of the top most layer where they
+	// exist, and the first of the names which only differ by case is listed.
+	want := []string{".", "README", "USR", "USR/BIN", "USR/BIN/python", "etc", "etc/group", "etc/hosts"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong names walked:\nwant: %q\ngot:  %q", want, names)
+	}
+
+	var walked []string
+	ocifs.WalkDir(rootfs, ".", func(name string, _ fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		return err
+	})
+	if !reflect.DeepEqual(walked, names) {
+		t.Errorf("WalkDir does not match fs.WalkDir:\nwant: %q\ngot:  %q", names, walked)
+	}
+
+	if got := ocifs.Layers(rootfs); !reflect.DeepEqual(got, layers) {
+		t.Errorf("the original layers must be returned: %v", got)
+	}
+
+	// Names are compared case-sensitively by default.
+	rootfs = ocifs.LayerFS(layers...)
+	if _, err := fs.Stat(rootfs, "ETC/HOSTS"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("names must be case-sensitive by default: %v", err)
+	}
+	if b, _ := fs.ReadFile(rootfs, "readme"); string(b) != "lower case" {
+		t.Errorf("wrong content of readme: %q", b)
+	}
+}
@@ -0,0 +1,290 @@
+package ocifs_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/ocifs"
+)
+
+// fuzzPaths are the paths that the layers generated by FuzzLayerFS are made
+// of, the root directory is only used for opaque markers.
+var fuzzPaths = func() []string {
+	paths := []string{"."}
+	names := []string{"a", "b", "c"}
+	for _, a := range names {
+		paths = append(paths, a)
+		for _, b := range names {
+			paths = append(paths, a+"/"+b)
+			for _, c := range names {
+				paths = append(paths, a+"/"+b+"/"+c)
+			}
+		}
+	}
+	return paths
+}()
+
+type fuzzKind int
+
+const (
+	fuzzFile fuzzKind = iota
+	fuzzDir
+	fuzzSymlink
+	fuzzWhiteout
+	fuzzOpaque
+)
+
+type fuzzEntry struct {
+	kind fuzzKind
+	data string
+}
+
+// fuzzLayer is the content of a layer, including the whiteout files, indexed
+// by path.
+type fuzzLayer map[string]fuzzEntry
+
+// add adds an entry to the layer the way it would be stored in a tar archive:
+// the parent directories exist in the layer, and files replace directories
+// with their content.
+func (layer fuzzLayer) add(name string, entry fuzzEntry) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if e, ok := layer[dir]; !ok || e.kind != fuzzDir {
+			layer[dir] = fuzzEntry{kind: fuzzDir}
+		}
+	}
+	if e, ok := layer[name]; ok && e.kind == fuzzDir && entry.kind == fuzzDir {
+		return
+	}
+	layer.removeAll(name)
+	layer[name] = entry
+}
+
+func (layer fuzzLayer) removeAll(name string) {
+	for key := range layer {
+		if strings.HasPrefix(key, name+"/") {
+			delete(layer, key)
+		}
+	}
+}
+
+func (layer fuzzLayer) build(t *testing.T) fs.FS {
+	var b ocifs.Builder
+	for name, entry := range layer {
+		switch entry.kind {
+		case fuzzFile, fuzzWhiteout, fuzzOpaque:
+			b.AddFile(name, 0644, []byte(entry.data))
+		case fuzzDir:
+			b.AddDir(name, 0755)
+		case fuzzSymlink:
+			b.AddSymlink(name, entry.data)
+		}
+	}
+	return build(t, &b)
+}
+
+// decodeFuzzLayers generates layers from the fuzzer input, where each group of
+// three bytes selects the layer, kind, and path of an entry.
+func decodeFuzzLayers(input []byte) []fuzzLayer {
+	if len(input) == 0 {
+		return nil
+	}
+	layers := make([]fuzzLayer, 1+int(input[0])%4)
+	for i := range layers {
+		layers[i] = fuzzLayer{}
+	}
+	for i := 1; i+2 < len(input); i += 3 {
+		index := int(input[i]) % len(layers)
+		kind := fuzzKind(input[i+1]) % 5
+		name := fuzzPaths[int(input[i+2])%len(fuzzPaths)]
+		layer := layers[index]
+
+		switch kind {
+		case fuzzOpaque:
+			layer.add(path.Join(name, ".wh..wh..opq"), fuzzEntry{kind: kind})
+		case fuzzWhiteout:
+			if name != "." {
+				layer.add(path.Join(path.Dir(name), ".wh."+path.Base(name)), fuzzEntry{kind: kind})
+			}
+		case fuzzSymlink:
+			// The targets never exist, the reference does not follow links.
+			if name != "." {
+				layer.add(name, fuzzEntry{kind: kind, data: fmt.Sprintf("missing-%d", i)})
+			}
+		default:
+			if name != "." {
+				layer.add(name, fuzzEntry{kind: kind, data: fmt.Sprintf("layer %d entry %d", index, i)})
+			}
+		}
+	}
+	return layers
+}
+
+// mergeFuzzLayers is the reference implementation of the layered file system,
+// which applies the layers on top of each other from the bottom one, like an
+// image is extracted.
+func mergeFuzzLayers(layers []fuzzLayer) map[string]fuzzEntry {
+	merged := map[string]fuzzEntry{".": {kind: fuzzDir}}
+	removeAll := func(name string) {
+		for key := range merged {
+			if name == "." || strings.HasPrefix(key, name+"/") {
+				if key != "." {
+					delete(merged, key)
+				}
+			}
+		}
+	}
+
+	for _, layer := range layers {
+		// Parent directories are applied before their content.
+		names := make([]string, 0, len(layer))
+		for name := range layer {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			switch layer[name].kind {
+			case fuzzOpaque:
+				removeAll(path.Dir(name))
+			case fuzzWhiteout:
+				masked := path.Join(path.Dir(name), strings.TrimPrefix(path.Base(name), ".wh."))
+				delete(merged, masked)
+				removeAll(masked)
+			}
+		}
+		for _, name := range names {
+			switch entry := layer[name]; entry.kind {
+			case fuzzOpaque, fuzzWhiteout:
+			case fuzzDir:
+				if merged[name].kind != fuzzDir {
+					removeAll(name)
+				}
+				merged[name] = entry
+			default:
+				removeAll(name)
+				merged[name] = entry
+			}
+		}
+	}
+	return merged
+}
+
+func FuzzLayerFS(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 1, 1, 1, 2})
+	f.Add([]byte{2, 0, 1, 1, 0, 0, 2, 1, 4, 1, 1, 3, 6, 2, 0, 5})
+	f.Add([]byte{3, 0, 0, 14, 1, 4, 1, 1, 1, 15, 2, 3, 1, 2, 2, 14, 0, 4, 0})
+	f.Add([]byte{3, 0, 1, 1, 1, 0, 1, 2, 1, 1, 1, 2, 3, 14, 2, 4, 0, 2, 1, 27})
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		layers := decodeFuzzLayers(input)
+		if len(layers) == 0 {
+			return
+		}
+		fsyses := make([]fs.FS, len(layers))
+		for i, layer := range layers {
+			fsyses[i] = layer.build(t)
+		}
+		expect := mergeFuzzLayers(layers)
+
+		for _, options := range [][]ocifs.Option{
+			nil,
+			{ocifs.WithLookupCache(), ocifs.WithStatCache(10)},
+			{ocifs.WithWhiteoutIndex()},
+			{ocifs.WithParallelLookup(4)},
+		} {
+			checkFuzzLayerFS(t, ocifs.LayerFSWithOptions(fsyses, options...), expect)
+		}
+	})
+}
+
+func checkFuzzLayerFS(t *testing.T, fsys fs.FS, expect map[string]fuzzEntry) {
+	t.Helper()
+
+	for _, name := range fuzzPaths {
+		entry, exist := expect[name]
+
+		info, err := fs.Stat(fsys, name)
+		if !exist {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("stat %s: expected fs.ErrNotExist, got %v", name, err)
+			}
+			if f, err := fsys.Open(name); err == nil {
+				f.Close()
+				t.Errorf("open %s: the file must not exist", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("stat %s: %v", name, err)
+			continue
+		}
+
+		switch entry.kind {
+		case fuzzFile:
+			if !info.Mode().IsRegular() {
+				t.Errorf("stat %s: not a regular file: %v", name, info.Mode())
+				continue
+			}
+			f, err := fsys.Open(name)
+			if err != nil {
+				t.Errorf("open %s: %v", name, err)
+				continue
+			}
+			b, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				t.Errorf("read %s: %v", name, err)
+			} else if string(b) != entry.data {
+				t.Errorf("read %s: wrong content: want=%q got=%q", name, entry.data, b)
+			}
+
+		case fuzzSymlink:
+			if info.Mode().Type() != fs.ModeSymlink {
+				t.Errorf("stat %s: not a symbolic link: %v", name, info.Mode())
+				continue
+			}
+			link, err := fslink.ReadLink(fsys, name)
+			if err != nil {
+				t.Errorf("readlink %s: %v", name, err)
+			} else if link != entry.data {
+				t.Errorf("readlink %s: wrong target: want=%q got=%q", name, entry.data, link)
+			}
+
+		case fuzzDir:
+			if !info.IsDir() {
+				t.Errorf("stat %s: not a directory: %v", name, info.Mode())
+				continue
+			}
+			entries, err := fs.ReadDir(fsys, name)
+			if err != nil {
+				t.Errorf("readdir %s: %v", name, err)
+				continue
+			}
+			got := make([]string, len(entries))
+			for i, e := range entries {
+				got[i] = e.Name()
+				if want := expect[path.Join(name, e.Name())]; want.kind == fuzzDir != e.IsDir() {
+					t.Errorf("readdir %s: wrong type of %s: %v", name, e.Name(), e.Type())
+				}
+			}
+			want := []string{}
+			for key := range expect {
+				if key != "." && path.Dir(key) == name {
+					want = append(want, path.Base(key))
+				}
+			}
+			sort.Strings(want)
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("readdir %s: wrong entries:\nwant: %q\ngot:  %q", name, want, got)
+			}
+		}
+	}
+}
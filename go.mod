@@ -1,10 +1,12 @@
 module github.com/stealthrocket/ocifs
 
-go 1.20
+go 1.21
 
 require (
+	github.com/klauspost/compress v1.16.7
 	github.com/stealthrocket/fslink v0.1.3
 	github.com/stealthrocket/fstest v0.1.6
+	golang.org/x/sync v0.10.0
 )
 
 require github.com/stealthrocket/fsinfo v0.1.1 // indirect
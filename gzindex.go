@@ -0,0 +1,206 @@
+package ocifs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// TarGzIndexFS is like TarGzFS but the content of files is not buffered in
+// memory. Instead, the gzip stream is decompressed once when the file system is
+// first accessed to index the tar archive, recording the offsets of files in
+// the uncompressed stream, and the content of files is decompressed from r on
+// demand.
+//
+// Since deflate streams cannot be decompressed from arbitrary offsets, reads
+// resume decompression from the start of the gzip member containing the data.
+// Streams made of many gzip members (such as eStargz layers, which compress
+// each file in its own member) therefore support efficient random access, while
+// reads from layers compressed as a single member need to decompress the data
+// preceding them. The decoder of the last read is retained so sequential reads
+// do not repeatedly decompress the same data, but reads of the file system are
+// serialized. This trades CPU time for memory compared to TarGzFS, which makes
+// it a better fit for large layers of which only a few files are read.
+//
+// Files opened from the file system implement io.ReaderAt and io.Seeker.
+func TarGzIndexFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	magic := make([]byte, len(gzipMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, &fs.PathError{Op: "read", Path: "gzip", Err: err}
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return nil, &fs.PathError{Op: "read", Path: "gzip", Err: gzip.ErrHeader}
+	}
+	return &lazyFS{
+		load: func() (fs.FS, error) {
+			index := &gzipIndex{r: r, size: size}
+			return index.readTar()
+		},
+	}, nil
+}
+
+// gzipIndex is an io.ReaderAt reading from the uncompressed content of a gzip
+// stream, using the offsets of the gzip members as checkpoints.
+type gzipIndex struct {
+	r       io.ReaderAt
+	size    int64
+	members []gzipMember
+
+	mutex  sync.Mutex
+	cursor *gzipCursor
+}
+
+// gzipMember is the position of a gzip member in the compressed stream and of
+// its content in the uncompressed stream.
+type gzipMember struct {
+	offset  int64
+	uoffset int64
+}
+
+// gzipCursor is a decoder positioned at an offset of the uncompressed stream.
+type gzipCursor struct {
+	z      *gzip.Reader
+	offset int64
+}
+
+// readTar decompresses the whole stream to record the offsets of the gzip
+// members and index the tar archive.
+func (index *gzipIndex) readTar() (*tarFS, error) {
+	compressed := &countReader{r: io.NewSectionReader(index.r, 0, index.size)}
+	br := bufio.NewReader(compressed)
+	// The position in the compressed stream is exact because the gzip reader
+	// does not buffer its input when it implements io.ByteReader.
+	position := func() int64 { return compressed.n - int64(br.Buffered()) }
+
+	index.members = append(index.members, gzipMember{offset: position()})
+	z, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: "gzip", Err: err}
+	}
+	defer z.Close()
+	z.Multistream(false)
+
+	members := &gzipMembers{
+		z:        z,
+		br:       br,
+		position: position,
+		next: func(member gzipMember) {
+			index.members = append(index.members, member)
+		},
+	}
+	fsys, err := readTar(members, func() (int64, bool) {
+		return members.offset, true
+	}, index)
+	if err != nil {
+		return nil, err
+	}
+	// Drain the stream so the decompressor verifies the checksums of the
+	// members following the end of the archive.
+	if _, err := io.Copy(io.Discard, members); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: "gzip", Err: err}
+	}
+	return fsys, nil
+}
+
+func (index *gzipIndex) ReadAt(b []byte, off int64) (int, error) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	// Resume decompression from the last member starting before the offset,
+	// unless the current decoder is already positioned between the two.
+	i := sort.Search(len(index.members), func(i int) bool {
+		return index.members[i].uoffset > off
+	}) - 1
+	member := index.members[i]
+
+	c := index.cursor
+	if c == nil || c.offset > off || c.offset < member.uoffset {
+		if c != nil {
+			c.z.Close()
+			index.cursor = nil
+		}
+		r := bufio.NewReader(io.NewSectionReader(index.r, member.offset, index.size-member.offset))
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		c = &gzipCursor{z: z, offset: member.uoffset}
+		index.cursor = c
+	}
+
+	if skip := off - c.offset; skip > 0 {
+		n, err := io.CopyN(io.Discard, c.z, skip)
+		c.offset += n
+		if err != nil {
+			return 0, index.fail(err)
+		}
+	}
+	n, err := io.ReadFull(c.z, b)
+	c.offset += int64(n)
+	switch err {
+	case nil:
+		return n, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, io.EOF
+	default:
+		return n, index.fail(err)
+	}
+}
+
+// fail discards the current decoder after an error.
+func (index *gzipIndex) fail(err error) error {
+	index.cursor.z.Close()
+	index.cursor = nil
+	return err
+}
+
+// gzipMembers reads the content of consecutive gzip members as a single
+// stream, calling next with the position of each new member.
+type gzipMembers struct {
+	z        *gzip.Reader
+	br       *bufio.Reader
+	position func() int64
+	next     func(gzipMember)
+	offset   int64
+	eof      bool
+}
+
+func (m *gzipMembers) Read(b []byte) (int, error) {
+	for !m.eof {
+		n, err := m.z.Read(b)
+		m.offset += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+		member := gzipMember{offset: m.position(), uoffset: m.offset}
+		if err := m.z.Reset(m.br); err != nil {
+			if err != io.EOF {
+				return n, err
+			}
+			m.eof = true
+		} else {
+			m.z.Multistream(false)
+			m.next(member)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package ocifs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// gzipMembers compresses b as a sequence of gzip members of the given size.
+func gzipMembers(t testing.TB, b []byte, size int) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	for len(b) > 0 {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	return buf.Bytes()
+}
+
+func TestTarGzIndexFS(t *testing.T) {
+	large := strings.Repeat("0123456789abcdef", 10000)
+	b := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("usr/share/large", large),
+		tarSymlink("usr/lib", "../lib"),
+		tarFile("usr/share/small", "hello"),
+	)
+	expect, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		scenario string
+		data     []byte
+	}{
+		{scenario: "single member", data: gzipBytes(t, b)},
+		{scenario: "multiple members", data: gzipMembers(t, b, 4096)},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			layer, err := ocifs.TarGzIndexFS(bytes.NewReader(test.data), int64(len(test.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(layer, "etc/hosts", "etc/.wh.passwd", "usr/share/large", "usr/share/small"); err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.EqualFS(expect, layer); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := layer.Open("usr/share/large")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			// Read backward so the decoder has to be restarted.
+			r := f.(io.ReaderAt)
+			buf := make([]byte, 16)
+			for off := len(large) - 16; off >= 0; off -= 16 * 999 {
+				if _, err := r.ReadAt(buf, int64(off)); err != nil {
+					t.Fatal(err)
+				}
+				if string(buf) != large[off:off+16] {
+					t.Fatalf("wrong content read at offset %d: %q", off, buf)
+				}
+			}
+			if n, err := r.ReadAt(buf, int64(len(large)-4)); n != 4 || err != io.EOF {
+				t.Errorf("reading past the end must return io.EOF: n=%d err=%v", n, err)
+			}
+
+			if _, err := f.(io.Seeker).Seek(-5, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+			tail, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(tail) != large[len(large)-5:] {
+				t.Errorf("wrong content read after seek: %q", tail)
+			}
+		})
+	}
+}
+
+func TestTarGzIndexFSInvalid(t *testing.T) {
+	_, err := ocifs.TarGzIndexFS(strings.NewReader("hello world"), 11)
+	if !errors.Is(err, gzip.ErrHeader) {
+		t.Errorf("invalid gzip stream must fail with gzip.ErrHeader: %v", err)
+	}
+
+	z := gzipBytes(t, makeTar(t, tarFile("hello", "world")))
+	z = append(z[:len(z)-8:len(z)-8], 0, 0, 0, 0, 0, 0, 0, 0)
+	layer, err := ocifs.TarGzIndexFS(bytes.NewReader(z), int64(len(z)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pathErr *fs.PathError
+	if _, err := fs.Stat(layer, "hello"); !errors.As(err, &pathErr) || !errors.Is(err, gzip.ErrChecksum) {
+		t.Errorf("corrupted gzip stream must fail with gzip.ErrChecksum: %v", err)
+	}
+}
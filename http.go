@@ -0,0 +1,97 @@
+package ocifs
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// HTTPFS adapts fsys to the http.FileSystem interface, so the content of a
+// container image can be served with http.FileServer.
+//
+// Unlike http.FS, symbolic links are resolved with EvalSymlinks, so links with
+// absolute targets or escaping the root of fsys are never followed. Directory
+// listings never contain whiteout files, even when fsys is a single layer
+// rather than a layered file system.
+//
+// Whiteout files are recognized with the options of fsys when it is a layered
+// file system (e.g. WithWhiteout or WithCaseInsensitive), the options passed to
+// HTTPFS are applied on top of them.
+//
+// Range requests are supported when the files opened from fsys implement
+// io.Seeker, which is the case of files opened from layered file systems.
+func HTTPFS(fsys fs.FS, options ...Option) http.FileSystem {
+	config := newConfig(nil)
+	switch f := fsys.(type) {
+	case *layerFS:
+		*config = *f.config
+	case *overlayFS:
+		*config = *f.merged.config
+	}
+	for _, opt := range options {
+		opt(config)
+	}
+	return &httpFS{fsys: fsys, config: config}
+}
+
+type httpFS struct {
+	fsys   fs.FS
+	config *config
+}
+
+func (h *httpFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+	resolved, err := EvalSymlinks(h.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := h.fsys.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return &httpFile{File: f, fsys: h, name: resolved}, nil
+}
+
+type httpFile struct {
+	fs.File
+	fsys *httpFS
+	name string
+}
+
+func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *httpFile) Readdir(count int) ([]fs.FileInfo, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+	var infos []fs.FileInfo
+	for {
+		entries, err := d.ReadDir(count - len(infos))
+		for _, entry := range entries {
+			if f.fsys.config.isWhiteout(entry.Name()) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return infos, err
+			}
+			infos = append(infos, info)
+		}
+		// Keep reading when whiteout files were filtered out of a partial
+		// read, so the caller only sees a short read at the end of the
+		// directory.
+		if count <= 0 || err != nil || len(infos) == count {
+			return infos, err
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ocifs_test
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestHTTPFS(t *testing.T) {
+	base := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("usr/"),
+		tarDir("usr/share/"),
+		tarFile("usr/share/index.txt", "0123456789"),
+	)
+	update := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarSymlink("etc/share", "../usr/share"),
+		tarSymlink("etc/escape", "../../etc/hosts"),
+		tarSymlink("etc/absolute", "/etc/hosts"),
+	)
+
+	server := httptest.NewServer(http.FileServer(ocifs.HTTPFS(ocifs.LayerFS(base, update))))
+	defer func() { server.Close() }()
+
+	get := func(t *testing.T, path string, header http.Header) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(b)
+	}
+
+	if code, body := get(t, "/etc/hosts", nil); code != 200 || body != "127.0.0.1 localhost" {
+		t.Errorf("wrong response: %d %q", code, body)
+	}
+	if code, _ := get(t, "/etc/passwd", nil); code != 404 {
+		t.Errorf("files masked by whiteouts must not be served: %d", code)
+	}
+	if code, body := get(t, "/etc/share/index.txt", nil); code != 200 || body != "0123456789" {
+		t.Errorf("wrong response through symbolic link: %d %q", code, body)
+	}
+	if code, body := get(t, "/etc/share/index.txt", http.Header{"Range": {"bytes=2-5"}}); code != 206 || body != "2345" {
+		t.Errorf("wrong response to range request: %d %q", code, body)
+	}
+	for _, path := range []string{"/etc/escape", "/etc/absolute"} {
+		if code, _ := get(t, path, nil); code == 200 {
+			t.Errorf("%s: symbolic links escaping the root must not be followed", path)
+		}
+	}
+
+	code, body := get(t, "/etc/", nil)
+	if code != 200 {
+		t.Fatalf("wrong status code for directory listing: %d", code)
+	}
+	if !strings.Contains(body, "hosts") || !strings.Contains(body, "share") {
+		t.Errorf("missing entries in directory listing: %s", body)
+	}
+	if strings.Contains(body, "passwd") || strings.Contains(body, ".wh.") {
+		t.Errorf("directory listing must not contain whiteouts or masked files: %s", body)
+	}
+
+	// Whiteout files are hidden even when serving a single layer.
+	server.Close()
+	server = httptest.NewServer(http.FileServer(ocifs.HTTPFS(update)))
+	if _, body := get(t, "/etc/", nil); strings.Contains(body, ".wh.") {
+		t.Errorf("directory listing must not contain whiteouts: %s", body)
+	}
+
+	// The whiteout convention of the layered file system applies, and can be
+	// configured when serving a single layer.
+	custom := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/.deleted.passwd", ""),
+	)
+	for _, fsys := range []http.FileSystem{
+		ocifs.HTTPFS(ocifs.LayerFSWithOptions([]fs.FS{custom}, ocifs.WithWhiteout(".deleted.", ""))),
+		ocifs.HTTPFS(custom, ocifs.WithWhiteout(".deleted.", "")),
+	} {
+		server.Close()
+		server = httptest.NewServer(http.FileServer(fsys))
+		if _, body := get(t, "/etc/", nil); !strings.Contains(body, "hosts") || strings.Contains(body, ".deleted.") {
+			t.Errorf("directory listing must not contain whiteouts of the configured convention: %s", body)
+		}
+	}
+}
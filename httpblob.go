@@ -0,0 +1,145 @@
+package ocifs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WithHTTPClient configures HTTPBlob to send requests with client instead of
+// http.DefaultClient, for example to authenticate with a registry.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) { c.httpClient = client }
+}
+
+// HTTPBlob returns a reader of the blob of the given size served at url, which
+// is read with HTTP range requests so the layer file systems of this package
+// (e.g. TarFS or EStargzFS) only download the parts of the blob that they
+// access.
+//
+// If the server does not honor range requests, the whole blob is downloaded
+// to memory on the first read and subsequent reads are served from memory.
+//
+// Errors are returned as *fs.PathError values with the url as path. A blob
+// which is not found on the server is reported with an error wrapping
+// fs.ErrNotExist.
+func HTTPBlob(url string, size int64, options ...Option) io.ReaderAt {
+	client := newConfig(options).httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpBlob{client: client, url: url, size: size}
+}
+
+type httpBlob struct {
+	client *http.Client
+	url    string
+	size   int64
+
+	// The content of the blob, downloaded when the server does not support
+	// range requests.
+	mutex sync.Mutex
+	data  *bytes.Reader
+}
+
+func (b *httpBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: b.url, Err: fs.ErrInvalid}
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if data := b.loaded(); data != nil {
+		return data.ReadAt(p, off)
+	}
+
+	n := len(p)
+	if limit := b.size - off; int64(n) > limit {
+		n = int(limit)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest("GET", b.url, nil)
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: b.url, Err: err}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(n)-1))
+
+	res, err := b.client.Do(req)
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: b.url, Err: err}
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if start, ok := contentRangeStart(res.Header.Get("Content-Range")); !ok || start != off {
+			return 0, &fs.PathError{Op: "read", Path: b.url, Err: fmt.Errorf("invalid content range: %q", res.Header.Get("Content-Range"))}
+		}
+		rn, err := io.ReadFull(res.Body, p[:n])
+		if err != nil {
+			return rn, &fs.PathError{Op: "read", Path: b.url, Err: noEOF(err)}
+		}
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	case http.StatusOK:
+		// The server ignored the range, the response has the whole blob.
+		data, err := b.load(res.Body)
+		if err != nil {
+			return 0, err
+		}
+		return data.ReadAt(p, off)
+	case http.StatusNotFound:
+		return 0, &fs.PathError{Op: "read", Path: b.url, Err: fmt.Errorf("%s (%w)", res.Status, fs.ErrNotExist)}
+	default:
+		return 0, &fs.PathError{Op: "read", Path: b.url, Err: fmt.Errorf("unexpected response: %s", res.Status)}
+	}
+}
+
+func (b *httpBlob) loaded() *bytes.Reader {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.data
+}
+
+// load reads the whole blob from r, which must have the size of the blob, and
+// retains it to serve the following reads.
+func (b *httpBlob) load(r io.Reader) (*bytes.Reader, error) {
+	data, err := io.ReadAll(io.LimitReader(r, b.size+1))
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: b.url, Err: err}
+	}
+	if int64(len(data)) != b.size {
+		return nil, &fs.PathError{Op: "read", Path: b.url, Err: fmt.Errorf("blob size mismatch: want=%d got=%d (%w)", b.size, len(data), fs.ErrInvalid)}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.data == nil {
+		b.data = bytes.NewReader(data)
+	}
+	return b.data, nil
+}
+
+// contentRangeStart parses the offset of the first byte in the value of a
+// Content-Range header, e.g. "bytes 100-199/1000".
+func contentRangeStart(contentRange string) (int64, bool) {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,89 @@
+package ocifs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestHTTPBlob(t *testing.T) {
+	b := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+
+	var ranges, requests atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	})
+	mux.HandleFunc("/full", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(b)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, path := range []string{"/range", "/full"} {
+		t.Run(path, func(t *testing.T) {
+			ranges.Store(0)
+			requests.Store(0)
+
+			blob := ocifs.HTTPBlob(server.URL+path, int64(len(b)), ocifs.WithHTTPClient(server.Client()))
+			layer, err := ocifs.TarFS(blob, int64(len(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fstest.TestFS(layer, "etc/hosts", "etc/passwd"); err != nil {
+				t.Fatal(err)
+			}
+
+			p := make([]byte, 16)
+			n, err := blob.ReadAt(p, int64(len(b)-8))
+			if n != 8 || err != io.EOF {
+				t.Errorf("reading past the end of the blob must return io.EOF: n=%d err=%v", n, err)
+			}
+			if !bytes.Equal(p[:n], b[len(b)-8:]) {
+				t.Errorf("wrong data read at the end of the blob: %q", p[:n])
+			}
+
+			switch path {
+			case "/range":
+				if ranges.Load() != requests.Load() {
+					t.Errorf("all requests must be range requests: %d/%d", ranges.Load(), requests.Load())
+				}
+			case "/full":
+				if requests.Load() != 1 {
+					t.Errorf("the blob must be downloaded once when the server does not support ranges: %d requests", requests.Load())
+				}
+			}
+		})
+	}
+
+	p := make([]byte, 10)
+	if _, err := ocifs.HTTPBlob(server.URL+"/missing", 100).ReadAt(p, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading a missing blob must fail with fs.ErrNotExist: %v", err)
+	}
+
+	url := server.URL + "/range"
+	server.Close()
+	_, err := ocifs.HTTPBlob(url, int64(len(b))).ReadAt(p, 0)
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != url {
+		t.Errorf("transport errors must be reported as *fs.PathError: %v", err)
+	}
+}
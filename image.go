@@ -0,0 +1,438 @@
+package ocifs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// Media types of OCI and Docker image indexes and manifests.
+const (
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Platform describes the platform that an image manifest was built for, as
+// found in the descriptors of an image index.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+func (p Platform) match(q *Platform) bool {
+	return q != nil && p.OS == q.OS && p.Architecture == q.Architecture && (p.Variant == "" || p.Variant == q.Variant)
+}
+
+type imageLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+type imageIndex struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type imageConfig struct {
+	Config ImageConfig `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ImageConfig is the execution configuration of an image, which describes how
+// to run containers from the image. The fields match the config object of the
+// OCI image configuration (see https://github.com/opencontainers/image-spec/blob/main/config.md).
+type ImageConfig struct {
+	// User or UID, and optionally group or GID, that processes run as, in
+	// the form user[:group].
+	User string `json:"User,omitempty"`
+	// Ports exposed by containers, in the form port/protocol (e.g. 80/tcp).
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	// Environment variables of processes, in the form KEY=value.
+	Env []string `json:"Env,omitempty"`
+	// Command line of processes, Cmd is appended to Entrypoint when both are
+	// set, and serves as the default arguments of the entrypoint.
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	// Directories of the container where volumes are mounted.
+	Volumes map[string]struct{} `json:"Volumes,omitempty"`
+	// Working directory of processes.
+	WorkingDir string `json:"WorkingDir,omitempty"`
+	// Arbitrary metadata of the image.
+	Labels map[string]string `json:"Labels,omitempty"`
+	// Signal sent to containers to stop them (e.g. SIGTERM).
+	StopSignal string `json:"StopSignal,omitempty"`
+}
+
+type imageManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+}
+
+// ImageFS constructs a layered file system from an OCI image layout, which is
+// a directory containing an oci-layout file, an index.json file, and a blobs
+// directory (see https://github.com/opencontainers/image-spec/blob/main/image-layout.md).
+//
+// The default manifest of the image is resolved from index.json, the layers
+// are loaded from the blobs directory according to their media types, and
+// stacked with LayerFS. An error is returned if the index contains more than
+// one manifest, in which case ImageFSForPlatform must be used to select one.
+//
+// The directory is usually obtained from os.DirFS:
+//
+//	rootfs, err := ocifs.ImageFS(os.DirFS("./myimage"))
+//
+// When the blob files implement io.ReaderAt (like *os.File does), the blobs of
+// uncompressed layers remain open for the lifetime of the returned file system
+// to read the content of files on demand. The file system implements io.Closer
+// to close them; the blobs of compressed layers are closed once they have been
+// read in memory.
+func ImageFS(dir fs.FS, options ...Option) (fs.FS, error) {
+	return loadImage(dir, nil, options)
+}
+
+// ImageFSForPlatform is like ImageFS but selects the manifest matching the
+// platform p when the image index contains manifests for multiple platforms.
+// If the variant of p is empty, it matches any variant.
+//
+// When p is the zero value, the platform of the host (runtime.GOOS and
+// runtime.GOARCH) is selected. An error listing the available platforms is
+// returned if no manifests match.
+func ImageFSForPlatform(dir fs.FS, p Platform, options ...Option) (fs.FS, error) {
+	if p == (Platform{}) {
+		p = Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	}
+	return loadImage(dir, &p, options)
+}
+
+// Config reads the execution configuration of an image from an OCI image
+// layout, resolving its default manifest like ImageFS does. Together with the
+// file system returned by ImageFS, it provides what is needed to run the image.
+func Config(dir fs.FS, options ...Option) (*ImageConfig, error) {
+	return loadConfig(dir, nil, options)
+}
+
+// ConfigForPlatform is like Config but selects the manifest matching the
+// platform p like ImageFSForPlatform does.
+func ConfigForPlatform(dir fs.FS, p Platform, options ...Option) (*ImageConfig, error) {
+	if p == (Platform{}) {
+		p = Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	}
+	return loadConfig(dir, &p, options)
+}
+
+func loadConfig(dir fs.FS, p *Platform, options []Option) (*ImageConfig, error) {
+	l := &imageLoader{dir: dir, config: newConfig(options), options: options}
+	m, err := l.readManifest(p)
+	if err != nil {
+		return nil, err
+	}
+	c := new(imageConfig)
+	if err := l.readBlobJSON(m.Config, c); err != nil {
+		return nil, err
+	}
+	return &c.Config, nil
+}
+
+// imageLoader carries the state needed to load the blobs of an image.
+type imageLoader struct {
+	dir     fs.FS
+	config  *config
+	options []Option
+}
+
+func loadImage(dir fs.FS, p *Platform, options []Option) (fs.FS, error) {
+	l := &imageLoader{dir: dir, config: newConfig(options), options: options}
+	m, err := l.readManifest(p)
+	if err != nil {
+		return nil, err
+	}
+	return l.loadLayers(m)
+}
+
+func (l *imageLoader) readManifest(p *Platform) (*imageManifest, error) {
+	dir := l.dir
+	layout := new(imageLayout)
+	if err := readJSON(dir, "oci-layout", layout); err != nil {
+		return nil, err
+	}
+	if layout.ImageLayoutVersion != "1.0.0" {
+		return nil, &fs.PathError{Op: "read", Path: "oci-layout", Err: fmt.Errorf("unsupported image layout version: %q", layout.ImageLayoutVersion)}
+	}
+
+	index := new(imageIndex)
+	if err := readJSON(dir, "index.json", index); err != nil {
+		return nil, err
+	}
+	desc, err := l.resolveManifest(index, p)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(imageManifest)
+	if err := l.readBlobJSON(desc, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// resolveManifest returns the descriptor of the manifest referenced by the
+// index, following nested indexes. When p is nil, the index must reference a
+// single manifest, otherwise the first manifest matching p is returned.
+func (l *imageLoader) resolveManifest(index *imageIndex, p *Platform) (descriptor, error) {
+	manifests, err := l.listManifests(index)
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	if p == nil {
+		if len(manifests) != 1 {
+			return descriptor{}, &fs.PathError{Op: "read", Path: "index.json", Err: fmt.Errorf("image index contains %d manifests, use ImageFSForPlatform to select a platform", len(manifests))}
+		}
+		return manifests[0], nil
+	}
+
+	platforms := make([]string, 0, len(manifests))
+	for _, desc := range manifests {
+		if p.match(desc.Platform) {
+			return desc, nil
+		}
+		if desc.Platform != nil {
+			platforms = append(platforms, desc.Platform.String())
+		}
+	}
+	return descriptor{}, &fs.PathError{Op: "read", Path: "index.json", Err: fmt.Errorf("no manifests for platform %s in image index, available platforms: %s", p, strings.Join(platforms, ", "))}
+}
+
+func (l *imageLoader) listManifests(index *imageIndex) ([]descriptor, error) {
+	var manifests []descriptor
+	for _, desc := range index.Manifests {
+		switch desc.MediaType {
+		case MediaTypeImageIndex, MediaTypeDockerManifestList:
+			nested := new(imageIndex)
+			if err := l.readBlobJSON(desc, nested); err != nil {
+				return nil, err
+			}
+			descs, err := l.listManifests(nested)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, descs...)
+		default:
+			manifests = append(manifests, desc)
+		}
+	}
+	return manifests, nil
+}
+
+func (l *imageLoader) loadLayers(m *imageManifest) (fs.FS, error) {
+	var diffIDs []string
+	if l.config.verifyDiffIDs {
+		c := new(imageConfig)
+		if err := l.readBlobJSON(m.Config, c); err != nil {
+			return nil, err
+		}
+		if len(c.RootFS.DiffIDs) != len(m.Layers) {
+			return nil, fmt.Errorf("image config has %d diff_ids for %d layers: %w", len(c.RootFS.DiffIDs), len(m.Layers), ErrDigestMismatch)
+		}
+		diffIDs = c.RootFS.DiffIDs
+	}
+
+	if max := l.config.maxLayers; max > 0 && len(m.Layers) > max {
+		return nil, fmt.Errorf("image has %d layers, exceeding the limit of %d: %w", len(m.Layers), max, ErrTooManyLayers)
+	}
+
+	// The blob files which the layers read on demand are closed when the file
+	// system is closed, or when one of the layers fails to load.
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+
+	layers := make([]fs.FS, len(m.Layers))
+	for i, desc := range m.Layers {
+		r, size, closer, err := l.openBlob(desc)
+		if err != nil {
+			return nil, err
+		}
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+		var check diffIDCheck
+		if diffIDs != nil {
+			check = verifyDiffID(i, diffIDs[i])
+		}
+		layer, err := blobFS(desc.MediaType, r, size, check)
+		if err != nil {
+			return nil, fmt.Errorf("loading layer %d (%s): %w", i, desc.Digest, err)
+		}
+		if closer != nil && !retainsBlob(desc.MediaType, check) {
+			// The layer was fully read in memory, the blob is not needed
+			// anymore.
+			closers = closers[:len(closers)-1]
+			closer.Close()
+		}
+		layers[i] = layer
+	}
+	fsys := layerFSWithOptions(layers, l.options)
+	fsys.closers, closers = closers, nil
+	return fsys.withMemoryUpper(), nil
+}
+
+func verifyDiffID(index int, expect string) diffIDCheck {
+	return func(diffID string) error {
+		if diffID != expect {
+			return fmt.Errorf("layer %d: %w: want diff_id=%s got=%s", index, ErrDigestMismatch, expect, diffID)
+		}
+		return nil
+	}
+}
+
+func blobPath(digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || encoded == "" || strings.ContainsAny(digest, "/.") {
+		return "", &fs.PathError{Op: "open", Path: digest, Err: fmt.Errorf("malformed digest (%w)", fs.ErrInvalid)}
+	}
+	return path.Join("blobs", algorithm, encoded), nil
+}
+
+// openBlob returns a reader for the blob referenced by desc, its size, and the
+// file that must be closed when the reader is not needed anymore. When the blob
+// file does not support random access, its content is loaded in memory and the
+// returned closer is nil.
+func (l *imageLoader) openBlob(desc descriptor) (io.ReaderAt, int64, io.Closer, error) {
+	name, err := blobPath(desc.Digest)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if cache := l.config.blobCache; cache != nil {
+		f, err := cache.open(l.dir, name, desc, !l.config.skipDigestVerification)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return f, desc.Size, f, nil
+	}
+	f, err := l.dir.Open(name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+
+	var closer io.Closer = f
+	r, ok := f.(io.ReaderAt)
+	size := s.Size()
+	if !ok {
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		r, size, closer = bytes.NewReader(b), int64(len(b)), nil
+	}
+
+	if !l.config.skipDigestVerification {
+		if err := verifyBlob(name, desc, io.NewSectionReader(r, 0, size)); err != nil {
+			if closer != nil {
+				closer.Close()
+			}
+			return nil, 0, nil, err
+		}
+	}
+	return r, size, closer, nil
+}
+
+func (l *imageLoader) readBlobJSON(desc descriptor, value any) error {
+	name, err := blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	b, err := fs.ReadFile(l.dir, name)
+	if err != nil {
+		return err
+	}
+	if !l.config.skipDigestVerification {
+		if err := verifyBlob(name, desc, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(b, value); err != nil {
+		return &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return nil
+}
+
+// ErrDigestMismatch is returned when the content of a blob does not match the
+// digest or size of its descriptor.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+func verifyBlob(name string, desc descriptor, r io.Reader) error {
+	algorithm, encoded, _ := strings.Cut(desc.Digest, ":")
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return &fs.PathError{Op: "verify", Path: name, Err: fmt.Errorf("unsupported digest algorithm: %q", algorithm)}
+	}
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return &fs.PathError{Op: "verify", Path: name, Err: err}
+	}
+	if size != desc.Size {
+		return &fs.PathError{Op: "verify", Path: name, Err: fmt.Errorf("%w: want size=%d got=%d", ErrDigestMismatch, desc.Size, size)}
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != encoded {
+		return &fs.PathError{Op: "verify", Path: name, Err: fmt.Errorf("%w: want=%s got=%s:%s", ErrDigestMismatch, desc.Digest, algorithm, actual)}
+	}
+	return nil
+}
+
+func readJSON(dir fs.FS, name string, value any) error {
+	b, err := fs.ReadFile(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, value); err != nil {
+		return &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return nil
+}
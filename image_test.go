@@ -0,0 +1,423 @@
+package ocifs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+type testDescriptor struct {
+	MediaType string            `json:"mediaType"`
+	Digest    string            `json:"digest"`
+	Size      int64             `json:"size"`
+	Platform  map[string]string `json:"platform,omitempty"`
+}
+
+type testLayer struct {
+	mediaType string
+	data      []byte
+}
+
+// addBlob stores data in the blobs directory of an image layout.
+func addBlob(image fstest.MapFS, mediaType string, data []byte) testDescriptor {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	image["blobs/sha256/"+digest] = &fstest.MapFile{Mode: 0644, Data: data}
+	return testDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + digest,
+		Size:      int64(len(data)),
+	}
+}
+
+func addJSONBlob(t testing.TB, image fstest.MapFS, mediaType string, value any) testDescriptor {
+	t.Helper()
+	b, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addBlob(image, mediaType, b)
+}
+
+// addManifest stores an image manifest and its config in the blobs directory.
+func addManifest(t testing.TB, image fstest.MapFS, config any, layers ...testLayer) testDescriptor {
+	t.Helper()
+	descriptors := make([]testDescriptor, len(layers))
+	for i, layer := range layers {
+		descriptors[i] = addBlob(image, layer.mediaType, layer.data)
+	}
+	return addJSONBlob(t, image, ocifs.MediaTypeImageManifest, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ocifs.MediaTypeImageManifest,
+		"config":        addJSONBlob(t, image, "application/vnd.oci.image.config.v1+json", config),
+		"layers":        descriptors,
+	})
+}
+
+// makeImageLayout constructs an OCI image layout with an index referencing the
+// given manifests.
+func makeImageLayout(t testing.TB, image fstest.MapFS, manifests ...testDescriptor) fstest.MapFS {
+	t.Helper()
+	b, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ocifs.MediaTypeImageIndex,
+		"manifests":     manifests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image["oci-layout"] = &fstest.MapFile{Mode: 0644, Data: []byte(`{"imageLayoutVersion":"1.0.0"}`)}
+	image["index.json"] = &fstest.MapFile{Mode: 0644, Data: b}
+	return image
+}
+
+func makeImage(t testing.TB, layers ...testLayer) fstest.MapFS {
+	t.Helper()
+	image := fstest.MapFS{}
+	return makeImageLayout(t, image, addManifest(t, image, map[string]any{}, layers...))
+}
+
+func TestImageFS(t *testing.T) {
+	layer1 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+
+	layer2 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("etc/hostname", "container"),
+	)
+
+	layer3 := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+	)
+
+	image := makeImage(t,
+		testLayer{ocifs.MediaTypeImageLayerGzip, gzipBytes(t, layer1)},
+		testLayer{ocifs.MediaTypeImageLayer, layer2},
+		testLayer{ocifs.MediaTypeImageLayerZstd, zstdBytes(t, layer3)},
+	)
+
+	rootfs, err := ocifs.ImageFS(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	expect := fstest.MapFS{
+		"etc":          &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"etc/hostname": file("container"),
+		"etc/hosts":    file("127.0.0.1 localhost"),
+	}
+
+	if err := fstest.EqualFS(expect, rootfs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openFilesFS tracks the files opened from a file system which are not closed.
+type openFilesFS struct {
+	fstest.MapFS
+	open atomic.Int64
+}
+
+func (fsys *openFilesFS) Open(name string) (fs.File, error) {
+	f, err := fsys.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys.open.Add(1)
+	return &openFile{File: f, fsys: fsys}, nil
+}
+
+type openFile struct {
+	fs.File
+	fsys   *openFilesFS
+	closed bool
+}
+
+func (f *openFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.File.(io.ReaderAt).ReadAt(b, off)
+}
+
+func (f *openFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		f.fsys.open.Add(-1)
+	}
+	return f.File.Close()
+}
+
+func TestImageFSClose(t *testing.T) {
+	layer := makeTar(t, tarFile("etc/hosts", "localhost"))
+	image := &openFilesFS{MapFS: makeImage(t,
+		testLayer{ocifs.MediaTypeImageLayerGzip, gzipBytes(t, layer)},
+		testLayer{ocifs.MediaTypeImageLayer, layer},
+		testLayer{ocifs.MediaTypeImageLayerZstd, zstdBytes(t, layer)},
+	)}
+
+	rootfs, err := ocifs.ImageFS(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(rootfs, "etc/hosts"); err != nil || string(b) != "localhost" {
+		t.Fatalf("wrong content of etc/hosts: %q (%v)", b, err)
+	}
+	// The gzip layer was read in memory, only the blobs of the tar and zstd
+	// layers remain open.
+	if n := image.open.Load(); n != 2 {
+		t.Errorf("wrong number of open blobs: %d", n)
+	}
+	if err := rootfs.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := image.open.Load(); n != 0 {
+		t.Errorf("closing the file system must close the blobs: %d open", n)
+	}
+
+	// Blobs opened before a layer fails to load are closed.
+	image = &openFilesFS{MapFS: makeImage(t,
+		testLayer{ocifs.MediaTypeImageLayer, layer},
+		testLayer{"application/octet-stream", layer},
+	)}
+	if _, err := ocifs.ImageFS(image); err == nil {
+		t.Fatal("loading a layer of unsupported media type must fail")
+	}
+	if n := image.open.Load(); n != 0 {
+		t.Errorf("blobs must be closed when loading the image fails: %d open", n)
+	}
+}
+
+func TestImageFSMultipleManifests(t *testing.T) {
+	layer := testLayer{ocifs.MediaTypeImageLayer, makeTar(t, tarFile("hello", "world"))}
+	image := fstest.MapFS{}
+	makeImageLayout(t, image,
+		addManifest(t, image, map[string]any{"architecture": "amd64"}, layer),
+		addManifest(t, image, map[string]any{"architecture": "arm64"}, layer),
+	)
+
+	_, err := ocifs.ImageFS(image)
+	if err == nil {
+		t.Fatal("loading an image with multiple manifests must fail")
+	}
+	if !strings.Contains(err.Error(), "platform") {
+		t.Errorf("error must suggest selecting a platform: %v", err)
+	}
+}
+
+func TestImageFSForPlatform(t *testing.T) {
+	image := fstest.MapFS{}
+
+	platforms := []map[string]string{
+		{"os": "linux", "architecture": "amd64"},
+		{"os": "linux", "architecture": "arm64", "variant": "v8"},
+		{"os": runtime.GOOS, "architecture": runtime.GOARCH, "variant": "host"},
+	}
+
+	manifests := make([]testDescriptor, len(platforms))
+	for i, p := range platforms {
+		layer := testLayer{ocifs.MediaTypeImageLayer, makeTar(t, tarFile("platform", p["architecture"]+p["variant"]))}
+		manifests[i] = addManifest(t, image, map[string]any{}, layer)
+		manifests[i].Platform = p
+	}
+
+	// Multi-platform images usually have a nested index referenced by the
+	// top-level index.json file.
+	makeImageLayout(t, image, addJSONBlob(t, image, ocifs.MediaTypeImageIndex, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ocifs.MediaTypeImageIndex,
+		"manifests":     manifests,
+	}))
+
+	tests := []struct {
+		platform ocifs.Platform
+		content  string
+	}{
+		{ocifs.Platform{OS: "linux", Architecture: "amd64"}, "amd64"},
+		{ocifs.Platform{OS: "linux", Architecture: "arm64"}, "arm64v8"},
+		{ocifs.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "arm64v8"},
+		{ocifs.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH, Variant: "host"}, runtime.GOARCH + "host"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.platform.String(), func(t *testing.T) {
+			rootfs, err := ocifs.ImageFSForPlatform(image, test.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := fs.ReadFile(rootfs, "platform")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.content {
+				t.Errorf("wrong manifest selected: want=%q got=%q", test.content, b)
+			}
+		})
+	}
+
+	if _, err := ocifs.ImageFSForPlatform(image, ocifs.Platform{}); err != nil {
+		t.Errorf("the host platform must be selected by default: %v", err)
+	}
+
+	_, err := ocifs.ImageFSForPlatform(image, ocifs.Platform{OS: "windows", Architecture: "amd64"})
+	if err == nil {
+		t.Fatal("selecting a missing platform must fail")
+	}
+	if !strings.Contains(err.Error(), "linux/arm64/v8") {
+		t.Errorf("error must list the available platforms: %v", err)
+	}
+}
+
+func TestImageFSDigestVerification(t *testing.T) {
+	layer := makeTar(t, tarFile("hello", "world"))
+	image := makeImage(t, testLayer{ocifs.MediaTypeImageLayer, layer})
+
+	// Corrupt the layer blob without changing its size.
+	for name, file := range image {
+		if bytes.Equal(file.Data, layer) {
+			corrupted := append([]byte{}, layer...)
+			copy(corrupted[512:], "WORLD")
+			image[name] = &fstest.MapFile{Mode: file.Mode, Data: corrupted}
+		}
+	}
+
+	if _, err := ocifs.ImageFS(image); !errors.Is(err, ocifs.ErrDigestMismatch) {
+		t.Fatalf("loading a corrupted layer must fail with ErrDigestMismatch: %v", err)
+	}
+
+	rootfs, err := ocifs.ImageFS(image, ocifs.WithoutDigestVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(rootfs, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "WORLD" {
+		t.Errorf("wrong content of unverified layer: %q", b)
+	}
+}
+
+func TestImageFSDiffIDVerification(t *testing.T) {
+	layer := makeTar(t, tarFile("hello", "world"))
+	sum := sha256.Sum256(layer)
+	diffID := "sha256:" + hex.EncodeToString(sum[:])
+
+	blobs := map[string][]byte{
+		ocifs.MediaTypeImageLayer:     layer,
+		ocifs.MediaTypeImageLayerGzip: gzipBytes(t, layer),
+		ocifs.MediaTypeImageLayerZstd: zstdBytes(t, layer),
+	}
+
+	for mediaType, blob := range blobs {
+		t.Run(mediaType, func(t *testing.T) {
+			rootfs := func(diffID string) map[string]any {
+				return map[string]any{"rootfs": map[string]any{"type": "layers", "diff_ids": []string{diffID}}}
+			}
+
+			image := fstest.MapFS{}
+			makeImageLayout(t, image, addManifest(t, image, rootfs(diffID), testLayer{mediaType, blob}))
+			if _, err := ocifs.ImageFS(image, ocifs.WithDiffIDVerification()); err != nil {
+				t.Fatal(err)
+			}
+
+			wrong := "sha256:" + strings.Repeat("0", 64)
+			image = fstest.MapFS{}
+			makeImageLayout(t, image, addManifest(t, image, rootfs(wrong), testLayer{mediaType, blob}))
+			if _, err := ocifs.ImageFS(image); err != nil {
+				t.Fatalf("diffIDs must not be verified by default: %v", err)
+			}
+			_, err := ocifs.ImageFS(image, ocifs.WithDiffIDVerification())
+			if !errors.Is(err, ocifs.ErrDigestMismatch) {
+				t.Fatalf("loading a layer with the wrong diffID must fail with ErrDigestMismatch: %v", err)
+			}
+			if msg := err.Error(); !strings.Contains(msg, "layer 0") || !strings.Contains(msg, wrong) || !strings.Contains(msg, diffID) {
+				t.Errorf("error must report the layer index and the expected and actual diffIDs: %v", err)
+			}
+		})
+	}
+}
+
+func TestConfig(t *testing.T) {
+	layer := testLayer{ocifs.MediaTypeImageLayer, makeTar(t, tarFile("hello", "world"))}
+	image := fstest.MapFS{}
+	makeImageLayout(t, image, addManifest(t, image, map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config": map[string]any{
+			"User":         "nobody:nogroup",
+			"ExposedPorts": map[string]any{"8080/tcp": map[string]any{}},
+			"Env":          []string{"PATH=/usr/bin:/bin", "HOME=/"},
+			"Entrypoint":   []string{"/bin/server"},
+			"Cmd":          []string{"--port", "8080"},
+			"WorkingDir":   "/srv",
+			"Labels":       map[string]string{"version": "1.0"},
+			"StopSignal":   "SIGINT",
+		},
+		"rootfs": map[string]any{"type": "layers", "diff_ids": []string{}},
+	}, layer))
+
+	config, err := ocifs.Config(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &ocifs.ImageConfig{
+		User:         "nobody:nogroup",
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+		Env:          []string{"PATH=/usr/bin:/bin", "HOME=/"},
+		Entrypoint:   []string{"/bin/server"},
+		Cmd:          []string{"--port", "8080"},
+		WorkingDir:   "/srv",
+		Labels:       map[string]string{"version": "1.0"},
+		StopSignal:   "SIGINT",
+	}
+	if !reflect.DeepEqual(config, expect) {
+		t.Errorf("wrong image config:\nwant: %+v\ngot:  %+v", expect, config)
+	}
+
+	// Images without execution configuration have an empty config.
+	image = makeImage(t, layer)
+	config, err = ocifs.Config(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, &ocifs.ImageConfig{}) {
+		t.Errorf("wrong image config: %+v", config)
+	}
+
+	image = fstest.MapFS{}
+	amd64 := addManifest(t, image, map[string]any{"config": map[string]any{"Cmd": []string{"amd64"}}}, layer)
+	amd64.Platform = map[string]string{"os": "linux", "architecture": "amd64"}
+	arm64 := addManifest(t, image, map[string]any{"config": map[string]any{"Cmd": []string{"arm64"}}}, layer)
+	arm64.Platform = map[string]string{"os": "linux", "architecture": "arm64"}
+	makeImageLayout(t, image, amd64, arm64)
+
+	if _, err := ocifs.Config(image); err == nil {
+		t.Error("reading the config of an image with multiple manifests must fail")
+	}
+	config, err = ocifs.ConfigForPlatform(image, ocifs.Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Cmd, []string{"arm64"}) {
+		t.Errorf("wrong manifest selected: %q", config.Cmd)
+	}
+}
@@ -1,13 +1,23 @@
 package ocifs
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
+	"os"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/stealthrocket/fslink"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -15,6 +25,24 @@ const (
 	whiteoutOpaque = ".wh..wh..opq"
 )
 
+// whiteoutMetadata is the table of names reserved by aufs for its internal
+// bookkeeping. They are never part of the merged view of the layers.
+var whiteoutMetadata = [...]string{
+	whiteoutOpaque, // opaque directory marker
+	".wh..wh.plnk", // directory of pseudo-links
+	".wh..wh.orph", // directory of orphaned files
+	".wh..wh.aufs", // external inode number translation table
+}
+
+func isWhiteoutMetadata(name string) bool {
+	for _, meta := range whiteoutMetadata {
+		if name == meta {
+			return true
+		}
+	}
+	return false
+}
+
 // LayerFS constructs a read-only overlay file system by stacking layers of OCI
 // images.
 //
@@ -29,71 +57,679 @@ const (
 //		ReadLink(name string) (string, error)
 //	}
 //
+// Symbolic links in the intermediate components of paths are resolved through
+// the merged view of the layers. Symbolic links in the last component are not
+// followed. Paths going through a link whose target is absolute or escapes the
+// root of the file system are rejected with an error wrapping fs.ErrInvalid.
+//
+// The layered file system implements fs.StatFS, fs.ReadFileFS, fs.GlobFS, and
+// fs.SubFS, which resolve the layers of a path once and only access the top
+// layer when the lower layers are not needed.
+//
+// It also implements ContextFS and ReadDirContextFS to allow canceling the
+// operations which may block on the layers.
+//
+// The information of files, including directories whose entries are merged
+// from multiple layers, is the one of the top most layer where they exist:
+// a directory has the permissions, ownership, and modification time of the
+// last layer that contained it, even if files were added to it by layers
+// below. See WithMergedDirModTime to report the latest modification time of
+// the layers instead.
+//
 // Files opened by a layered file system implement fs.ReadFileFS, io.ReaderAt,
 // and io.Seeker. If the underlying files do not support these extensions of the
 // fs.File interface, and fs.PathError wrapping fs.ErrInvalid is returned.
 func LayerFS(layers ...fs.FS) fs.FS {
-	layers = append([]fs.FS{}, layers...)
+	return LayerFSWithOptions(layers)
+}
+
+// LayerFSWithOptions is like LayerFS but accepts a list of options to
+// configure the behavior of the layered file system.
+//
+// If one of the layers is nil, or if there are more layers than allowed by
+// WithMaxLayers, all the methods of the returned file system fail with an
+// error describing the problem.
+func LayerFSWithOptions(layers []fs.FS, options ...Option) fs.FS {
+	return layerFSWithOptions(layers, options).withMemoryUpper()
+}
+
+func layerFSWithOptions(layers []fs.FS, options []Option) *layerFS {
+	config := newConfig(options)
 	// Reverse the layers so we can use range loops to iterate the list in the
 	// right priority order.
-	for i, j := 0, len(layers)-1; i < j; {
-		layers[i], layers[j] = layers[j], layers[i]
-		i++
-		j--
+	reversed := make([]layer, len(layers))
+	for i, fsys := range layers {
+		if config.caseInsensitive && fsys != nil {
+			fsys = &foldFS{fsys: fsys}
+		}
+		reversed[len(layers)-(i+1)] = layer{fsys: fsys, index: i}
+	}
+	fsys := newLayerFS(reversed, config)
+	fsys.err = config.validateLayers(layers)
+	return fsys
+}
+
+// ErrTooManyLayers is returned when a layered file system is constructed with
+// more layers than allowed by WithMaxLayers.
+var ErrTooManyLayers = errors.New("too many layers")
+
+func (c *config) validateLayers(layers []fs.FS) error {
+	if c.maxLayers > 0 && len(layers) > c.maxLayers {
+		return fmt.Errorf("%d layers exceed the limit of %d: %w", len(layers), c.maxLayers, ErrTooManyLayers)
+	}
+	for i, layer := range layers {
+		if layer == nil {
+			return fmt.Errorf("layer %d is nil: %w", i, fs.ErrInvalid)
+		}
+	}
+	return nil
+}
+
+// MergeFS constructs a read-only union of file systems, where the files of the
+// upper layers shadow the files of the lower layers and directories are merged,
+// like LayerFS, but without interpreting whiteout files. Files named with the
+// whiteout prefix are exposed like any other file.
+//
+// MergeFS is useful to combine file systems which are not layers of OCI images,
+// for example an embed.FS on top of a directory of the local file system.
+func MergeFS(layers ...fs.FS) fs.FS {
+	return LayerFSWithOptions(layers, func(c *config) { c.noWhiteouts = true })
+}
+
+// Layers returns the layers of fsys in the order they were passed to LayerFS,
+// from the bottom layer to the top one. If fsys is not a layered file system,
+// it is returned as the only layer.
+func Layers(fsys fs.FS) []fs.FS {
+	l, ok := fsys.(*layerFS)
+	if !ok {
+		return []fs.FS{fsys}
+	}
+	layers := make([]fs.FS, len(l.layers))
+	for i, layer := range l.layers {
+		layers[len(l.layers)-(i+1)] = baseFS(layer.fsys)
+	}
+	return layers
+}
+
+// NumLayers returns the number of layers of fsys, which is 1 if fsys is not a
+// layered file system.
+func NumLayers(fsys fs.FS) int {
+	if l, ok := fsys.(*layerFS); ok {
+		return len(l.layers)
+	}
+	return 1
+}
+
+func newLayerFS(layers []layer, config *config) *layerFS {
+	fsys := &layerFS{layers: layers, config: config}
+	if config.lookupCache {
+		fsys.cache = new(lookupCache)
+	}
+	if config.statCacheSize > 0 {
+		fsys.stats = newStatCache(config.statCacheSize, config.metrics)
+	}
+	if config.singleflight {
+		fsys.flight = new(singleflight.Group)
+	}
+	if config.whiteoutIndex && !config.noWhiteouts {
+		fsys.whiteouts = new(whiteoutIndex)
+	}
+	return fsys
+}
+
+type layerFS struct {
+	layers []layer
+	config *config
+	cache  *lookupCache
+	stats  *statCache
+	flight *singleflight.Group
+	// set when whiteouts are indexed, see WithWhiteoutIndex
+	whiteouts *whiteoutIndex
+	// set when the top layer is writable, see OverlayFS
+	writable bool
+	// set when the layers are invalid, returned by all operations
+	err error
+	// blob files that the layers are read from, see ImageFS
+	closers []io.Closer
+}
+
+// Close closes the blob files that the layers of images constructed by ImageFS
+// are read from. File systems constructed by LayerFS do not hold resources,
+// closing them has no effect.
+func (fsys *layerFS) Close() error {
+	errs := make([]error, 0, len(fsys.closers))
+	for _, c := range fsys.closers {
+		errs = append(errs, c.Close())
+	}
+	fsys.closers = nil
+	return errors.Join(errs...)
+}
+
+// String returns a summary of the layered file system, listing its layers from
+// bottom to top when they all implement fmt.Stringer.
+func (fsys *layerFS) String() string {
+	var b strings.Builder
+	b.WriteString("layerFS(")
+	b.WriteString(strconv.Itoa(len(fsys.layers)))
+	if len(fsys.layers) == 1 {
+		b.WriteString(" layer")
+	} else {
+		b.WriteString(" layers")
+	}
+
+	names := make([]string, len(fsys.layers))
+	for i, layer := range fsys.layers {
+		s, ok := baseFS(layer.fsys).(fmt.Stringer)
+		if !ok {
+			names = nil
+			break
+		}
+		names[len(fsys.layers)-(i+1)] = s.String()
+	}
+	if len(names) > 0 {
+		b.WriteString(": ")
+		b.WriteString(strings.Join(names, ", "))
 	}
-	return layerFS(layers)
+	b.WriteString(")")
+	return b.String()
 }
 
-type layerFS []fs.FS
+// layer is a file system of the stack, paired with its position in the list
+// of layers passed to the constructor.
+type layer struct {
+	fsys  fs.FS
+	index int
+}
+
+func (fsys *layerFS) Open(name string) (fs.File, error) {
+	return fsys.OpenCtx(context.Background(), name)
+}
+
+// OpenFile is like Open but accepts the flags of os.OpenFile for compatibility
+// with code expecting writable file systems. Since layered file systems are
+// read-only, flags requesting to write, create, or truncate files result in an
+// error wrapping syscall.EROFS and fs.ErrPermission. The permissions are
+// ignored.
+func (fsys *layerFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if (flag & writeFlags) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("%w: open flags %s (%w)", syscall.EROFS, formatOpenFlags(flag), fs.ErrPermission)}
+	}
+	return fsys.Open(name)
+}
+
+// formatOpenFlags returns a human-readable representation of flags passed to
+// OpenFile.
+func formatOpenFlags(flag int) string {
+	var names []string
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		names = append(names, "O_RDONLY")
+	case os.O_WRONLY:
+		names = append(names, "O_WRONLY")
+	case os.O_RDWR:
+		names = append(names, "O_RDWR")
+	}
+	flag &^= os.O_RDONLY | os.O_WRONLY | os.O_RDWR
+	for _, f := range []struct {
+		flag int
+		name string
+	}{
+		{os.O_APPEND, "O_APPEND"},
+		{os.O_CREATE, "O_CREATE"},
+		{os.O_EXCL, "O_EXCL"},
+		{os.O_SYNC, "O_SYNC"},
+		{os.O_TRUNC, "O_TRUNC"},
+	} {
+		if (flag & f.flag) != 0 {
+			names = append(names, f.name)
+			flag &^= f.flag
+		}
+	}
+	if flag != 0 {
+		names = append(names, "0x"+strconv.FormatInt(int64(flag), 16))
+	}
+	return strings.Join(names, "|")
+}
+
+// OpenCtx is like Open but aborts the lookup of the file when ctx is canceled,
+// and passes ctx to the layers implementing ContextFS.
+func (fsys *layerFS) OpenCtx(ctx context.Context, name string) (fs.File, error) {
+	f, err := fsys.open(ctx, "open", name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
 
-func (layers layerFS) Open(name string) (fs.File, error) {
-	visibleLayers, err := layers.lookup("open", name)
+// open implements OpenCtx, reporting errors to resolve name with op as the
+// operation, so methods opening files on behalf of the application (e.g.
+// ReadDirCtx) report the operation they perform.
+func (fsys *layerFS) open(ctx context.Context, op, name string) (*layerFile, error) {
+	visibleLayers, realName, err := fsys.lookupContext(ctx, op, name)
 	if err != nil {
 		return nil, err
 	}
 
-	files := make([]fs.File, 0, len(layers))
+	// Only directories have more than one visible layer, lookup stops at the
+	// top most layer when it has a file which is not a directory, so we only
+	// hold handles on all the layers when ReadDir needs to merge entries.
+	files := make([]fs.File, 0, len(visibleLayers))
 	defer func() {
 		for _, f := range files {
 			f.Close()
 		}
 	}()
 
+	metrics := fsys.config.metrics
+	var top fs.FS
 	for _, layer := range visibleLayers {
-		f, err := layer.Open(name)
+		f, err := openContext(ctx, layer.fsys, realName)
 		if err != nil {
+			// Layers which do not expose their root directory, for example
+			// because it is implied by the paths of their files, do not
+			// contribute entries to the merged root.
+			if realName == "." && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
 			return nil, err
 		}
+		if metrics != nil {
+			metrics.LayerOpens.Add(1)
+		}
+		if top == nil {
+			top = layer.fsys
+		}
 		files = append(files, f)
 	}
+	if len(files) == 0 {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	if fsys.config.unsupportedHandler != nil {
+		s, err := files[0].Stat()
+		if err != nil {
+			return nil, err
+		}
+		fsys.config.checkSupported(name, s.Mode())
+	}
+
+	// Whether reads can be prefetched depends on the file of the layer, and
+	// not on the wrapper installed by WithConsistentReads.
+	readAhead := fsys.config.readahead > 0 && len(files) == 1 && canReadAhead(files[0])
+
+	if fsys.config.consistentReads {
+		if err := snapshot(files, name); err != nil {
+			return nil, err
+		}
+	}
 
-	defer func() { files = nil }()
-	return &layerFile{layers: files, name: name}, nil
+	if metrics != nil {
+		metrics.OpenHandles.Add(int64(len(files)))
+	}
+	f := &layerFile{fsys: fsys, layers: files, top: top, name: name, realName: realName}
+	if readAhead {
+		f.readahead = &readahead{r: files[0].(io.ReaderAt), window: fsys.config.readahead}
+	}
+	files = nil
+	return f, nil
 }
 
-func (layers layerFS) Sub(name string) (fs.FS, error) {
-	visibleLayers, err := layers.lookup("open", name)
+func (fsys *layerFS) Stat(name string) (fs.FileInfo, error) {
+	info, _, err := fsys.find("stat", name)
+	return info, err
+}
+
+// find resolves the layers of name and returns the information of the file in
+// the top layer where it is visible, along with the index of the layer. Like
+// the lookup, the information is obtained with the Lstat method of the layer
+// if it has one.
+func (fsys *layerFS) find(op, name string) (fs.FileInfo, int, error) {
+	visibleLayers, realName, err := fsys.lookup(op, name)
+	if err != nil {
+		return nil, -1, err
+	}
+	// Only the top layer determines the metadata of the file, there is no
+	// need to open the lower layers like Open does, unless the modification
+	// times of directories are merged.
+	visibleLayers, info, err := fsys.statTop(op, visibleLayers, realName)
+	if err != nil {
+		return nil, -1, err
+	}
+	top := visibleLayers[0]
+	if fsys.config.mergedDirModTime && info.IsDir() && len(visibleLayers) > 1 {
+		infos := make([]fs.FileInfo, 1, len(visibleLayers))
+		infos[0] = info
+		for _, l := range visibleLayers[1:] {
+			s, err := fsys.stat(l, realName)
+			if err != nil {
+				return nil, -1, err
+			}
+			infos = append(infos, s)
+		}
+		return fsys.dirInfo(infos), top.index, nil
+	}
+	return fsys.fileInfo(info), top.index, nil
+}
+
+func (fsys *layerFS) ReadFile(name string) ([]byte, error) {
+	visibleLayers, realName, err := fsys.lookup("read", name)
 	if err != nil {
 		return nil, err
 	}
-	for i, layer := range visibleLayers {
-		layer, err := fslink.Sub(layer, name)
+	// The content of files is always read from the top layer, the lower layers
+	// only matter to merge directories.
+	top := visibleLayers[0]
+	if r, ok := top.fsys.(fs.ReadFileFS); ok {
+		return r.ReadFile(realName)
+	}
+	// The size of the file is obtained through the stat cache, if enabled, to
+	// preallocate the buffer the file is read into.
+	info, err := fsys.stat(top, realName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := top.fsys.Open(realName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if metrics := fsys.config.metrics; metrics != nil {
+		metrics.LayerOpens.Add(1)
+	}
+
+	data := make([]byte, 0, info.Size()+1)
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+		n, err := f.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return data, err
+		}
+	}
+}
+
+// ReadFile reads the named file from fsys. When fsys is a layered file system,
+// the file is read directly from the top most layer where it exists, without
+// opening the layers below. Otherwise, it is equivalent to fs.ReadFile.
+func ReadFile(fsys fs.FS, name string) ([]byte, error) {
+	if layers, ok := fsys.(*layerFS); ok {
+		return layers.ReadFile(name)
+	}
+	return fs.ReadFile(fsys, name)
+}
+
+// OpenReaderAt opens the named file of fsys for random access, returning a
+// reader and the size of the file, which can be passed to io.NewSectionReader.
+// When fsys is a layered file system, the file is read from the top most layer
+// where it exists.
+//
+// The function fails with an error wrapping fs.ErrInvalid if the file is not a
+// regular file, or if the file opened from the layer does not implement
+// io.ReaderAt. The reader also implements io.Closer, which must be called to
+// release the file when it is not used anymore.
+func OpenReaderAt(fsys fs.FS, name string) (io.ReaderAt, int64, error) {
+	var f fs.File
+	var readerAt bool
+	if layers, ok := fsys.(*layerFS); ok {
+		lf, err := layers.open(context.Background(), "open", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Files of layered file systems always have a ReadAt method, which
+		// falls back to Seek and Read when the file of the layer is not an
+		// io.ReaderAt.
+		f, readerAt = lf, isReaderAt(lf.layers[0])
+	} else {
+		file, err := fsys.Open(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, readerAt = file.(io.ReaderAt)
+		f = file
+	}
+
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !s.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("not a regular file (%w)", fs.ErrInvalid)}
+	}
+	if !readerAt {
+		f.Close()
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fmt.Errorf("file does not support random access (%w)", fs.ErrInvalid)}
+	}
+	return f.(io.ReaderAt), s.Size(), nil
+}
+
+func (fsys *layerFS) Glob(pattern string) ([]string, error) {
+	// Check the pattern is well-formed, path.Match only reports errors on the
+	// parts of the pattern it had to evaluate.
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	if !hasMeta(pattern) {
+		if _, err := fsys.Stat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+
+	dir, file := path.Split(pattern)
+	dir = cleanGlobPath(dir)
+
+	if !hasMeta(dir) {
+		return fsys.glob(dir, file, nil)
+	}
+	if dir == pattern {
+		return nil, path.ErrBadPattern
+	}
+
+	dirs, err := fsys.Glob(dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, d := range dirs {
+		matches, err = fsys.glob(d, file, matches)
 		if err != nil {
 			return nil, err
 		}
-		visibleLayers[i] = layer
 	}
-	return layerFS(visibleLayers), nil
+	return matches, nil
+}
+
+// glob appends to matches the entries of the directory dir matching pattern.
+// The directory entries are listed through the layered view, so names masked
+// by whiteouts are never matched and names present in multiple layers are
+// only matched once.
+func (fsys *layerFS) glob(dir, pattern string, matches []string) ([]string, error) {
+	f, err := fsys.Open(dir)
+	if err != nil {
+		return matches, nil // ignore I/O errors like fs.Glob
+	}
+	defer f.Close()
+
+	entries, err := f.(*layerFile).ReadDir(-1)
+	if err != nil {
+		return matches, nil
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return matches, err
+		}
+		if matched {
+			matches = append(matches, path.Join(dir, name))
+		}
+	}
+	return matches, nil
+}
+
+func cleanGlobPath(path string) string {
+	switch path {
+	case "":
+		return "."
+	default:
+		return path[:len(path)-1] // chop off trailing separator
+	}
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+func (fsys *layerFS) Sub(name string) (fs.FS, error) {
+	visibleLayers, realName, err := fsys.lookup("sub", name)
+	if err != nil {
+		return nil, err
+	}
+	for i, layer := range visibleLayers {
+		visibleLayers[i].fsys = newSubLayer(layer.fsys, realName)
+	}
+	sub := newLayerFS(visibleLayers, fsys.config)
+	sub.writable = fsys.writable
+	return sub, nil
+}
+
+// subLayer is a layer of a layered file system returned by Sub, which exposes
+// the directory dir of the layer as its root.
+//
+// The file systems returned by fslink.Sub reject absolute targets of symbolic
+// links and do not have Stat and Lstat methods, which would prevent resolving
+// paths through links in the layers of the sub file system, and change the
+// information of links that Stat returns on layers which do not follow them.
+// Instead, subLayer passes all the methods used by the layered file system
+// through to the layer.
+type subLayer struct {
+	fsys fs.FS
+	dir  string
+}
+
+func newSubLayer(fsys fs.FS, dir string) fs.FS {
+	if dir == "." {
+		return fsys
+	}
+	if s, ok := fsys.(*subLayer); ok {
+		return &subLayer{fsys: s.fsys, dir: path.Join(s.dir, dir)}
+	}
+	return &subLayer{fsys: fsys, dir: dir}
+}
+
+func (fsys *subLayer) fullName(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(fsys.dir, name), nil
+}
+
+// fixErr strips the directory of the sub file system from the paths reported
+// in errors.
+func (fsys *subLayer) fixErr(err error) error {
+	if e, ok := err.(*fs.PathError); ok {
+		if e.Path == fsys.dir {
+			e.Path = "."
+		} else if name, ok := strings.CutPrefix(e.Path, fsys.dir+"/"); ok {
+			e.Path = name
+		}
+	}
+	return err
+}
+
+func (fsys *subLayer) Open(name string) (fs.File, error) {
+	return fsys.OpenCtx(context.Background(), name)
+}
+
+func (fsys *subLayer) OpenCtx(ctx context.Context, name string) (fs.File, error) {
+	fullName, err := fsys.fullName("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := openContext(ctx, fsys.fsys, fullName)
+	return f, fsys.fixErr(err)
 }
 
-func (layers layerFS) ReadLink(name string) (string, error) {
-	visibleLayers, err := layers.lookup("readlink", name)
+func (fsys *subLayer) Stat(name string) (fs.FileInfo, error) {
+	fullName, err := fsys.fullName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.Stat(fsys.fsys, fullName)
+	return info, fsys.fixErr(err)
+}
+
+func (fsys *subLayer) Lstat(name string) (fs.FileInfo, error) {
+	fullName, err := fsys.fullName("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := Lstat(fsys.fsys, fullName)
+	return info, fsys.fixErr(err)
+}
+
+func (fsys *subLayer) ReadDir(name string) ([]fs.DirEntry, error) {
+	fullName, err := fsys.fullName("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(fsys.fsys, fullName)
+	return entries, fsys.fixErr(err)
+}
+
+func (fsys *subLayer) ReadFile(name string) ([]byte, error) {
+	fullName, err := fsys.fullName("read", name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fs.ReadFile(fsys.fsys, fullName)
+	return b, fsys.fixErr(err)
+}
+
+// ReadLink returns the target of the symbolic link at name unchanged, absolute
+// targets are not rejected so the layered file system reports them like it does
+// for its own layers.
+func (fsys *subLayer) ReadLink(name string) (string, error) {
+	fullName, err := fsys.fullName("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	link, err := readLink(fsys.fsys, fullName)
+	return link, fsys.fixErr(err)
+}
+
+var (
+	_ ContextFS         = (*subLayer)(nil)
+	_ fs.StatFS         = (*subLayer)(nil)
+	_ fs.ReadDirFS      = (*subLayer)(nil)
+	_ fs.ReadFileFS     = (*subLayer)(nil)
+	_ fslink.ReadLinkFS = (*subLayer)(nil)
+)
+
+// Lstat returns information about the file at name without following the
+// symbolic link if it is one. The information is read from the top most layer
+// where the file is visible, using the Lstat method of the layer if it has one.
+func (fsys *layerFS) Lstat(name string) (fs.FileInfo, error) {
+	info, _, err := fsys.find("lstat", name)
+	return info, err
+}
+
+func (fsys *layerFS) ReadLink(name string) (string, error) {
+	visibleLayers, realName, err := fsys.lookup("readlink", name)
 	if err != nil {
 		return "", err
 	}
 
 	for _, layer := range visibleLayers {
-		link, err := fslink.ReadLink(layer, name)
+		link, err := fslink.ReadLink(layer.fsys, realName)
 		switch {
 		case err == nil:
 			return link, nil
@@ -104,22 +740,91 @@ func (layers layerFS) ReadLink(name string) (string, error) {
 		}
 	}
 
-	return "", &fs.PathError{"readlink", name, fs.ErrNotExist}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+}
+
+// lookup resolves the layers where name is visible. It also returns the path
+// of the file in the layers, which differs from name when the path traverses
+// symbolic links.
+func (fsys *layerFS) lookup(op, name string) ([]layer, string, error) {
+	return fsys.lookupContext(context.Background(), op, name)
+}
+
+func (fsys *layerFS) lookupContext(ctx context.Context, op, name string) ([]layer, string, error) {
+	if fsys.err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fsys.err}
+	}
+	if fsys.cache != nil {
+		return fsys.cache.lookup(ctx, fsys, op, name)
+	}
+	return fsys.resolveOnce(ctx, op, name)
+}
+
+// resolve computes the list of layers where name is visible, ordered from top
+// to bottom. The returned slice is owned by the caller.
+func (fsys *layerFS) resolve(ctx context.Context, op, name string) ([]layer, string, error) {
+	logger := fsys.config.logger
+	if logger == nil || !logger.Enabled(ctx, slog.LevelDebug) {
+		return fsys.resolveLayers(ctx, op, name, nil)
+	}
+	whiteouts := 0
+	visibleLayers, realName, err := fsys.resolveLayers(ctx, op, name, &whiteouts)
+	attrs := []slog.Attr{
+		slog.String("op", op),
+		slog.String("path", name),
+		slog.Int("layers", len(visibleLayers)),
+		slog.Int("whiteouts", whiteouts),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	} else {
+		attrs = append(attrs, slog.Int("top", visibleLayers[0].index))
+		if realName != name {
+			attrs = append(attrs, slog.String("resolved", realName))
+		}
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "ocifs lookup", attrs...)
+	return visibleLayers, realName, err
+}
+
+func countWhiteout(whiteouts *int) {
+	if whiteouts != nil {
+		*whiteouts++
+	}
 }
 
-func (layers layerFS) lookup(op, name string) ([]fs.FS, error) {
+// resolveLayers implements resolve, incrementing whiteouts (if not nil) each
+// time a whiteout masks the path in lower layers.
+func (fsys *layerFS) resolveLayers(ctx context.Context, op, name string, whiteouts *int) ([]layer, string, error) {
 	if !fs.ValidPath(name) {
-		return nil, &fs.PathError{op, name, fs.ErrNotExist}
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
 	}
+	visibleLayers := append([]layer{}, fsys.layers...)
 	if name == "." {
-		return layers, nil
+		// The root directory exists in all layers, but an opaque marker at
+		// the root of a layer masks the content of all the layers below.
+		if !fsys.config.noWhiteouts {
+			for i := range visibleLayers {
+				if err := ctx.Err(); err != nil {
+					return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+				}
+				if exist, err := fsys.hasOneOf(visibleLayers[i], fsys.config.whiteoutOpaque); err != nil {
+					return nil, "", err
+				} else if exist {
+					countWhiteout(whiteouts)
+					visibleLayers = visibleLayers[:i+1]
+					break
+				}
+			}
+		}
+		return visibleLayers, name, nil
 	}
-	visibleLayers := append([]fs.FS{}, layers...)
 	// To determine if a layer is masking the ones below, we have to walk
 	// through each element of the path and determine if any of the upper
 	// layer has whiteout files that would mask the lower layers.
 	path := name
 	walk := 0
+	links := 0
 
 	for walk < len(path) && len(visibleLayers) > 0 {
 		if i := strings.IndexByte(path[walk:], '/'); i < 0 {
@@ -128,24 +833,76 @@ func (layers layerFS) lookup(op, name string) ([]fs.FS, error) {
 			walk = walk + i
 		}
 
-		whiteoutOne, whiteoutAll := whiteout(path[:walk])
+		// Whiteout files are control entries of the layers, they are never
+		// visible in the merged view.
+		if fsys.config.isWhiteout(path[strings.LastIndexByte(path[:walk], '/')+1 : walk]) {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+
+		whiteoutOne, whiteoutAll := fsys.config.whiteout(path[:walk])
+		var topMode fs.FileMode
+
+		// When the layers are checked concurrently, the results are gathered
+		// before the loop and consumed in the same order as the sequential
+		// checks; the layers are indexed since the loop removes them from
+		// the list of visible layers.
+		var stats map[int]*layerStat
+		if fsys.config.parallelLookup > 1 && len(visibleLayers) > 1 {
+			stats = fsys.statLayers(ctx, visibleLayers, path[:walk], whiteoutOne, whiteoutAll)
+		}
+		hasWhiteout := func(l layer) (bool, error) {
+			if r := stats[l.index]; r != nil {
+				return r.whiteout, r.whiteoutErr
+			}
+			return fsys.hasWhiteout(l, whiteoutOne, whiteoutAll)
+		}
 
 		for i := 0; i < len(visibleLayers); {
-			s, err := fs.Stat(visibleLayers[i], path[:walk])
+			if err := ctx.Err(); err != nil {
+				return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+			}
+			var s fs.FileInfo
+			var err error
+			if r := stats[visibleLayers[i].index]; r != nil {
+				s, err = r.info, r.err
+			} else {
+				s, err = fsys.stat(visibleLayers[i], path[:walk])
+			}
+			if err == nil && i == 0 {
+				topMode = s.Mode()
+			}
 			if err != nil {
 				if !errors.Is(err, fs.ErrNotExist) {
-					return nil, err
+					return nil, "", err
+				}
+				// The layer does not have the file, but it may still have a
+				// whiteout masking the file in the layers below.
+				if exist, err := hasWhiteout(visibleLayers[i]); err != nil {
+					return nil, "", err
+				} else if exist {
+					countWhiteout(whiteouts)
+					visibleLayers = visibleLayers[:i]
+					break
 				}
 				// The layer does not have the file, it cannot be part of the
 				// visible layers.
 				n := copy(visibleLayers[i:], visibleLayers[i+1:])
 				visibleLayers = visibleLayers[:i+n]
 				continue
+			} else if fsys.config.charDeviceWhiteouts && isCharDeviceWhiteout(s) {
+				// The layer has a whiteout in place of the file, which masks
+				// the file in the layers below.
+				countWhiteout(whiteouts)
+				visibleLayers = visibleLayers[:i]
+				break
 			} else if !s.IsDir() {
 				// The layer is not a directory, it will mask all the files in
-				// layers below. However, if this is not the top most layer it
-				// indicates that the previous layers contained directories and
-				// therefore the current layer cannot be included.
+				// layers below, including the content of their directories.
+				// However, if this is not the top most layer it indicates that
+				// the previous layers contained directories which replaced the
+				// file, and therefore the current layer cannot be included;
+				// the directories above do not merge with the directories of
+				// the layers below the file either.
 				if i == 0 {
 					i++
 				}
@@ -153,40 +910,150 @@ func (layers layerFS) lookup(op, name string) ([]fs.FS, error) {
 				break
 			}
 
-			if exist, err := hasOneOf(visibleLayers[i], whiteoutOne, whiteoutAll); err != nil {
-				return nil, err
+			if exist, err := hasWhiteout(visibleLayers[i]); err != nil {
+				return nil, "", err
 			} else if exist {
 				// The layer has whiteout files that mask all the layers below,
 				// we strip them out of the list of visible layers.
+				countWhiteout(whiteouts)
 				visibleLayers = visibleLayers[:i+1]
 				break
 			}
 			i++
 		}
+
+		if walk < len(path) && len(visibleLayers) > 0 && !topMode.IsDir() && topMode.Type() != fs.ModeSymlink {
+			// An intermediate component of the path is a file which replaced
+			// the directories of the lower layers. Layers backed by the local
+			// file system would report ENOTDIR, the path does not exist in
+			// the merged view regardless of the type of layers.
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if walk < len(path) && len(visibleLayers) > 0 && topMode.Type() == fs.ModeSymlink {
+			// An intermediate component of the path is a symbolic link, the
+			// walk restarts from the root with the target of the link in
+			// place of the path prefix. Layers which follow symbolic links
+			// when calling fs.Stat and have no Lstat method never get here,
+			// they resolve links within their own file system.
+			if links++; links > fsys.config.maxSymlinks {
+				return nil, "", errTooManyLinks(op, name)
+			}
+			link, err := readLink(visibleLayers[0].fsys, path[:walk])
+			if err != nil {
+				return nil, "", err
+			}
+			target, ok := joinLink(path[:walk], link, path[walk+1:])
+			if !ok {
+				return nil, "", errEscapingLink(op, name, path[:walk], link)
+			}
+			path = target
+			visibleLayers = append(visibleLayers[:0], fsys.layers...)
+			walk = 0
+			continue
+		}
 		walk++
 	}
 
 	if len(visibleLayers) == 0 {
-		return nil, &fs.PathError{op, name, fs.ErrNotExist}
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
 	}
-	return visibleLayers, nil
+	return visibleLayers, path, nil
 }
 
 var (
-	_ fs.SubFS          = (layerFS)(nil)
-	_ fslink.ReadLinkFS = (layerFS)(nil)
+	_ fs.StatFS         = (*layerFS)(nil)
+	_ fs.ReadFileFS     = (*layerFS)(nil)
+	_ fs.GlobFS         = (*layerFS)(nil)
+	_ fs.SubFS          = (*layerFS)(nil)
+	_ fslink.ReadLinkFS = (*layerFS)(nil)
 )
 
-func whiteout(name string) (whiteoutOne, whiteoutAll string) {
-	dir, base := path.Split(name)
-	whiteoutOne = path.Join(dir, whiteoutPrefix+base)
-	whiteoutAll = path.Join(dir, whiteoutOpaque)
-	return
+// stat returns information about name in a layer, going through the stat
+// cache if it was enabled.
+// statTop returns the information of name in the top most of the visible
+// layers. Like open, layers which do not expose their root directory are
+// skipped when name is the root, and removed from the returned layers.
+func (fsys *layerFS) statTop(op string, visibleLayers []layer, name string) ([]layer, fs.FileInfo, error) {
+	if name != "." {
+		info, err := fsys.stat(visibleLayers[0], name)
+		return visibleLayers, info, err
+	}
+	layers := make([]layer, 0, len(visibleLayers))
+	var info fs.FileInfo
+	for _, l := range visibleLayers {
+		s, err := fsys.stat(l, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, nil, err
+		}
+		if info == nil {
+			info = s
+		}
+		layers = append(layers, l)
+	}
+	if len(layers) == 0 {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return layers, info, nil
+}
+
+func (fsys *layerFS) stat(l layer, name string) (fs.FileInfo, error) {
+	if fsys.stats != nil {
+		return fsys.stats.stat(l, name)
+	}
+	return statLayer(l, name, fsys.config.metrics)
 }
 
-func hasOneOf(fsys fs.FS, names ...string) (bool, error) {
+// statLayer returns information about name in a layer, without following
+// symbolic links when the layer has a Lstat method (e.g. fs.ReadLinkFS), so
+// links are resolved through the merged view of the layers. Layers which do
+// not implement fs.StatFS are accessed by opening the file and calling Stat on
+// the handle; errors from the handle are wrapped to indicate which layer
+// failed. The call is counted in metrics if it is not nil.
+func statLayer(l layer, name string, metrics *Metrics) (fs.FileInfo, error) {
+	if metrics != nil {
+		metrics.LayerStats.Add(1)
+	}
+	if s, ok := l.fsys.(interface {
+		Lstat(string) (fs.FileInfo, error)
+	}); ok {
+		return s.Lstat(name)
+	}
+	if s, ok := l.fsys.(fs.StatFS); ok {
+		return s.Stat(name)
+	}
+	f, err := l.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fmt.Errorf("layer %d: stat of the opened file failed: %w", l.index, err)}
+	}
+	return info, nil
+}
+
+// hasWhiteout returns true if the layer has one of the whiteout files, which
+// is always false when whiteouts are disabled (see MergeFS).
+func (fsys *layerFS) hasWhiteout(l layer, whiteoutOne, whiteoutAll string) (bool, error) {
+	if fsys.config.noWhiteouts {
+		return false, nil
+	}
+	return fsys.hasOneOf(l, whiteoutOne, whiteoutAll)
+}
+
+func (fsys *layerFS) hasOneOf(l layer, names ...string) (bool, error) {
 	for _, name := range names {
-		_, err := fs.Stat(fsys, name)
+		if fsys.whiteouts != nil {
+			if exist, err := fsys.whiteouts.has(fsys, l, name); err != nil || exist {
+				return exist, err
+			}
+			continue
+		}
+		_, err := fsys.stat(l, name)
 		if err == nil {
 			return true, nil
 		}
@@ -198,17 +1065,40 @@ func hasOneOf(fsys fs.FS, names ...string) (bool, error) {
 }
 
 type layerFile struct {
+	fsys   *layerFS
 	layers []fs.File
+	top    fs.FS
 	name   string
+	// name of the file in the layers, after resolving symbolic links
+	realName string
 	// lazily allocated by ReadDir
 	dirReader *dirReader
+	// set when reads are prefetched, see WithReadahead
+	readahead *readahead
+	// serializes the emulation of ReadAt with Read and Seek
+	mutex sync.Mutex
+	// set when the file was closed, to only update metrics once
+	closed bool
 }
 
 func (f *layerFile) Close() error {
+	f.mutex.Lock()
+	if !f.closed {
+		f.closed = true
+		if metrics := f.fsys.config.metrics; metrics != nil {
+			metrics.OpenHandles.Add(-int64(len(f.layers)))
+		}
+	}
+	if f.readahead != nil {
+		// The prefetch must not read from the layer after it was closed.
+		f.readahead.close()
+	}
+	f.mutex.Unlock()
+	errs := make([]error, 0, len(f.layers))
 	for _, layer := range f.layers {
-		layer.Close()
+		errs = append(errs, layer.Close())
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func (f *layerFile) Stat() (fs.FileInfo, error) {
@@ -216,26 +1106,117 @@ func (f *layerFile) Stat() (fs.FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &layerInfo{s}, nil
+	if s.IsDir() {
+		// The information of directories is read from the file system of the
+		// top layer so it matches Stat and the entries listed by ReadDir;
+		// some layers (e.g. fstest.MapFS) report different information for
+		// implicit directories on the open handle. Other files are described
+		// by their handle, which may differ from the name on mutable layers.
+		if s, err = fs.Stat(f.top, f.realName); err != nil {
+			return nil, err
+		}
+	}
+	if f.fsys.config.mergedDirModTime && s.IsDir() && len(f.layers) > 1 {
+		infos := make([]fs.FileInfo, 1, len(f.layers))
+		infos[0] = s
+		for _, file := range f.layers[1:] {
+			s, err := file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, s)
+		}
+		return f.fsys.dirInfo(infos), nil
+	}
+	return f.fsys.fileInfo(s), nil
 }
 
 func (f *layerFile) Read(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.readahead != nil {
+		return f.readahead.Read(b)
+	}
 	return f.layers[0].Read(b)
 }
 
+// WriteTo writes the remaining content of the file to w, starting from the
+// current position. It delegates to the file of the top layer when it
+// implements io.WriterTo.
+func (f *layerFile) WriteTo(w io.Writer) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.readahead != nil {
+		// The position of the file of the top layer does not advance when
+		// reads are prefetched, it must be synchronized before and after.
+		s := f.layers[0].(io.Seeker)
+		if _, err := s.Seek(f.readahead.offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		defer func() {
+			if offset, err := s.Seek(0, io.SeekCurrent); err == nil {
+				f.readahead.offset = offset
+			}
+		}()
+	}
+	if wt, ok := f.layers[0].(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, f.layers[0])
+}
+
+// ReadAt reads from the file at the given offset. When the file of the top
+// layer does not implement io.ReaderAt but implements io.Seeker, ReadAt seeks
+// to the offset, reads, and restores the previous position. The emulation is
+// serialized with calls to Read and Seek, so concurrent calls to ReadAt are
+// safe but do not execute in parallel.
 func (f *layerFile) ReadAt(b []byte, offset int64) (int, error) {
-	if r, ok := f.layers[0].(io.ReaderAt); ok {
-		return r.ReadAt(b, offset)
+	if isReaderAt(f.layers[0]) {
+		return f.layers[0].(io.ReaderAt).ReadAt(b, offset)
 	}
-	return 0, &fs.PathError{"read", f.name, fs.ErrInvalid}
+	if s, ok := f.layers[0].(io.Seeker); ok {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return f.seekReadAt(s, b, offset)
+	}
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *layerFile) seekReadAt(s io.Seeker, b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	prev, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(f.layers[0], b)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if _, seekErr := s.Seek(prev, io.SeekStart); seekErr != nil && err == nil {
+		err = seekErr
+	}
+	return n, err
 }
 
 func (f *layerFile) Seek(offset int64, whence int) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 	if s, ok := f.layers[0].(io.Seeker); ok {
+		if f.readahead != nil && whence == io.SeekCurrent {
+			offset, whence = f.readahead.offset+offset, io.SeekStart
+		}
 		offset, err := s.Seek(offset, whence)
 		if err != nil {
 			return offset, err
 		}
+		if f.readahead != nil {
+			f.readahead.offset = offset
+		}
 		if offset == 0 && f.dirReader != nil {
 			// Using lseek to reset the directory position is supported by posix
 			// so we be good citizens and comply, assuming that if we get to
@@ -245,27 +1226,52 @@ func (f *layerFile) Seek(offset int64, whence int) (int64, error) {
 		}
 		return offset, nil
 	}
-	return 0, &fs.PathError{"seek", f.name, fs.ErrInvalid}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
 }
 
+// ReadDir reads the merged entries of the directory. When n <= 0, the entries
+// are sorted by name as documented by fs.ReadDirFile. When n > 0, the entries
+// are returned in the order they are found in the layers, from the top most
+// layer to the bottom one, which is not sorted across calls.
 func (f *layerFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return f.readDir(context.Background(), n)
+}
+
+func (f *layerFile) readDir(ctx context.Context, n int) ([]fs.DirEntry, error) {
 	if f.dirReader == nil {
+		// Files which are not directories only have one visible layer, and
+		// reading them as directories fails like it does on the layers
+		// constructed from tar archives.
+		if len(f.layers) == 1 {
+			s, err := f.layers[0].Stat()
+			if err != nil {
+				return nil, err
+			}
+			if !s.IsDir() {
+				return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+			}
+		}
 		files := make([]fs.ReadDirFile, 0, len(f.layers))
 		for _, layer := range f.layers {
 			if f, ok := layer.(fs.ReadDirFile); ok {
 				files = append(files, f)
 			}
 		}
-		f.dirReader = &dirReader{files: files}
+		f.dirReader = &dirReader{files: files, fsys: f.fsys, name: f.name}
 	}
 	if n < 0 {
 		n = 0
 	}
 	ret := make([]fs.DirEntry, 0, n)
-	err := f.dirReader.scan(n, func(e fs.DirEntry) error {
+	err := f.dirReader.scan(ctx, n, func(e fs.DirEntry) error {
 		ret = append(ret, e)
 		return nil
 	})
+	if n == 0 {
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].Name() < ret[j].Name()
+		})
+	}
 	return ret, err
 }
 
@@ -273,47 +1279,168 @@ var (
 	_ fs.ReadDirFile = (*layerFile)(nil)
 	_ io.ReaderAt    = (*layerFile)(nil)
 	_ io.Seeker      = (*layerFile)(nil)
+	_ io.WriterTo    = (*layerFile)(nil)
 )
 
-type layerInfo struct{ fs.FileInfo }
+// fileInfo returns the information of a file as exposed by the layered file
+// system, with write permissions removed unless the layers are writable.
+func (fsys *layerFS) fileInfo(info fs.FileInfo) fs.FileInfo {
+	return &layerInfo{FileInfo: info, writable: fsys.writable}
+}
+
+// dirInfo returns the information of a directory merged from the layers
+// where it exists, ordered from the top one, with the latest modification time
+// of the layers (see WithMergedDirModTime).
+func (fsys *layerFS) dirInfo(infos []fs.FileInfo) fs.FileInfo {
+	info := &layerInfo{FileInfo: infos[0], writable: fsys.writable}
+	modTime := infos[0].ModTime()
+	for _, s := range infos[1:] {
+		if t := s.ModTime(); t.After(modTime) {
+			modTime = t
+			info.modTime = t
+		}
+	}
+	return info
+}
+
+type layerInfo struct {
+	fs.FileInfo
+	writable bool
+	// set when the modification time differs from the one of the top layer
+	modTime time.Time
+}
+
+func (info *layerInfo) ModTime() time.Time {
+	if !info.modTime.IsZero() {
+		return info.modTime
+	}
+	return info.FileInfo.ModTime()
+}
 
 func (info *layerInfo) Mode() fs.FileMode {
-	// Layers are read-only, so mask all write permissions on the files to let
-	// the application know that it is not allowed to write those layers.
 	mode := info.FileInfo.Mode()
-	mode &= ^fs.FileMode(0222)
+	if !info.writable {
+		// Layers are read-only, so mask all write permissions on the files to let
+		// the application know that it is not allowed to write those layers.
+		mode &= ^fs.FileMode(0222)
+	}
 	return mode
 }
 
+// Sys returns a *FileInfoSys when the layer exposes the metadata of files from
+// tar headers, otherwise the value returned by the layer is passed through.
+func (info *layerInfo) Sys() any {
+	sys := info.FileInfo.Sys()
+	if s, ok := fileInfoSys(sys); ok {
+		if !info.modTime.IsZero() {
+			// The value may be shared with the layer, it must not be
+			// modified.
+			merged := *s
+			merged.Mtime = info.modTime
+			return &merged
+		}
+		return s
+	}
+	return sys
+}
+
+type layerEntry struct {
+	fs.DirEntry
+	fsys *layerFS
+	name string
+}
+
+func (entry layerEntry) Info() (fs.FileInfo, error) {
+	if entry.IsDir() {
+		// The directory entry was listed from the top most layer where it
+		// exists, but the information of directories must be consistent with
+		// what Stat would return, so we resolve it through the layered file
+		// system.
+		return fs.Stat(entry.fsys, entry.name)
+	}
+	info, err := entry.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return entry.fsys.fileInfo(info), nil
+}
+
+// dirReader merges the entries of a directory across layers.
+//
+// The names found in a layer are recorded in masks once the layer has been
+// fully read, so they hide the entries of the layers below. Names are not
+// recorded while reading the bottom layer since there is nothing left to mask,
+// and the masks are released when all the layers have been read, so the memory
+// retained by the directory is bounded by the entries of the upper layers.
+//
+// When names are compared case-insensitively (see WithCaseInsensitive), the
+// masks record the folded names, and the entries are masked as soon as they are
+// listed since a layer may contain several names which only differ by case.
 type dirReader struct {
 	files []fs.ReadDirFile
 	names []string
 	masks map[string]struct{}
+	fsys  *layerFS
+	name  string
+}
+
+func (dir *dirReader) isCharDeviceWhiteout(entry fs.DirEntry) bool {
+	if !dir.fsys.config.charDeviceWhiteouts || entry.Type()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	info, err := entry.Info()
+	return err == nil && isCharDeviceWhiteout(info)
 }
 
-func (dir *dirReader) scan(n int, f func(fs.DirEntry) error) error {
-	if dir.masks == nil {
-		dir.masks = make(map[string]struct{})
+// mask records name to be masked in the layers below the current one.
+func (dir *dirReader) mask(name string) {
+	if len(dir.files) > 1 {
+		dir.names = append(dir.names, name)
 	}
+}
 
+func (dir *dirReader) scan(ctx context.Context, n int, f func(fs.DirEntry) error) error {
+	config := dir.fsys.config
+	whiteoutPrefix := config.fold(config.whiteoutPrefix)
+	whiteoutOpaque := config.fold(config.whiteoutOpaque)
 	dirents := 0
 	for len(dir.files) > 0 {
 		for {
+			if err := ctx.Err(); err != nil {
+				return &fs.PathError{Op: "readdir", Path: dir.name, Err: err}
+			}
 			entries, err := dir.files[0].ReadDir(n - dirents)
 
 			for _, entry := range entries {
 				name := entry.Name()
-				if _, seen := dir.masks[name]; seen {
+				key := config.fold(name)
+				if _, seen := dir.masks[key]; seen {
 					continue
 				}
 				switch {
-				case name == whiteoutOpaque:
+				case !config.noWhiteouts && key == whiteoutOpaque:
+					// Drop the layers below the current one; the remaining
+					// entries of the current layer are still emitted, in the
+					// same chunk or in subsequent calls.
 					dir.files = dir.files[:1]
-				case strings.HasPrefix(name, whiteoutPrefix):
-					dir.names = append(dir.names, name[len(whiteoutPrefix):])
+				case config.isWhiteoutMetadata(name):
+				case !config.noWhiteouts && strings.HasPrefix(key, whiteoutPrefix):
+					dir.mask(key[len(whiteoutPrefix):])
+				case dir.isCharDeviceWhiteout(entry):
+					dir.mask(key)
 				default:
-					dir.names = append(dir.names, name)
-					if err := f(entry); err != nil {
+					if config.caseInsensitive {
+						// Names which only differ by case may exist in the same
+						// layer, only the first one is listed.
+						if dir.masks == nil {
+							dir.masks = make(map[string]struct{})
+						}
+						dir.masks[key] = struct{}{}
+					} else {
+						dir.mask(name)
+					}
+					dir.fsys.config.checkSupported(path.Join(dir.name, name), entry.Type())
+					if err := f(layerEntry{entry, dir.fsys, path.Join(dir.name, name)}); err != nil {
 						return err
 					}
 					dirents++
@@ -326,16 +1453,33 @@ func (dir *dirReader) scan(n int, f func(fs.DirEntry) error) error {
 			if n == dirents || err != nil {
 				return err
 			}
+			// The layer may legally return fewer entries than requested, in
+			// which case we keep reading from it until it reports io.EOF, but
+			// a layer returning nothing would never make progress.
+			if len(entries) == 0 {
+				return &fs.PathError{Op: "readdir", Path: dir.name, Err: io.ErrNoProgress}
+			}
 		}
 
 		// Apply names after completing iteration of the layer otherwise
 		// it could end up mistakenly masking its own entries.
+		if len(dir.names) > 0 && dir.masks == nil {
+			dir.masks = make(map[string]struct{}, len(dir.names))
+		}
 		for _, name := range dir.names {
 			dir.masks[name] = struct{}{}
 		}
-		dir.names = dir.names[:0]
+		dir.names = nil
 		dir.files = dir.files[1:]
+
+		// The layer may have returned io.EOF with the last entries needed to
+		// complete the page, in which case we must not read the next layer
+		// since ReadDir(0) would return all its entries.
+		if n > 0 && n == dirents && len(dir.files) > 0 {
+			return nil
+		}
 	}
+	dir.masks = nil
 
 	if dirents < n {
 		return io.EOF
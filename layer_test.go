@@ -1,9 +1,25 @@
 package ocifs_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/stealthrocket/fslink"
 	"github.com/stealthrocket/fstest"
 	"github.com/stealthrocket/ocifs"
 )
@@ -70,3 +86,1892 @@ func TestLayerFS(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLayerFSReadDirSorted(t *testing.T) {
+	file := &fstest.MapFile{Mode: 0444}
+	layers := ocifs.LayerFS(
+		fstest.MapFS{"b": file, "d": file, "f": file},
+		fstest.MapFS{"a": file, "c": file, "e": file},
+		fstest.MapFS{"d": file, "g": file},
+	)
+
+	readDir := func(t *testing.T, n int) []string {
+		t.Helper()
+		f, err := layers.Open(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var names []string
+		for {
+			entries, err := f.(fs.ReadDirFile).ReadDir(n)
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if n <= 0 || err != nil {
+				return names
+			}
+		}
+	}
+
+	expect := []string{"a", "b", "c", "d", "e", "f", "g"}
+	if names := readDir(t, -1); !reflect.DeepEqual(names, expect) {
+		t.Errorf("wrong directory entries:\nwant=%v\ngot= %v", expect, names)
+	}
+
+	// Paginated reads return entries in layer order, but must still list
+	// each entry exactly once.
+	names := readDir(t, 2)
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("wrong paginated directory entries:\nwant=%v\ngot= %v", expect, names)
+	}
+
+	if err := fstest.TestFS(layers, expect...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// chunkFS wraps a file system so directories return their entries in uneven
+// chunks smaller than requested by ReadDir.
+type chunkFS struct {
+	fsys fs.FS
+	// When true, io.EOF is returned with the last chunk of entries rather than
+	// by a separate call to ReadDir.
+	eofWithLast bool
+}
+
+func (fsys chunkFS) Open(name string) (fs.File, error) {
+	f, err := fsys.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return f, nil
+	}
+	entries, err := d.ReadDir(-1)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &chunkDir{File: f, entries: entries, eofWithLast: fsys.eofWithLast}, nil
+}
+
+type chunkDir struct {
+	fs.File
+	entries     []fs.DirEntry
+	calls       int
+	eofWithLast bool
+}
+
+func (d *chunkDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	d.calls++
+	size := 1 + d.calls%3
+	if size > n {
+		size = n
+	}
+	if size > len(d.entries) {
+		size = len(d.entries)
+	}
+	entries := d.entries[:size:size]
+	d.entries = d.entries[size:]
+	if len(d.entries) == 0 && d.eofWithLast {
+		return entries, io.EOF
+	}
+	return entries, nil
+}
+
+func TestLayerFSReadDirChunks(t *testing.T) {
+	file := &fstest.MapFile{Mode: 0444}
+
+	layer1 := fstest.MapFS{}
+	for i := 0; i < 20; i++ {
+		layer1[fmt.Sprintf("a/%02d", i)] = file
+		layer1[fmt.Sprintf("b/%02d", i)] = file
+	}
+	layer2 := fstest.MapFS{
+		"a/.wh.03":       file,
+		"a/.wh.04":       file,
+		"a/.wh.17":       file,
+		"a/05":           file,
+		"a/new":          file,
+		"b/.wh..wh..opq": file,
+		"b/07":           file,
+		"b/new":          file,
+	}
+
+	var expectA, expectB []string
+	for i := 0; i < 20; i++ {
+		switch i {
+		case 3, 4, 17:
+		default:
+			expectA = append(expectA, fmt.Sprintf("%02d", i))
+		}
+	}
+	expectA = append(expectA, "new")
+	expectB = []string{"07", "new"}
+
+	for _, eofWithLast := range []bool{false, true} {
+		layers := ocifs.LayerFS(
+			chunkFS{layer1, eofWithLast},
+			chunkFS{layer2, eofWithLast},
+		)
+
+		for _, n := range []int{-1, 1, 2, 3, 5, 100} {
+			for dir, expect := range map[string][]string{"a": expectA, "b": expectB} {
+				f, err := layers.Open(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for {
+					entries, err := f.(fs.ReadDirFile).ReadDir(n)
+					for _, entry := range entries {
+						names = append(names, entry.Name())
+					}
+					if err == io.EOF || (n <= 0 && err == nil) {
+						break
+					}
+					if err != nil {
+						t.Fatalf("%s (n=%d, eofWithLast=%t): %v", dir, n, eofWithLast, err)
+					}
+					if len(entries) != n {
+						t.Errorf("%s: ReadDir(%d) returned %d entries before the end of the directory", dir, n, len(entries))
+					}
+				}
+				f.Close()
+
+				sort.Strings(names)
+				if !reflect.DeepEqual(names, expect) {
+					t.Errorf("%s (n=%d, eofWithLast=%t): wrong directory entries:\nwant=%v\ngot= %v", dir, n, eofWithLast, expect, names)
+				}
+			}
+		}
+	}
+}
+
+func TestLayerFSOpaqueWhiteoutWithSiblings(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	layers := ocifs.LayerFS(
+		fstest.MapFS{
+			"d/+early": file("lower"),
+			"d/hidden": file("lower"),
+			"d/late":   file("lower"),
+		},
+		// The opaque marker is listed in the middle of the entries of the
+		// directory, which all arrive in the same chunk of ReadDir.
+		fstest.MapFS{
+			"d/+early":         file("upper"),
+			"d/.wh..wh..opq":   file(""),
+			"d/late":           file("upper"),
+			"d/z/.wh..wh..opq": file(""),
+		},
+	)
+
+	expect := []string{"+early", "late", "z"}
+	for _, n := range []int{-1, 1, 2, 10} {
+		f, err := layers.Open("d")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for {
+			entries, err := f.(fs.ReadDirFile).ReadDir(n)
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if err == io.EOF || (n <= 0 && err == nil) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		f.Close()
+
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, expect) {
+			t.Errorf("n=%d: wrong directory entries:\nwant=%v\ngot= %v", n, expect, names)
+		}
+	}
+
+	for _, name := range []string{"d/+early", "d/late"} {
+		b, err := fs.ReadFile(layers, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "upper" {
+			t.Errorf("%s: wrong content: %q", name, b)
+		}
+	}
+	if _, err := fs.Stat(layers, "d/hidden"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("d/hidden: expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestLayers(t *testing.T) {
+	layer1 := fstest.MapFS{"1": &fstest.MapFile{}}
+	layer2 := fstest.MapFS{"2": &fstest.MapFile{}}
+	layer3 := fstest.MapFS{"3": &fstest.MapFile{}}
+
+	layers := ocifs.Layers(ocifs.LayerFS(layer1, layer2, layer3))
+	if !reflect.DeepEqual(layers, []fs.FS{layer1, layer2, layer3}) {
+		t.Errorf("wrong layers: %v", layers)
+	}
+	if n := ocifs.NumLayers(ocifs.LayerFS(layer1, layer2, layer3)); n != 3 {
+		t.Errorf("wrong number of layers: %d", n)
+	}
+
+	if layers := ocifs.Layers(layer1); !reflect.DeepEqual(layers, []fs.FS{layer1}) {
+		t.Errorf("wrong layers of a file system which is not layered: %v", layers)
+	}
+	if n := ocifs.NumLayers(layer1); n != 1 {
+		t.Errorf("wrong number of layers of a file system which is not layered: %d", n)
+	}
+}
+
+type namedFS struct {
+	fstest.MapFS
+	name string
+}
+
+func (fsys namedFS) String() string { return fsys.name }
+
+func TestLayerFSString(t *testing.T) {
+	base := namedFS{fstest.MapFS{}, "base"}
+	update := namedFS{fstest.MapFS{}, "update"}
+
+	tests := []struct {
+		fsys   fs.FS
+		expect string
+	}{
+		{ocifs.LayerFS(), "layerFS(0 layers)"},
+		{ocifs.LayerFS(base), "layerFS(1 layer: base)"},
+		{ocifs.LayerFS(base, update), "layerFS(2 layers: base, update)"},
+		{ocifs.LayerFS(base, fstest.MapFS{}, update), "layerFS(3 layers)"},
+	}
+	for _, test := range tests {
+		if s := fmt.Sprint(test.fsys); s != test.expect {
+			t.Errorf("wrong string: want=%q got=%q", test.expect, s)
+		}
+	}
+}
+
+func TestMergeFS(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	lower := fstest.MapFS{
+		"a":       dir(),
+		"a/one":   file("1"),
+		"a/two":   file("2"),
+		"b":       dir(),
+		"b/three": file("3"),
+	}
+	upper := fstest.MapFS{
+		"a":              dir(),
+		"a/two":          file("-2"),
+		"a/.wh.one":      file(""),
+		"b":              dir(),
+		"b/.wh..wh..opq": file(""),
+	}
+
+	expect := fstest.MapFS{
+		"a":              dir(),
+		"a/one":          file("1"),
+		"a/two":          file("-2"),
+		"a/.wh.one":      file(""),
+		"b":              dir(),
+		"b/three":        file("3"),
+		"b/.wh..wh..opq": file(""),
+	}
+
+	merged := ocifs.MergeFS(lower, upper)
+	if err := fstest.EqualFS(expect, merged); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(expect))
+	for name := range expect {
+		names = append(names, name)
+	}
+	if err := fstest.TestFS(merged, names...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayerFSSub(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer1 := fstest.MapFS{
+		"a/b/one":        file("1"),
+		"a/b/two":        file("2"),
+		"a/b/three":      file("3"),
+		"a/b/c/deep":     file("deep"),
+		"a/b/d/gone":     file("gone"),
+		"a/b/e":          file("file"),
+		"a/b/opaque/old": file("old"),
+		"a/x":            file("x"),
+	}
+	layer2 := fstest.MapFS{
+		"a/b/two":                 file("-2"),
+		"a/b/.wh.three":           file(""),
+		"a/b/c/deep":              file("deeper"),
+		"a/b/c/new":               file("new"),
+		"a/b/.wh.d":               file(""),
+		"a/b/e":                   dir(),
+		"a/b/e/f":                 file("f"),
+		"a/b/opaque":              dir(),
+		"a/b/opaque/.wh..wh..opq": file(""),
+		"a/b/opaque/new":          file("new"),
+	}
+	layer3 := fstest.MapFS{
+		"a/b/two":        file("--2"),
+		"a/b/c/.wh.new":  file(""),
+		"a/b/d/back":     file("back"),
+		"a/b/opaque/top": file("top"),
+	}
+
+	// MapFS reports no permissions for the root of its sub file systems when
+	// the directory is implicit, so the directories are declared explicitly.
+	for _, layer := range []fstest.MapFS{layer1, layer2, layer3} {
+		for name := range layer {
+			for dirName := path.Dir(name); dirName != "."; dirName = path.Dir(dirName) {
+				if layer[dirName] == nil {
+					layer[dirName] = dir()
+				}
+			}
+		}
+	}
+
+	// Every path of the subtrees must resolve to the same file through the
+	// sub file system as through the full path on the parent.
+	compare := func(t *testing.T, parent, sub fs.FS, prefix string) {
+		t.Helper()
+		seen := 0
+		err := fs.WalkDir(parent, prefix, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			subName := strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/")
+			if subName == "" {
+				subName = "."
+			}
+			seen++
+
+			want, err := fs.Stat(parent, name)
+			if err != nil {
+				return err
+			}
+			got, err := fs.Stat(sub, subName)
+			if err != nil {
+				return err
+			}
+			if want.Mode() != got.Mode() || want.Size() != got.Size() {
+				t.Errorf("%s: wrong file: want=%v/%d got=%v/%d", subName, want.Mode(), want.Size(), got.Mode(), got.Size())
+			}
+
+			if d.IsDir() {
+				want, err := fs.ReadDir(parent, name)
+				if err != nil {
+					return err
+				}
+				got, err := fs.ReadDir(sub, subName)
+				if err != nil {
+					return err
+				}
+				if !reflect.DeepEqual(entryNames(want), entryNames(got)) {
+					t.Errorf("%s: wrong entries: want=%q got=%q", subName, entryNames(want), entryNames(got))
+				}
+			} else {
+				want, err := fs.ReadFile(parent, name)
+				if err != nil {
+					return err
+				}
+				got, err := fs.ReadFile(sub, subName)
+				if err != nil {
+					return err
+				}
+				if string(want) != string(got) {
+					t.Errorf("%s: wrong content: want=%q got=%q", subName, want, got)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen < 2 {
+			t.Fatalf("%s: the subtree is empty", prefix)
+		}
+	}
+
+	options := map[string][]ocifs.Option{
+		"default":      nil,
+		"lookup cache": {ocifs.WithLookupCache()},
+		"stat cache":   {ocifs.WithStatCache(100)},
+	}
+
+	for scenario, options := range options {
+		t.Run(scenario, func(t *testing.T) {
+			layers := ocifs.LayerFSWithOptions([]fs.FS{layer1, layer2, layer3}, options...)
+
+			for _, prefix := range []string{"a", "a/b", "a/b/c", "a/b/e", "a/b/opaque"} {
+				sub, err := fs.Sub(layers, prefix)
+				if err != nil {
+					t.Fatal(err)
+				}
+				compare(t, layers, sub, prefix)
+			}
+
+			a, err := fs.Sub(layers, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ab, err := fs.Sub(a, "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			compare(t, layers, ab, "a/b")
+
+			for _, name := range []string{"three", "d/gone", "c/new", "opaque/old", ".wh.three"} {
+				if _, err := fs.Stat(ab, name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s: expected fs.ErrNotExist, got %v", name, err)
+				}
+			}
+			if b, err := fs.ReadFile(ab, "two"); err != nil || string(b) != "--2" {
+				t.Errorf("the top most layer must shadow the others: %q (%v)", b, err)
+			}
+		})
+	}
+}
+
+func TestLayerFSSubReadLink(t *testing.T) {
+	lower := tarFS(t,
+		tarDir("a/"),
+		tarDir("a/dir/"),
+		tarFile("a/dir/file", "data"),
+		tarFile("a/shadowed", "lower"),
+	)
+	upper := tarFS(t,
+		tarDir("a/"),
+		tarSymlink("a/rel", "dir/file"),
+		tarSymlink("a/reldir", "dir"),
+		tarSymlink("a/absdir", "/dir"),
+		tarSymlink("a/shadowed", "dir/file"),
+	)
+	layers := ocifs.LayerFS(lower, upper)
+
+	sub, err := fs.Sub(layers, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ocifs.Capabilities(sub).Has(ocifs.CapReadLink) {
+		t.Error("the sub file system must support reading symbolic links")
+	}
+
+	for name, target := range map[string]string{
+		"rel":      "dir/file",
+		"reldir":   "dir",
+		"shadowed": "dir/file",
+	} {
+		link, err := fslink.ReadLink(sub, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if link != target {
+			t.Errorf("%s: wrong link: want=%q got=%q", name, target, link)
+		}
+
+		info, err := ocifs.Lstat(sub, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if info.Mode().Type() != fs.ModeSymlink {
+			t.Errorf("%s: not a symbolic link: %v", name, info.Mode())
+		}
+	}
+
+	if _, err := fslink.ReadLink(sub, "dir/file"); !errors.Is(err, fs.ErrInvalid) && !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading a file which is not a link must fail: %v", err)
+	}
+
+	// Links traversed by paths are resolved relative to the root of the sub
+	// file system, absolute links are refused.
+	b, err := fs.ReadFile(sub, "reldir/file")
+	if err != nil {
+		t.Error(err)
+	} else if string(b) != "data" {
+		t.Errorf("wrong content: %q", b)
+	}
+	if _, err := fs.ReadFile(sub, "absdir/file"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("reading through an absolute link must fail with fs.ErrInvalid: %v", err)
+	}
+}
+
+func entryNames(entries []fs.DirEntry) []string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names
+}
+
+func TestLayerFSRootOpaqueWhiteout(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	lower := &countOpenFS{MapFS: fstest.MapFS{
+		"a":      dir(),
+		"a/file": file("lower"),
+		"b":      file("lower"),
+		"x":      dir(),
+		"x/old":  file("lower"),
+	}}
+	middle := fstest.MapFS{
+		".wh..wh..opq": file(""),
+		"c":            file("middle"),
+		"x":            dir(),
+		"x/new":        file("middle"),
+	}
+	upper := fstest.MapFS{
+		"d":                file("upper"),
+		"x":                dir(),
+		"x/.wh..wh..opq":   file(""),
+		"x/newer":          file("upper"),
+		"x/y":              dir(),
+		"x/y/.wh..wh..opq": file(""),
+	}
+
+	layers := ocifs.LayerFS(lower, middle, upper)
+	expect := fstest.MapFS{
+		"c":       file("middle"),
+		"d":       file("upper"),
+		"x":       dir(),
+		"x/newer": file("upper"),
+		"x/y":     dir(),
+	}
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "a/file", "b", "x/old", "x/new"} {
+		if _, err := fs.Stat(layers, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected fs.ErrNotExist, got %v", name, err)
+		}
+	}
+
+	lower.opens = 0
+	f, err := layers.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if lower.opens != 0 {
+		t.Errorf("opening the root directory must not open layers masked by an opaque whiteout: opens=%d", lower.opens)
+	}
+}
+
+func TestLayerFSWhiteoutsNotAccessible(t *testing.T) {
+	file := &fstest.MapFile{Mode: 0444}
+	layers := ocifs.LayerFS(
+		fstest.MapFS{
+			"a/foo":   file,
+			"a/bar/x": file,
+		},
+		fstest.MapFS{
+			".wh..wh..opq":   file,
+			"a/.wh.foo":      file,
+			"a/.wh.bar":      &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+			"a/.wh.bar/x":    file,
+			"a/.wh..wh..opq": file,
+		},
+	)
+
+	for _, name := range []string{
+		".wh..wh..opq",
+		"a/.wh.foo",
+		"a/.wh.bar",
+		"a/.wh.bar/x",
+		"a/.wh..wh..opq",
+	} {
+		if _, err := layers.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("open %s: expected fs.ErrNotExist, got %v", name, err)
+		}
+		if _, err := fs.Stat(layers, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stat %s: expected fs.ErrNotExist, got %v", name, err)
+		}
+		if _, err := layers.(fslink.ReadLinkFS).ReadLink(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("readlink %s: expected fs.ErrNotExist, got %v", name, err)
+		}
+	}
+}
+
+func TestLayerFSOpaqueWhiteoutSiblings(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	layers := ocifs.LayerFS(
+		fstest.MapFS{
+			"a":        &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+			"a/b":      &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+			"a/b/file": file("lower"),
+			"a/x":      &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+			"a/x/old":  file("lower"),
+		},
+		fstest.MapFS{
+			"a/x":              &fstest.MapFile{Mode: 0500 | fs.ModeDir},
+			"a/x/.wh..wh..opq": file(""),
+			"a/x/new":          file("upper"),
+		},
+	)
+
+	expect := fstest.MapFS{
+		"a":        &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"a/b":      &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"a/b/file": file("lower"),
+		"a/x":      &fstest.MapFile{Mode: 0500 | fs.ModeDir},
+		"a/x/new":  file("upper"),
+	}
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := fs.Stat(layers, "a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Mode() != 0500|fs.ModeDir {
+		t.Errorf("a/x: directory must have the metadata of the layer with the opaque marker: %v", s.Mode())
+	}
+	if _, err := fs.Stat(layers, "a/x/old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a/x/old: expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+// statErrorFS opens files which fail to report their information.
+type statErrorFS struct{ fsys fs.FS }
+
+func (f statErrorFS) Open(name string) (fs.File, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return statErrorFile{file}, nil
+}
+
+type statErrorFile struct{ fs.File }
+
+func (statErrorFile) Stat() (fs.FileInfo, error) { return nil, errors.New("no stat") }
+
+func TestLayerFSOpenOnlyLayers(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+	dir := &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+
+	layers := ocifs.LayerFS(
+		openOnlyFS{fstest.MapFS{"a": dir, "a/one": file("1"), "a/two": file("2")}},
+		openOnlyFS{fstest.MapFS{"a": dir, "a/.wh.one": file(""), "a/three": file("3")}},
+	)
+	expect := fstest.MapFS{"a": dir, "a/two": file("2"), "a/three": file("3")}
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := fs.Stat(ocifs.LayerFS(statErrorFS{fstest.MapFS{"a": dir}}), "a")
+	if err == nil || !strings.Contains(err.Error(), "layer 0") {
+		t.Errorf("the error must indicate which layer failed: %v", err)
+	}
+}
+
+func TestLayerFSInvalidLayers(t *testing.T) {
+	layer := fstest.MapFS{"file": &fstest.MapFile{Mode: 0444}}
+
+	fsys := ocifs.LayerFSWithOptions([]fs.FS{layer, layer, layer}, ocifs.WithMaxLayers(2))
+	if _, err := fsys.Open("file"); !errors.Is(err, ocifs.ErrTooManyLayers) {
+		t.Errorf("expected ocifs.ErrTooManyLayers, got %v", err)
+	}
+	fsys = ocifs.LayerFSWithOptions([]fs.FS{layer, layer}, ocifs.WithMaxLayers(2))
+	if _, err := fs.Stat(fsys, "file"); err != nil {
+		t.Error(err)
+	}
+
+	fsys = ocifs.LayerFS(layer, nil, layer)
+	_, err := fs.Stat(fsys, "file")
+	if !errors.Is(err, fs.ErrInvalid) || !strings.Contains(err.Error(), "layer 1") {
+		t.Errorf("the error must indicate which layer is nil: %v", err)
+	}
+}
+
+func TestLayerFSOpenFile(t *testing.T) {
+	type openFileFS interface {
+		OpenFile(string, int, fs.FileMode) (fs.File, error)
+	}
+	layers := ocifs.LayerFS(fstest.MapFS{"file": &fstest.MapFile{Mode: 0644, Data: []byte("hello")}})
+
+	f, err := layers.(openFileFS).OpenFile("file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, flag := range []int{
+		os.O_WRONLY,
+		os.O_RDWR,
+		os.O_RDONLY | os.O_CREATE,
+		os.O_RDONLY | os.O_TRUNC,
+		os.O_WRONLY | os.O_APPEND,
+	} {
+		_, err := layers.(openFileFS).OpenFile("file", flag, 0644)
+		if !errors.Is(err, fs.ErrPermission) || !errors.Is(err, syscall.EROFS) {
+			t.Errorf("flag %#x: expected an error wrapping fs.ErrPermission and syscall.EROFS, got %v", flag, err)
+		}
+	}
+
+	_, err = layers.(openFileFS).OpenFile("file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil || !strings.Contains(err.Error(), "O_WRONLY|O_CREATE|O_TRUNC") {
+		t.Errorf("the error must contain the requested flags: %v", err)
+	}
+}
+
+func TestLayerFSWithLogger(t *testing.T) {
+	file := &fstest.MapFile{Mode: 0444}
+	lower := fstest.MapFS{"a/file": file, "a/old": file}
+	upper := fstest.MapFS{"a/file": file, "a/.wh.old": file}
+
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	layers := ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithLogger(logger))
+
+	if _, err := fs.Stat(layers, "a/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(layers, "a/old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	type record struct {
+		Op        string `json:"op"`
+		Path      string `json:"path"`
+		Layers    int    `json:"layers"`
+		Whiteouts int    `json:"whiteouts"`
+		Top       *int   `json:"top"`
+	}
+	var records []record
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+
+	one := 1
+	expect := []record{
+		{Op: "stat", Path: "a/file", Layers: 1, Whiteouts: 0, Top: &one},
+		{Op: "stat", Path: "a/old", Layers: 0, Whiteouts: 1},
+	}
+	if !reflect.DeepEqual(records, expect) {
+		t.Errorf("wrong log records:\nwant=%+v\ngot= %+v", expect, records)
+	}
+
+	// Nothing is logged when the debug level is not enabled.
+	buf.Reset()
+	logger = slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	layers = ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithLogger(logger))
+	if _, err := fs.Stat(layers, "a/file"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log records: %s", buf)
+	}
+}
+
+func TestLayerFSUnsupportedHandler(t *testing.T) {
+	layer := fstest.MapFS{
+		"run":          &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"run/app.sock": &fstest.MapFile{Mode: 0666 | fs.ModeSocket},
+		"run/app.pid":  &fstest.MapFile{Mode: 0444, Data: []byte("42")},
+	}
+
+	type unsupported struct {
+		name string
+		mode fs.FileMode
+	}
+	var found []unsupported
+
+	fsys := ocifs.LayerFSWithOptions([]fs.FS{layer},
+		ocifs.WithUnsupportedHandler(func(name string, mode fs.FileMode) {
+			found = append(found, unsupported{name, mode})
+		}),
+	)
+
+	entries, err := fs.ReadDir(fsys, "run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("unsupported entries must remain visible: %d entries", len(entries))
+	}
+
+	f, err := fsys.Open("run/app.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if len(found) != 2 {
+		t.Fatalf("handler must be invoked when listing and opening: %+v", found)
+	}
+	for _, u := range found {
+		if u.name != "run/app.sock" || u.mode != fs.ModeSocket {
+			t.Errorf("wrong unsupported entry: %+v", u)
+		}
+	}
+}
+
+func TestLayerFSDirectoryWithOwnWhiteout(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer1 := fstest.MapFS{
+		"a":       dir(),
+		"a/x":     dir(),
+		"a/x/old": file("old"),
+		"a/y":     file("y"),
+	}
+
+	// The layer contains both the directory a/x and a whiteout for it: the
+	// directory replaces a/x at this level, masking a/x from lower layers.
+	layer2 := fstest.MapFS{
+		"a":       dir(),
+		"a/.wh.x": file(""),
+		"a/x":     dir(),
+		"a/x/new": file("new"),
+	}
+
+	expect := fstest.MapFS{
+		"a":       dir(),
+		"a/x":     dir(),
+		"a/x/new": file("new"),
+		"a/y":     file("y"),
+	}
+
+	layers := ocifs.LayerFS(layer1, layer2)
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(layers, "a/x/old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a/x/old must be masked by the whiteout: %v", err)
+	}
+	if err := fstest.TestFS(layers, "a", "a/x", "a/x/new", "a/y"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayerFSWhiteoutMetadata(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer1 := fstest.MapFS{
+		"a":   dir(),
+		"a/x": file("x"),
+	}
+
+	layer2 := fstest.MapFS{
+		".wh..wh.aufs":        file(""),
+		".wh..wh.orph":        dir(),
+		".wh..wh.orph/file":   file("orphan"),
+		".wh..wh.plnk":        dir(),
+		".wh..wh.plnk/1234.5": file("link"),
+		"a":                   dir(),
+		"a/.wh..wh.plnk":      dir(),
+		"a/y":                 file("y"),
+	}
+
+	expect := fstest.MapFS{
+		"a":   dir(),
+		"a/x": file("x"),
+		"a/y": file("y"),
+	}
+
+	layers := ocifs.LayerFS(layer1, layer2)
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		".wh..wh.aufs",
+		".wh..wh.orph",
+		".wh..wh.orph/file",
+		".wh..wh.plnk",
+		".wh..wh.plnk/1234.5",
+		"a/.wh..wh.plnk",
+	} {
+		if _, err := layers.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: aufs metadata must not be openable: %v", name, err)
+		}
+	}
+}
+
+// countOpenFS counts the calls to Open on the file system it wraps, while
+// still exposing fs.StatFS.
+type countOpenFS struct {
+	fstest.MapFS
+	opens int
+}
+
+func (f *countOpenFS) Open(name string) (fs.File, error) {
+	f.opens++
+	return f.MapFS.Open(name)
+}
+
+func (f *countOpenFS) Stat(name string) (fs.FileInfo, error) {
+	return f.MapFS.Stat(name)
+}
+
+func TestLayerFSErrorOps(t *testing.T) {
+	lower := fstest.MapFS{
+		"dir/file": &fstest.MapFile{Mode: 0644, Data: []byte("hello")},
+	}
+	upper := fstest.MapFS{
+		"dir/.wh.file": &fstest.MapFile{Mode: 0644},
+	}
+
+	type layeredFS interface {
+		fs.StatFS
+		fs.ReadFileFS
+		fs.SubFS
+		fslink.ReadLinkFS
+		ocifs.ContextFS
+		ocifs.ReadDirContextFS
+		Lstat(string) (fs.FileInfo, error)
+	}
+
+	tests := []struct {
+		op   string
+		call func(fsys layeredFS, name string) error
+	}{
+		{"open", func(fsys layeredFS, name string) error { _, err := fsys.Open(name); return err }},
+		{"open", func(fsys layeredFS, name string) error {
+			_, err := fsys.OpenCtx(context.Background(), name)
+			return err
+		}},
+		{"stat", func(fsys layeredFS, name string) error { _, err := fsys.Stat(name); return err }},
+		{"read", func(fsys layeredFS, name string) error { _, err := fsys.ReadFile(name); return err }},
+		{"readdir", func(fsys layeredFS, name string) error {
+			_, err := fsys.ReadDirCtx(context.Background(), name)
+			return err
+		}},
+		{"sub", func(fsys layeredFS, name string) error { _, err := fsys.Sub(name); return err }},
+		{"lstat", func(fsys layeredFS, name string) error { _, err := fsys.Lstat(name); return err }},
+		{"readlink", func(fsys layeredFS, name string) error { _, err := fsys.ReadLink(name); return err }},
+	}
+
+	layers := map[string]fs.FS{
+		"default":        ocifs.LayerFS(lower, upper),
+		"lookup cache":   ocifs.LayerFSWithOptions([]fs.FS{lower, upper}, ocifs.WithLookupCache()),
+		"invalid layers": ocifs.LayerFS(lower, nil),
+	}
+
+	for scenario, fsys := range layers {
+		t.Run(scenario, func(t *testing.T) {
+			for _, name := range []string{"dir/file", "dir/missing", "../dir"} {
+				// The operations are repeated to verify that they do not
+				// report the operation of a cached lookup.
+				for i := 0; i < 2; i++ {
+					for _, test := range tests {
+						err := test.call(fsys.(layeredFS), name)
+						var e *fs.PathError
+						if !errors.As(err, &e) {
+							t.Errorf("%s %s: expected *fs.PathError, got %v", test.op, name, err)
+						} else if e.Op != test.op || e.Path != name {
+							t.Errorf("%s %s: wrong error: %v", test.op, name, err)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLayerFSStat(t *testing.T) {
+	lower := &countOpenFS{MapFS: fstest.MapFS{
+		"a":      &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"a/file": &fstest.MapFile{Mode: 0644, Data: []byte("lower")},
+	}}
+	upper := &countOpenFS{MapFS: fstest.MapFS{
+		"a":      &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"a/file": &fstest.MapFile{Mode: 0600, Data: []byte("upper layer")},
+	}}
+
+	layers := ocifs.LayerFS(lower, upper)
+	s, err := fs.Stat(layers, "a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != int64(len("upper layer")) {
+		t.Errorf("wrong size: want=%d got=%d", len("upper layer"), s.Size())
+	}
+	if s.Mode() != 0400 {
+		t.Errorf("wrong mode: want=%v got=%v", fs.FileMode(0400), s.Mode())
+	}
+	if lower.opens != 0 || upper.opens != 0 {
+		t.Errorf("stat must not open files: lower=%d upper=%d", lower.opens, upper.opens)
+	}
+
+	if _, err := fs.Stat(layers, "a/nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of missing file must fail with fs.ErrNotExist: %v", err)
+	}
+}
+
+func TestLayerFSReadFile(t *testing.T) {
+	lower := &countOpenFS{MapFS: fstest.MapFS{
+		"a":      &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"a/file": &fstest.MapFile{Mode: 0644, Data: []byte("lower")},
+		"a/old":  &fstest.MapFile{Mode: 0644, Data: []byte("old")},
+	}}
+	upper := &countOpenFS{MapFS: fstest.MapFS{
+		"a":         &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"a/file":    &fstest.MapFile{Mode: 0644, Data: []byte("upper")},
+		"a/.wh.old": &fstest.MapFile{Mode: 0644},
+	}}
+
+	layers := ocifs.LayerFS(lower, upper)
+	b, err := fs.ReadFile(layers, "a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "upper" {
+		t.Errorf("wrong file content: %q", b)
+	}
+	if lower.opens != 0 {
+		t.Errorf("reading a file must not open the lower layers: opens=%d", lower.opens)
+	}
+
+	if _, err := fs.ReadFile(layers, "a/old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading a file masked by a whiteout must fail with fs.ErrNotExist: %v", err)
+	}
+}
+
+func TestLayerFSOpenTopLayerOnly(t *testing.T) {
+	dir := &fstest.MapFile{Mode: 0755 | fs.ModeDir}
+	newLayer := func(data string) *countOpenFS {
+		return &countOpenFS{MapFS: fstest.MapFS{
+			"a":      dir,
+			"a/file": &fstest.MapFile{Mode: 0644, Data: []byte(data)},
+		}}
+	}
+	layer1, layer2, layer3 := newLayer("1"), newLayer("2"), newLayer("3")
+	layers := ocifs.LayerFS(layer1, layer2, layer3)
+
+	f, err := layers.Open("a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if layer1.opens != 0 || layer2.opens != 0 || layer3.opens != 1 {
+		t.Errorf("opening a file must only open the top layer: opens=[%d %d %d]", layer1.opens, layer2.opens, layer3.opens)
+	}
+
+	d, err := layers.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if layer1.opens != 1 || layer2.opens != 1 || layer3.opens != 2 {
+		t.Errorf("opening a directory must open all the layers: opens=[%d %d %d]", layer1.opens, layer2.opens, layer3.opens)
+	}
+}
+
+type closeErrorFS struct {
+	fstest.MapFS
+	err error
+}
+
+func (f closeErrorFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return closeErrorFile{file, f.err}, nil
+}
+
+type closeErrorFile struct {
+	fs.File
+	err error
+}
+
+func (f closeErrorFile) Close() error {
+	f.File.Close()
+	return f.err
+}
+
+func TestLayerFSCloseErrors(t *testing.T) {
+	dir := &fstest.MapFile{Mode: 0755 | fs.ModeDir}
+	errLower := errors.New("lower")
+	errUpper := errors.New("upper")
+
+	layers := ocifs.LayerFS(
+		closeErrorFS{fstest.MapFS{"a": dir}, errLower},
+		fstest.MapFS{"a": dir},
+		closeErrorFS{fstest.MapFS{"a": dir}, errUpper},
+	)
+
+	f, err := layers.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if !errors.Is(err, errLower) || !errors.Is(err, errUpper) {
+		t.Errorf("close must report the errors of all layers: %v", err)
+	}
+}
+
+// seekOnlyFS hides the io.ReaderAt implementation of the files it opens.
+type seekOnlyFS struct{ fstest.MapFS }
+
+func (f seekOnlyFS) Open(name string) (fs.File, error) {
+	file, err := f.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return seekOnlyFile{file, file.(io.Seeker)}, nil
+}
+
+type seekOnlyFile struct {
+	fs.File
+	seeker io.Seeker
+}
+
+func (f seekOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	return f.seeker.Seek(offset, whence)
+}
+
+func TestLayerFSReadAtWithSeeker(t *testing.T) {
+	layer := seekOnlyFS{fstest.MapFS{
+		"file": &fstest.MapFile{Mode: 0644, Data: []byte("0123456789")},
+	}}
+
+	// The emulation of ReadAt does not depend on the wrapper installed by
+	// WithConsistentReads.
+	for _, options := range [][]ocifs.Option{nil, {ocifs.WithConsistentReads()}} {
+		f, err := ocifs.LayerFSWithOptions([]fs.FS{layer}, options...).Open("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(f, b); err != nil {
+			t.Fatal(err)
+		}
+
+		r := f.(io.ReaderAt)
+		n, err := r.ReadAt(b, 6)
+		if err != nil || string(b[:n]) != "6789" {
+			t.Errorf("wrong ReadAt result: n=%d err=%v data=%q", n, err, b[:n])
+		}
+		n, err = r.ReadAt(b, 8)
+		if err != io.EOF || string(b[:n]) != "89" {
+			t.Errorf("wrong ReadAt result at the end of the file: n=%d err=%v data=%q", n, err, b[:n])
+		}
+
+		// The position of the file must not have been changed by ReadAt.
+		rest, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != "456789" {
+			t.Errorf("wrong content after ReadAt: %q", rest)
+		}
+	}
+}
+
+func TestLayerFSWriteTo(t *testing.T) {
+	data := []byte("0123456789")
+	for _, layer := range []fs.FS{
+		fstest.MapFS{"file": &fstest.MapFile{Mode: 0644, Data: data}},
+		seekOnlyFS{fstest.MapFS{"file": &fstest.MapFile{Mode: 0644, Data: data}}},
+	} {
+		f, err := ocifs.LayerFS(layer).Open("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(f, b); err != nil {
+			t.Fatal(err)
+		}
+		w := new(bytes.Buffer)
+		n, err := f.(io.WriterTo).WriteTo(w)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 7 || w.String() != "3456789" {
+			t.Errorf("wrong content written: n=%d data=%q", n, w.String())
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	lower := fstest.MapFS{"file": &fstest.MapFile{Mode: 0644, Data: []byte("lower")}}
+	upper := fstest.MapFS{"file": &fstest.MapFile{Mode: 0644, Data: []byte("upper layer")}}
+
+	for _, fsys := range []fs.FS{
+		ocifs.LayerFS(lower, upper),
+		ocifs.LayerFS(lower, openOnlyFS{upper}),
+		openOnlyFS{ocifs.LayerFS(lower, upper)},
+	} {
+		b, err := ocifs.ReadFile(fsys, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "upper layer" {
+			t.Errorf("wrong file content: %q", b)
+		}
+	}
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	const numLayers, numFiles = 5, 1000
+
+	layers := make([]fs.FS, numLayers)
+	names := make([]string, 0, numFiles)
+	for i := range layers {
+		headers := []*tar.Header{tarDir("etc/")}
+		for j := 0; j < numFiles/numLayers; j++ {
+			name := fmt.Sprintf("etc/%d-%d.conf", i, j)
+			headers = append(headers, tarFile(name, "key=value\n"))
+			names = append(names, name)
+		}
+		layers[i] = tarFS(b, headers...)
+	}
+
+	benchmarks := []struct {
+		name     string
+		fsys     fs.FS
+		readFile func(fs.FS, string) ([]byte, error)
+	}{
+		{"fs.ReadFile", openOnlyFS{ocifs.LayerFS(layers...)}, fs.ReadFile},
+		{"ocifs.ReadFile", ocifs.LayerFS(layers...), ocifs.ReadFile},
+		{"ocifs.ReadFile+cache", ocifs.LayerFSWithOptions(layers, ocifs.WithLookupCache()), ocifs.ReadFile},
+	}
+
+	for _, bench := range benchmarks {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, name := range names {
+					if _, err := bench.readFile(bench.fsys, name); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	base := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+	upper := tarFS(t,
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+	)
+
+	for _, test := range []struct {
+		scenario string
+		fsys     fs.FS
+		name     string
+		data     string
+	}{
+		{scenario: "top layer", fsys: ocifs.LayerFS(base, upper), name: "etc/hosts", data: "127.0.0.1 localhost"},
+		{scenario: "lower layer", fsys: ocifs.LayerFS(base, upper), name: "etc/passwd", data: "root:x:0:0"},
+		{scenario: "consistent reads", fsys: ocifs.LayerFSWithOptions([]fs.FS{base, upper}, ocifs.WithConsistentReads()), name: "etc/hosts", data: "127.0.0.1 localhost"},
+		{scenario: "single layer", fsys: base, name: "etc/hosts", data: "localhost"},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			r, size, err := ocifs.OpenReaderAt(test.fsys, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.(io.Closer).Close()
+
+			if size != int64(len(test.data)) {
+				t.Errorf("wrong size: want=%d got=%d", len(test.data), size)
+			}
+			b, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.data {
+				t.Errorf("wrong content: want=%q got=%q", test.data, b)
+			}
+		})
+	}
+
+	seekOnly := seekOnlyFS{fstest.MapFS{
+		"file": &fstest.MapFile{Mode: 0644, Data: []byte("0123456789")},
+	}}
+	for _, fsys := range []fs.FS{seekOnly, ocifs.LayerFS(seekOnly)} {
+		if _, _, err := ocifs.OpenReaderAt(fsys, "file"); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("opening a file without random access must fail with fs.ErrInvalid: %v", err)
+		}
+	}
+	if _, _, err := ocifs.OpenReaderAt(ocifs.LayerFS(base, upper), "etc"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("opening a directory must fail with fs.ErrInvalid: %v", err)
+	}
+	if _, _, err := ocifs.OpenReaderAt(ocifs.LayerFS(base, upper), "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a missing file must fail with fs.ErrNotExist: %v", err)
+	}
+}
+
+func TestLayerFSGlob(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer1 := fstest.MapFS{
+		"etc":               dir(),
+		"etc/host.conf":     file("1"),
+		"etc/nsswitch.conf": file("1"),
+		"etc/resolv.conf":   file("1"),
+		"opt":               dir(),
+		"opt/a":             dir(),
+		"opt/a/app.conf":    file("1"),
+		"opt/b":             dir(),
+		"opt/b/app.conf":    file("1"),
+	}
+
+	layer2 := fstest.MapFS{
+		"etc":                   dir(),
+		"etc/.wh.resolv.conf":   file(""), // masks etc/resolv.conf in layer1
+		"etc/host.conf":         file("2"),
+		"etc/ld.so.conf":        file("2"),
+		"opt":                   dir(),
+		"opt/.wh.b":             file(""), // masks opt/b in layer1
+		"opt/c":                 dir(),
+		"opt/c/app.conf":        file("2"),
+		"opt/c/app.conf.ignore": file("2"),
+	}
+
+	layers := ocifs.LayerFS(layer1, layer2)
+
+	tests := []struct {
+		pattern string
+		matches []string
+	}{
+		{"etc/*.conf", []string{"etc/host.conf", "etc/ld.so.conf", "etc/nsswitch.conf"}},
+		{"etc/resolv.conf", nil},
+		{"etc/host.conf", []string{"etc/host.conf"}},
+		{"*/*/app.conf", []string{"opt/a/app.conf", "opt/c/app.conf"}},
+		{"opt/[ab]/*", []string{"opt/a/app.conf"}},
+		{"etc/.wh.*", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			matches, err := fs.Glob(layers, test.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(matches, test.matches) {
+				t.Errorf("wrong matches: want=%q got=%q", test.matches, matches)
+			}
+		})
+	}
+
+	if _, err := fs.Glob(layers, "etc/[*.conf"); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("malformed patterns must fail with path.ErrBadPattern: %v", err)
+	}
+}
+
+func TestLayerFSCharDeviceWhiteouts(t *testing.T) {
+	whiteout := func(name string) *tar.Header {
+		return &tar.Header{Typeflag: tar.TypeChar, Name: name, Mode: 0600}
+	}
+
+	layer1 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("var/"),
+		tarFile("var/log", "?"),
+	)
+
+	layer2 := tarFS(t,
+		tarDir("etc/"),
+		whiteout("etc/passwd"),
+		whiteout("var"),
+		// Devices other than 0/0 are not whiteouts.
+		&tar.Header{Typeflag: tar.TypeChar, Name: "etc/hosts", Mode: 0600, Devmajor: 1, Devminor: 3},
+	)
+
+	expect := fstest.MapFS{
+		"etc":       &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"etc/hosts": &fstest.MapFile{Mode: 0400 | fs.ModeDevice | fs.ModeCharDevice},
+	}
+
+	layers := ocifs.LayerFSWithOptions([]fs.FS{layer1, layer2}, ocifs.WithCharDeviceWhiteouts())
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"etc/passwd", "var", "var/log"} {
+		if _, err := fs.Stat(layers, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: stat of a file masked by a whiteout must fail with fs.ErrNotExist: %v", name, err)
+		}
+	}
+
+	// Without the option, the character devices are regular entries of the
+	// layers and do not mask the files below.
+	if _, err := fs.Stat(ocifs.LayerFS(layer1, layer2), "var"); err != nil {
+		t.Errorf("character devices must not be whiteouts by default: %v", err)
+	}
+}
+
+func TestLayerFSWithWhiteout(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer1 := fstest.MapFS{
+		"a":       dir(),
+		"a/one":   file("1"),
+		"a/two":   file("2"),
+		"b":       dir(),
+		"b/three": file("3"),
+	}
+
+	layer2 := fstest.MapFS{
+		"a":          dir(),
+		"a/_del_one": file(""), // masks a/one in layer1
+		"a/.wh.two":  file(""), // not a whiteout with the custom convention
+		"b":          dir(),
+		"b/_opaque_": file(""), // masks everything in b/*
+		"b/four":     file("4"),
+	}
+
+	expect := fstest.MapFS{
+		"a":         dir(),
+		"a/.wh.two": file(""),
+		"a/two":     file("2"),
+		"b":         dir(),
+		"b/four":    file("4"),
+	}
+
+	layers := ocifs.LayerFSWithOptions([]fs.FS{layer1, layer2}, ocifs.WithWhiteout("_del_", "_opaque_"))
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/one", "b/three", "b/_opaque_"} {
+		if _, err := fs.Stat(layers, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: stat must fail with fs.ErrNotExist: %v", name, err)
+		}
+	}
+
+	// The default convention is the one of the OCI specification.
+	defaults := ocifs.LayerFSWithOptions([]fs.FS{layer1, layer2}, ocifs.WithWhiteout("", ""))
+	if _, err := fs.Stat(defaults, "a/two"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the default whiteout prefix must be .wh.: %v", err)
+	}
+}
+
+func TestLayerFSIntermediateSymlinks(t *testing.T) {
+	layer1 := tarFS(t,
+		tarDir("usr/"),
+		tarDir("usr/lib/"),
+		tarFile("usr/lib/libc.so", "libc"),
+		tarSymlink("lib", "usr/lib"),
+		tarDir("etc/"),
+		tarSymlink("etc/alternatives", "../usr/lib"),
+		tarSymlink("etc/escape", "../../../usr"),
+		tarSymlink("loop", "loop"),
+	)
+
+	layer2 := tarFS(t,
+		tarDir("usr/"),
+		tarDir("usr/lib/"),
+		tarFile("usr/lib/libm.so", "libm"),
+		tarFile("usr/lib/.wh.libc.so", ""),
+		tarSymlink("opt", "usr"),
+		tarSymlink("srv", "/usr"),
+	)
+
+	layers := ocifs.LayerFS(layer1, layer2)
+
+	for name, data := range map[string]string{
+		"lib/libm.so":              "libm",
+		"etc/alternatives/libm.so": "libm",
+		"opt/lib/libm.so":          "libm",
+	} {
+		b, err := fs.ReadFile(layers, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(b) != data {
+			t.Errorf("%s: wrong file content: want=%q got=%q", name, data, b)
+		}
+	}
+
+	// The symbolic links are resolved in the merged view, so whiteouts of the
+	// upper layers apply to the targets.
+	for _, name := range []string{"lib/libc.so", "opt/lib/libc.so"} {
+		if _, err := fs.Stat(layers, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: stat of a file masked by a whiteout must fail with fs.ErrNotExist: %v", name, err)
+		}
+	}
+
+	entries, err := fs.ReadDir(layers, "opt/lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "libm.so" {
+		t.Errorf("wrong entries listed through a symbolic link: %v", entries)
+	}
+
+	// Targets which are absolute or escape the root are rejected instead of
+	// resolving them relative to the root.
+	for _, name := range []string{"etc/escape/lib/libm.so", "srv/lib/libm.so"} {
+		if _, err := fs.ReadFile(layers, name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%s: resolving a symbolic link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+		}
+	}
+
+	if _, err := fs.Stat(layers, "loop/file"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("resolving a symbolic link cycle must fail with ELOOP: %v", err)
+	}
+}
+
+// TestLayerFSShadowing verifies that files replacing directories of the lower
+// layers, and directories replacing files, shadow the lower layers the same way
+// as when the layers are extracted on top of each other: the type of the top
+// most layer wins, and the content of lower directories is only visible
+// through upper layers which are directories too.
+func TestLayerFSShadowing(t *testing.T) {
+	type layers struct {
+		name string
+		fsys func(t *testing.T) fs.FS
+	}
+	for _, test := range []layers{
+		{
+			name: "tar",
+			fsys: func(t *testing.T) fs.FS {
+				return ocifs.LayerFS(
+					tarFS(t,
+						tarFile("opt/app", "app"),
+						tarFile("opt/conf", "conf"),
+						tarFile("data/old/x", "x"),
+					),
+					tarFS(t,
+						tarFile("data", "file"),
+					),
+					tarFS(t,
+						tarFile("opt", "file"),
+						tarFile("data/new", "new"),
+					),
+				)
+			},
+		},
+		{
+			name: "dir",
+			fsys: func(t *testing.T) fs.FS {
+				return ocifs.LayerFS(
+					ocifs.DirFS(extract(t, map[string]string{
+						"opt/app":    "app",
+						"opt/conf":   "conf",
+						"data/old/x": "x",
+					})),
+					ocifs.DirFS(extract(t, map[string]string{
+						"data": "file",
+					})),
+					ocifs.DirFS(extract(t, map[string]string{
+						"opt":      "file",
+						"data/new": "new",
+					})),
+				)
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fsys := test.fsys(t)
+
+			entries, err := fs.ReadDir(fsys, ".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := map[string]bool{}
+			for _, entry := range entries {
+				types[entry.Name()] = entry.IsDir()
+			}
+			if want := map[string]bool{"data": true, "opt": false}; !reflect.DeepEqual(types, want) {
+				t.Errorf("wrong root entries: want=%v got=%v", want, types)
+			}
+
+			// (a) The file of the upper layer wins over the directory of the
+			// lower layer, the content of the directory vanishes.
+			b, err := fs.ReadFile(fsys, "opt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "file" {
+				t.Errorf("wrong content of the file replacing a directory: %q", b)
+			}
+			for _, name := range []string{"opt/app", "opt/conf"} {
+				if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("stat %s: expected fs.ErrNotExist, got %v", name, err)
+				}
+				if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("open %s: expected fs.ErrNotExist, got %v", name, err)
+				}
+			}
+			if _, err := fs.ReadDir(fsys, "opt"); err == nil {
+				t.Error("reading a file replacing a directory as a directory must fail")
+			}
+
+			// (b) The directory of the upper layer wins over the file of the
+			// lower layer, which also shadows the directory below it; the
+			// children only come from the upper directory.
+			info, err := fs.Stat(fsys, "data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.IsDir() {
+				t.Errorf("the directory replacing a file must be a directory: %v", info.Mode())
+			}
+			entries, err = fs.ReadDir(fsys, "data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := entryNames(entries); !reflect.DeepEqual(names, []string{"new"}) {
+				t.Errorf("wrong entries of the directory replacing a file: %q", names)
+			}
+			for _, name := range []string{"data/old", "data/old/x"} {
+				if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("stat %s: expected fs.ErrNotExist, got %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+// noRootFS is a layer which cannot open its root directory, like file systems
+// where the root is only implied by the paths of files.
+type noRootFS struct{ fs.FS }
+
+func (fsys noRootFS) Open(name string) (fs.File, error) {
+	if name == "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return fsys.FS.Open(name)
+}
+
+func TestLayerFSOpenRootWithoutRoot(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+	layers := ocifs.LayerFS(
+		tarFS(t,
+			tarDir("./"),
+			tarFile("etc/hosts", "localhost"),
+		),
+		noRootFS{fstest.MapFS{
+			"usr/bin/app": file("app"),
+		}},
+		fstest.MapFS{
+			"tmp/file": file("tmp"),
+		},
+		noRootFS{fstest.MapFS{
+			"var/log/app": file("log"),
+		}},
+	)
+
+	f, err := layers.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := f.(fs.ReadDirFile).ReadDir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"etc", "tmp"}) {
+		t.Errorf("wrong entries of the merged root: %q", names)
+	}
+	if info, err := f.Stat(); err != nil || !info.IsDir() {
+		t.Errorf("the merged root must be a directory: %v (%v)", info, err)
+	}
+
+	// The top layer cannot open its root, the root is still found by stat and
+	// walking the tree.
+	if info, err := fs.Stat(layers, "."); err != nil || !info.IsDir() {
+		t.Errorf("the merged root must be a directory: %v (%v)", info, err)
+	}
+	for _, walk := range []func(fs.FS, string, fs.WalkDirFunc) error{fs.WalkDir, ocifs.WalkDir} {
+		var names []string
+		err := walk(layers, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{".", "etc", "etc/hosts", "tmp", "tmp/file"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("wrong files walked from the merged root:\nwant=%q\ngot= %q", want, names)
+		}
+	}
+
+	// The files of the layers which cannot open their root are still visible.
+	for _, name := range []string{"usr/bin/app", "var/log/app"} {
+		if _, err := fs.ReadFile(layers, name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := ocifs.LayerFS(noRootFS{fstest.MapFS{}}).Open("."); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening the root of layers which cannot open it must fail with fs.ErrNotExist: %v", err)
+	}
+	if _, err := fs.Stat(ocifs.LayerFS(noRootFS{fstest.MapFS{}}), "."); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the root of layers which cannot open it must fail with fs.ErrNotExist: %v", err)
+	}
+}
+
+func TestLayerFSDirModTime(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	t2 := t0.Add(2 * time.Hour)
+	dir := func(name string, mtime time.Time) *tar.Header {
+		h := tarDir(name)
+		h.ModTime = mtime
+		return h
+	}
+	file := func(name string, mtime time.Time) *tar.Header {
+		h := tarFile(name, name)
+		h.ModTime = mtime
+		return h
+	}
+
+	layers := []fs.FS{
+		tarFS(t,
+			dir("etc/", t0),
+			file("etc/hosts", t0),
+			dir("var/", t0),
+		),
+		tarFS(t,
+			dir("etc/", t2),
+			file("etc/group", t2),
+			dir("var/", t2),
+		),
+		tarFS(t,
+			dir("etc/", t1),
+			file("etc/hosts", t1),
+		),
+	}
+
+	for _, test := range []struct {
+		scenario string
+		options  []ocifs.Option
+		mtimes   map[string]time.Time
+	}{
+		{
+			// By default, the information of directories comes from the top
+			// most layer where they exist.
+			scenario: "default",
+			mtimes:   map[string]time.Time{"etc": t1, "var": t2, "etc/hosts": t1, "etc/group": t2},
+		},
+		{
+			scenario: "merged",
+			options:  []ocifs.Option{ocifs.WithMergedDirModTime()},
+			mtimes:   map[string]time.Time{"etc": t2, "var": t2, "etc/hosts": t1, "etc/group": t2},
+		},
+	} {
+		t.Run(test.scenario, func(t *testing.T) {
+			fsys := ocifs.LayerFSWithOptions(layers, test.options...)
+
+			for name, mtime := range test.mtimes {
+				info, err := fs.Stat(fsys, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.ModTime().Equal(mtime) {
+					t.Errorf("stat %s: wrong modification time: want=%v got=%v", name, mtime, info.ModTime())
+				}
+				if sys, ok := info.Sys().(*ocifs.FileInfoSys); !ok || !sys.Mtime.Equal(mtime) {
+					t.Errorf("stat %s: wrong modification time in FileInfoSys: %+v", name, info.Sys())
+				}
+
+				f, err := fsys.Open(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				info, err = f.Stat()
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !info.ModTime().Equal(mtime) {
+					t.Errorf("open %s: wrong modification time: want=%v got=%v", name, mtime, info.ModTime())
+				}
+			}
+
+			entries, err := fs.ReadDir(fsys, ".")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				info, err := entry.Info()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mtime := test.mtimes[entry.Name()]; !info.ModTime().Equal(mtime) {
+					t.Errorf("readdir %s: wrong modification time: want=%v got=%v", entry.Name(), mtime, info.ModTime())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package ocifs
+
+import (
+	"io/fs"
+	"sync"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// lazyFS is a file system which is constructed on first use. Errors that
+// occur during the construction are returned by every method call.
+type lazyFS struct {
+	once sync.Once
+	load func() (fs.FS, error)
+	fsys fs.FS
+	err  error
+}
+
+func (fsys *lazyFS) get() (fs.FS, error) {
+	fsys.once.Do(func() {
+		fsys.fsys, fsys.err = fsys.load()
+		fsys.load = nil
+	})
+	return fsys.fsys, fsys.err
+}
+
+func (fsys *lazyFS) Open(name string) (fs.File, error) {
+	f, err := fsys.get()
+	if err != nil {
+		return nil, err
+	}
+	return f.Open(name)
+}
+
+func (fsys *lazyFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := fsys.get()
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(f, name)
+}
+
+func (fsys *lazyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := fsys.get()
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(f, name)
+}
+
+func (fsys *lazyFS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.get()
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(f, name)
+}
+
+func (fsys *lazyFS) ReadLink(name string) (string, error) {
+	f, err := fsys.get()
+	if err != nil {
+		return "", err
+	}
+	return fslink.ReadLink(f, name)
+}
+
+var (
+	_ fs.StatFS         = (*lazyFS)(nil)
+	_ fs.ReadDirFS      = (*lazyFS)(nil)
+	_ fs.ReadFileFS     = (*lazyFS)(nil)
+	_ fslink.ReadLinkFS = (*lazyFS)(nil)
+)
@@ -0,0 +1,177 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// LazyTarFS is like TarFS but the archive is not indexed when the function is
+// called. The index is built incrementally as the file system is accessed,
+// scanning the archive only until the requested file is found, and resuming
+// from there on the next access. Opening a file near the beginning of a large
+// archive therefore does not need to read the headers of the whole archive.
+//
+// Listing a directory, opening a hard link, or looking up a file which does not
+// exist requires indexing the rest of the archive. Once the archive is fully
+// indexed, the file system behaves exactly like the one returned by TarFS.
+// Errors in the archive are reported by the access which scans them, and by
+// all the following ones.
+//
+// When the archive contains multiple entries for the same path, the entry
+// which was scanned last is returned, so files may be observed in a previous
+// version until the rest of the archive was indexed. Layers produced by the
+// usual image builders do not contain such entries.
+func LazyTarFS(r io.ReaderAt, size int64) fs.FS {
+	section := io.NewSectionReader(r, 0, size)
+	fsys := newTarFS()
+	fsys.size = size
+	return &lazyTarFS{
+		fsys: fsys,
+		scanner: newTarScanner(section, func() (int64, bool) {
+			offset, err := section.Seek(0, io.SeekCurrent)
+			return offset, err == nil
+		}, r),
+		implied: map[string]struct{}{},
+	}
+}
+
+type lazyTarFS struct {
+	mutex sync.Mutex
+	fsys  *tarFS
+	// set until the archive is fully indexed
+	scanner *tarScanner
+	// directories implied by the paths of the entries scanned so far, which
+	// are synthesized by tarFS.link once the archive is fully indexed
+	implied map[string]struct{}
+	// set when indexing the archive failed, returned by all operations
+	err error
+}
+
+// entry returns the entry at name, scanning the archive until it is found. The
+// archive is fully indexed first when complete is true.
+func (fsys *lazyTarFS) entry(op, name string, complete bool) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	for fsys.scanner != nil {
+		if !complete {
+			if entry := fsys.found(name); entry != nil {
+				return entry, nil
+			}
+		}
+		if err := fsys.scan(); err != nil {
+			return nil, err
+		}
+	}
+	if fsys.err != nil {
+		return nil, fsys.err
+	}
+	return fsys.fsys.entry(op, name)
+}
+
+// found returns the entry at name if it can be used before the archive is
+// fully indexed. Hard links are resolved once the whole archive was read, and
+// the entries of directories are only known at that point as well, directory
+// entries returned by this method are only used for their metadata.
+func (fsys *lazyTarFS) found(name string) *tarEntry {
+	if entry := fsys.fsys.files[name]; entry != nil {
+		switch {
+		case entry.header.Typeflag == tar.TypeLink:
+			return nil
+		case entry.info.IsDir():
+			// Directories are updated in place by the following scans.
+			dir := *entry
+			return &dir
+		}
+		return entry
+	}
+	if _, ok := fsys.implied[name]; ok {
+		return newTarDir(name)
+	}
+	return nil
+}
+
+// scan indexes the next entry of the archive, completing the index at the end
+// of the archive.
+func (fsys *lazyTarFS) scan() error {
+	name, entry, err := fsys.scanner.next()
+	switch err {
+	case nil:
+		fsys.fsys.put(name, entry)
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			fsys.implied[dir] = struct{}{}
+		}
+		return nil
+	case io.EOF:
+		if err = fsys.fsys.resolveHardlinks(); err == nil {
+			err = fsys.fsys.link()
+		}
+	}
+	fsys.scanner, fsys.implied, fsys.err = nil, nil, err
+	return err
+}
+
+// Size returns the size of the tar archive.
+func (fsys *lazyTarFS) Size() int64 {
+	return fsys.fsys.size
+}
+
+func (fsys *lazyTarFS) Open(name string) (fs.File, error) {
+	entry, err := fsys.entry("open", name, false)
+	if err != nil {
+		return nil, err
+	}
+	if entry.info.IsDir() {
+		if entry, err = fsys.entry("open", name, true); err != nil {
+			return nil, err
+		}
+	}
+	return entry.open(), nil
+}
+
+func (fsys *lazyTarFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := fsys.entry("stat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+func (fsys *lazyTarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := fsys.entry("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return entry.readDir()
+}
+
+func (fsys *lazyTarFS) ReadFile(name string) ([]byte, error) {
+	entry, err := fsys.entry("read", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return entry.readFile()
+}
+
+func (fsys *lazyTarFS) ReadLink(name string) (string, error) {
+	entry, err := fsys.entry("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	return entry.readLink()
+}
+
+var (
+	_ fs.StatFS         = (*lazyTarFS)(nil)
+	_ fs.ReadDirFS      = (*lazyTarFS)(nil)
+	_ fs.ReadFileFS     = (*lazyTarFS)(nil)
+	_ fslink.ReadLinkFS = (*lazyTarFS)(nil)
+)
@@ -0,0 +1,124 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// offsetReaderAt records the end of the furthest read from the reader it wraps.
+type offsetReaderAt struct {
+	io.ReaderAt
+	mutex sync.Mutex
+	end   int64
+}
+
+func (r *offsetReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(b, off)
+	r.mutex.Lock()
+	r.end = max(r.end, off+int64(n))
+	r.mutex.Unlock()
+	return n, err
+}
+
+func (r *offsetReaderAt) read() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.end
+}
+
+func TestLazyTarFS(t *testing.T) {
+	headers := []*tar.Header{
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarSymlink("etc/localtime", "../usr/share/doc/000"),
+	}
+	for i := 0; i < 100; i++ {
+		headers = append(headers, tarFile(fmt.Sprintf("usr/share/doc/%03d", i), strings.Repeat("x", 1000)))
+	}
+	headers = append(headers,
+		tarFile("var/log/boot", "ok"),
+		&tar.Header{Typeflag: tar.TypeLink, Name: "var/log/hosts", Linkname: "etc/hosts"},
+	)
+	b := makeTar(t, headers...)
+
+	r := &offsetReaderAt{ReaderAt: bytes.NewReader(b)}
+	fsys := ocifs.LazyTarFS(r, int64(len(b)))
+	if n := r.read(); n != 0 {
+		t.Errorf("the archive must not be read before the file system is accessed: %d bytes read", n)
+	}
+
+	if _, err := fs.Stat(fsys, "etc/localtime"); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.read(); n == 0 || n > int64(len(b))/10 {
+		t.Errorf("looking up a file at the beginning of the archive must only read the beginning: %d/%d bytes read", n, len(b))
+	}
+	// Implied directories are found before the archive is fully indexed.
+	if info, err := fs.Stat(fsys, "usr/share"); err != nil || !info.IsDir() {
+		t.Errorf("implied directory not found: %v", err)
+	}
+	data, err := fs.ReadFile(fsys, "usr/share/doc/049")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1000 {
+		t.Errorf("wrong file size: %d", len(data))
+	}
+	if n := r.read(); n < int64(len(b))/3 || n > int64(len(b))*2/3 {
+		t.Errorf("the archive must be indexed until the file is found: %d/%d bytes read", n, len(b))
+	}
+
+	data, err = fs.ReadFile(fsys, "var/log/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "localhost" {
+		t.Errorf("wrong hard link content: %q", data)
+	}
+
+	// Once fully indexed, the file system is the same as the one returned by
+	// TarFS.
+	eager, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.EqualFS(eager, fsys); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(ocifs.LazyTarFS(bytes.NewReader(b), int64(len(b))), "etc/hosts", "usr/share/doc/099", "var/log/hosts"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Looking up a missing file indexes the whole archive.
+	r = &offsetReaderAt{ReaderAt: bytes.NewReader(b)}
+	fsys = ocifs.LazyTarFS(r, int64(len(b)))
+	if _, err := fs.Stat(fsys, "etc/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("looking up a missing file must fail with fs.ErrNotExist: %v", err)
+	}
+	if n := r.read(); n != int64(len(b)) {
+		t.Errorf("looking up a missing file must index the whole archive: %d/%d bytes read", n, len(b))
+	}
+
+	// Errors in the archive are reported by all the accesses which follow
+	// the one which scanned them.
+	invalid := b[:len(b)/2]
+	fsys = ocifs.LazyTarFS(bytes.NewReader(invalid), int64(len(invalid)))
+	if _, err := fs.Stat(fsys, "etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	_, err1 := fs.Stat(fsys, "var/log/boot")
+	_, err2 := fs.Stat(fsys, "etc/hosts")
+	if err1 == nil || err2 == nil || err1.Error() != err2.Error() {
+		t.Errorf("the error of the archive must be returned by all the following accesses: %v, %v", err1, err2)
+	}
+}
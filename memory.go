@@ -0,0 +1,417 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WithMemoryUpper configures LayerFSWithOptions and ImageFS to return a
+// writable overlay of the layers, where all modifications are held in memory
+// by an upper layer constructed with MemoryLayer. The returned file system
+// implements WritableFS, see OverlayFS for the semantics of modifications.
+//
+// The modifications are never written to the layers, they are discarded when
+// the file system is garbage collected. This is useful for tests and short
+// lived sandboxes which need to make temporary changes to an image.
+func WithMemoryUpper() Option {
+	return func(c *config) { c.memoryUpper = true }
+}
+
+// MemoryLayer returns an empty layer held in memory which can be modified,
+// typically used as the upper layer of OverlayFS when modifications do not
+// need to be persisted.
+//
+// The layer is safe to use concurrently from multiple goroutines. Files opened
+// from the layer implement io.ReaderAt and io.Seeker, and observe the writes
+// made through other files opened at the same path, like files of the local
+// file system.
+func MemoryLayer() WritableFS {
+	fsys := &memoryFS{}
+	fsys.layer.AddDir(".", 0755)
+	return fsys
+}
+
+// MemorySnapshot returns a writable view of the file system base, where all
+// modifications are held in memory by an upper layer constructed with
+// MemoryLayer, see OverlayFS for the semantics of modifications.
+//
+// Each call returns an independent view: snapshots of the same base share its
+// content, but the files they write and remove are only visible to the
+// snapshot that they were made in, and base is never modified. Constructing a
+// snapshot does not access base, so it is cheap to give each consumer of the
+// same image (e.g. each test of a test suite) its own snapshot.
+//
+// Unlike Snapshot, which indexes a file system to speed up reads, MemorySnapshot
+// does not index base: reads go through base, and nothing is copied until files
+// are modified. Use Snapshot when base is only read, MemorySnapshot when it
+// needs temporary modifications, or pass the file system returned by Snapshot
+// as base to get both.
+func MemorySnapshot(base fs.FS) WritableFS {
+	return OverlayFS(base, MemoryLayer())
+}
+
+// withMemoryUpper returns a writable overlay of fsys if it was configured with
+// WithMemoryUpper, or fsys itself otherwise.
+func (fsys *layerFS) withMemoryUpper() fs.FS {
+	if fsys.config.memoryUpper {
+		return OverlayFS(fsys, MemoryLayer())
+	}
+	return fsys
+}
+
+// memoryFS is a memory layer, its content is held by a Builder where the data
+// of regular files is modified in place by the writes to the files. Parent
+// directories are not synthesized, they must be created before their files.
+type memoryFS struct {
+	mutex sync.RWMutex
+	layer Builder
+}
+
+// lookup returns the entry at name, which must be called with the mutex held.
+func (fsys *memoryFS) lookup(op, name string) (*builderEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	entry := fsys.layer.files[name]
+	if entry == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+// lookupParent returns the directory containing name, which must be called
+// with the mutex held.
+func (fsys *memoryFS) lookupParent(op, name string) (*builderEntry, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir := fsys.layer.files[path.Dir(name)]
+	if dir == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if dir.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return dir, nil
+}
+
+// add adds a new entry at name with the builder method add, setting the
+// modification times of the entry and its parent directory.
+func (fsys *memoryFS) add(dir *builderEntry, name string, add func(string)) *builderEntry {
+	add(name)
+	entry := fsys.layer.files[name]
+	entry.header.ModTime = time.Now()
+	dir.header.ModTime = entry.header.ModTime
+	return entry
+}
+
+func (fsys *memoryFS) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fsys *memoryFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if (flag & writeFlags) == 0 {
+		fsys.mutex.RLock()
+		defer fsys.mutex.RUnlock()
+
+		entry, err := fsys.lookup("open", name)
+		if err != nil {
+			return nil, err
+		}
+		if entry.header.Typeflag == tar.TypeDir {
+			return &memoryDir{name: name, info: memoryInfo(name, entry), entries: fsys.readDir(name)}, nil
+		}
+		return &memoryLayerFile{fsys: fsys, entry: entry, name: name, flag: flag}, nil
+	}
+
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	dir, err := fsys.lookupParent("open", name)
+	if err != nil {
+		return nil, err
+	}
+	entry := fsys.layer.files[name]
+	switch {
+	case entry == nil:
+		if (flag & os.O_CREATE) == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		entry = fsys.add(dir, name, func(name string) { fsys.layer.AddFile(name, perm, nil) })
+	case (flag&os.O_CREATE) != 0 && (flag&os.O_EXCL) != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case entry.header.Typeflag == tar.TypeDir:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case (flag & os.O_TRUNC) != 0:
+		entry.data = nil
+		entry.header.ModTime = time.Now()
+	}
+	return &memoryLayerFile{fsys: fsys, entry: entry, name: name, flag: flag}, nil
+}
+
+func (fsys *memoryFS) Mkdir(name string, perm fs.FileMode) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	dir, err := fsys.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if fsys.layer.files[name] != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	fsys.add(dir, name, func(name string) { fsys.layer.AddDir(name, perm) })
+	return nil
+}
+
+func (fsys *memoryFS) Remove(name string) error {
+	fsys.mutex.Lock()
+	defer fsys.mutex.Unlock()
+
+	dir, err := fsys.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+	entry := fsys.layer.files[name]
+	if entry == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if entry.header.Typeflag == tar.TypeDir && len(fsys.readDir(name)) != 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fsys.layer.files, name)
+	dir.header.ModTime = time.Now()
+	return nil
+}
+
+func (fsys *memoryFS) Stat(name string) (fs.FileInfo, error) {
+	fsys.mutex.RLock()
+	defer fsys.mutex.RUnlock()
+
+	entry, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return memoryInfo(name, entry), nil
+}
+
+func (fsys *memoryFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.mutex.RLock()
+	defer fsys.mutex.RUnlock()
+
+	entry, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return fsys.readDir(name), nil
+}
+
+func (fsys *memoryFS) ReadFile(name string) ([]byte, error) {
+	fsys.mutex.RLock()
+	defer fsys.mutex.RUnlock()
+
+	entry, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.header.Typeflag == tar.TypeDir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte{}, entry.data...), nil
+}
+
+// readDir returns the entries of the directory at name in lexical order, which
+// must be called with the mutex held.
+func (fsys *memoryFS) readDir(name string) []fs.DirEntry {
+	var entries []fs.DirEntry
+	for childName, child := range fsys.layer.files {
+		if childName != "." && path.Dir(childName) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memoryInfo(childName, child)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+// memoryInfo returns the information of the entry at name, which must be
+// called with the mutex held since the size changes with writes.
+func memoryInfo(name string, entry *builderEntry) fs.FileInfo {
+	header := entry.header
+	header.Name = name
+	header.Size = int64(len(entry.data))
+	return header.FileInfo()
+}
+
+var (
+	_ fs.StatFS     = (*memoryFS)(nil)
+	_ fs.ReadDirFS  = (*memoryFS)(nil)
+	_ fs.ReadFileFS = (*memoryFS)(nil)
+	_ WritableFS    = (*memoryFS)(nil)
+)
+
+type memoryLayerFile struct {
+	fsys   *memoryFS
+	entry  *builderEntry
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memoryLayerFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memoryLayerFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.fsys.mutex.RLock()
+	defer f.fsys.mutex.RUnlock()
+	return memoryInfo(f.name, f.entry), nil
+}
+
+func (f *memoryLayerFile) Read(b []byte) (int, error) {
+	n, err := f.readAt("read", b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memoryLayerFile) ReadAt(b []byte, offset int64) (int, error) {
+	n, err := f.readAt("read", b, offset)
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *memoryLayerFile) readAt(op string, b []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if (f.flag & os.O_WRONLY) != 0 {
+		return 0, &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: op, Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.fsys.mutex.RLock()
+	defer f.fsys.mutex.RUnlock()
+
+	if offset >= int64(len(f.entry.data)) {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(b, f.entry.data[offset:]), nil
+}
+
+func (f *memoryLayerFile) Write(b []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if (f.flag & (os.O_WRONLY | os.O_RDWR)) == 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	f.fsys.mutex.Lock()
+	defer f.fsys.mutex.Unlock()
+
+	entry := f.entry
+	if (f.flag & os.O_APPEND) != 0 {
+		f.offset = int64(len(entry.data))
+	}
+	if end := f.offset + int64(len(b)); end > int64(len(entry.data)) {
+		if end > int64(cap(entry.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, entry.data)
+			entry.data = data
+		} else {
+			entry.data = entry.data[:end]
+		}
+	}
+	n := copy(entry.data[f.offset:], b)
+	f.offset += int64(n)
+	entry.header.ModTime = time.Now()
+	return n, nil
+}
+
+func (f *memoryLayerFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.fsys.mutex.RLock()
+		offset += int64(len(f.entry.data))
+		f.fsys.mutex.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memoryLayerFile) inMemory() bool {
+	return true
+}
+
+var (
+	_ io.ReaderAt = (*memoryLayerFile)(nil)
+	_ io.Seeker   = (*memoryLayerFile)(nil)
+	_ io.Writer   = (*memoryLayerFile)(nil)
+)
+
+type memoryDir struct {
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memoryDir) Close() error {
+	return nil
+}
+
+func (d *memoryDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *memoryDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *memoryDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+	return append([]fs.DirEntry{}, entries...), nil
+}
+
+var _ fs.ReadDirFile = (*memoryDir)(nil)
@@ -0,0 +1,269 @@
+package ocifs_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestMemoryLayer(t *testing.T) {
+	layer := ocifs.MemoryLayer()
+
+	if err := layer.Mkdir("etc", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, layer, "etc/hosts", os.O_WRONLY|os.O_CREATE|os.O_EXCL, "localhost\n")
+	writeFile(t, layer, "etc/hosts", os.O_WRONLY|os.O_APPEND, "127.0.0.1 localhost\n")
+	writeFile(t, layer, "etc/hostname", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, "container")
+	writeFile(t, layer, "etc/hostname", os.O_WRONLY|os.O_TRUNC, "sandbox")
+
+	expect := fstest.MapFS{
+		"etc":          &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"etc/hostname": &fstest.MapFile{Mode: 0644, Data: []byte("sandbox")},
+		"etc/hosts":    &fstest.MapFile{Mode: 0644, Data: []byte("localhost\n127.0.0.1 localhost\n")},
+	}
+	if err := fstest.EqualFS(expect, layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(layer, "etc/hostname", "etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files opened for reading observe the writes made through other files.
+	f, err := layer.Open("etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeFile(t, layer, "etc/hostname", os.O_WRONLY|os.O_APPEND, "-1")
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "sandbox-1" {
+		t.Errorf("wrong file content: %q", b)
+	}
+	if _, err := f.(io.Writer).Write([]byte("!")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("writing to a file opened for reading must fail with EBADF: %v", err)
+	}
+
+	if err := layer.Remove("etc"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("removing a non-empty directory must fail with ENOTEMPTY: %v", err)
+	}
+	if err := layer.Mkdir("etc", 0755); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("creating an existing directory must fail with fs.ErrExist: %v", err)
+	}
+	if _, err := layer.OpenFile("etc/hosts", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("exclusive creation of an existing file must fail with fs.ErrExist: %v", err)
+	}
+	if _, err := layer.OpenFile("var/log/boot", os.O_WRONLY|os.O_CREATE, 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("creating a file in a missing directory must fail with fs.ErrNotExist: %v", err)
+	}
+	if _, err := layer.OpenFile("etc", os.O_WRONLY, 0); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("opening a directory for writing must fail with EISDIR: %v", err)
+	}
+
+	for _, name := range []string{"etc/hosts", "etc/hostname", "etc"} {
+		if err := layer.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fstest.EqualFS(fstest.MapFS{}, layer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayerFSMemoryUpper(t *testing.T) {
+	layers := []fs.FS{
+		tarFS(t,
+			tarDir("etc/"),
+			tarFile("etc/hosts", "localhost\n"),
+			tarFile("etc/passwd", "root:x:0:0"),
+		),
+		tarFS(t,
+			tarDir("etc/"),
+			tarFile("etc/hostname", "container"),
+		),
+	}
+
+	fsys, ok := ocifs.LayerFSWithOptions(layers, ocifs.WithMemoryUpper()).(ocifs.WritableFS)
+	if !ok {
+		t.Fatal("layered file system with a memory upper layer must implement ocifs.WritableFS")
+	}
+
+	writeFile(t, fsys, "etc/hosts", os.O_WRONLY|os.O_APPEND, "127.0.0.1 localhost\n")
+	writeFile(t, fsys, "tmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, "scratch")
+	if err := fsys.Remove("etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("etc/hostname"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := fstest.MapFS{
+		"etc":       &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"etc/hosts": &fstest.MapFile{Mode: 0644, Data: []byte("localhost\n127.0.0.1 localhost\n")},
+		"tmp":       &fstest.MapFile{Mode: 0644, Data: []byte("scratch")},
+	}
+	if err := fstest.EqualFS(expect, fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	// The layers are not modified, a new file system starts from their
+	// original content.
+	expect = fstest.MapFS{
+		"etc":          &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"etc/hostname": &fstest.MapFile{Mode: 0644, Data: []byte("container")},
+		"etc/hosts":    &fstest.MapFile{Mode: 0644, Data: []byte("localhost\n")},
+		"etc/passwd":   &fstest.MapFile{Mode: 0644, Data: []byte("root:x:0:0")},
+	}
+	if err := fstest.EqualFS(expect, ocifs.LayerFSWithOptions(layers, ocifs.WithMemoryUpper())); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid layers are reported by the overlay.
+	invalid := ocifs.LayerFSWithOptions([]fs.FS{layers[0], nil}, ocifs.WithMemoryUpper())
+	if _, err := fs.Stat(invalid, "etc/hosts"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("nil layers must be reported with fs.ErrInvalid: %v", err)
+	}
+}
+
+func TestImageFSMemoryUpper(t *testing.T) {
+	layer := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+	image := &openFilesFS{MapFS: makeImage(t, testLayer{ocifs.MediaTypeImageLayer, layer})}
+
+	rootfs, err := ocifs.ImageFS(image, ocifs.WithMemoryUpper())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, ok := rootfs.(ocifs.WritableFS)
+	if !ok {
+		t.Fatal("image with a memory upper layer must implement ocifs.WritableFS")
+	}
+
+	writeFile(t, fsys, "etc/hosts", os.O_WRONLY|os.O_TRUNC, "127.0.0.1 localhost")
+	if err := fsys.Remove("etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := fstest.MapFS{
+		"etc":       &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"etc/hosts": &fstest.MapFile{Mode: 0644, Data: []byte("127.0.0.1 localhost")},
+	}
+	if err := fstest.EqualFS(expect, fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blobs of the image are still closed with the file system.
+	if err := rootfs.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := image.open.Load(); n != 0 {
+		t.Errorf("closing the file system must close the blobs: %d open", n)
+	}
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	base := ocifs.LayerFS(
+		tarFS(t,
+			tarDir("etc/"),
+			tarFile("etc/hosts", "localhost"),
+			tarFile("etc/passwd", "root:x:0:0"),
+		),
+	)
+
+	snapshots := []ocifs.WritableFS{
+		ocifs.MemorySnapshot(base),
+		ocifs.MemorySnapshot(base),
+	}
+
+	// The snapshots make conflicting changes concurrently.
+	write := func(fsys ocifs.WritableFS, name string, flag int, data string) error {
+		f, err := fsys.OpenFile(name, flag, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f.(io.Writer), data); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	var wg sync.WaitGroup
+	for i, fsys := range snapshots {
+		wg.Add(1)
+		go func(i int, fsys ocifs.WritableFS) {
+			defer wg.Done()
+			err := errors.Join(
+				write(fsys, "etc/hosts", os.O_WRONLY|os.O_TRUNC, fmt.Sprintf("snapshot %d", i)),
+				write(fsys, "etc/owner", os.O_WRONLY|os.O_CREATE|os.O_EXCL, fmt.Sprint(i)),
+			)
+			if i == 0 {
+				err = errors.Join(err, fsys.Remove("etc/passwd"))
+			} else {
+				err = errors.Join(err, write(fsys, "etc/passwd", os.O_WRONLY|os.O_APPEND, "\nuser:x:1000:1000"))
+			}
+			if err != nil {
+				t.Errorf("snapshot %d: %v", i, err)
+			}
+		}(i, fsys)
+	}
+	wg.Wait()
+
+	expect := []fstest.MapFS{
+		{
+			"etc":       &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+			"etc/hosts": &fstest.MapFile{Mode: 0644, Data: []byte("snapshot 0")},
+			"etc/owner": &fstest.MapFile{Mode: 0644, Data: []byte("0")},
+		},
+		{
+			"etc":        &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+			"etc/hosts":  &fstest.MapFile{Mode: 0644, Data: []byte("snapshot 1")},
+			"etc/owner":  &fstest.MapFile{Mode: 0644, Data: []byte("1")},
+			"etc/passwd": &fstest.MapFile{Mode: 0644, Data: []byte("root:x:0:0\nuser:x:1000:1000")},
+		},
+	}
+	for i, fsys := range snapshots {
+		if err := fstest.EqualFS(expect[i], fsys); err != nil {
+			t.Errorf("snapshot %d: %v", i, err)
+		}
+	}
+
+	// The base is left untouched.
+	pristine := fstest.MapFS{
+		"etc":        &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"etc/hosts":  &fstest.MapFile{Mode: 0444, Data: []byte("localhost")},
+		"etc/passwd": &fstest.MapFile{Mode: 0444, Data: []byte("root:x:0:0")},
+	}
+	if err := fstest.EqualFS(pristine, base); err != nil {
+		t.Errorf("base: %v", err)
+	}
+
+	// Indexed file systems returned by Snapshot can be modified in memory.
+	index, err := ocifs.Snapshot(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := ocifs.MemorySnapshot(index)
+	if err := write(fsys, "etc/hosts", os.O_WRONLY|os.O_APPEND, "\n127.0.0.1 localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(fsys, "etc/hosts"); err != nil || string(b) != "localhost\n127.0.0.1 localhost" {
+		t.Errorf("wrong content of the file modified in the snapshot of an index: %q (%v)", b, err)
+	}
+	if err := fstest.EqualFS(pristine, index); err != nil {
+		t.Errorf("index: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package ocifs
+
+import "sync/atomic"
+
+// Metrics is a set of counters updated by layered file systems configured with
+// WithMetrics. The counters are updated atomically and may be read at any time,
+// for example to export them to a monitoring system.
+//
+// The same Metrics value may be shared by multiple file systems to aggregate
+// their counters.
+type Metrics struct {
+	// Number of paths resolved from the cache enabled by WithLookupCache.
+	LookupCacheHits atomic.Int64
+	// Number of paths resolved by accessing the layers because they were not
+	// in the lookup cache.
+	LookupCacheMisses atomic.Int64
+	// Number of calls to stat served by the cache enabled by WithStatCache.
+	StatCacheHits atomic.Int64
+	// Number of calls to stat which were not in the stat cache.
+	StatCacheMisses atomic.Int64
+	// Number of calls to stat on the layers, which includes the lookups of
+	// whiteout files.
+	LayerStats atomic.Int64
+	// Number of files opened on the layers.
+	LayerOpens atomic.Int64
+	// Number of files currently open on the layers, which are released when
+	// the files returned by Open are closed.
+	OpenHandles atomic.Int64
+}
+
+// WithMetrics configures a layered file system to update the counters of m.
+func WithMetrics(m *Metrics) Option {
+	return func(c *config) { c.metrics = m }
+}
@@ -0,0 +1,54 @@
+package ocifs_test
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestMetrics(t *testing.T) {
+	dir := &fstest.MapFile{Mode: 0755 | fs.ModeDir}
+	file := &fstest.MapFile{Mode: 0444, Data: []byte("hello")}
+	lower := fstest.MapFS{"a": dir, "a/file": file}
+	upper := fstest.MapFS{"a": dir, "a/other": file}
+
+	metrics := new(ocifs.Metrics)
+	layers := ocifs.LayerFSWithOptions([]fs.FS{lower, upper},
+		ocifs.WithLookupCache(),
+		ocifs.WithStatCache(100),
+		ocifs.WithMetrics(metrics),
+	)
+
+	for i := 0; i < 3; i++ {
+		if _, err := fs.Stat(layers, "a/file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits, misses := metrics.LookupCacheHits.Load(), metrics.LookupCacheMisses.Load(); hits != 2 || misses != 1 {
+		t.Errorf("wrong lookup cache metrics: hits=%d misses=%d", hits, misses)
+	}
+	if metrics.LayerStats.Load() == 0 {
+		t.Error("layer stats were not counted")
+	}
+	if metrics.StatCacheMisses.Load() != metrics.LayerStats.Load() {
+		t.Errorf("all stat cache misses must stat the layers: misses=%d stats=%d", metrics.StatCacheMisses.Load(), metrics.LayerStats.Load())
+	}
+
+	d, err := layers.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := metrics.OpenHandles.Load(); n != 2 {
+		t.Errorf("wrong number of open handles: %d", n)
+	}
+	d.Close()
+	d.Close()
+	if n := metrics.OpenHandles.Load(); n != 0 {
+		t.Errorf("wrong number of open handles after closing the directory: %d", n)
+	}
+	if n := metrics.LayerOpens.Load(); n != 2 {
+		t.Errorf("wrong number of layer opens: %d", n)
+	}
+}
@@ -1,3 +1,23 @@
 // Package ocifs provides abstractions to bridge OCI image to Go's fs.FS file
 // system API.
+//
+// # Layers
+//
+// LayerFS stacks file systems of any type, but some of its features depend on
+// optional methods of the layers: symbolic links can only be read from layers
+// implementing ReadLink (see fslink.ReadLinkFS), and files opened from the
+// layered file system only implement io.ReaderAt and io.Seeker when the files
+// of the layers do.
+//
+// The layers constructed by this package implement all of them:
+//
+//   - TarFS, TarGzFS, TarZstdFS, TarGzIndexFS, EStargzFS, BlobFS, DetectFS,
+//     and ZipFS implement ReadLink, and their files implement io.ReaderAt and
+//     io.Seeker.
+//   - DirFS, DirLayer, and WritableDirLayer implement ReadLink and Lstat, and
+//     their files are *os.File values, which implement io.ReaderAt and
+//     io.Seeker.
+//
+// File systems of the standard library may not: os.DirFS only implements
+// ReadLink since Go 1.25, and embed.FS cannot contain symbolic links.
 package ocifs
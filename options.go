@@ -0,0 +1,336 @@
+package ocifs
+
+import (
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Option represents options that can be passed to constructors of the file
+// systems in this package to configure their behavior.
+type Option func(*config)
+
+type config struct {
+	consistentReads        bool
+	unsupportedHandler     func(string, fs.FileMode)
+	skipDigestVerification bool
+	verifyDiffIDs          bool
+	lookupCache            bool
+	statCacheSize          int
+	charDeviceWhiteouts    bool
+	whiteoutPrefix         string
+	whiteoutOpaque         string
+	maxSymlinks            int
+	compareContent         bool
+	gzipLayer              bool
+	reproducible           bool
+	noWhiteouts            bool
+	maxLayers              int
+	logger                 *slog.Logger
+	metrics                *Metrics
+	singleflight           bool
+	readahead              int
+	blobCache              *BlobCache
+	caseInsensitive        bool
+	mtimeClamp             time.Time
+	rootOwnership          bool
+	stripXattrs            bool
+	followSymlinks         bool
+	whiteoutIndex          bool
+	parallelLookup         int
+	mergedDirModTime       bool
+	httpClient             *http.Client
+	memoryUpper            bool
+	strictPaths            bool
+}
+
+func newConfig(options []Option) *config {
+	c := &config{
+		whiteoutPrefix: whiteoutPrefix,
+		whiteoutOpaque: whiteoutOpaque,
+		maxSymlinks:    maxSymlinks,
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// WithConsistentReads configures the layered file system to snapshot the size
+// of regular files when they are opened, and guarantee that reads performed
+// during the lifetime of the file are consistent with that snapshot.
+//
+// Layers are expected to be immutable, but when a layer is backed by a mutable
+// source (e.g. a directory on the local file system), files could be modified
+// while they are being read. With this option enabled, reads never return data
+// beyond the size observed when the file was opened, and an error wrapping
+// ErrFileChanged is returned if the file was truncated underneath.
+func WithConsistentReads() Option {
+	return func(c *config) { c.consistentReads = true }
+}
+
+// WithUnsupportedHandler configures a function invoked when the layered file
+// system encounters entries that cannot be faithfully represented through the
+// fs.FS interface, such as sockets or irregular files. The function receives
+// the path of the entry and its type bits.
+//
+// The handler is invoked when listing directories and when opening such files.
+// It does not alter the behavior of the file system, the entries remain
+// visible; this gives the application an opportunity to log or record them.
+// By default, unsupported entries are silently ignored.
+func WithUnsupportedHandler(handler func(name string, mode fs.FileMode)) Option {
+	return func(c *config) { c.unsupportedHandler = handler }
+}
+
+const unsupportedModes = fs.ModeSocket | fs.ModeIrregular
+
+func (c *config) checkSupported(name string, mode fs.FileMode) {
+	if c.unsupportedHandler != nil && (mode&unsupportedModes) != 0 {
+		c.unsupportedHandler(name, mode.Type())
+	}
+}
+
+// WithoutDigestVerification disables the verification of blob digests when
+// loading images with ImageFS.
+//
+// By default, the content of each blob is hashed when it is first loaded and
+// compared to the digest of its descriptor. Applications which trust their
+// content store may use this option to reduce the startup latency.
+func WithoutDigestVerification() Option {
+	return func(c *config) { c.skipDigestVerification = true }
+}
+
+// WithDiffIDVerification enables the verification of layer diffIDs when
+// loading images with ImageFS.
+//
+// The image config records in rootfs.diff_ids the digest of each uncompressed
+// layer. With this option, the digest of the decompressed tar stream of each
+// layer is computed and compared to the config, which detects layers that were
+// incorrectly recompressed. Because the layers must be decompressed to compute
+// their digests, zstd layers are no longer lazily loaded when it is enabled.
+func WithDiffIDVerification() Option {
+	return func(c *config) { c.verifyDiffIDs = true }
+}
+
+// WithLookupCache configures the layered file system to memoize the list of
+// layers that each path resolves to.
+//
+// Resolving a path requires checking every layer for the path and its
+// whiteouts at each level of the directory tree, which dominates the cost of
+// operations on images with many layers. Since layers are immutable, the
+// results can be cached for the lifetime of the file system without being
+// invalidated. The cache grows with the number of distinct paths accessed.
+func WithLookupCache() Option {
+	return func(c *config) { c.lookupCache = true }
+}
+
+// WithSingleflight configures a layered file system to coalesce concurrent
+// resolutions of the same path, so that goroutines opening the same file at
+// once only access the layers one time. This is useful when layers are backed
+// by remote storage. Unlike WithLookupCache, the results are not retained
+// after the concurrent calls have completed.
+func WithSingleflight() Option {
+	return func(c *config) { c.singleflight = true }
+}
+
+// WithReadahead configures a layered file system to prefetch the content of
+// files read sequentially, reading windows of the given number of bytes from
+// the layers and fetching the next window in the background while the previous
+// one is consumed. This hides the latency of layers backed by remote storage
+// (e.g. EStargzFS with a reader issuing HTTP range requests).
+//
+// Reading ahead only applies to files implementing io.ReaderAt and io.Seeker,
+// and not to files that the layers hold in memory (e.g. the layers returned by
+// TarGzFS and TarZstdFS). It does not change the results of Seek and ReadAt.
+func WithReadahead(bytes int) Option {
+	return func(c *config) { c.readahead = bytes }
+}
+
+// WithStatCache configures the layered file system to cache up to size results
+// of calling fs.Stat on its layers.
+//
+// Resolving paths checks the same directories and whiteout files of each layer
+// repeatedly; for example, opening a/b and a/b/c both need to stat a in every
+// layer. The cache records both the information of files and the fact that a
+// file did not exist, and evicts the least recently used entries when it is
+// full. Unlike WithLookupCache, the memory used by the cache is bounded.
+func WithStatCache(size int) Option {
+	return func(c *config) { c.statCacheSize = size }
+}
+
+// WithCharDeviceWhiteouts configures the layered file system to recognize the
+// whiteout convention of overlayfs, in addition to the ".wh." files of the OCI
+// specification.
+//
+// Overlayfs represents deleted files as character devices with device number
+// 0/0. The device number is obtained from the Sys method of fs.FileInfo, which
+// must return either a *tar.Header (as returned by the layers of TarFS) or a
+// *syscall.Stat_t (as returned by os.DirFS on unix systems).
+func WithCharDeviceWhiteouts() Option {
+	return func(c *config) { c.charDeviceWhiteouts = true }
+}
+
+// WithWhiteout configures the naming convention of whiteout files recognized
+// by the layered file system. A file named prefix+name masks the file name in
+// the layers below, and a file named opaque masks the entire content of its
+// directory in the layers below.
+//
+// The default convention is the one of the OCI image specification, with the
+// prefix ".wh." and the opaque marker ".wh..wh..opq". Empty strings retain the
+// default values.
+func WithWhiteout(prefix, opaque string) Option {
+	return func(c *config) {
+		if prefix != "" {
+			c.whiteoutPrefix = prefix
+		}
+		if opaque != "" {
+			c.whiteoutOpaque = opaque
+		}
+	}
+}
+
+// WithMaxSymlinkDepth configures the maximum number of symbolic links followed
+// when resolving a path in the layered file system, or with EvalSymlinks.
+// Resolving a path which requires following more links fails with an error
+// wrapping syscall.ELOOP, which guarantees that cycles of links are detected.
+//
+// The default limit is 40, like on Linux. Values less than one retain the
+// default.
+func WithMaxSymlinkDepth(n int) Option {
+	return func(c *config) {
+		if n > 0 {
+			c.maxSymlinks = n
+		}
+	}
+}
+
+// WithContentComparison configures Diff to compare the content of regular files
+// which have the same size, permissions, and modification time, instead of
+// considering them unchanged.
+func WithContentComparison() Option {
+	return func(c *config) { c.compareContent = true }
+}
+
+// WithGzip configures WriteLayer and Squash to compress the layer with gzip, producing a
+// blob of media type application/vnd.oci.image.layer.v1.tar+gzip.
+func WithGzip() Option {
+	return func(c *config) { c.gzipLayer = true }
+}
+
+// WithReproducible configures Squash and WriteLayer to zero the timestamps of
+// the files they write, so the output only depends on the content of the files.
+// Squash also writes the entries in sorted order of their names, like WriteLayer
+// does.
+//
+// Combined with WithRootOwnership and WithStripXattrs, squashing the same tree
+// of files always produces the same bytes, which is what tar --sort=name
+// --mtime=@0 --owner=0 --group=0 --no-xattrs does.
+func WithReproducible() Option {
+	return func(c *config) { c.reproducible = true }
+}
+
+// WithMtimeClamp configures Squash and WriteLayer to set the timestamps of the
+// files that they write which are later than t to t, similarly to the
+// SOURCE_DATE_EPOCH convention of reproducible builds. WithReproducible takes
+// precedence over this option.
+func WithMtimeClamp(t time.Time) Option {
+	return func(c *config) { c.mtimeClamp = t }
+}
+
+// WithRootOwnership configures Squash and WriteLayer to write files owned by
+// the user and group 0, without user and group names.
+func WithRootOwnership() Option {
+	return func(c *config) { c.rootOwnership = true }
+}
+
+// WithStripXattrs configures Squash and WriteLayer to omit the extended
+// attributes of the files that they write.
+func WithStripXattrs() Option {
+	return func(c *config) { c.stripXattrs = true }
+}
+
+// WithFollowSymlinks configures Squash to write the files that symbolic links
+// resolve to in place of the links, for consumers of the layer which do not
+// support symbolic links. Links to directories are written as directories with
+// the content of their targets.
+//
+// Links are resolved with EvalSymlinks, squashing fails if a link does not
+// resolve to an existing file, if its target is absolute or escapes the root of
+// the file system, or if it creates a cycle of directories.
+func WithFollowSymlinks() Option {
+	return func(c *config) { c.followSymlinks = true }
+}
+
+// WithMergedDirModTime configures a layered file system to report the latest
+// modification time of the layers where a directory exists as the modification
+// time of the directory, instead of the one of the top most layer, so adding
+// files to a directory in a layer below is reflected by its modification time.
+// The other information of directories still comes from the top most layer.
+func WithMergedDirModTime() Option {
+	return func(c *config) { c.mergedDirModTime = true }
+}
+
+// WithMaxLayers limits the number of layers of a layered file system to n.
+// Constructing a layered file system with more layers results in a file system
+// whose methods fail with an error wrapping ErrTooManyLayers, and ImageFS fails
+// to load images with more layers. A value of zero means no limit.
+func WithMaxLayers(n int) Option {
+	return func(c *config) { c.maxLayers = n }
+}
+
+// WithLogger configures a layered file system to log the resolution of paths
+// to their layers at the debug level: the path, the number of visible layers,
+// the number of whiteouts masking lower layers, and the index of the top most
+// layer that the path resolved to. Paths resolved from the cache configured
+// by WithLookupCache are not logged.
+//
+// Nothing is logged, and no overhead is incurred, when no logger is configured
+// or when the logger does not have the debug level enabled.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) { c.logger = logger }
+}
+
+// WithStrictPaths configures TarFS to reject archives which contain multiple
+// entries for the same path, failing with an error wrapping ErrDuplicateEntry.
+//
+// By default, the last entry wins, which matches the behavior of extracting the
+// archive with tar. Entries which conflict with the type of their parent
+// directory (e.g. a file a and a file a/b) are always rejected.
+func WithStrictPaths() Option {
+	return func(c *config) { c.strictPaths = true }
+}
+
+// whiteout returns the names of the whiteout files which would mask name.
+func (c *config) whiteout(name string) (whiteoutOne, whiteoutAll string) {
+	dir, base := path.Split(name)
+	whiteoutOne = path.Join(dir, c.whiteoutPrefix+base)
+	whiteoutAll = path.Join(dir, c.whiteoutOpaque)
+	return
+}
+
+// isWhiteout returns true if name is a whiteout file or one of the reserved
+// names of aufs.
+func (c *config) isWhiteout(name string) bool {
+	if c.noWhiteouts {
+		return false
+	}
+	return strings.HasPrefix(c.fold(name), c.fold(c.whiteoutPrefix)) || c.isWhiteoutMetadata(name)
+}
+
+func (c *config) isWhiteoutMetadata(name string) bool {
+	if c.noWhiteouts {
+		return false
+	}
+	if c.caseInsensitive {
+		for _, meta := range whiteoutMetadata {
+			if strings.EqualFold(name, meta) {
+				return true
+			}
+		}
+		return strings.EqualFold(name, c.whiteoutOpaque)
+	}
+	return name == c.whiteoutOpaque || isWhiteoutMetadata(name)
+}
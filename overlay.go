@@ -0,0 +1,401 @@
+package ocifs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// WritableFS is an extension of the fs.FS interface implemented by file systems
+// which can be modified.
+//
+// Files opened by OpenFile with one of the os.O_WRONLY or os.O_RDWR flags must
+// implement io.Writer.
+type WritableFS interface {
+	fs.FS
+	// Opens the file at name with the flags and permissions of os.OpenFile.
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	// Creates a directory at name.
+	Mkdir(name string, perm fs.FileMode) error
+	// Removes the file or empty directory at name.
+	Remove(name string) error
+}
+
+// OverlayFS constructs a writable overlay of the read-only file system lower,
+// where all modifications are written to upper.
+//
+// Reads go through the merged view of the layers, with the same semantics as
+// LayerFS, the upper layer being stacked on top of the lower one. When lower
+// is a layered file system, its layers and options are reused by the overlay.
+//
+// Opening a file for writing copies it up from the lower layer to the upper
+// layer first, creating its parent directories in the upper layer as needed.
+// Symbolic links in the parent directories are resolved through the merged
+// view, so writing through a link modifies the directory it points to.
+// Removing a file which exists in the lower layer creates a whiteout file in
+// the upper layer to mask it; when all the entries of a directory of the lower
+// layer have been removed, the whiteout files are replaced by an opaque marker.
+// The lower layer is never modified.
+//
+// The overlay does not use the caches configured by WithLookupCache,
+// WithStatCache, and WithWhiteoutIndex since its content changes.
+//
+// The overlay implements io.Closer, closing it closes lower if it implements
+// io.Closer as well (e.g. a file system returned by ImageFS).
+func OverlayFS(lower fs.FS, upper WritableFS) WritableFS {
+	lowerLayers := []layer{{fsys: lower, index: 0}}
+	config := newConfig(nil)
+	var err error
+	if l, ok := lower.(*layerFS); ok {
+		lowerLayers, config, err = l.layers, l.config, l.err
+	}
+
+	c := *config
+	c.lookupCache = false
+	c.statCacheSize = 0
+	c.whiteoutIndex = false
+
+	upperIndex := 0
+	for _, l := range lowerLayers {
+		if l.index >= upperIndex {
+			upperIndex = l.index + 1
+		}
+	}
+
+	layers := make([]layer, 0, 1+len(lowerLayers))
+	layers = append(layers, layer{fsys: upper, index: upperIndex})
+	layers = append(layers, lowerLayers...)
+
+	merged := newLayerFS(layers, &c)
+	merged.writable = true
+	merged.err = err
+	lowerFS := newLayerFS(lowerLayers, &c)
+	lowerFS.err = err
+	closer, _ := lower.(io.Closer)
+	return &overlayFS{
+		lower:      lowerFS,
+		upper:      upper,
+		upperIndex: upperIndex,
+		merged:     merged,
+		closer:     closer,
+	}
+}
+
+type overlayFS struct {
+	lower      *layerFS
+	upper      WritableFS
+	upperIndex int
+	merged     *layerFS
+	// the lower file system passed to OverlayFS, if it needs to be closed
+	closer io.Closer
+}
+
+func (fsys *overlayFS) Close() error {
+	if fsys.closer != nil {
+		return fsys.closer.Close()
+	}
+	return nil
+}
+
+func (fsys *overlayFS) Open(name string) (fs.File, error) {
+	return fsys.merged.Open(name)
+}
+
+func (fsys *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.merged.Stat(name)
+}
+
+func (fsys *overlayFS) ReadFile(name string) ([]byte, error) {
+	return fsys.merged.ReadFile(name)
+}
+
+func (fsys *overlayFS) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.merged.Lstat(name)
+}
+
+func (fsys *overlayFS) ReadLink(name string) (string, error) {
+	return fsys.merged.ReadLink(name)
+}
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_APPEND | os.O_TRUNC
+
+func (fsys *overlayFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if (flag & writeFlags) == 0 {
+		return fsys.merged.Open(name)
+	}
+
+	name, err := fsys.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.merged.Stat(name)
+	switch {
+	case err == nil:
+		if (flag&os.O_CREATE) != 0 && (flag&os.O_EXCL) != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+		if info.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if err := fsys.copyUp(name, info, (flag&os.O_TRUNC) != 0); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if (flag & os.O_CREATE) == 0 {
+			return nil, err
+		}
+		if err := fsys.create(name); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	return fsys.upper.OpenFile(name, flag, perm)
+}
+
+func (fsys *overlayFS) Mkdir(name string, perm fs.FileMode) error {
+	name, err := fsys.resolve("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.merged.Stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := fsys.create(name); err != nil {
+		return err
+	}
+	if err := fsys.upper.Mkdir(name, perm); err != nil {
+		return err
+	}
+	// When a directory of the lower layer was removed and is created again,
+	// its previous content must remain masked.
+	if _, err := fsys.lower.Stat(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return fsys.writeOpaque(name)
+}
+
+func (fsys *overlayFS) Remove(name string) error {
+	name, err := fsys.resolve("remove", name)
+	if err != nil {
+		return err
+	}
+	visibleLayers, _, err := fsys.merged.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+
+	info, err := fsys.merged.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := fs.ReadDir(fsys.merged, name)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+
+	if visibleLayers[0].index == fsys.upperIndex {
+		if info.IsDir() {
+			// The directory is empty in the merged view, but it may still
+			// contain whiteout files in the upper layer.
+			entries, err := fs.ReadDir(fsys.upper, name)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := fsys.upper.Remove(path.Join(name, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		if err := fsys.upper.Remove(name); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fsys.lower.Stat(name); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := fsys.writeWhiteout(name); err != nil {
+		return err
+	}
+	return fsys.compactWhiteouts(path.Dir(name))
+}
+
+// resolve returns the path of name with the symbolic links of its parent
+// directories resolved through the merged view, so files are written to the
+// directories that the links point to instead of copies of the links in the
+// upper layer. The last component of name is not resolved.
+func (fsys *overlayFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir, err := EvalSymlinks(fsys.merged, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, path.Base(name)), nil
+}
+
+// create prepares the upper layer for the creation of a new file at name,
+// copying up its parent directory and removing whiteouts masking the name.
+func (fsys *overlayFS) create(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := fsys.copyUpDir(path.Dir(name)); err != nil {
+		return err
+	}
+	whiteoutOne, _ := fsys.merged.config.whiteout(name)
+	if err := fsys.upper.Remove(whiteoutOne); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// copyUp copies the regular file at name from the lower layer to the upper
+// layer, unless it already exists in the upper layer. When truncate is true,
+// the content of the file is not copied.
+func (fsys *overlayFS) copyUp(name string, info fs.FileInfo, truncate bool) error {
+	visibleLayers, _, err := fsys.merged.lookup("open", name)
+	if err != nil {
+		return err
+	}
+	if visibleLayers[0].index == fsys.upperIndex {
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return &fs.PathError{Op: "copyup", Path: name, Err: fmt.Errorf("only regular files can be copied up (%w)", fs.ErrInvalid)}
+	}
+	if err := fsys.copyUpDir(path.Dir(name)); err != nil {
+		return err
+	}
+
+	dst, err := fsys.upper.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if !truncate {
+		src, err := fsys.lower.Open(name)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		w, ok := dst.(io.Writer)
+		if !ok {
+			return &fs.PathError{Op: "copyup", Path: name, Err: fmt.Errorf("file opened for writing does not implement io.Writer (%w)", fs.ErrInvalid)}
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			return &fs.PathError{Op: "copyup", Path: name, Err: err}
+		}
+	}
+	return dst.Close()
+}
+
+// copyUpDir creates the directory at name and its parents in the upper layer,
+// with the permissions they have in the merged view.
+func (fsys *overlayFS) copyUpDir(name string) error {
+	if name == "." {
+		return nil
+	}
+	if info, err := fs.Stat(fsys.upper, name); err == nil && info.IsDir() {
+		return nil
+	}
+	info, err := fsys.merged.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: "copyup", Path: name, Err: syscall.ENOTDIR}
+	}
+	if err := fsys.copyUpDir(path.Dir(name)); err != nil {
+		return err
+	}
+	return fsys.upper.Mkdir(name, info.Mode().Perm())
+}
+
+// writeWhiteout creates a whiteout file in the upper layer masking name in the
+// lower layer.
+func (fsys *overlayFS) writeWhiteout(name string) error {
+	if err := fsys.copyUpDir(path.Dir(name)); err != nil {
+		return err
+	}
+	whiteoutOne, _ := fsys.merged.config.whiteout(name)
+	f, err := fsys.upper.OpenFile(whiteoutOne, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeOpaque creates an opaque marker in the directory at name of the upper
+// layer, masking the content of the directory in the lower layer.
+func (fsys *overlayFS) writeOpaque(name string) error {
+	f, err := fsys.upper.OpenFile(path.Join(name, fsys.merged.config.whiteoutOpaque), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// compactWhiteouts replaces the whiteout files of the directory at name in the
+// upper layer with an opaque marker when all the entries of the directory in
+// the lower layer have been removed, so the directory does not accumulate one
+// whiteout file per entry.
+func (fsys *overlayFS) compactWhiteouts(name string) error {
+	entries, err := fs.ReadDir(fsys.merged, name)
+	if err != nil || len(entries) != 0 {
+		return err
+	}
+	config := fsys.merged.config
+	upperEntries, err := fs.ReadDir(fsys.upper, name)
+	if err != nil {
+		return err
+	}
+	if err := fsys.writeOpaque(name); err != nil {
+		return err
+	}
+	for _, entry := range upperEntries {
+		if entry.Name() != config.whiteoutOpaque && strings.HasPrefix(entry.Name(), config.whiteoutPrefix) {
+			if err := fsys.upper.Remove(path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	_ fs.StatFS         = (*overlayFS)(nil)
+	_ fs.ReadFileFS     = (*overlayFS)(nil)
+	_ fslink.ReadLinkFS = (*overlayFS)(nil)
+	_ WritableFS        = (*overlayFS)(nil)
+	_ io.Closer         = (*overlayFS)(nil)
+)
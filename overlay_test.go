@@ -0,0 +1,232 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// writeFile writes data to a file of a writable file system.
+func writeFile(t *testing.T, fsys ocifs.WritableFS, name string, flag int, data string) {
+	t.Helper()
+	f, err := fsys.OpenFile(name, flag, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f.(io.Writer), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newOverlay(t *testing.T, lower fs.FS) (ocifs.WritableFS, string) {
+	t.Helper()
+	dir := t.TempDir()
+	upper, err := ocifs.WritableDirLayer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ocifs.OverlayFS(lower, upper), dir
+}
+
+func TestOverlayFS(t *testing.T) {
+	lower := ocifs.LayerFS(
+		tarFS(t,
+			tarDir("etc/"),
+			tarFile("etc/hosts", "localhost\n"),
+			tarFile("etc/passwd", "root:x:0:0"),
+			tarDir("var/"),
+			tarDir("var/log/"),
+		),
+		tarFS(t,
+			tarDir("etc/"),
+			tarFile("etc/hostname", "container"),
+		),
+	)
+
+	overlay, dir := newOverlay(t, lower)
+
+	writeFile(t, overlay, "etc/hosts", os.O_WRONLY|os.O_APPEND, "127.0.0.1 localhost\n")
+	writeFile(t, overlay, "var/log/boot", os.O_WRONLY|os.O_CREATE|os.O_EXCL, "ok")
+	writeFile(t, overlay, "etc/hostname", os.O_WRONLY|os.O_TRUNC, "sandbox")
+
+	if err := overlay.Mkdir("tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Remove("etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0644, Data: []byte(data)}
+	}
+
+	expect := fstest.MapFS{
+		"etc":          &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"etc/hostname": file("sandbox"),
+		"etc/hosts":    file("localhost\n127.0.0.1 localhost\n"),
+		"tmp":          &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"var":          &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"var/log":      &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"var/log/boot": file("ok"),
+	}
+	if err := fstest.EqualFS(expect, overlay); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lower layers are never modified.
+	b, err := fs.ReadFile(lower, "etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "localhost\n" {
+		t.Errorf("lower layer was modified: %q", b)
+	}
+	if _, err := fs.Stat(lower, "etc/passwd"); err != nil {
+		t.Errorf("lower layer was modified: %v", err)
+	}
+
+	// Removing a file of the lower layer creates a whiteout in the upper layer.
+	if _, err := os.Stat(filepath.Join(dir, "etc", ".wh.passwd")); err != nil {
+		t.Errorf("whiteout missing from the upper layer: %v", err)
+	}
+
+	if _, err := overlay.OpenFile("etc/passwd", os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("opening a removed file must fail with fs.ErrNotExist: %v", err)
+	}
+	if _, err := overlay.OpenFile("etc/hosts", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("exclusive creation of an existing file must fail with fs.ErrExist: %v", err)
+	}
+	if err := overlay.Remove("var"); err == nil {
+		t.Errorf("removing a non-empty directory must fail")
+	}
+}
+
+func TestOverlayFSWhiteouts(t *testing.T) {
+	lower := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("etc/ssl/"),
+		tarFile("etc/ssl/cert.pem", "?"),
+		tarDir("opt/"),
+		tarFile("opt/app", "v1"),
+	)
+
+	overlay, dir := newOverlay(t, lower)
+
+	for _, name := range []string{"etc/hosts", "etc/ssl/cert.pem", "etc/ssl", "etc/passwd"} {
+		if err := overlay.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := fs.ReadDir(overlay, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("removed entries are still listed: %v", entries)
+	}
+
+	// All the entries of the lower directory were removed, the individual
+	// whiteouts are replaced by an opaque marker.
+	upperEntries, err := os.ReadDir(filepath.Join(dir, "etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upperEntries) != 1 || upperEntries[0].Name() != ".wh..wh..opq" {
+		t.Errorf("wrong entries in the upper layer: %v", upperEntries)
+	}
+
+	// Adding back a file with the name of a removed file must not make the
+	// other removed files of the lower layer visible.
+	writeFile(t, overlay, "etc/hosts", os.O_WRONLY|os.O_CREATE, "127.0.0.1 localhost")
+	if err := overlay.Mkdir("etc/ssl", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removing a directory of the lower layer and creating it again must not
+	// make its previous content visible.
+	if err := overlay.Remove("opt/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Remove("opt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(overlay, "opt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a removed directory must fail with fs.ErrNotExist: %v", err)
+	}
+	if err := overlay.Mkdir("opt", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := fstest.MapFS{
+		"etc":       &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"etc/hosts": &fstest.MapFile{Mode: 0644, Data: []byte("127.0.0.1 localhost")},
+		"etc/ssl":   &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+		"opt":       &fstest.MapFile{Mode: 0755 | fs.ModeDir},
+	}
+	if err := fstest.EqualFS(expect, overlay); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayFSSymlinkedDirs(t *testing.T) {
+	lower := tarFS(t,
+		tarDir("run/"),
+		tarFile("run/lock", "1"),
+		tarFile("run/utmp", "?"),
+		tarDir("var/"),
+		tarSymlink("var/run", "../run"),
+	)
+
+	overlay, dir := newOverlay(t, lower)
+
+	// The files are written in the directory that the link points to.
+	writeFile(t, overlay, "var/run/pid", os.O_WRONLY|os.O_CREATE|os.O_EXCL, "42")
+	writeFile(t, overlay, "var/run/lock", os.O_WRONLY|os.O_APPEND, "2")
+	if err := overlay.Mkdir("var/run/user", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Remove("var/run/utmp"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string]string{"run/pid": "42", "run/lock": "12"} {
+		b, err := fs.ReadFile(overlay, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("%s: wrong content: want=%q got=%q", name, data, b)
+		}
+	}
+	if info, err := fs.Stat(overlay, "run/user"); err != nil || !info.IsDir() {
+		t.Errorf("the directory must be created in the target of the link: %v", err)
+	}
+	if _, err := fs.Stat(overlay, "run/utmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a removed file must fail with fs.ErrNotExist: %v", err)
+	}
+
+	// The link is not replaced by a directory in the upper layer.
+	info, err := ocifs.Lstat(overlay, "var/run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("the symbolic link was replaced: %v", info.Mode())
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "var", "run")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the symbolic link must not be copied up as a directory: %v", err)
+	}
+}
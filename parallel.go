@@ -0,0 +1,62 @@
+package ocifs
+
+import (
+	"context"
+	"io/fs"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// WithParallelLookup configures a layered file system to check the layers
+// concurrently when resolving paths, with up to n calls to fs.Stat in flight.
+//
+// Resolving a path checks each layer for every component of the path and its
+// whiteout files one layer at a time, so the latency of the layers adds up on
+// deep stacks of layers backed by remote storage. With this option, the checks
+// of all the layers for a path component are issued at once before deciding
+// which layers are visible, which gives the same results as the sequential
+// resolution. Layers are checked for whiteout files even when the decision
+// does not need it, so the option increases the number of calls to fs.Stat and
+// should only be used when the layers have a significant latency.
+//
+// A value of n lower than 2 disables concurrency, which is the default.
+func WithParallelLookup(n int) Option {
+	return func(c *config) { c.parallelLookup = n }
+}
+
+// layerStat is the result of checking a layer for a path component, gathered
+// concurrently by statLayers.
+type layerStat struct {
+	info        fs.FileInfo
+	err         error
+	whiteout    bool
+	whiteoutErr error
+}
+
+// statLayers checks the layers for name and its whiteout files concurrently,
+// returning the results indexed by layer. The resolution of the path applies
+// the results in order, as if the layers had been checked sequentially.
+func (fsys *layerFS) statLayers(ctx context.Context, layers []layer, name, whiteoutOne, whiteoutAll string) map[int]*layerStat {
+	results := make(map[int]*layerStat, len(layers))
+	for _, l := range layers {
+		results[l.index] = new(layerStat)
+	}
+
+	var group errgroup.Group
+	group.SetLimit(fsys.config.parallelLookup)
+
+	for _, l := range layers {
+		l, r := l, results[l.index]
+		group.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				r.err = &fs.PathError{Op: "stat", Path: name, Err: err}
+				return nil
+			}
+			r.info, r.err = fsys.stat(l, name)
+			r.whiteout, r.whiteoutErr = fsys.hasWhiteout(l, whiteoutOne, whiteoutAll)
+			return nil
+		})
+	}
+	group.Wait()
+	return results
+}
@@ -0,0 +1,97 @@
+package ocifs_test
+
+import (
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+// latentFS simulates a layer backed by remote storage, where each call to Stat
+// takes some time. It records the maximum number of concurrent calls.
+type latentFS struct {
+	fstest.MapFS
+	latency time.Duration
+	mutex   *sync.Mutex
+	calls   *int
+	max     *int
+}
+
+func (f latentFS) Stat(name string) (fs.FileInfo, error) {
+	f.mutex.Lock()
+	*f.calls++
+	if *f.calls > *f.max {
+		*f.max = *f.calls
+	}
+	f.mutex.Unlock()
+
+	time.Sleep(f.latency)
+
+	f.mutex.Lock()
+	*f.calls--
+	f.mutex.Unlock()
+	return f.MapFS.Stat(name)
+}
+
+// latentLayers returns n layers with the given latency, where each layer i
+// has a file layer-i/file and a file shared/i, and every third layer masks the
+// files of the layers below it in shared/.
+func latentLayers(n int, latency time.Duration) (layers []fs.FS, max func() int) {
+	mutex, calls, maxCalls := new(sync.Mutex), new(int), new(int)
+	for i := 0; i < n; i++ {
+		files := fstest.MapFS{
+			fmt.Sprintf("layer-%d/file", i): &fstest.MapFile{Mode: 0444, Data: []byte("file")},
+			fmt.Sprintf("shared/%d", i):     &fstest.MapFile{Mode: 0444, Data: []byte("shared")},
+		}
+		if i%3 == 2 {
+			files["shared/.wh..wh..opq"] = &fstest.MapFile{Mode: 0444}
+		}
+		layers = append(layers, latentFS{MapFS: files, latency: latency, mutex: mutex, calls: calls, max: maxCalls})
+	}
+	return layers, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return *maxCalls
+	}
+}
+
+func TestLayerFSParallelLookup(t *testing.T) {
+	layers, _ := latentLayers(8, 0)
+	expect := ocifs.LayerFS(layers...)
+
+	parallelLayers, max := latentLayers(8, time.Millisecond)
+	parallel := ocifs.LayerFSWithOptions(parallelLayers, ocifs.WithParallelLookup(4))
+
+	if err := fstest.EqualFS(expect, parallel); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		want, wantErr := ocifs.Origin(expect, fmt.Sprintf("shared/%d", i))
+		got, gotErr := ocifs.Origin(parallel, fmt.Sprintf("shared/%d", i))
+		if want != got || (wantErr == nil) != (gotErr == nil) {
+			t.Errorf("shared/%d: wrong origin: want=%d (%v) got=%d (%v)", i, want, wantErr, got, gotErr)
+		}
+	}
+	if n := max(); n < 2 || n > 4 {
+		t.Errorf("wrong number of concurrent calls to stat: %d", n)
+	}
+}
+
+func BenchmarkLayerFSParallelLookup(b *testing.B) {
+	for _, parallel := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			layers, _ := latentLayers(16, 50*time.Microsecond)
+			fsys := ocifs.LayerFSWithOptions(layers, ocifs.WithParallelLookup(parallel))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := fs.Stat(fsys, "shared/15"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package ocifs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+)
+
+// memoryFile is implemented by files which may hold their content in memory,
+// in which case reading ahead is not useful.
+type memoryFile interface {
+	inMemory() bool
+}
+
+func (f *tarFile) inMemory() bool {
+	_, ok := f.entry.data.(*bytes.Reader)
+	return ok || f.entry.data == nil
+}
+
+// canReadAhead returns true if reads from f can be prefetched, which requires
+// f to implement io.ReaderAt and io.Seeker, and to not be held in memory.
+func canReadAhead(f fs.File) bool {
+	if m, ok := f.(memoryFile); ok && m.inMemory() {
+		return false
+	}
+	_, isReaderAt := f.(io.ReaderAt)
+	_, isSeeker := f.(io.Seeker)
+	return isReaderAt && isSeeker
+}
+
+// readahead serves sequential reads of a file from a buffer filled with
+// ReadAt, fetching the following window of data in the background while the
+// buffer is being consumed.
+//
+// Since the data is read with ReadAt, the position of the underlying file does
+// not advance, the position of reads is tracked by the offset field instead.
+//
+// Two buffers of the window size are alternated between the data being read
+// and the background fetch, which is always waited on before its buffer is
+// reused or the file is closed.
+type readahead struct {
+	r      io.ReaderAt
+	window int
+	offset int64
+
+	buf       []byte
+	bufOffset int64
+	// error returned when reading past the end of the buffer
+	err error
+	// buffer that the next window is fetched into
+	spare []byte
+
+	next       chan readaheadResult
+	nextOffset int64
+	// closed when the file is closed, to skip fetches which did not start
+	done chan struct{}
+}
+
+type readaheadResult struct {
+	buf []byte
+	err error
+}
+
+func (ra *readahead) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	end := ra.bufOffset + int64(len(ra.buf))
+	if ra.offset < ra.bufOffset || ra.offset >= end {
+		if ra.offset == end && ra.err != nil {
+			return 0, ra.err
+		}
+		ra.fill()
+		if len(ra.buf) == 0 {
+			if ra.err == nil {
+				return 0, io.ErrNoProgress
+			}
+			return 0, ra.err
+		}
+	}
+	n := copy(b, ra.buf[ra.offset-ra.bufOffset:])
+	ra.offset += int64(n)
+	return n, nil
+}
+
+// fill replaces the buffer with the window of data starting at the current
+// offset, using the result of the background fetch if it read the same window,
+// then starts fetching the next window.
+func (ra *readahead) fill() {
+	var res readaheadResult
+	if ra.next != nil {
+		// The background fetch owns the spare buffer until it completes, the
+		// result is discarded if it read another window.
+		res = <-ra.next
+		ra.next = nil
+		if ra.nextOffset != ra.offset {
+			res = ra.fetch(res.buf[:cap(res.buf)], ra.offset)
+		}
+	} else {
+		if ra.done == nil {
+			ra.done = make(chan struct{})
+		}
+		res = ra.fetch(ra.spare, ra.offset)
+	}
+	ra.spare = ra.buf[:cap(ra.buf)]
+	ra.buf, ra.bufOffset, ra.err = res.buf, ra.offset, res.err
+
+	if ra.err == nil {
+		next := make(chan readaheadResult, 1)
+		offset := ra.bufOffset + int64(len(ra.buf))
+		spare, done := ra.spare, ra.done
+		go func() {
+			select {
+			case <-done:
+				next <- readaheadResult{buf: spare[:0]}
+			default:
+				next <- ra.fetch(spare, offset)
+			}
+		}()
+		ra.next, ra.nextOffset = next, offset
+	}
+}
+
+// fetch reads the window of data starting at offset into b, which is allocated
+// if it is nil.
+func (ra *readahead) fetch(b []byte, offset int64) readaheadResult {
+	if b == nil {
+		b = make([]byte, ra.window)
+	}
+	n, err := ra.r.ReadAt(b, offset)
+	return readaheadResult{buf: b[:n], err: err}
+}
+
+// close cancels the background fetch and waits for it to complete, so the
+// file is not read after it was closed.
+func (ra *readahead) close() {
+	if ra.done != nil {
+		close(ra.done)
+		ra.done = nil
+	}
+	if ra.next != nil {
+		<-ra.next
+		ra.next = nil
+	}
+}
@@ -0,0 +1,185 @@
+package ocifs_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+// latentReaderAt simulates a remote blob, each call to ReadAt is delayed.
+type latentReaderAt struct {
+	r       io.ReaderAt
+	latency time.Duration
+	reads   atomic.Int64
+	// number of calls to ReadAt in progress
+	active atomic.Int64
+}
+
+func (r *latentReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	r.active.Add(1)
+	defer r.active.Add(-1)
+	time.Sleep(r.latency)
+	return r.r.ReadAt(b, off)
+}
+
+func TestLayerFSReadahead(t *testing.T) {
+	data := strings.Repeat("0123456789abcdef", 4096)
+	b := makeTar(t, tarFile("file", data))
+	r := &latentReaderAt{r: bytes.NewReader(b)}
+	layer, err := ocifs.TarFS(r, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := ocifs.LayerFSWithOptions([]fs.FS{layer}, ocifs.WithReadahead(10000))
+
+	f, err := fsys.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := f.(io.Seeker)
+
+	reads := r.reads.Load()
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != data[:100] {
+		t.Errorf("wrong content read: %q", buf)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := r.reads.Load() - reads; n > 2 {
+		t.Errorf("sequential reads were not served from the readahead buffer: %d calls to ReadAt", n)
+	}
+
+	for _, test := range []struct {
+		offset int64
+		whence int
+		expect int64
+	}{
+		{offset: 0, whence: io.SeekCurrent, expect: 5100},
+		{offset: -110, whence: io.SeekCurrent, expect: 5000},
+		{offset: 30000, whence: io.SeekStart, expect: 30000},
+		{offset: -10, whence: io.SeekEnd, expect: int64(len(data) - 10)},
+	} {
+		offset, err := s.Seek(test.offset, test.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != test.expect {
+			t.Fatalf("wrong offset after seek: want=%d got=%d", test.expect, offset)
+		}
+		n, err := f.Read(buf[:10])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), data[offset:offset+10]; got != want {
+			t.Fatalf("wrong content read at offset %d: want=%q got=%q", offset, want, got)
+		}
+	}
+	if n, err := f.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("reading at the end of the file must return io.EOF: n=%d err=%v", n, err)
+	}
+
+	if _, err := s.Seek(60000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	w := new(bytes.Buffer)
+	if _, err := f.(io.WriterTo).WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != data[60100:] {
+		t.Errorf("WriteTo must start at the position of the file: %d bytes written", w.Len())
+	}
+	if offset, _ := s.Seek(0, io.SeekCurrent); offset != int64(len(data)) {
+		t.Errorf("wrong offset after WriteTo: %d", offset)
+	}
+}
+
+func TestLayerFSReadaheadClose(t *testing.T) {
+	data := strings.Repeat("0123456789abcdef", 4096)
+	b := makeTar(t, tarFile("file", data))
+	r := &latentReaderAt{r: bytes.NewReader(b), latency: 10 * time.Millisecond}
+	layer, err := ocifs.TarFS(r, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := ocifs.LayerFSWithOptions([]fs.FS{layer}, ocifs.WithReadahead(1000))
+
+	f, err := fsys.Open("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	// The first read started fetching the next window in the background,
+	// closing the file must wait for it.
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.active.Load(); n != 0 {
+		t.Errorf("the file is still read after it was closed: %d reads in progress", n)
+	}
+	reads := r.reads.Load()
+	time.Sleep(3 * r.latency)
+	if n := r.reads.Load() - reads; n != 0 {
+		t.Errorf("the file was read %d times after it was closed", n)
+	}
+}
+
+func BenchmarkReadahead(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	blob := makeTar(b, tarFile("file", string(data)))
+	layer, err := ocifs.TarFS(&latentReaderAt{r: bytes.NewReader(blob), latency: 100 * time.Microsecond}, int64(len(blob)))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bench := range []struct {
+		scenario string
+		options  []ocifs.Option
+	}{
+		{scenario: "without readahead"},
+		{scenario: "with readahead", options: []ocifs.Option{ocifs.WithReadahead(256 * 1024)}},
+	} {
+		b.Run(bench.scenario, func(b *testing.B) {
+			fsys := ocifs.LayerFSWithOptions([]fs.FS{layer}, bench.options...)
+			buf := make([]byte, 32*1024)
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				f, err := fsys.Open("file")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for {
+					_, err := f.Read(buf)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					// Simulate the processing of the data by the consumer.
+					time.Sleep(20 * time.Microsecond)
+				}
+				f.Close()
+			}
+		})
+	}
+}
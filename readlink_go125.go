@@ -0,0 +1,14 @@
+//go:build go1.25
+
+package ocifs
+
+import "io/fs"
+
+// Go 1.25 added fs.ReadLinkFS to the standard library, which has the same
+// ReadLink method as fslink.ReadLinkFS and an additional Lstat method.
+var (
+	_ fs.ReadLinkFS = (*layerFS)(nil)
+	_ fs.ReadLinkFS = (*overlayFS)(nil)
+	_ fs.ReadLinkFS = (*snapshotFS)(nil)
+	_ fs.ReadLinkFS = (*dirFS)(nil)
+)
@@ -0,0 +1,100 @@
+//go:build go1.25
+
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	stdfstest "testing/fstest"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestLayerFSStdReadLinkFS(t *testing.T) {
+	base := tarFS(t,
+		tarDir("usr/"),
+		tarDir("usr/lib/"),
+		tarFile("usr/lib/libc.so", "libc"),
+		tarSymlink("lib", "usr/lib"),
+		tarSymlink("old", "usr/lib"),
+	)
+	update := tarFS(t,
+		tarFile(".wh.old", ""),
+	)
+	layers := ocifs.LayerFS(base, update)
+
+	if _, ok := layers.(fs.ReadLinkFS); !ok {
+		t.Fatal("layered file systems must implement fs.ReadLinkFS")
+	}
+
+	link, err := fs.ReadLink(layers, "lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "usr/lib" {
+		t.Errorf("wrong link target: %q", link)
+	}
+
+	info, err := fs.Lstat(layers, "lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("lstat must not follow symbolic links: %v", info.Mode())
+	}
+
+	if _, err := fs.Lstat(layers, "old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("lstat of a symbolic link masked by a whiteout must fail with fs.ErrNotExist: %v", err)
+	}
+}
+
+func TestLayerFSStdMapFSSymlinks(t *testing.T) {
+	// The MapFS of the standard library follows symbolic links in Open and
+	// Stat since Go 1.25, links pointing to files of the lower layers must
+	// still resolve through the merged view.
+	lower := stdfstest.MapFS{
+		"etc/target":   {Data: []byte("target")},
+		"usr/lib/libc": {Data: []byte("libc")},
+		"usr/lib/libm": {Data: []byte("libm")},
+	}
+	upper := stdfstest.MapFS{
+		"etc/link": {Mode: fs.ModeSymlink, Data: []byte("target")},
+		"lib":      {Mode: fs.ModeSymlink, Data: []byte("usr/lib")},
+	}
+	layers := ocifs.LayerFS(lower, upper)
+
+	link, err := fs.ReadLink(layers, "etc/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "target" {
+		t.Errorf("wrong link target: %q", link)
+	}
+	for _, stat := range []func(fs.FS, string) (fs.FileInfo, error){fs.Stat, fs.Lstat} {
+		info, err := stat(layers, "etc/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Type() != fs.ModeSymlink {
+			t.Errorf("symbolic links in the last component must not be followed: %v", info.Mode())
+		}
+	}
+
+	resolved, err := ocifs.EvalSymlinks(layers, "etc/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != "etc/target" {
+		t.Errorf("wrong resolved path: %q", resolved)
+	}
+	if b, err := fs.ReadFile(layers, resolved); err != nil || string(b) != "target" {
+		t.Errorf("wrong content of %s: %q (%v)", resolved, b, err)
+	}
+
+	// Links in the intermediate components of paths resolve to the files of
+	// the lower layers.
+	if b, err := fs.ReadFile(layers, "lib/libm"); err != nil || string(b) != "libm" {
+		t.Errorf("wrong content of lib/libm: %q (%v)", b, err)
+	}
+}
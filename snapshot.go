@@ -0,0 +1,270 @@
+package ocifs
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// Snapshot walks the tree of files visible in fsys once, and returns a
+// read-only file system backed by an index of the files, where paths resolve
+// with a single map lookup instead of accessing the layers. It is intended for
+// layered file systems which are served for a long time after being opened.
+//
+// The content of files is still read from the layer that a file resolves to,
+// but the metadata of files, the targets of symbolic links, and the entries
+// of directories are served from the index. Symbolic links in the intermediate
+// components of paths are resolved through the index as well, like LayerFS.
+//
+// The layers of fsys must not change after the snapshot was taken.
+//
+// Snapshot is an optimization of the reads of a file system which does not
+// change, use MemorySnapshot instead to obtain a view of a file system which
+// can be modified. The two can be combined, MemorySnapshot accepts the file
+// system returned by Snapshot as base.
+func Snapshot(fsys fs.FS) (fs.FS, error) {
+	snapshot := &snapshotFS{
+		files: make(map[string]*snapshotEntry),
+		limit: maxSymlinks,
+	}
+	if layers, ok := fsys.(*layerFS); ok {
+		snapshot.limit = layers.config.maxSymlinks
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		e := &snapshotEntry{fsys: fsys, name: name, info: info}
+
+		switch info.Mode().Type() {
+		case fs.ModeDir:
+		case fs.ModeSymlink:
+			if e.link, err = readRawLink(fsys, name); err != nil {
+				return err
+			}
+			fallthrough
+		default:
+			if layers, ok := fsys.(*layerFS); ok {
+				visibleLayers, realName, err := layers.lookup("snapshot", name)
+				if err != nil {
+					return err
+				}
+				e.fsys, e.name = visibleLayers[0].fsys, realName
+			}
+		}
+
+		snapshot.files[name] = e
+		if name != "." {
+			parent := snapshot.files[path.Dir(name)]
+			parent.entries = append(parent.entries, fs.FileInfoToDirEntry(info))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+type snapshotFS struct {
+	files map[string]*snapshotEntry
+	limit int
+}
+
+type snapshotEntry struct {
+	// file system and name that the content of the file is read from
+	fsys fs.FS
+	name string
+	info fs.FileInfo
+	// target of symbolic links
+	link string
+	// entries of directories, sorted by name
+	entries []fs.DirEntry
+}
+
+func (fsys *snapshotFS) Open(name string) (fs.File, error) {
+	e, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		return &snapshotDir{entry: e}, nil
+	}
+	f, err := e.fsys.Open(e.name)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotFile{File: f, info: e.info, name: name}, nil
+}
+
+func (fsys *snapshotFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (fsys *snapshotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return append([]fs.DirEntry{}, e.entries...), nil
+}
+
+func (fsys *snapshotFS) ReadFile(name string) ([]byte, error) {
+	e, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(e.fsys, e.name)
+}
+
+// Lstat is like Stat; the index records the information of symbolic links
+// rather than of their targets.
+func (fsys *snapshotFS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := fsys.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (fsys *snapshotFS) ReadLink(name string) (string, error) {
+	e, err := fsys.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.info.Mode().Type() != fs.ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.link, nil
+}
+
+// lookup returns the entry of the index for name. Paths which contain symbolic
+// links in their intermediate components are not in the index, they are
+// resolved by following the links recorded in the index.
+func (fsys *snapshotFS) lookup(op, name string) (*snapshotEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if e, ok := fsys.files[name]; ok {
+		return e, nil
+	}
+
+	p := name
+	walk := 0
+	links := 0
+	for {
+		i := strings.IndexByte(p[walk:], '/')
+		if i < 0 {
+			break
+		}
+		walk += i
+		e, ok := fsys.files[p[:walk]]
+		switch {
+		case !ok:
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		case e.info.Mode().Type() == fs.ModeSymlink:
+			if links++; links > fsys.limit {
+				return nil, errTooManyLinks(op, name)
+			}
+			target, ok := joinLink(p[:walk], e.link, p[walk+1:])
+			if !ok {
+				return nil, errEscapingLink(op, name, p[:walk], e.link)
+			}
+			p, walk = target, 0
+			continue
+		case !e.info.IsDir():
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		walk++
+	}
+
+	if e, ok := fsys.files[p]; ok {
+		return e, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+var (
+	_ fs.StatFS         = (*snapshotFS)(nil)
+	_ fs.ReadDirFS      = (*snapshotFS)(nil)
+	_ fs.ReadFileFS     = (*snapshotFS)(nil)
+	_ fslink.ReadLinkFS = (*snapshotFS)(nil)
+)
+
+type snapshotFile struct {
+	fs.File
+	info fs.FileInfo
+	name string
+}
+
+func (f *snapshotFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *snapshotFile) ReadAt(b []byte, offset int64) (int, error) {
+	if r, ok := f.File.(io.ReaderAt); ok {
+		return r.ReadAt(b, offset)
+	}
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+}
+
+func (f *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+}
+
+type snapshotDir struct {
+	entry  *snapshotEntry
+	offset int
+}
+
+func (d *snapshotDir) Close() error {
+	return nil
+}
+
+func (d *snapshotDir) Stat() (fs.FileInfo, error) {
+	return d.entry.info, nil
+}
+
+func (d *snapshotDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: fs.ErrInvalid}
+}
+
+func (d *snapshotDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entry.entries[d.offset:]
+	if n <= 0 {
+		d.offset += len(entries)
+		return append([]fs.DirEntry{}, entries...), nil
+	}
+	if len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(entries) {
+		n = len(entries)
+	}
+	d.offset += n
+	return append([]fs.DirEntry{}, entries[:n]...), nil
+}
+
+var (
+	_ io.ReaderAt    = (*snapshotFile)(nil)
+	_ io.Seeker      = (*snapshotFile)(nil)
+	_ fs.ReadDirFile = (*snapshotDir)(nil)
+)
@@ -0,0 +1,85 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestSnapshot(t *testing.T) {
+	base := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("usr/"),
+		tarDir("usr/lib/"),
+		tarFile("usr/lib/libc.so", "libc"),
+	)
+	update := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+		tarFile("etc/.wh.passwd", ""),
+		tarSymlink("lib", "usr/lib"),
+	)
+
+	layers := ocifs.LayerFS(base, update)
+	snapshot, err := ocifs.Snapshot(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.EqualFS(layers, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(snapshot, "etc/hosts", "lib", "usr/lib/libc.so"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.ReadFile(snapshot, "lib/libc.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "libc" {
+		t.Errorf("wrong content through symbolic link: %q", b)
+	}
+	link, err := ocifs.EvalSymlinks(snapshot, "lib/libc.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "usr/lib/libc.so" {
+		t.Errorf("wrong symbolic link resolution: %q", link)
+	}
+	if _, err := fs.Stat(snapshot, "etc/passwd"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("files masked by whiteouts must not exist in the snapshot: %v", err)
+	}
+}
+
+func TestSnapshotDoesNotStatLayers(t *testing.T) {
+	lower := &countStatFS{MapFS: fstest.MapFS{
+		"a/b/file": &fstest.MapFile{Mode: 0444, Data: []byte("lower")},
+	}}
+	upper := &countStatFS{MapFS: fstest.MapFS{
+		"a/b/other": &fstest.MapFile{Mode: 0444, Data: []byte("upper")},
+	}}
+
+	snapshot, err := ocifs.Snapshot(ocifs.LayerFS(lower, upper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lower.stats.Store(0)
+	upper.stats.Store(0)
+
+	for i := 0; i < 10; i++ {
+		for _, name := range []string{"a/b/file", "a/b/other", "a/b/nope"} {
+			fs.Stat(snapshot, name)
+		}
+		if _, err := fs.ReadDir(snapshot, "a/b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := lower.stats.Load() + upper.stats.Load(); n != 0 {
+		t.Errorf("the snapshot must not access the layers to resolve paths: stats=%d", n)
+	}
+}
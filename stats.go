@@ -0,0 +1,232 @@
+package ocifs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+)
+
+// LayerStat carries statistics about the contribution of a layer to the merged
+// view of a layered file system.
+type LayerStat struct {
+	// Index of the layer, in the order that layers were passed to LayerFS.
+	Index int
+	// Size of the raw layer, or -1 if it is unknown. The size is known when
+	// the layer has a method with the signature Size() int64.
+	Size int64
+	// Number of files, directories, and symbolic links that the layer
+	// contributes to the merged view.
+	Files int
+	// Number of whiteout files and opaque markers in the layer which are
+	// masking content of lower layers in the merged view. Whiteouts masking
+	// files which do not exist in the lower layers are not counted.
+	Whiteouts int
+	// Total size of the regular files contributed to the merged view.
+	Bytes int64
+}
+
+// LayerStats walks the merged view of fsys and returns statistics about the
+// contribution of each layer, in the order that layers were passed to LayerFS.
+//
+// File systems returned by the Sub method of layered file systems only retain
+// the layers which contain the directory, the statistics of the other layers
+// are still reported, with no files and an unknown size.
+//
+// If fsys is not a layered file system, it is treated as a single layer.
+func LayerStats(fsys fs.FS) ([]LayerStat, error) {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		layers = LayerFS(fsys).(*layerFS)
+	}
+
+	numLayers := 0
+	for _, layer := range layers.layers {
+		numLayers = max(numLayers, layer.index+1)
+	}
+	stats := make([]LayerStat, numLayers)
+	for i := range stats {
+		stats[i].Index = i
+		stats[i].Size = -1
+	}
+	for _, layer := range layers.layers {
+		if s, ok := baseFS(layer.fsys).(interface{ Size() int64 }); ok {
+			stats[layer.index].Size = s.Size()
+		}
+	}
+
+	err := fs.WalkDir(layers, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		visibleLayers, _, err := layers.lookup("stat", name)
+		if err != nil {
+			return err
+		}
+
+		if name != "." {
+			stat := &stats[visibleLayers[0].index]
+			stat.Files++
+			if entry.Type().IsRegular() {
+				info, err := entry.Info()
+				if err != nil {
+					return err
+				}
+				stat.Bytes += info.Size()
+			}
+		}
+
+		if entry.IsDir() {
+			for _, layer := range visibleLayers {
+				entries, err := fs.ReadDir(layer.fsys, name)
+				if err != nil {
+					return err
+				}
+				for _, e := range entries {
+					if !layers.config.isWhiteout(e.Name()) {
+						continue
+					}
+					masking, err := layers.masksLowerLayers(layer, name, e.Name())
+					if err != nil {
+						return err
+					}
+					if masking {
+						stats[layer.index].Whiteouts++
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// masksLowerLayers returns true if the whiteout file or opaque marker named
+// whiteout in the directory dir of the layer l masks files of the layers below
+// it.
+func (fsys *layerFS) masksLowerLayers(l layer, dir, whiteout string) (bool, error) {
+	c := fsys.config
+	var below *layerFS
+	for i, layer := range fsys.layers {
+		if layer.index == l.index {
+			below = newLayerFS(fsys.layers[i+1:], c)
+		}
+	}
+	if len(below.layers) == 0 {
+		return false, nil
+	}
+	switch {
+	case c.fold(whiteout) == c.fold(c.whiteoutOpaque):
+		entries, err := below.ReadDirCtx(context.Background(), dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return len(entries) > 0, err
+	case c.isWhiteoutMetadata(whiteout):
+		return false, nil
+	default:
+		_, err := below.Lstat(path.Join(dir, whiteout[len(c.whiteoutPrefix):]))
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
+// Origin returns the index of the layer that the file at name resolves to in
+// the layered file system fsys, in the order that layers were passed to
+// LayerFS. Files masked by whiteouts are reported as not existing rather than
+// resolving to the lower layers.
+//
+// If fsys is not a layered file system, it is treated as a single layer.
+func Origin(fsys fs.FS, name string) (int, error) {
+	_, index, err := resolveLayer(fsys, "origin", name)
+	return index, err
+}
+
+// Resolve returns both the information of the file at name in the layered file
+// system fsys and the index of the layer that it resolves to, in the order that
+// layers were passed to LayerFS, resolving the layers of the path once instead
+// of calling Stat and Origin. Files masked by whiteouts are reported as not
+// existing rather than resolving to the lower layers.
+//
+// Like Stat, symbolic links in the last component of name are not followed.
+// If fsys is not a layered file system, it is treated as a single layer.
+func Resolve(fsys fs.FS, name string) (info fs.FileInfo, layerIndex int, err error) {
+	return resolveLayer(fsys, "resolve", name)
+}
+
+func resolveLayer(fsys fs.FS, op, name string) (fs.FileInfo, int, error) {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		layers = LayerFS(fsys).(*layerFS)
+	}
+	return layers.find(op, name)
+}
+
+// DiskUsage walks the merged view of fsys and returns the number of regular
+// files and their total size. Files present in multiple layers are only
+// counted once, with the size they have in the top most layer, and files
+// masked by whiteouts are not counted.
+//
+// If fsys is not a layered file system, it is treated as a single layer.
+func DiskUsage(fsys fs.FS) (files int64, bytes int64, err error) {
+	usage, err := DiskUsageByDir(fsys)
+	if err != nil {
+		return 0, 0, err
+	}
+	root := usage["."]
+	return root.Files, root.Bytes, nil
+}
+
+// DirUsage is the disk usage of a directory reported by DiskUsageByDir.
+type DirUsage struct {
+	// Number of regular files in the directory and its subdirectories.
+	Files int64
+	// Total size of the regular files in the directory and its subdirectories.
+	Bytes int64
+}
+
+// DiskUsageByDir is like DiskUsage but returns the usage of each directory of
+// the merged view, including the content of its subdirectories like du(1).
+// The usage of the whole file system is reported for the root directory ".".
+func DiskUsageByDir(fsys fs.FS) (map[string]DirUsage, error) {
+	if _, ok := fsys.(*layerFS); !ok {
+		fsys = LayerFS(fsys)
+	}
+
+	usage := make(map[string]DirUsage)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			usage[name] = DirUsage{}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			u := usage[dir]
+			u.Files++
+			u.Bytes += info.Size()
+			usage[dir] = u
+			if dir == "." {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,289 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+type sizedFS struct {
+	fstest.MapFS
+	size int64
+}
+
+func (fsys sizedFS) Size() int64 { return fsys.size }
+
+func TestLayerStats(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer0 := fstest.MapFS{
+		"etc":        dir(),
+		"etc/passwd": file("root:x:0:0"),
+		"etc/hosts":  file("localhost"),
+		"tmp":        dir(),
+		"tmp/junk":   file("junk"),
+	}
+
+	layer1 := fstest.MapFS{
+		"etc":          dir(),
+		"etc/hosts":    file("127.0.0.1 localhost"), // shadows layer0
+		"tmp":          dir(),
+		"tmp/.wh.junk": file(""), // masks tmp/junk
+	}
+
+	layer2 := fstest.MapFS{
+		"usr":         dir(),
+		"usr/bin":     dir(),
+		"usr/bin/app": file("#!/bin/sh"),
+	}
+
+	fsys := ocifs.LayerFS(layer0, sizedFS{layer1, 1024}, layer2)
+
+	stats, err := ocifs.LayerStats(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []ocifs.LayerStat{
+		{Index: 0, Size: -1, Files: 1, Whiteouts: 0, Bytes: 10},
+		{Index: 1, Size: 1024, Files: 3, Whiteouts: 1, Bytes: 19},
+		{Index: 2, Size: -1, Files: 3, Whiteouts: 0, Bytes: 9},
+	}
+
+	if !reflect.DeepEqual(stats, expect) {
+		t.Errorf("wrong layer stats:\nwant=%+v\ngot= %+v", expect, stats)
+	}
+
+	// Only the top layer contains usr, the statistics of the layers dropped by
+	// Sub are still reported at their index.
+	sub, err := fs.Sub(fsys, "usr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = ocifs.LayerStats(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect = []ocifs.LayerStat{
+		{Index: 0, Size: -1},
+		{Index: 1, Size: -1},
+		{Index: 2, Size: -1, Files: 2, Whiteouts: 0, Bytes: 9},
+	}
+
+	if !reflect.DeepEqual(stats, expect) {
+		t.Errorf("wrong layer stats of sub file system:\nwant=%+v\ngot= %+v", expect, stats)
+	}
+}
+
+func TestLayerStatsWhiteouts(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	layer0 := fstest.MapFS{
+		"a":   dir(),
+		"a/x": file("x"),
+		"b":   dir(),
+		"c":   dir(),
+		"c/y": file("y"),
+	}
+
+	layer1 := fstest.MapFS{
+		"a":                 dir(),
+		"a/.wh.x":           file(""), // masks a/x
+		"a/.WH.nothing":     file(""), // masks nothing
+		"b":                 dir(),
+		"b/.wh..wh..opq":    file(""), // b is empty in layer0
+		"c":                 dir(),
+		"c/.WH..WH..OPQ":    file(""), // masks c/y
+		".wh..wh.plnk":      dir(),    // aufs metadata
+		".wh..wh.plnk/1234": file(""),
+	}
+
+	fsys := ocifs.LayerFSWithOptions([]fs.FS{layer0, layer1}, ocifs.WithCaseInsensitive())
+
+	stats, err := ocifs.LayerStats(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Whiteouts != 0 || stats[1].Whiteouts != 2 {
+		t.Errorf("only whiteouts masking files of lower layers must be counted: %+v", stats)
+	}
+
+	// The layer in the middle does not contain a, so the layers below the
+	// top one are not adjacent in the sub file system.
+	fsys = ocifs.LayerFS(layer0, fstest.MapFS{"b": dir()}, layer1)
+	sub, err := fs.Sub(fsys, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = ocifs.LayerStats(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || stats[0].Whiteouts != 0 || stats[1].Whiteouts != 0 || stats[2].Whiteouts != 1 {
+		t.Errorf("whiteouts must be counted against the layers below in the sub file system: %+v", stats)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	layer0 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarFile("etc/group", "root:x:0:"),
+	)
+	layer1 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarFile("etc/hostname", "container"),
+	)
+	layer2 := tarFS(t,
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+	)
+
+	layers := ocifs.LayerFS(layer0, layer1, layer2)
+
+	for name, index := range map[string]int{
+		".":            2,
+		"etc":          2, // implied by etc/hosts in layer2
+		"etc/group":    0,
+		"etc/hostname": 1,
+		"etc/hosts":    2,
+	} {
+		origin, err := ocifs.Origin(layers, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if origin != index {
+			t.Errorf("%s: wrong origin: want=%d got=%d", name, index, origin)
+		}
+	}
+
+	if _, err := ocifs.Origin(layers, "etc/passwd"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the origin of a whiteout file must fail with fs.ErrNotExist: %v", err)
+	}
+	if origin, err := ocifs.Origin(layer0, "etc/passwd"); err != nil || origin != 0 {
+		t.Errorf("wrong origin in a single layer: %d (%v)", origin, err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	layer0 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+	layer1 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/.wh.passwd", ""),
+		tarSymlink("etc/localtime", "/usr/share/zoneinfo/UTC"),
+	)
+	layer2 := tarFS(t,
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+	)
+
+	layers := ocifs.LayerFS(layer0, layer1, layer2)
+
+	for _, test := range []struct {
+		name  string
+		index int
+		size  int64
+		mode  fs.FileMode
+	}{
+		{name: "etc/hosts", index: 2, size: 19},
+		{name: "etc/localtime", index: 1, mode: fs.ModeSymlink},
+		{name: "etc", index: 2, mode: fs.ModeDir},
+	} {
+		info, index, err := ocifs.Resolve(layers, test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if index != test.index {
+			t.Errorf("%s: wrong layer: want=%d got=%d", test.name, test.index, index)
+		}
+		if info.Mode().Type() != test.mode {
+			t.Errorf("%s: wrong type: want=%v got=%v", test.name, test.mode, info.Mode().Type())
+		}
+		if test.mode == 0 && info.Size() != test.size {
+			t.Errorf("%s: wrong size: want=%d got=%d", test.name, test.size, info.Size())
+		}
+		if s, err := fs.Stat(layers, test.name); err != nil || s.Mode() != info.Mode() {
+			t.Errorf("%s: information differs from Stat: %v (%v)", test.name, s, err)
+		}
+	}
+
+	if _, index, err := ocifs.Resolve(layers, "etc/passwd"); !errors.Is(err, fs.ErrNotExist) || index != -1 {
+		t.Errorf("resolving a whiteout file must fail with fs.ErrNotExist: %d (%v)", index, err)
+	}
+	if info, index, err := ocifs.Resolve(layer0, "etc/passwd"); err != nil || index != 0 || info.Size() != 10 {
+		t.Errorf("wrong resolution in a single layer: %d (%v)", index, err)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	layer0 := fstest.MapFS{
+		"etc/passwd":  file("root:x:0:0"),
+		"etc/hosts":   file("localhost"),
+		"tmp/junk":    file("junk"),
+		"usr/bin/app": file("app"),
+	}
+	layer1 := fstest.MapFS{
+		"etc/hosts":    file("127.0.0.1 localhost"), // shadows layer0
+		"etc/.wh.junk": file(""),                    // does not match any file
+		"tmp/.wh.junk": file(""),                    // masks tmp/junk
+		"usr/bin/tool": file("tool"),
+	}
+
+	files, bytes, err := ocifs.DiskUsage(ocifs.LayerFS(layer0, layer1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// etc/passwd (10) + etc/hosts (19) + usr/bin/app (3) + usr/bin/tool (4)
+	if files != 4 || bytes != 36 {
+		t.Errorf("wrong disk usage: files=%d bytes=%d", files, bytes)
+	}
+
+	usage, err := ocifs.DiskUsageByDir(ocifs.LayerFS(layer0, layer1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]ocifs.DirUsage{
+		".":       {Files: 4, Bytes: 36},
+		"etc":     {Files: 2, Bytes: 29},
+		"tmp":     {Files: 0, Bytes: 0},
+		"usr":     {Files: 2, Bytes: 7},
+		"usr/bin": {Files: 2, Bytes: 7},
+	}
+	if !reflect.DeepEqual(usage, expect) {
+		t.Errorf("wrong disk usage by directory:\nwant=%v\ngot= %v", expect, usage)
+	}
+
+	// A single layer is not affected by its own whiteout files.
+	files, bytes, err = ocifs.DiskUsage(layer1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 || bytes != 23 {
+		t.Errorf("wrong disk usage of a single layer: files=%d bytes=%d", files, bytes)
+	}
+}
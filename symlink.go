@@ -0,0 +1,144 @@
+package ocifs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// EvalSymlinks returns the path name after resolving all the symbolic links it
+// contains, like filepath.EvalSymlinks but for the file system fsys. When fsys
+// is a layered file system, the links are resolved through the merged view of
+// its layers, accounting for whiteouts.
+//
+// An error wrapping fs.ErrInvalid is returned if a link target is absolute or
+// escapes the root of fsys, and an error wrapping syscall.ELOOP is returned if
+// more than 40 links are followed (or the limit set by WithMaxSymlinkDepth on a
+// layered file system).
+//
+// This function is useful to safely serve the content of container images,
+// since the returned path never leaves the file system.
+func EvalSymlinks(fsys fs.FS, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "evalsymlinks", Path: name, Err: fs.ErrInvalid}
+	}
+
+	limit := maxSymlinks
+	if layers, ok := fsys.(*layerFS); ok {
+		limit = layers.config.maxSymlinks
+	}
+
+	resolved, rest := ".", name
+	links := 0
+
+	for rest != "." {
+		elem, tail, _ := strings.Cut(rest, "/")
+		next := path.Join(resolved, elem)
+
+		link, err := readRawLink(fsys, next)
+		switch {
+		case err == nil:
+			if links++; links > limit {
+				return "", errTooManyLinks("evalsymlinks", name)
+			}
+			target, ok := joinLink(next, link, tail)
+			if !ok {
+				return "", errEscapingLink("evalsymlinks", name, next, link)
+			}
+			// Links are resolved from the root again since the target may
+			// itself contain symbolic links.
+			resolved, rest = ".", path.Join(".", target)
+		case errors.Is(err, fs.ErrInvalid):
+			resolved, rest = next, path.Join(".", tail)
+		default:
+			return "", err
+		}
+	}
+
+	if _, ok := fsys.(fslink.ReadLinkFS); !ok {
+		// File systems without support for symbolic links report all names as
+		// invalid links, check that the file exists.
+		if _, err := fs.Stat(fsys, resolved); err != nil {
+			return "", err
+		}
+	}
+	return resolved, nil
+}
+
+// Lstat returns information about the file at name in fsys without following
+// the symbolic link if it is one, so the mode of links has fs.ModeSymlink set.
+// When fsys is a layered file system, the information is read from the top
+// most layer where the file is visible, and links masked by whiteouts are
+// reported as not existing.
+//
+// If fsys has no Lstat method, the information is obtained by listing the
+// parent directory, see fslink.Lstat.
+func Lstat(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if l, ok := fsys.(interface {
+		Lstat(string) (fs.FileInfo, error)
+	}); ok {
+		return l.Lstat(name)
+	}
+	return fslink.Lstat(fsys, name)
+}
+
+// readRawLink reads the symbolic link at name, returning absolute targets
+// instead of rejecting them so the callers can report or refuse them. When fsys
+// is a layered file system, the link is read from the top layer where name is
+// visible.
+func readRawLink(fsys fs.FS, name string) (string, error) {
+	if layers, ok := fsys.(*layerFS); ok {
+		visibleLayers, realName, err := layers.lookup("readlink", name)
+		if err != nil {
+			return "", err
+		}
+		return readLink(visibleLayers[0].fsys, realName)
+	}
+	return readLink(fsys, name)
+}
+
+// readLink is like fslink.ReadLink but it does not reject absolute targets,
+// which are common in container images; paths going through them are refused
+// by joinLink.
+func readLink(fsys fs.FS, name string) (string, error) {
+	if f, ok := fsys.(fslink.ReadLinkFS); ok {
+		return f.ReadLink(name)
+	}
+	return fslink.ReadLink(fsys, name)
+}
+
+// maxSymlinks is the default maximum number of symbolic links followed when
+// resolving a path, which is the same limit as Linux.
+const maxSymlinks = 40
+
+func errTooManyLinks(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("too many levels of symbolic links (%w)", syscall.ELOOP)}
+}
+
+// joinLink returns the path obtained by replacing the symbolic link at name
+// with its target and appending the rest of the path. The target is resolved
+// relative to the directory of name. False is returned if the target is
+// absolute or escapes the root, either would reach outside the file system if
+// the layers were extracted to a directory.
+func joinLink(name, link, rest string) (string, bool) {
+	if strings.HasPrefix(link, "/") {
+		return "", false
+	}
+	target := path.Join(path.Dir(name), link)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return "", false
+	}
+	return strings.TrimPrefix(path.Clean("/"+target+"/"+rest), "/"), true
+}
+
+// errEscapingLink returns the error reported when resolving name requires
+// following the symbolic link at linkName, whose target is absolute or escapes
+// the root.
+func errEscapingLink(op, name, linkName, link string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("symbolic link %s escapes the root: %q (%w)", linkName, link, fs.ErrInvalid)}
+}
@@ -0,0 +1,218 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestEvalSymlinks(t *testing.T) {
+	layer1 := tarFS(t,
+		tarDir("usr/"),
+		tarDir("usr/lib/"),
+		tarFile("usr/lib/libc.so.6", "libc"),
+		tarSymlink("usr/lib/libc.so", "libc.so.6"),
+		tarSymlink("lib", "usr/lib"),
+		tarDir("etc/"),
+		tarSymlink("etc/localtime", "../usr/share/zoneinfo/UTC"),
+		tarSymlink("etc/escape", "../../etc"),
+		tarSymlink("etc/absolute", "/usr/share/zoneinfo/UTC"),
+		tarSymlink("loop", "loop"),
+		tarFile("usr/share", "?"),
+	)
+
+	layer2 := tarFS(t,
+		tarDir("usr/"),
+		tarFile("usr/.wh.share", ""),
+		tarDir("usr/share/"),
+		tarDir("usr/share/zoneinfo/"),
+		tarFile("usr/share/zoneinfo/UTC", "UTC"),
+		tarSymlink("usr/lib64", "../lib"),
+	)
+
+	layers := ocifs.LayerFS(layer1, layer2)
+
+	tests := []struct {
+		name   string
+		expect string
+	}{
+		{".", "."},
+		{"usr/lib/libc.so.6", "usr/lib/libc.so.6"},
+		{"usr/lib/libc.so", "usr/lib/libc.so.6"},
+		{"lib/libc.so", "usr/lib/libc.so.6"},
+		{"usr/lib64/libc.so", "usr/lib/libc.so.6"},
+		{"usr/lib64", "usr/lib"},
+		{"etc/localtime", "usr/share/zoneinfo/UTC"},
+	}
+
+	for _, test := range tests {
+		resolved, err := ocifs.EvalSymlinks(layers, test.name)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if resolved != test.expect {
+			t.Errorf("%s: wrong path: want=%q got=%q", test.name, test.expect, resolved)
+		}
+	}
+
+	if _, err := ocifs.EvalSymlinks(layers, "lib/nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("resolving a missing file must fail with fs.ErrNotExist: %v", err)
+	}
+	for _, name := range []string{"etc/escape/passwd", "etc/absolute"} {
+		if _, err := ocifs.EvalSymlinks(layers, name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%s: resolving a link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+		}
+	}
+	if _, err := ocifs.EvalSymlinks(layers, "loop"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("resolving a symbolic link cycle must fail with ELOOP: %v", err)
+	}
+}
+
+func TestSymlinkTraversal(t *testing.T) {
+	layer := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("var/"),
+		tarDir("var/www/"),
+		tarSymlink("var/www/absolute", "/etc/passwd"),
+		tarSymlink("var/www/relative", "../../../../etc/passwd"),
+		tarSymlink("var/www/etc", "../../../../etc"),
+		tarSymlink("var/www/dotdot", "/../../etc"),
+	)
+	layers := ocifs.LayerFS(layer)
+	snapshot, err := ocifs.Snapshot(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpfs := ocifs.HTTPFS(layers)
+
+	readFile := func(fsys fs.FS, name string) (string, error) {
+		resolved, err := ocifs.EvalSymlinks(fsys, name)
+		if err != nil {
+			return "", err
+		}
+		b, err := fs.ReadFile(fsys, resolved)
+		return string(b), err
+	}
+	readHTTP := func(name string) (string, error) {
+		f, err := httpfs.Open("/" + name)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		return string(b), err
+	}
+
+	// Absolute targets, including ".." at the root, and relative targets
+	// escaping the root are refused by all the helpers which resolve paths.
+	for _, name := range []string{
+		"var/www/absolute",
+		"var/www/dotdot/passwd",
+		"var/www/relative",
+		"var/www/etc/passwd",
+	} {
+		for _, fsys := range []fs.FS{layers, snapshot} {
+			if _, err := readFile(fsys, name); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("%s: resolving a link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+			}
+		}
+		if _, err := readHTTP(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%s: serving a link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+		}
+	}
+	for _, name := range []string{"var/www/dotdot/passwd", "var/www/etc/passwd"} {
+		for _, fsys := range []fs.FS{layers, snapshot} {
+			if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("%s: stat through a link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+			}
+			if _, err := fsys.Open(name); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("%s: open through a link escaping the root must fail with fs.ErrInvalid: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestMaxSymlinkDepth(t *testing.T) {
+	layer1 := tarFS(t,
+		tarSymlink("a", "b"),
+		tarSymlink("self", "self"),
+		tarDir("dir/"),
+		tarFile("dir/file", "hello"),
+		tarSymlink("link1", "dir"),
+	)
+
+	layer2 := tarFS(t,
+		tarSymlink("b", "a"), // cycle with a in layer1
+		tarSymlink("link2", "link1"),
+	)
+
+	layer3 := tarFS(t,
+		tarSymlink("self", "./self"), // masks the link in layer1
+		tarSymlink("link3", "link2"),
+	)
+
+	layers := ocifs.LayerFSWithOptions([]fs.FS{layer1, layer2, layer3}, ocifs.WithMaxSymlinkDepth(2))
+
+	for _, name := range []string{"a/file", "b/file", "self/file", "link3/file"} {
+		if _, err := fs.Stat(layers, name); !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("%s: stat must fail with ELOOP: %v", name, err)
+		} else if _, ok := err.(*fs.PathError); !ok {
+			t.Errorf("%s: error must be a *fs.PathError: %T", name, err)
+		}
+		if _, err := ocifs.EvalSymlinks(layers, name); !errors.Is(err, syscall.ELOOP) {
+			t.Errorf("%s: resolving symbolic links must fail with ELOOP: %v", name, err)
+		}
+	}
+
+	// Chains of links which are within the limit are resolved.
+	b, err := fs.ReadFile(layers, "link2/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("wrong file content: %q", b)
+	}
+	if _, err := fs.Stat(ocifs.LayerFS(layer1, layer2, layer3), "link3/file"); err != nil {
+		t.Errorf("the default limit must allow three levels of symbolic links: %v", err)
+	}
+}
+
+func TestLstat(t *testing.T) {
+	base := tarFS(t,
+		tarDir("usr/"),
+		tarDir("usr/lib/"),
+		tarFile("usr/lib/libc.so", "libc"),
+		tarSymlink("lib", "usr/lib"),
+		tarSymlink("old", "usr/lib"),
+	)
+	update := tarFS(t,
+		tarFile(".wh.old", ""),
+	)
+
+	for _, fsys := range []fs.FS{base, ocifs.LayerFS(base, update), openOnlyFS{ocifs.LayerFS(base, update)}} {
+		info, err := ocifs.Lstat(fsys, "lib")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Type() != fs.ModeSymlink {
+			t.Errorf("%T: lstat must not follow symbolic links: %v", fsys, info.Mode())
+		}
+
+	}
+
+	info, err := ocifs.Lstat(ocifs.LayerFS(base, update), "lib/libc.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("intermediate symbolic links must be followed: %v", info.Mode())
+	}
+
+	if _, err := ocifs.Lstat(ocifs.LayerFS(base, update), "old"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("lstat of a symbolic link masked by a whiteout must fail with fs.ErrNotExist: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// FileInfoSys is the value returned by the Sys method of fs.FileInfo values
+// of a layered file system when the layers carry the metadata of files in tar
+// headers (e.g. layers returned by TarFS or BlobFS).
+type FileInfoSys struct {
+	// User and group owning the file.
+	Uid, Gid int
+	// Access, modification, and change times of the file. The times have
+	// nanosecond precision when the archive was written in the PAX format,
+	// the access and change times are zero if they were not recorded.
+	Atime, Mtime, Ctime time.Time
+	// Device number of character and block devices, encoded like the st_rdev
+	// field of the stat structure on Linux.
+	Rdev uint64
+	// Extended attributes of the file, or nil if it has none.
+	Xattrs map[string][]byte
+}
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+func fileInfoSys(sys any) (*FileInfoSys, bool) {
+	switch sys := sys.(type) {
+	case *FileInfoSys:
+		return sys, true
+	case *tar.Header:
+		s := &FileInfoSys{
+			Uid:   sys.Uid,
+			Gid:   sys.Gid,
+			Atime: sys.AccessTime,
+			Mtime: sys.ModTime,
+			Ctime: sys.ChangeTime,
+		}
+		if sys.Typeflag == tar.TypeChar || sys.Typeflag == tar.TypeBlock {
+			s.Rdev = makedev(sys.Devmajor, sys.Devminor)
+		}
+		for key, value := range sys.PAXRecords {
+			if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+				if s.Xattrs == nil {
+					s.Xattrs = make(map[string][]byte)
+				}
+				s.Xattrs[name] = []byte(value)
+			}
+		}
+		return s, true
+	default:
+		return nil, false
+	}
+}
+
+// Xattrs returns the extended attributes of the file at name in fsys, or nil
+// if the file has none. Extended attributes are read from the tar headers of
+// the layers (see FileInfoSys).
+//
+// When fsys is a layered file system, the attributes of a directory present in
+// multiple layers are merged, the attributes of upper layers overriding those
+// of lower layers. Layers masked by whiteouts do not contribute attributes.
+func Xattrs(fsys fs.FS, name string) (map[string][]byte, error) {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		return xattrs(info), nil
+	}
+
+	visibleLayers, realName, err := layers.lookup("xattrs", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs map[string][]byte
+	for i := len(visibleLayers) - 1; i >= 0; i-- {
+		info, err := layers.stat(visibleLayers[i], realName)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range xattrs(info) {
+			if attrs == nil {
+				attrs = make(map[string][]byte)
+			}
+			attrs[key] = value
+		}
+	}
+	return attrs, nil
+}
+
+func xattrs(info fs.FileInfo) map[string][]byte {
+	if s, ok := fileInfoSys(info.Sys()); ok {
+		return s.Xattrs
+	}
+	return nil
+}
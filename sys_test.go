@@ -0,0 +1,151 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestFileInfoSys(t *testing.T) {
+	mtime := time.Date(2023, 7, 1, 12, 30, 0, 123456789, time.UTC)
+	atime := mtime.Add(time.Hour)
+
+	layer := tarFS(t,
+		tarDir("bin/"),
+		&tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       "bin/ping",
+			Mode:       0755,
+			Uid:        1000,
+			Gid:        100,
+			ModTime:    mtime,
+			AccessTime: atime,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+			},
+		},
+	)
+
+	layers := ocifs.LayerFS(layer)
+	info, err := fs.Stat(layers, "bin/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sys, ok := info.Sys().(*ocifs.FileInfoSys)
+	if !ok {
+		t.Fatalf("wrong type returned by Sys: %T", info.Sys())
+	}
+	if sys.Uid != 1000 || sys.Gid != 100 {
+		t.Errorf("wrong ownership: uid=%d gid=%d", sys.Uid, sys.Gid)
+	}
+	if !sys.Mtime.Equal(mtime) {
+		t.Errorf("wrong modification time: want=%v got=%v", mtime, sys.Mtime)
+	}
+	if !sys.Atime.Equal(atime) {
+		t.Errorf("wrong access time: want=%v got=%v", atime, sys.Atime)
+	}
+	if !sys.Ctime.IsZero() {
+		t.Errorf("change time must be zero when it was not recorded: %v", sys.Ctime)
+	}
+	if capability := string(sys.Xattrs["security.capability"]); capability != "\x01\x00\x00\x02" {
+		t.Errorf("wrong extended attribute: %q", capability)
+	}
+
+	entries, err := fs.ReadDir(layers, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryInfo, err := entries[0].Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entryInfo.Sys().(*ocifs.FileInfoSys); !ok {
+		t.Errorf("wrong type returned by Sys of directory entries: %T", entryInfo.Sys())
+	}
+
+	// Layers which do not carry tar metadata are passed through.
+	mapLayer := fstest.MapFS{"file": &fstest.MapFile{Mode: 0644, Sys: "sys"}}
+	info, err = fs.Stat(ocifs.LayerFS(mapLayer), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Sys() != "sys" {
+		t.Errorf("wrong value returned by Sys: %v", info.Sys())
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	xattrs := func(header *tar.Header, attrs map[string]string) *tar.Header {
+		header.Format = tar.FormatPAX
+		header.PAXRecords = make(map[string]string)
+		for key, value := range attrs {
+			header.PAXRecords["SCHILY.xattr."+key] = value
+		}
+		return header
+	}
+
+	layer1 := tarFS(t,
+		xattrs(tarDir("etc/"), map[string]string{
+			"security.selinux": "system_u:object_r:etc_t:s0",
+			"user.layer":       "1",
+		}),
+		xattrs(tarFile("etc/shadow", "?"), map[string]string{
+			"security.selinux": "system_u:object_r:shadow_t:s0",
+		}),
+		xattrs(tarFile("etc/hosts", "localhost"), map[string]string{
+			"user.layer": "1",
+		}),
+	)
+
+	layer2 := tarFS(t,
+		xattrs(tarDir("etc/"), map[string]string{
+			"user.layer": "2",
+		}),
+		tarFile("etc/.wh.shadow", ""),
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+	)
+
+	layers := ocifs.LayerFS(layer1, layer2)
+
+	attrs, err := ocifs.Xattrs(layers, "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][]byte{
+		"security.selinux": []byte("system_u:object_r:etc_t:s0"),
+		"user.layer":       []byte("2"),
+	}
+	if !reflect.DeepEqual(attrs, expect) {
+		t.Errorf("wrong attributes of merged directory: want=%q got=%q", expect, attrs)
+	}
+
+	// The file in the upper layer replaces the lower one, including its
+	// extended attributes.
+	attrs, err = ocifs.Xattrs(layers, "etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs != nil {
+		t.Errorf("attributes of a masked file must not be returned: %q", attrs)
+	}
+
+	if _, err := ocifs.Xattrs(layers, "etc/shadow"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("reading attributes of a whiteout file must fail with fs.ErrNotExist: %v", err)
+	}
+
+	attrs, err = ocifs.Xattrs(layer1, "etc/shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(attrs["security.selinux"]) != "system_u:object_r:shadow_t:s0" {
+		t.Errorf("wrong attributes of a single layer: %q", attrs)
+	}
+}
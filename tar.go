@@ -0,0 +1,569 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stealthrocket/fslink"
+)
+
+// TarFS constructs a file system from the content of a tar archive, typically
+// a layer of an OCI image.
+//
+// The archive is indexed when the function is called, the content of files is
+// read from r on demand. Directories which are implied by the paths of entries
+// in the archive but do not have their own headers are synthesized with mode
+// 0755. When the archive contains multiple entries for the same path, the last
+// one wins, which matches the behavior of extracting the archive with tar; use
+// WithStrictPaths to reject such archives instead. Global PAX headers are applied to the entries that follow them and do not
+// appear in the file system.
+//
+// Whiteout files are exposed verbatim so the file system can be stacked with
+// LayerFS. Symbolic links are not followed, they can be read with the ReadLink
+// method. Hard links are exposed as regular files sharing the content of the
+// files they point to. Devices and named pipes are exposed with their types and
+// device numbers (see FileInfoSys), opening them returns files with no content.
+//
+// Files opened from the file system implement io.ReaderAt and io.Seeker.
+func TarFS(r io.ReaderAt, size int64, options ...Option) (fs.FS, error) {
+	section := io.NewSectionReader(r, 0, size)
+	fsys, err := readTar(section, func() (int64, bool) {
+		offset, err := section.Seek(0, io.SeekCurrent)
+		return offset, err == nil
+	}, r, options...)
+	if err != nil {
+		return nil, err
+	}
+	fsys.size = size
+	return fsys, nil
+}
+
+// ErrDuplicateEntry is returned when a tar archive contains multiple entries
+// for the same path and WithStrictPaths is used.
+var ErrDuplicateEntry = errors.New("duplicate entry")
+
+// TarGzFS is like TarFS but the tar archive is read from a gzip-compressed
+// stream, which is the usual format of OCI image layers (media type
+// application/vnd.oci.image.layer.v1.tar+gzip).
+//
+// Because gzip streams cannot be read at random offsets, the content of files
+// is buffered in memory so that files opened from the file system still
+// implement io.ReaderAt and io.Seeker.
+//
+// Decompression errors are returned as *fs.PathError values wrapping the
+// error from the gzip decoder.
+func TarGzFS(r io.Reader) (fs.FS, error) {
+	return tarGzFS(r, nil)
+}
+
+func tarGzFS(r io.Reader, check diffIDCheck) (fs.FS, error) {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: "gzip", Err: err}
+	}
+	defer z.Close()
+	return readCompressedTar(z, "gzip", check)
+}
+
+// diffIDCheck is a function called with the digest of an uncompressed tar
+// stream (the layer diffID) after it was fully read.
+type diffIDCheck func(diffID string) error
+
+// readCompressedTar indexes a tar archive read from a stream, draining the
+// stream after the end of the archive so the decompressor verifies checksums.
+func readCompressedTar(r io.Reader, format string, check diffIDCheck) (*tarFS, error) {
+	var h hash.Hash
+	if check != nil {
+		h = sha256.New()
+		r = io.TeeReader(r, h)
+	}
+	fsys, err := readTar(r, func() (int64, bool) { return 0, false }, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: format, Err: err}
+	}
+	if check != nil {
+		if err := check("sha256:" + hex.EncodeToString(h.Sum(nil))); err != nil {
+			return nil, err
+		}
+	}
+	return fsys, nil
+}
+
+type tarFS struct {
+	files map[string]*tarEntry
+	size  int64
+}
+
+type tarEntry struct {
+	header  *tar.Header
+	info    fs.FileInfo
+	data    io.ReaderAt
+	entries []fs.DirEntry
+}
+
+// readTar indexes the entries of a tar archive read from r. The offset
+// function returns the position of r when file data can be read directly from
+// the source, in which case the content of files is not buffered in memory.
+func readTar(r io.Reader, offset func() (int64, bool), source io.ReaderAt, options ...Option) (*tarFS, error) {
+	c := newConfig(options)
+	fsys := newTarFS()
+	s := newTarScanner(r, offset, source)
+	// paths of the entries read so far, only tracked in strict mode
+	var seen map[string]struct{}
+	if c.strictPaths {
+		seen = map[string]struct{}{}
+	}
+	for {
+		name, entry, err := s.next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if seen != nil {
+			if _, dup := seen[name]; dup {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: ErrDuplicateEntry}
+			}
+			seen[name] = struct{}{}
+		}
+		fsys.put(name, entry)
+	}
+
+	if err := fsys.resolveHardlinks(); err != nil {
+		return nil, err
+	}
+	if err := fsys.link(); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+func newTarFS() *tarFS {
+	return &tarFS{
+		files: map[string]*tarEntry{
+			".": newTarDir("."),
+		},
+		size: -1,
+	}
+}
+
+// tarScanner reads the entries of a tar archive one at a time, see readTar.
+type tarScanner struct {
+	tr      *tar.Reader
+	offset  func() (int64, bool)
+	source  io.ReaderAt
+	globals map[string]string
+}
+
+func newTarScanner(r io.Reader, offset func() (int64, bool), source io.ReaderAt) *tarScanner {
+	return &tarScanner{
+		tr:      tar.NewReader(r),
+		offset:  offset,
+		source:  source,
+		globals: map[string]string{},
+	}
+}
+
+// next returns the next entry of the archive which can be exposed in a file
+// system, with its cleaned name. The error is io.EOF at the end of the archive.
+func (s *tarScanner) next() (string, *tarEntry, error) {
+	for {
+		header, err := s.tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return "", nil, io.EOF
+			}
+			return "", nil, &fs.PathError{Op: "read", Path: "tar", Err: err}
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			for key, value := range header.PAXRecords {
+				s.globals[key] = value
+			}
+			continue
+		}
+		applyGlobals(header, s.globals)
+
+		name, ok := cleanTarPath(header.Name)
+		if !ok {
+			continue
+		}
+
+		entry := &tarEntry{header: header}
+		header.Name = name
+
+		if !isSupportedTarEntry(header) {
+			continue
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			if start, ok := s.offset(); ok && !isSparse(header) {
+				entry.data = io.NewSectionReader(s.source, start, header.Size)
+			} else {
+				b, err := io.ReadAll(s.tr)
+				if err != nil {
+					return "", nil, &fs.PathError{Op: "read", Path: name, Err: err}
+				}
+				entry.data = bytes.NewReader(b)
+			}
+		}
+
+		entry.info = header.FileInfo()
+		return name, entry, nil
+	}
+}
+
+func newTarDir(name string) *tarEntry {
+	header := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name,
+		Mode:     0755,
+	}
+	return &tarEntry{header: header, info: header.FileInfo()}
+}
+
+// applyGlobals sets the values of global PAX records on the header, unless the
+// header has its own values for them.
+func applyGlobals(header *tar.Header, globals map[string]string) {
+	for key, value := range globals {
+		if _, ok := header.PAXRecords[key]; ok {
+			continue
+		}
+		switch key {
+		case "uid":
+			fmt.Sscan(value, &header.Uid)
+		case "gid":
+			fmt.Sscan(value, &header.Gid)
+		case "uname":
+			header.Uname = value
+		case "gname":
+			header.Gname = value
+		case "mtime":
+			header.ModTime = parsePAXTime(value)
+		case "atime":
+			header.AccessTime = parsePAXTime(value)
+		case "ctime":
+			header.ChangeTime = parsePAXTime(value)
+		}
+	}
+}
+
+func parsePAXTime(s string) time.Time {
+	var sec, nsec int64
+	secs, frac, _ := strings.Cut(s, ".")
+	fmt.Sscan(secs, &sec)
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		fmt.Sscan(frac, &nsec)
+	}
+	return time.Unix(sec, nsec)
+}
+
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanTarPath converts the name of a tar entry to a path usable in a fs.FS,
+// returning false if the name is not valid or escapes the root.
+func cleanTarPath(name string) (string, bool) {
+	name = path.Clean("/" + name)[1:]
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+// isSupportedTarEntry returns true if the file described by header can be
+// exposed in a file system.
+//
+// Devices and named pipes are exposed with their types, and have no content.
+// Character devices with device number 0/0 are also the whiteouts of the
+// overlayfs convention (see WithCharDeviceWhiteouts).
+func isSupportedTarEntry(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink,
+		tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	default:
+		return false
+	}
+}
+
+// put adds the entry at name to the file system, replacing the previous entry
+// for the same path.
+func (fsys *tarFS) put(name string, entry *tarEntry) {
+	prev := fsys.files[name]
+	if prev != nil && prev.header.Typeflag == tar.TypeDir {
+		if entry.header.Typeflag == tar.TypeDir {
+			// The directory was already seen (or synthesized), only its
+			// metadata changes.
+			prev.header = entry.header
+			prev.info = entry.info
+			return
+		}
+		fsys.removeAll(name)
+	}
+	fsys.files[name] = entry
+}
+
+func (fsys *tarFS) removeAll(name string) {
+	prefix := name + "/"
+	for key := range fsys.files {
+		if strings.HasPrefix(key, prefix) {
+			delete(fsys.files, key)
+		}
+	}
+}
+
+// resolveHardlinks makes hard links share the content of the regular files
+// that they point to. Hard links are resolved after the whole archive was read,
+// so their targets may appear later in the archive.
+func (fsys *tarFS) resolveHardlinks() error {
+	for name, entry := range fsys.files {
+		if entry.header.Typeflag != tar.TypeLink {
+			continue
+		}
+		target := entry
+		// Hard links to hard links are followed, bounded by the number of
+		// entries in case of cycles.
+		for i := 0; target != nil && target.header.Typeflag == tar.TypeLink && i <= len(fsys.files); i++ {
+			linkname, ok := cleanTarPath(target.header.Linkname)
+			if !ok {
+				target = nil
+				break
+			}
+			target = fsys.files[linkname]
+		}
+		if target == nil || target.header.Typeflag != tar.TypeReg {
+			return &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("hard link to missing regular file: %q (%w)", entry.header.Linkname, fs.ErrNotExist)}
+		}
+		header := *entry.header
+		header.Size = target.header.Size
+		entry.header = &header
+		entry.info = header.FileInfo()
+		entry.data = target.data
+	}
+	return nil
+}
+
+// link constructs the directory listings, synthesizing the parent directories
+// that did not have their own entries in the archive.
+func (fsys *tarFS) link() error {
+	names := make([]string, 0, len(fsys.files))
+	for name := range fsys.files {
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		for child := name; child != "."; {
+			parent := path.Dir(child)
+			if dir := fsys.files[parent]; dir != nil {
+				if !dir.info.IsDir() {
+					return &fs.PathError{Op: "read", Path: name, Err: fmt.Errorf("parent is not a directory (%w)", fs.ErrInvalid)}
+				}
+				break
+			}
+			fsys.files[parent] = newTarDir(parent)
+			child = parent
+		}
+	}
+
+	for name, entry := range fsys.files {
+		if name != "." {
+			parent := fsys.files[path.Dir(name)]
+			parent.entries = append(parent.entries, fs.FileInfoToDirEntry(entry.info))
+		}
+	}
+
+	for _, entry := range fsys.files {
+		sort.Slice(entry.entries, func(i, j int) bool {
+			return entry.entries[i].Name() < entry.entries[j].Name()
+		})
+	}
+	return nil
+}
+
+func (fsys *tarFS) entry(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	entry := fsys.files[name]
+	if entry == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+// Size returns the size of the tar archive, or -1 if it is unknown.
+func (fsys *tarFS) Size() int64 {
+	return fsys.size
+}
+
+func (fsys *tarFS) Open(name string) (fs.File, error) {
+	entry, err := fsys.entry("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.open(), nil
+}
+
+func (fsys *tarFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := fsys.entry("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info, nil
+}
+
+func (fsys *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := fsys.entry("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.readDir()
+}
+
+func (fsys *tarFS) ReadFile(name string) ([]byte, error) {
+	entry, err := fsys.entry("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return entry.readFile()
+}
+
+func (fsys *tarFS) ReadLink(name string) (string, error) {
+	entry, err := fsys.entry("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return entry.readLink()
+}
+
+func (entry *tarEntry) open() fs.File {
+	if entry.info.IsDir() {
+		return &tarDir{entry: entry}
+	}
+	file := &tarFile{entry: entry}
+	if entry.data != nil {
+		file.SectionReader = *io.NewSectionReader(entry.data, 0, entry.header.Size)
+	}
+	return file
+}
+
+func (entry *tarEntry) readDir() ([]fs.DirEntry, error) {
+	if !entry.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: entry.header.Name, Err: fs.ErrInvalid}
+	}
+	return append([]fs.DirEntry{}, entry.entries...), nil
+}
+
+func (entry *tarEntry) readFile() ([]byte, error) {
+	if !entry.info.Mode().IsRegular() {
+		return nil, &fs.PathError{Op: "read", Path: entry.header.Name, Err: fs.ErrInvalid}
+	}
+	b := make([]byte, entry.header.Size)
+	if _, err := entry.data.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, &fs.PathError{Op: "read", Path: entry.header.Name, Err: err}
+	}
+	return b, nil
+}
+
+func (entry *tarEntry) readLink() (string, error) {
+	if entry.header.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: entry.header.Name, Err: fs.ErrInvalid}
+	}
+	return entry.header.Linkname, nil
+}
+
+var (
+	_ fs.StatFS         = (*tarFS)(nil)
+	_ fs.ReadDirFS      = (*tarFS)(nil)
+	_ fs.ReadFileFS     = (*tarFS)(nil)
+	_ fslink.ReadLinkFS = (*tarFS)(nil)
+)
+
+type tarFile struct {
+	io.SectionReader
+	entry *tarEntry
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.entry.info, nil
+}
+
+var (
+	_ io.ReaderAt = (*tarFile)(nil)
+	_ io.Seeker   = (*tarFile)(nil)
+)
+
+type tarDir struct {
+	entry  *tarEntry
+	offset int
+}
+
+func (d *tarDir) Close() error {
+	return nil
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) {
+	return d.entry.info, nil
+}
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.header.Name, Err: fs.ErrInvalid}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entry.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+	return append([]fs.DirEntry{}, entries...), nil
+}
+
+func (d *tarDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &fs.PathError{Op: "seek", Path: d.entry.header.Name, Err: fs.ErrInvalid}
+	}
+	d.offset = 0
+	return 0, nil
+}
+
+var (
+	_ fs.ReadDirFile = (*tarDir)(nil)
+	_ io.Seeker      = (*tarDir)(nil)
+)
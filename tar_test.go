@@ -0,0 +1,488 @@
+package ocifs_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func tarDir(name string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}
+}
+
+func tarFile(name, data string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data)), Linkname: data}
+}
+
+func tarSymlink(name, target string) *tar.Header {
+	return &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Mode: 0777, Linkname: target}
+}
+
+// makeTar constructs a tar archive from a list of headers. For regular files,
+// the content is taken from the Linkname field of the header.
+func makeTar(t testing.TB, headers ...*tar.Header) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, h := range headers {
+		h := *h
+		data := ""
+		if h.Typeflag == tar.TypeReg {
+			data, h.Linkname = h.Linkname, ""
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarFS(t testing.TB, headers ...*tar.Header) fs.FS {
+	t.Helper()
+	b := makeTar(t, headers...)
+	fsys, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestTarFS(t *testing.T) {
+	layer := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarSymlink("etc/localhost", "hosts"),
+		tarFile("usr/bin/app", "#!/bin/sh"), // no headers for usr/ and usr/bin/
+		tarFile("tmp/file", "first"),
+		tarFile("tmp/file", "second"), // duplicates take the last entry
+	)
+
+	if err := fstest.TestFS(layer, "etc/hosts", "usr/bin/app", "tmp/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"usr", "usr/bin"} {
+		s, err := fs.Stat(layer, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Mode() != 0755|fs.ModeDir {
+			t.Errorf("%s: wrong mode of implied directory: %v", name, s.Mode())
+		}
+	}
+
+	b, err := fs.ReadFile(layer, "tmp/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "second" {
+		t.Errorf("duplicate entries must resolve to the last one: %q", b)
+	}
+
+	link, err := fslink.ReadLink(layer, "etc/localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "hosts" {
+		t.Errorf("wrong symbolic link target: %q", link)
+	}
+
+	f, err := layer.Open("etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b = make([]byte, 4)
+	if _, err := f.(io.ReaderAt).ReadAt(b, 5); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "host" {
+		t.Errorf("wrong content read at offset: %q", b)
+	}
+	if _, err := f.(io.Seeker).Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(f); string(b) != "host" {
+		t.Errorf("wrong content read after seek: %q", b)
+	}
+}
+
+func TestTarFSStrictPaths(t *testing.T) {
+	tests := []struct {
+		scenario string
+		headers  []*tar.Header
+		path     string
+	}{
+		{
+			scenario: "duplicate files",
+			headers: []*tar.Header{
+				tarDir("a/"),
+				tarFile("a/b", "first"),
+				tarFile("a/b", "second"),
+			},
+			path: "a/b",
+		},
+		{
+			scenario: "duplicate directories",
+			headers: []*tar.Header{
+				tarDir("a/"),
+				tarFile("a/b", "b"),
+				tarDir("a/"),
+			},
+			path: "a",
+		},
+		{
+			scenario: "file replacing a directory",
+			headers: []*tar.Header{
+				tarDir("a/"),
+				tarFile("a", "a"),
+			},
+			path: "a",
+		},
+		{
+			scenario: "symlink replacing a file",
+			headers: []*tar.Header{
+				tarFile("a", "a"),
+				tarSymlink("a", "b"),
+			},
+			path: "a",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			b := makeTar(t, test.headers...)
+
+			// The last entry wins by default.
+			if _, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b))); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b)), ocifs.WithStrictPaths())
+			if !errors.Is(err, ocifs.ErrDuplicateEntry) {
+				t.Fatalf("duplicate entries must fail with ocifs.ErrDuplicateEntry: %v", err)
+			}
+			var pathErr *fs.PathError
+			if !errors.As(err, &pathErr) || pathErr.Path != test.path {
+				t.Errorf("the error must report the duplicate path %q: %v", test.path, err)
+			}
+		})
+	}
+
+	// Archives without duplicates are accepted.
+	b := makeTar(t,
+		tarDir("a/"),
+		tarFile("a/b", "b"),
+		tarFile("c/d", "d"), // no header for c/
+	)
+	fsys, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b)), ocifs.WithStrictPaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a/b", "c/d"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarFSGlobalHeader(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	layer := tarFS(t,
+		&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"mtime": "1600000000"},
+		},
+		tarFile("hello", "world"),
+	)
+
+	entries, err := fs.ReadDir(layer, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "hello" {
+		t.Fatalf("global headers must not appear in the file system: %v", entries)
+	}
+
+	s, err := fs.Stat(layer, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.ModTime().Equal(mtime) {
+		t.Errorf("global header was not applied: want=%v got=%v", mtime, s.ModTime())
+	}
+}
+
+func TestTarFSLayers(t *testing.T) {
+	layer1 := tarFS(t,
+		tarDir("a/"),
+		tarDir("a/x/"),
+		tarFile("a/x/one", "1"),
+		tarFile("a/x/two", "2"),
+		tarFile("a/y", "y"),
+	)
+
+	layer2 := tarFS(t,
+		tarDir("a/"),
+		tarFile("a/.wh.y", ""),
+		tarDir("a/x/"),
+		tarFile("a/x/.wh..wh..opq", ""),
+		tarFile("a/x/three", "3"),
+	)
+
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+
+	dir := func() *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0555 | fs.ModeDir}
+	}
+
+	expect := fstest.MapFS{
+		"a":         dir(),
+		"a/x":       dir(),
+		"a/x/three": file("3"),
+	}
+
+	layers := ocifs.LayerFS(layer1, layer2)
+	if err := fstest.EqualFS(expect, layers); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(layers, "a", "a/x", "a/x/three"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarFSHardlinks(t *testing.T) {
+	hardlink := func(name, target string) *tar.Header {
+		return &tar.Header{Typeflag: tar.TypeLink, Name: name, Mode: 0644, Linkname: target}
+	}
+
+	layer1 := tarFS(t,
+		tarDir("bin/"),
+		hardlink("bin/sh", "bin/busybox"), // target appears later in the archive
+		tarFile("bin/busybox", "#!busybox"),
+		hardlink("bin/ls", "./bin/busybox"),
+		hardlink("bin/cat", "bin/ls"), // hard link to a hard link
+	)
+
+	for _, name := range []string{"bin/sh", "bin/ls", "bin/cat"} {
+		b, err := fs.ReadFile(layer1, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "#!busybox" {
+			t.Errorf("%s: wrong content: %q", name, b)
+		}
+
+		f, err := layer1.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 6)
+		n, err := f.(io.ReaderAt).ReadAt(buf, 2)
+		f.Close()
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "busybo" {
+			t.Errorf("%s: wrong content read at offset: %q", name, buf[:n])
+		}
+	}
+
+	// Hard links are resolved within their layer, masking the target in an
+	// upper layer does not affect the hard links.
+	layer2 := tarFS(t,
+		tarDir("bin/"),
+		tarFile("bin/.wh.busybox", ""),
+	)
+
+	expect := fstest.MapFS{
+		"bin":     &fstest.MapFile{Mode: 0555 | fs.ModeDir},
+		"bin/cat": &fstest.MapFile{Mode: 0444, Data: []byte("#!busybox")},
+		"bin/ls":  &fstest.MapFile{Mode: 0444, Data: []byte("#!busybox")},
+		"bin/sh":  &fstest.MapFile{Mode: 0444, Data: []byte("#!busybox")},
+	}
+	if err := fstest.EqualFS(expect, ocifs.LayerFS(layer1, layer2)); err != nil {
+		t.Fatal(err)
+	}
+
+	b := makeTar(t, hardlink("sh", "busybox"))
+	if _, err := ocifs.TarFS(bytes.NewReader(b), int64(len(b))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("hard links to missing files must fail with fs.ErrNotExist: %v", err)
+	}
+}
+
+func gzipBytes(t testing.TB, b []byte) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarGzFS(t *testing.T) {
+	b := makeTar(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/.wh.passwd", ""),
+	)
+
+	layer, err := ocifs.TarGzFS(bytes.NewReader(gzipBytes(t, b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(layer, "etc/hosts", "etc/.wh.passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := layer.Open("etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 4)
+	if _, err := f.(io.ReaderAt).ReadAt(buf, 5); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "host" {
+		t.Errorf("wrong content read at offset: %q", buf)
+	}
+}
+
+func TestTarGzFSInvalid(t *testing.T) {
+	z := gzipBytes(t, makeTar(t, tarFile("hello", "world")))
+
+	tests := []struct {
+		scenario string
+		data     []byte
+		err      error
+	}{
+		{
+			scenario: "not a gzip stream",
+			data:     []byte("hello world"),
+			err:      gzip.ErrHeader,
+		},
+		{
+			scenario: "corrupted checksum",
+			data:     append(append([]byte{}, z[:len(z)-8]...), 0, 0, 0, 0, 0, 0, 0, 0),
+			err:      gzip.ErrChecksum,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			_, err := ocifs.TarGzFS(bytes.NewReader(test.data))
+			var pathErr *fs.PathError
+			if !errors.As(err, &pathErr) {
+				t.Fatalf("error must be a *fs.PathError: %v", err)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("wrong error: want=%v got=%v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestTarFSSpecialFiles(t *testing.T) {
+	lower := tarFS(t,
+		tarDir("dev/"),
+		&tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0666, Devmajor: 1, Devminor: 3},
+		&tar.Header{Typeflag: tar.TypeBlock, Name: "dev/sda", Mode: 0660, Devmajor: 8, Devminor: 0},
+		&tar.Header{Typeflag: tar.TypeFifo, Name: "dev/initctl", Mode: 0600},
+	)
+	upper := tarFS(t,
+		tarDir("dev/"),
+		tarFile("dev/.wh.sda", ""),
+	)
+
+	tests := []struct {
+		name string
+		mode fs.FileMode
+		rdev uint64
+	}{
+		{"dev/null", fs.ModeDevice | fs.ModeCharDevice | 0666, 1<<8 | 3},
+		{"dev/sda", fs.ModeDevice | 0660, 8 << 8},
+		{"dev/initctl", fs.ModeNamedPipe | 0600, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := fs.Stat(lower, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode() != test.mode {
+				t.Errorf("wrong mode: want=%v got=%v", test.mode, info.Mode())
+			}
+
+			layers := ocifs.LayerFS(lower)
+			info, err = fs.Stat(layers, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Type() != test.mode.Type() {
+				t.Errorf("wrong file type in layered file system: want=%v got=%v", test.mode.Type(), info.Mode().Type())
+			}
+			sys, ok := info.Sys().(*ocifs.FileInfoSys)
+			if !ok {
+				t.Fatalf("wrong type returned by Sys: %T", info.Sys())
+			}
+			if sys.Rdev != test.rdev {
+				t.Errorf("wrong device number: want=%#x got=%#x", test.rdev, sys.Rdev)
+			}
+
+			f, err := layers.Open(test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if s, err := f.Stat(); err != nil {
+				t.Error(err)
+			} else if s.Mode().Type() != test.mode.Type() {
+				t.Errorf("wrong file type of open file: want=%v got=%v", test.mode.Type(), s.Mode().Type())
+			}
+			if b, err := io.ReadAll(f); err != nil || len(b) != 0 {
+				t.Errorf("special files must have no content: %q (%v)", b, err)
+			}
+		})
+	}
+
+	layers := ocifs.LayerFS(lower, upper)
+	if _, err := fs.Stat(layers, "dev/sda"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("devices masked by whiteouts must not exist: %v", err)
+	}
+	entries, err := fs.ReadDir(layers, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"initctl", "null"}) {
+		t.Errorf("wrong directory entries: %q", names)
+	}
+}
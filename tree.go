@@ -0,0 +1,114 @@
+package ocifs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// Tree writes to w an indented tree of the merged view of fsys, like tree(1),
+// which is useful to explain how the layers of an image combine. Each entry is
+// annotated with its type, the size of regular files, and the index of the
+// layer that it resolves to, as reported by Origin:
+//
+//	. (dir, layer 1)
+//	├── bin -> usr/bin (symlink, layer 0)
+//	└── etc (dir, layer 1)
+//	    ├── hosts (file, 9 bytes, layer 0)
+//	    └── passwd (file, 10 bytes, layer 1)
+//
+// The entries of directories are listed like WalkDir does, in lexical order;
+// files masked by whiteouts are not printed.
+//
+// If fsys is not a layered file system, it is treated as a single layer.
+func Tree(w io.Writer, fsys fs.FS) error {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		layers = LayerFS(fsys).(*layerFS)
+	}
+	root, err := layers.walkRoot(".")
+	if err != nil {
+		return err
+	}
+	p := &treePrinter{fsys: layers, w: bufio.NewWriter(w)}
+	if err := p.print(".", ".", root, "", ""); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+type treePrinter struct {
+	fsys *layerFS
+	w    *bufio.Writer
+}
+
+// print writes the line of the file at name, prefixed with branch, then the
+// lines of its entries if it is a directory, indented with indent. The entries
+// are listed like WalkDir does, from the layers that the directory is visible
+// in, so printing the tree does not resolve the path of every file.
+func (p *treePrinter) print(name, label string, entry *walkEntry, branch, indent string) error {
+	info, err := entry.Info()
+	if err != nil {
+		return err
+	}
+	index := entry.layers[0].index
+
+	mode := info.Mode()
+	switch mode.Type() {
+	case fs.ModeDir:
+		fmt.Fprintf(p.w, "%s%s (dir, layer %d)\n", branch, label, index)
+	case fs.ModeSymlink:
+		link, err := readRawLink(p.fsys, name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.w, "%s%s -> %s (symlink, layer %d)\n", branch, label, link, index)
+	case 0:
+		fmt.Fprintf(p.w, "%s%s (file, %d bytes, layer %d)\n", branch, label, info.Size(), index)
+	default:
+		fmt.Fprintf(p.w, "%s%s (%s, layer %d)\n", branch, label, fileTypeName(mode), index)
+	}
+	if !mode.IsDir() {
+		return nil
+	}
+
+	entries, err := p.fsys.walkReadDir(name, entry)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		branch, next := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, next = "└── ", "    "
+		}
+		if err := p.print(path.Join(name, entry.Name()), entry.Name(), entry, indent+branch, indent+next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileTypeName returns the name of the type of files with the given mode, as
+// printed by Tree and DumpJSON.
+func fileTypeName(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeCharDevice != 0:
+		return "char device"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	case mode&fs.ModeNamedPipe != 0:
+		return "pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	default:
+		return "irregular"
+	}
+}
@@ -0,0 +1,106 @@
+package ocifs_test
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestTree(t *testing.T) {
+	layer0 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+		tarDir("tmp/"),
+		tarFile("tmp/junk", "junk"),
+		tarDir("usr/"),
+		tarDir("usr/bin/"),
+		tarFile("usr/bin/sh", "#!"),
+	)
+	layer1 := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "127.0.0.1 localhost"),
+		tarDir("tmp/"),
+		tarFile("tmp/.wh.junk", ""),
+		tarSymlink("bin", "usr/bin"),
+	)
+	fsys := ocifs.LayerFS(layer0, layer1)
+
+	var b strings.Builder
+	if err := ocifs.Tree(&b, fsys); err != nil {
+		t.Fatal(err)
+	}
+	expect := `. (dir, layer 1)
+├── bin -> usr/bin (symlink, layer 1)
+├── etc (dir, layer 1)
+│   ├── hosts (file, 19 bytes, layer 1)
+│   └── passwd (file, 10 bytes, layer 0)
+├── tmp (dir, layer 1)
+└── usr (dir, layer 0)
+    └── bin (dir, layer 0)
+        └── sh (file, 2 bytes, layer 0)
+`
+	if got := b.String(); got != expect {
+		t.Errorf("wrong tree:\nwant:\n%s\ngot:\n%s", expect, got)
+	}
+
+	// File systems which are not layered are printed as a single layer,
+	// whiteout files are hidden like ReadDir does.
+	b.Reset()
+	if err := ocifs.Tree(&b, layer1); err != nil {
+		t.Fatal(err)
+	}
+	expect = `. (dir, layer 0)
+├── bin -> usr/bin (symlink, layer 0)
+├── etc (dir, layer 0)
+│   └── hosts (file, 19 bytes, layer 0)
+└── tmp (dir, layer 0)
+`
+	if got := b.String(); got != expect {
+		t.Errorf("wrong tree of a single layer:\nwant:\n%s\ngot:\n%s", expect, got)
+	}
+}
+
+func TestTreeDoesNotResolvePaths(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0644, Data: []byte(data)}
+	}
+	layer0 := &countStatFS{MapFS: fstest.MapFS{
+		"etc/hosts":      file("localhost"),
+		"etc/passwd":     file("root:x:0:0"),
+		"usr/bin/sh":     file("#!"),
+		"usr/lib/libc.a": file("!<arch>"),
+	}}
+	layer1 := &countStatFS{MapFS: fstest.MapFS{
+		"etc/.wh.passwd":  file(""),
+		"etc/group":       file("root:x:0:"),
+		"usr/lib/libm.a":  file("!<arch>"),
+		"usr/share/doc/a": file("a"),
+	}}
+	stats := func() int64 { return layer0.stats.Load() + layer1.stats.Load() }
+	fsys := ocifs.LayerFS(layer0, layer1)
+
+	// Printing the tree must not stat more files than walking it and
+	// getting the information of every entry.
+	before := stats()
+	ocifs.WalkDir(fsys, ".", func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = d.Info()
+		return err
+	})
+	walkStats := stats() - before
+
+	before = stats()
+	if err := ocifs.Tree(io.Discard, fsys); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats() - before; n > walkStats {
+		t.Errorf("printing the tree must not resolve the path of files: WalkDir=%d Tree=%d", walkStats, n)
+	}
+}
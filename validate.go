@@ -0,0 +1,198 @@
+package ocifs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ProblemKind represents the kind of problems reported by Validate.
+type ProblemKind int
+
+const (
+	// The layer is nil or its content could not be read.
+	InvalidLayer ProblemKind = iota
+	// A whiteout file or opaque marker does not mask any file of the layers
+	// below.
+	UnusedWhiteout
+	// The relative target of a symbolic link escapes the root of the file
+	// system; resolving paths through the link fails with fs.ErrInvalid.
+	EscapingSymlink
+	// A file replaces a directory of the layers below, or a directory replaces
+	// a file, without a whiteout file masking the file below.
+	TypeConflict
+)
+
+func (kind ProblemKind) String() string {
+	switch kind {
+	case InvalidLayer:
+		return "invalid layer"
+	case UnusedWhiteout:
+		return "unused whiteout"
+	case EscapingSymlink:
+		return "escaping symlink"
+	case TypeConflict:
+		return "type conflict"
+	default:
+		return "unknown"
+	}
+}
+
+// Problem describes an inconsistency of a stack of layers found by Validate.
+type Problem struct {
+	// Kind of problem.
+	Kind ProblemKind
+	// Index of the layer where the problem was found, in the order that layers
+	// were passed to LayerFS, or -1 if the problem is not specific to a layer.
+	Layer int
+	// Path of the file in the layer, or "." if the problem affects the whole
+	// layer.
+	Path string
+	// Error describing the problem.
+	Err error
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("layer %d: %s: %s: %v", p.Layer, p.Path, p.Kind, p.Err)
+}
+
+// Validate checks the consistency of the layers of fsys and returns the list of
+// problems that it found, ordered by layer from the bottom one, or nil if the
+// layers are consistent.
+//
+// The problems do not prevent the layered file system from working, they are
+// usually signs of a defect in the tools that produced the layers: whiteout
+// files masking nothing, symbolic links escaping the root, files replacing
+// directories of the lower layers (or the opposite) without whiteouts, and
+// layers which cannot be read. Errors reading a layer are reported as problems
+// of kind InvalidLayer, and the validation continues with the other files.
+//
+// If fsys is not a layered file system, it is treated as a single layer.
+func Validate(fsys fs.FS) []Problem {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		layers = LayerFS(fsys).(*layerFS)
+	}
+	v := &validator{config: layers.config}
+
+	if layers.err != nil && errors.Is(layers.err, ErrTooManyLayers) {
+		v.report(InvalidLayer, -1, ".", layers.err)
+	}
+	// The layers are ordered from the top one, and nil layers are excluded
+	// from the stacks of lower layers.
+	stack := make([]layer, 0, len(layers.layers))
+	for _, l := range layers.layers {
+		if l.fsys != nil {
+			stack = append(stack, l)
+		}
+	}
+	n := len(stack)
+	for i := len(layers.layers) - 1; i >= 0; i-- {
+		l := layers.layers[i]
+		if l.fsys == nil {
+			v.report(InvalidLayer, l.index, ".", fmt.Errorf("layer is nil: %w", fs.ErrInvalid))
+			continue
+		}
+		n--
+		v.validateLayer(l, newLayerFS(stack[n+1:], layers.config))
+	}
+	return v.problems
+}
+
+type validator struct {
+	config   *config
+	problems []Problem
+}
+
+func (v *validator) report(kind ProblemKind, layer int, name string, err error) {
+	v.problems = append(v.problems, Problem{Kind: kind, Layer: layer, Path: name, Err: err})
+}
+
+// validateLayer checks the files of the layer l against below, which is the
+// stack of the layers below it.
+func (v *validator) validateLayer(l layer, below *layerFS) {
+	c := v.config
+	fs.WalkDir(l.fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			v.report(InvalidLayer, l.index, name, err)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if name == "." {
+			return nil
+		}
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+
+		switch {
+		case !c.noWhiteouts && base == c.whiteoutOpaque:
+			if !v.hasEntries(below, dir) {
+				v.report(UnusedWhiteout, l.index, name, errors.New("opaque marker masks an empty directory"))
+			}
+			return nil
+		case c.isWhiteoutMetadata(base):
+			return nil
+		case !c.noWhiteouts && strings.HasPrefix(base, c.whiteoutPrefix):
+			v.checkMasked(l, below, name, path.Join(dir, base[len(c.whiteoutPrefix):]))
+			return nil
+		}
+
+		if c.charDeviceWhiteouts && entry.Type()&fs.ModeCharDevice != 0 {
+			if info, err := entry.Info(); err == nil && isCharDeviceWhiteout(info) {
+				v.checkMasked(l, below, name, name)
+				return nil
+			}
+		}
+
+		if entry.Type() == fs.ModeSymlink {
+			link, err := readLink(l.fsys, name)
+			if err != nil {
+				v.report(InvalidLayer, l.index, name, err)
+			} else if !strings.HasPrefix(link, "/") {
+				if target := path.Join(dir, link); target == ".." || strings.HasPrefix(target, "../") {
+					v.report(EscapingSymlink, l.index, name, fmt.Errorf("symbolic link target escapes the root: %q", link))
+				}
+			}
+		}
+
+		lower, err := fs.Stat(below, name)
+		if err != nil || lower.IsDir() == entry.IsDir() {
+			return nil
+		}
+		// The file of the lower layer may be masked by a whiteout in the same
+		// layer, which is how layers produced by image builders replace files.
+		whiteoutOne, whiteoutAll := c.whiteout(name)
+		if masked, _ := below.hasWhiteout(l, whiteoutOne, whiteoutAll); masked {
+			return nil
+		}
+		if entry.IsDir() {
+			v.report(TypeConflict, l.index, name, errors.New("directory replaces a file of the layers below"))
+		} else {
+			v.report(TypeConflict, l.index, name, errors.New("file replaces a directory of the layers below"))
+		}
+		return nil
+	})
+}
+
+// hasEntries returns true if the directory dir has entries in the stack of
+// layers below.
+func (v *validator) hasEntries(below *layerFS, dir string) bool {
+	if len(below.layers) == 0 {
+		return false
+	}
+	entries, err := below.ReadDirCtx(context.Background(), dir)
+	return err == nil && len(entries) > 0
+}
+
+// checkMasked reports a problem if the whiteout file at name does not mask the
+// file masked in the stack of layers below.
+func (v *validator) checkMasked(l layer, below *layerFS, name, masked string) {
+	if _, err := below.Lstat(masked); errors.Is(err, fs.ErrNotExist) {
+		v.report(UnusedWhiteout, l.index, name, fmt.Errorf("whiteout masks a file which does not exist: %q", masked))
+	}
+}
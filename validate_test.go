@@ -0,0 +1,84 @@
+package ocifs_test
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestValidate(t *testing.T) {
+	var lower ocifs.Builder
+	lower.AddFile("bin/sh", 0755, []byte("#!"))
+	lower.AddFile("etc/hosts", 0644, []byte("localhost"))
+	lower.AddFile("etc/passwd", 0644, []byte("root:x:0:0"))
+	lower.AddFile("lib/libc.so", 0644, []byte("ELF"))
+	lower.AddFile("lib64/libc.so", 0644, []byte("ELF"))
+	lower.AddFile("opt/app", 0644, []byte("app"))
+	lower.AddFile("var/run", 0644, []byte("file"))
+	lower.AddDir("empty", 0755)
+	lower.Remove("nothing")
+
+	var upper ocifs.Builder
+	upper.Remove("etc/passwd")
+	upper.Remove("etc/missing")
+	upper.RemoveAll("opt")
+	upper.AddFile("opt/new", 0644, []byte("new"))
+	upper.RemoveAll("empty")
+	upper.AddFile("var/run/pid", 0644, []byte("1"))
+	upper.AddFile("lib", 0644, []byte("not a directory"))
+	upper.Remove("lib64")
+	upper.AddSymlink("lib64", "lib")
+	upper.AddSymlink("usr/escape", "../../outside")
+	upper.AddSymlink("usr/absolute", "/outside")
+
+	layers := ocifs.LayerFS(build(t, &lower), build(t, &upper))
+	problems := ocifs.Validate(layers)
+
+	type problem struct {
+		Kind  ocifs.ProblemKind
+		Layer int
+		Path  string
+	}
+	got := make([]problem, len(problems))
+	for i, p := range problems {
+		got[i] = problem{p.Kind, p.Layer, p.Path}
+		if p.Err == nil {
+			t.Errorf("%s: problem has no error", p)
+		}
+	}
+	want := []problem{
+		{ocifs.UnusedWhiteout, 0, ".wh.nothing"},
+		{ocifs.UnusedWhiteout, 1, "empty/.wh..wh..opq"},
+		{ocifs.UnusedWhiteout, 1, "etc/.wh.missing"},
+		{ocifs.TypeConflict, 1, "lib"},
+		{ocifs.EscapingSymlink, 1, "usr/escape"},
+		{ocifs.TypeConflict, 1, "var/run"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("wrong problems:\nwant: %v\ngot:  %v", want, problems)
+	}
+
+	// File systems which are not layered are validated as a single layer.
+	if problems := ocifs.Validate(build(t, &lower)); len(problems) != 1 || problems[0].Kind != ocifs.UnusedWhiteout {
+		t.Errorf("wrong problems of a single layer: %v", problems)
+	}
+
+	problems = ocifs.Validate(ocifs.LayerFS(build(t, &upper), nil))
+	if len(problems) == 0 {
+		t.Fatal("no problems reported for a nil layer")
+	}
+	last := problems[len(problems)-1]
+	if last.Kind != ocifs.InvalidLayer || last.Layer != 1 || !errors.Is(last.Err, fs.ErrInvalid) {
+		t.Errorf("wrong problem reported for a nil layer: %v", last)
+	}
+
+	var clean ocifs.Builder
+	clean.Remove("etc/hosts")
+	clean.AddFile("etc/hostname", 0644, []byte("container"))
+	if problems := ocifs.Validate(ocifs.LayerFS(build(t, &lower), build(t, &clean))); len(problems) != 1 {
+		t.Errorf("only the whiteout of the lower layer must be reported: %v", problems)
+	}
+}
@@ -0,0 +1,232 @@
+package ocifs
+
+import (
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WalkDir walks the file tree rooted at root, calling fn for each file or
+// directory in the tree, including root. It behaves like fs.WalkDir, visiting
+// the entries of directories in lexical order and interpreting fs.SkipDir and
+// fs.SkipAll the same way, and falls back to fs.WalkDir when fsys is not a
+// layered file system.
+//
+// Walking a layered file system with fs.WalkDir resolves the path of every
+// directory from the root of the layers, and obtaining the information of
+// directory entries resolves their paths again. WalkDir instead carries the
+// layers that each directory is visible in down to its entries, determining
+// which layers contribute to subdirectories from the directory listings of the
+// layers, so walking the tree does not need to stat files in the layers.
+func WalkDir(fsys fs.FS, root string, fn fs.WalkDirFunc) error {
+	layers, ok := fsys.(*layerFS)
+	if !ok {
+		return fs.WalkDir(fsys, root, fn)
+	}
+
+	entry, err := layers.walkRoot(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = layers.walkDir(root, entry, fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkRoot returns the entry that walking the tree rooted at root starts from.
+func (fsys *layerFS) walkRoot(root string) (*walkEntry, error) {
+	visibleLayers, realName, err := fsys.lookup("stat", root)
+	if err != nil {
+		return nil, err
+	}
+	visibleLayers, s, err := fsys.statTop("stat", visibleLayers, realName)
+	if err != nil {
+		return nil, err
+	}
+	return &walkEntry{
+		DirEntry: fs.FileInfoToDirEntry(fsys.fileInfo(s)),
+		fsys:     fsys,
+		layers:   visibleLayers,
+		realName: realName,
+	}, nil
+}
+
+// walkEntry is a directory entry of a layered file system carrying the layers
+// that the file is visible in.
+type walkEntry struct {
+	fs.DirEntry
+	fsys     *layerFS
+	layers   []layer
+	realName string
+}
+
+func (entry *walkEntry) Info() (fs.FileInfo, error) {
+	if entry.IsDir() {
+		// Like layerEntry, the information of directories comes from the top
+		// most layer, which is already known.
+		s, err := entry.fsys.stat(entry.layers[0], entry.realName)
+		if err != nil {
+			return nil, err
+		}
+		return entry.fsys.fileInfo(s), nil
+	}
+	info, err := entry.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return entry.fsys.fileInfo(info), nil
+}
+
+func (fsys *layerFS) walkDir(name string, d *walkEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.walkReadDir(name, d)
+	if err != nil {
+		err = fn(name, d, err)
+		if err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := fsys.walkDir(path.Join(name, entry.Name()), entry, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// walkListing is the content of a directory in one of the layers.
+type walkListing struct {
+	entries   map[string]fs.DirEntry
+	whiteouts map[string]struct{}
+	opaque    bool
+}
+
+// walkReadDir lists the entries of the directory dir, determining the layers
+// that each entry is visible in. The layers of entries are resolved like
+// resolveLayers does, using the directory listings in place of calls to stat.
+func (fsys *layerFS) walkReadDir(name string, dir *walkEntry) ([]*walkEntry, error) {
+	config := fsys.config
+	whiteoutPrefix := config.fold(config.whiteoutPrefix)
+	whiteoutOpaque := config.fold(config.whiteoutOpaque)
+	layers := dir.layers
+	listings := make([]walkListing, 0, len(layers))
+	var keys []string
+
+	for i, l := range layers {
+		entries, err := fs.ReadDir(l.fsys, dir.realName)
+		if err != nil {
+			return nil, err
+		}
+		listing := walkListing{entries: make(map[string]fs.DirEntry, len(entries))}
+		for _, entry := range entries {
+			entryName := entry.Name()
+			key := config.fold(entryName)
+			switch {
+			case !config.noWhiteouts && key == whiteoutOpaque:
+				listing.opaque = true
+			case config.isWhiteoutMetadata(entryName):
+			case !config.noWhiteouts && strings.HasPrefix(key, whiteoutPrefix):
+				if listing.whiteouts == nil {
+					listing.whiteouts = make(map[string]struct{})
+				}
+				listing.whiteouts[key[len(whiteoutPrefix):]] = struct{}{}
+			default:
+				// The first of the names which only differ by case is the one
+				// visible when names are compared case-insensitively.
+				if _, seen := listing.entries[key]; !seen {
+					keys = append(keys, key)
+					listing.entries[key] = entry
+				}
+			}
+		}
+		listings = append(listings, listing)
+		if listing.opaque {
+			// The layers below are masked, the same way that dirReader drops
+			// them when it encounters the opaque marker.
+			layers = layers[:i+1]
+			break
+		}
+	}
+
+	sort.Strings(keys)
+	walkEntries := make([]*walkEntry, 0, len(keys))
+
+	for i, key := range keys {
+		if i > 0 && keys[i-1] == key {
+			continue
+		}
+		visible := make([]int, 0, len(layers))
+		for j := range layers {
+			listing := &listings[j]
+			_, masked := listing.whiteouts[key]
+			masked = masked || listing.opaque
+
+			entry, exist := listing.entries[key]
+			if !exist {
+				if masked {
+					break
+				}
+				continue
+			}
+			if config.charDeviceWhiteouts && entry.Type()&fs.ModeCharDevice != 0 {
+				if info, err := entry.Info(); err == nil && isCharDeviceWhiteout(info) {
+					break
+				}
+			}
+			if !entry.IsDir() {
+				// Files which are not directories mask the layers below, and
+				// are masked by directories of the layers above.
+				if len(visible) == 0 {
+					visible = append(visible, j)
+				}
+				break
+			}
+			visible = append(visible, j)
+			if masked {
+				break
+			}
+		}
+		if len(visible) == 0 {
+			continue
+		}
+
+		top := listings[visible[0]].entries[key]
+		entryName := top.Name()
+		config.checkSupported(path.Join(name, entryName), top.Type())
+
+		entryLayers := make([]layer, len(visible))
+		for k, j := range visible {
+			entryLayers[k] = layers[j]
+		}
+		walkEntries = append(walkEntries, &walkEntry{
+			DirEntry: top,
+			fsys:     fsys,
+			layers:   entryLayers,
+			realName: path.Join(dir.realName, entryName),
+		})
+	}
+	if config.caseInsensitive {
+		// The order of folded names may differ from the order of the names.
+		sort.Slice(walkEntries, func(i, j int) bool {
+			return walkEntries[i].Name() < walkEntries[j].Name()
+		})
+	}
+	return walkEntries, nil
+}
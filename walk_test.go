@@ -0,0 +1,115 @@
+package ocifs_test
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestWalkDir(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0644, Data: []byte(data)}
+	}
+	layer1 := &countStatFS{MapFS: fstest.MapFS{
+		"bin/sh":           file("#!"),
+		"etc/hosts":        file("localhost"),
+		"etc/passwd":       file("root:x:0:0"),
+		"opt/app/config":   file("a=1"),
+		"opt/app/data/x":   file("x"),
+		"usr/lib/libc.so":  file("ELF"),
+		"usr/share/doc/a":  file("a"),
+		"var/log/messages": file("boot"),
+		"replaced/file":    file("lower"),
+	}}
+	layer2 := &countStatFS{MapFS: fstest.MapFS{
+		"etc/.wh.passwd":       file(""),
+		"etc/group":            file("root:x:0:"),
+		"opt/app/.wh..wh..opq": file(""),
+		"opt/app/config":       file("a=2"),
+		"usr/share/doc/b":      file("b"),
+		"var/.wh.log":          file(""),
+		"replaced":             file("now a file"),
+		"tmp/.keep":            file(""),
+	}}
+	layer3 := &countStatFS{MapFS: fstest.MapFS{
+		"usr/share/.wh.doc": file(""),
+		"usr/share/man/1":   file("man"),
+		"var/log/new":       file("new"),
+	}}
+	stats := func() int64 {
+		return layer1.stats.Load() + layer2.stats.Load() + layer3.stats.Load()
+	}
+	layers := ocifs.LayerFS(layer1, layer2, layer3)
+
+	walk := func(walkDir func(fs.FS, string, fs.WalkDirFunc) error, root string, skip map[string]error) ([]string, error) {
+		var visited []string
+		err := walkDir(layers, root, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				visited = append(visited, fmt.Sprintf("%s: %v", name, err))
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			visited = append(visited, fmt.Sprintf("%s %v %v", name, d.Type(), info.Mode()))
+			return skip[name]
+		})
+		return visited, err
+	}
+
+	tests := []struct {
+		scenario string
+		root     string
+		skip     map[string]error
+	}{
+		{scenario: "walk all", root: "."},
+		{scenario: "walk subtree", root: "usr"},
+		{scenario: "walk file", root: "etc/hosts"},
+		{scenario: "walk missing", root: "var/log"},
+		{scenario: "skip directory", root: ".", skip: map[string]error{"opt": fs.SkipDir}},
+		{scenario: "skip remaining files", root: ".", skip: map[string]error{"etc/group": fs.SkipDir}},
+		{scenario: "skip all", root: ".", skip: map[string]error{"opt/app/config": fs.SkipAll}},
+		{scenario: "skip root", root: ".", skip: map[string]error{".": fs.SkipDir}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			want, wantErr := walk(fs.WalkDir, test.root, test.skip)
+			got, gotErr := walk(ocifs.WalkDir, test.root, test.skip)
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("wrong walk:\nwant: %q\ngot:  %q", want, got)
+			}
+			if wantErr != gotErr {
+				t.Errorf("wrong error: want=%v got=%v", wantErr, gotErr)
+			}
+		})
+	}
+
+	before := stats()
+	fs.WalkDir(layers, ".", func(string, fs.DirEntry, error) error { return nil })
+	walkDirStats := stats() - before
+
+	before = stats()
+	ocifs.WalkDir(layers, ".", func(string, fs.DirEntry, error) error { return nil })
+	if n := stats() - before; n*10 > walkDirStats {
+		t.Errorf("walking the layers must not stat files: fs.WalkDir=%d ocifs.WalkDir=%d", walkDirStats, n)
+	}
+
+	// File systems which are not layered are walked with fs.WalkDir.
+	var names []string
+	ocifs.WalkDir(layer3.MapFS, ".", func(name string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			names = append(names, path.Base(name))
+		}
+		return err
+	})
+	if !reflect.DeepEqual(names, []string{".wh.doc", "1", "new"}) {
+		t.Errorf("wrong files walked: %q", names)
+	}
+}
@@ -0,0 +1,43 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"io/fs"
+)
+
+// isCharDeviceWhiteout returns true if info describes a character device with
+// device number 0/0, which is how overlayfs represents whiteouts.
+func isCharDeviceWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	rdev, ok := deviceNumber(info.Sys())
+	return ok && rdev == 0
+}
+
+// deviceNumber extracts the device number from the value returned by the Sys
+// method of fs.FileInfo, returning false if it is not known.
+func deviceNumber(sys any) (uint64, bool) {
+	switch sys := sys.(type) {
+	case *tar.Header:
+		return makedev(sys.Devmajor, sys.Devminor), true
+	case *FileInfoSys:
+		return sys.Rdev, true
+	default:
+		return sysDeviceNumber(sys)
+	}
+}
+
+// makedev encodes a device number from its major and minor parts like the
+// makedev function of glibc.
+func makedev(major, minor int64) uint64 {
+	ma, mi := uint64(major), uint64(minor)
+	return (ma&0xfffff000)<<32 | (ma&0x00000fff)<<8 | (mi&0xffffff00)<<12 | (mi & 0x000000ff)
+}
+
+// unmakedev is the inverse of makedev.
+func unmakedev(dev uint64) (major, minor int64) {
+	major = int64((dev>>32)&0xfffff000 | (dev>>8)&0x00000fff)
+	minor = int64((dev>>12)&0xffffff00 | dev&0x000000ff)
+	return major, minor
+}
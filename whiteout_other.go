@@ -0,0 +1,7 @@
+//go:build !unix
+
+package ocifs
+
+func sysDeviceNumber(sys any) (uint64, bool) {
+	return 0, false
+}
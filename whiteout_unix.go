@@ -0,0 +1,12 @@
+//go:build unix
+
+package ocifs
+
+import "syscall"
+
+func sysDeviceNumber(sys any) (uint64, bool) {
+	if stat, ok := sys.(*syscall.Stat_t); ok {
+		return uint64(stat.Rdev), true
+	}
+	return 0, false
+}
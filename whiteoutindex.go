@@ -0,0 +1,84 @@
+package ocifs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sync"
+)
+
+// WithWhiteoutIndex configures the layered file system to index the whiteout
+// files of its layers instead of checking for them with fs.Stat.
+//
+// Resolving a path checks every layer for the whiteout files which could mask
+// each component of the path, which mostly results in negative lookups since
+// images usually have few whiteouts. With this option, the directories of each
+// layer are listed the first time that a path within them is resolved, and the
+// names of the whiteout files they contain are retained in memory, so checking
+// for whiteouts no longer accesses the layers. The index grows with the number
+// of distinct directories accessed, but only the names of whiteout files are
+// retained.
+//
+// The option is most effective with layers where fs.Stat performs a system
+// call or a network request, for example layers backed by directories of the
+// local file system.
+func WithWhiteoutIndex() Option {
+	return func(c *config) { c.whiteoutIndex = true }
+}
+
+// whiteoutIndex records the names of the whiteout files in the directories of
+// the layers of a layered file system.
+type whiteoutIndex struct {
+	mutex sync.Mutex
+	dirs  map[whiteoutDir]map[string]struct{}
+}
+
+type whiteoutDir struct {
+	layer int
+	name  string
+}
+
+// has returns true if the layer has the whiteout file at name.
+func (index *whiteoutIndex) has(fsys *layerFS, l layer, name string) (bool, error) {
+	dir, base := path.Split(name)
+	whiteouts, err := index.whiteouts(fsys, l, path.Clean(dir))
+	if err != nil {
+		return false, err
+	}
+	_, ok := whiteouts[fsys.config.fold(base)]
+	return ok, nil
+}
+
+func (index *whiteoutIndex) whiteouts(fsys *layerFS, l layer, dir string) (map[string]struct{}, error) {
+	key := whiteoutDir{layer: l.index, name: dir}
+
+	index.mutex.Lock()
+	whiteouts, ok := index.dirs[key]
+	index.mutex.Unlock()
+	if ok {
+		return whiteouts, nil
+	}
+
+	entries, err := fs.ReadDir(l.fsys, dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	// Directories which do not exist in the layer have no whiteouts, the nil
+	// map is recorded so the layer is not listed again.
+	for _, entry := range entries {
+		if name := entry.Name(); fsys.config.isWhiteout(name) {
+			if whiteouts == nil {
+				whiteouts = make(map[string]struct{})
+			}
+			whiteouts[fsys.config.fold(name)] = struct{}{}
+		}
+	}
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if index.dirs == nil {
+		index.dirs = make(map[whiteoutDir]map[string]struct{})
+	}
+	index.dirs[key] = whiteouts
+	return whiteouts, nil
+}
@@ -0,0 +1,69 @@
+package ocifs_test
+
+import (
+	"io/fs"
+	"testing"
+
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+func TestLayerFSWhiteoutIndex(t *testing.T) {
+	file := func(data string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: 0444, Data: []byte(data)}
+	}
+	layers := func() []fs.FS {
+		return []fs.FS{
+			&countStatFS{MapFS: fstest.MapFS{
+				"etc/hosts":        file("localhost"),
+				"etc/passwd":       file("root:x:0:0"),
+				"opt/app/config":   file("a=1"),
+				"opt/app/data/x":   file("x"),
+				"usr/lib/libc.so":  file("ELF"),
+				"usr/share/doc/a":  file("a"),
+				"usr/share/doc/b":  file("b"),
+				"var/log/messages": file("boot"),
+			}},
+			&countStatFS{MapFS: fstest.MapFS{
+				"etc/.wh.passwd":       file(""),
+				"etc/group":            file("root:x:0:"),
+				"opt/app/.wh..wh..opq": file(""),
+				"opt/app/config":       file("a=2"),
+				"usr/share/doc/c":      file("c"),
+			}},
+			&countStatFS{MapFS: fstest.MapFS{
+				"usr/share/doc/.wh.a": file(""),
+				"var/.wh.log":         file(""),
+				"var/run/pid":         file("1"),
+			}},
+		}
+	}
+	stats := func(layers []fs.FS) (n int64) {
+		for _, layer := range layers {
+			n += layer.(*countStatFS).stats.Load()
+		}
+		return n
+	}
+
+	for _, options := range [][]ocifs.Option{
+		nil,
+		{ocifs.WithCaseInsensitive()},
+		{ocifs.WithLookupCache(), ocifs.WithStatCache(100)},
+	} {
+		withoutIndex, withIndex := layers(), layers()
+		expect := ocifs.LayerFSWithOptions(withoutIndex, options...)
+		indexed := ocifs.LayerFSWithOptions(withIndex, append(options, ocifs.WithWhiteoutIndex())...)
+
+		if err := fstest.EqualFS(expect, indexed); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"etc/passwd", "opt/app/data/x", "usr/share/doc/a", "var/log/messages"} {
+			if _, err := fs.Stat(indexed, name); err == nil {
+				t.Errorf("%s: the file masked by a whiteout must not exist", name)
+			}
+		}
+		if n, m := stats(withIndex), stats(withoutIndex); n*2 > m {
+			t.Errorf("indexing whiteouts must reduce the number of calls to stat: with index=%d without=%d", n, m)
+		}
+	}
+}
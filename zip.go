@@ -0,0 +1,123 @@
+package ocifs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+)
+
+// ZipFS constructs a file system from the content of a zip archive, so that
+// archives which are not OCI layers can be stacked with LayerFS.
+//
+// The archive is indexed when the function is called. The content of stored
+// files is read from r on demand, while compressed files are decompressed and
+// buffered in memory so that files opened from the file system implement
+// io.ReaderAt and io.Seeker. Like TarFS, directories implied by the paths of
+// entries are synthesized with mode 0755, the last entry wins when the
+// archive contains multiple entries for the same path, and whiteout files are
+// exposed verbatim.
+//
+// Symbolic links are recognized from the Unix permissions recorded in the
+// archive, their targets are read from the content of the entries. Entries of
+// other types than regular files, directories, and symbolic links are ignored.
+func ZipFS(r io.ReaderAt, size int64) (fs.FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: "zip", Err: err}
+	}
+
+	fsys := &tarFS{
+		files: map[string]*tarEntry{
+			".": newTarDir("."),
+		},
+		size: size,
+	}
+
+	for _, f := range zr.File {
+		name, ok := cleanTarPath(f.Name)
+		if !ok {
+			continue
+		}
+		header := zipHeader(name, &f.FileHeader)
+		if header == nil || (name == "." && header.Typeflag != tar.TypeDir) {
+			continue
+		}
+		entry := &tarEntry{header: header}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			data, err := zipData(r, f)
+			if err != nil {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+			}
+			entry.data = data
+		case tar.TypeSymlink:
+			rc, err := f.Open()
+			if err != nil {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+			}
+			link, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+			}
+			header.Linkname = string(link)
+			header.Size = 0
+		}
+
+		entry.info = header.FileInfo()
+		fsys.put(name, entry)
+	}
+
+	if err := fsys.link(); err != nil {
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// zipHeader converts the header of a zip entry to a tar header, returning nil
+// if the type of the entry is not supported.
+func zipHeader(name string, h *zip.FileHeader) *tar.Header {
+	mode := h.Mode()
+	header := &tar.Header{
+		Name:    name,
+		Mode:    tarMode(mode),
+		ModTime: h.Modified,
+	}
+	switch mode.Type() {
+	case fs.ModeDir:
+		header.Typeflag = tar.TypeDir
+	case fs.ModeSymlink:
+		header.Typeflag = tar.TypeSymlink
+	case 0:
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(h.UncompressedSize64)
+	default:
+		return nil
+	}
+	return header
+}
+
+// zipData returns the content of a regular file of the archive. Stored files
+// are read directly from r, compressed files are buffered in memory.
+func zipData(r io.ReaderAt, f *zip.File) (io.ReaderAt, error) {
+	if f.Method == zip.Store {
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(r, offset, int64(f.UncompressedSize64)), nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
@@ -0,0 +1,128 @@
+package ocifs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/stealthrocket/fslink"
+	"github.com/stealthrocket/fstest"
+	"github.com/stealthrocket/ocifs"
+)
+
+type zipEntry struct {
+	name   string
+	mode   fs.FileMode
+	data   string
+	method uint16
+}
+
+func makeZip(t testing.TB, entries ...zipEntry) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: e.method}
+		h.SetMode(e.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipFS(t *testing.T) {
+	b := makeZip(t,
+		zipEntry{name: "docs/", mode: fs.ModeDir | 0755},
+		zipEntry{name: "docs/README", mode: 0644, data: "stored", method: zip.Store},
+		zipEntry{name: "docs/guide.txt", mode: 0600, data: "deflated content", method: zip.Deflate},
+		zipEntry{name: "docs/latest", mode: fs.ModeSymlink | 0777, data: "guide.txt"},
+		zipEntry{name: "data/pack/a.bin", mode: 0644, data: "a"},
+		zipEntry{name: "etc/.wh.passwd", mode: 0644},
+	)
+	layer, err := ocifs.ZipFS(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(layer, "docs/README", "docs/guide.txt", "data/pack/a.bin", "etc/.wh.passwd"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mode := range map[string]fs.FileMode{
+		"docs":           fs.ModeDir | 0755,
+		"docs/README":    0644,
+		"docs/guide.txt": 0600,
+		"docs/latest":    fs.ModeSymlink | 0777,
+		"data/pack":      fs.ModeDir | 0755,
+	} {
+		info, err := ocifs.Lstat(layer, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("%s: wrong mode: want=%v got=%v", name, mode, info.Mode())
+		}
+	}
+
+	link, err := fslink.ReadLink(layer, "docs/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "guide.txt" {
+		t.Errorf("wrong link target: %q", link)
+	}
+
+	for name, data := range map[string]string{
+		"docs/README":    "stored",
+		"docs/guide.txt": "deflated content",
+	} {
+		f, err := layer.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, ok := f.(io.ReaderAt)
+		if !ok {
+			t.Fatalf("%s: file does not implement io.ReaderAt", name)
+		}
+		if _, ok := f.(io.Seeker); !ok {
+			t.Fatalf("%s: file does not implement io.Seeker", name)
+		}
+		buf := make([]byte, len(data)-2)
+		if _, err := r.ReadAt(buf, 2); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data[2:] {
+			t.Errorf("%s: wrong content: want=%q got=%q", name, data[2:], buf)
+		}
+		f.Close()
+	}
+
+	// Zip archives can be stacked with tar layers, whiteouts apply to the
+	// layers below.
+	base := tarFS(t,
+		tarDir("etc/"),
+		tarFile("etc/hosts", "localhost"),
+		tarFile("etc/passwd", "root:x:0:0"),
+	)
+	entries, err := fs.ReadDir(ocifs.LayerFS(base, layer), "etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !reflect.DeepEqual(names, []string{"hosts"}) {
+		t.Errorf("wrong entries: %q", names)
+	}
+
+	if _, err := ocifs.ZipFS(bytes.NewReader([]byte("not a zip")), 9); err == nil {
+		t.Error("expected an error constructing a file system from an invalid archive")
+	}
+}